@@ -3,11 +3,15 @@ package main
 import (
     "log"
     "net/http"
+    "time"
 
     "auth-service/config"
     "auth-service/database"
+    "auth-service/mailer"
     "auth-service/models"
     "auth-service/routes"
+    "auth-service/services"
+    "auth-service/utils"
 
     "github.com/rs/cors"
 )
@@ -16,14 +20,48 @@ func main() {
     // Load environment variables/configuration
     config.LoadEnv()
 
+    if err := utils.ValidateArgon2Params(); err != nil {
+        log.Fatal("Invalid password hashing settings:", err)
+    }
+
     // Initialize database connection
     database.Init()
 
-    // Run migration for User table
-    _, err := database.DB.Exec(models.UserTableMigration())
-    if err != nil {
-        log.Fatal("Failed migration:", err)
+    // Run migrations for users and their tokens
+    for _, migration := range []string{
+        models.UserTableMigration(),
+        models.RefreshTokenTableMigration(),
+        models.TokenDenylistTableMigration(),
+        models.SigningKeyTableMigration(),
+        models.AccessTokenTableMigration(),
+        models.TwoFactorTableMigration(),
+        models.LoginFailureTableMigration(),
+        models.UserTokenTableMigration(),
+        models.PendingRenameTableMigration(),
+    } {
+        if _, err := database.DB.Exec(migration); err != nil {
+            log.Fatal("Failed migration:", err)
+        }
+    }
+
+    // Promote the configured account so a fresh install has an admin
+    if admin := config.GetEnv("BOOTSTRAP_ADMIN"); admin != "" {
+        if _, err := database.DB.Exec("UPDATE users SET role = $1 WHERE username = $2", models.RoleAdmin, admin); err != nil {
+            log.Fatal("Failed to promote bootstrap admin:", err)
+        }
+    }
+
+    if err := services.InitKeys(); err != nil {
+        log.Fatal("Failed to load signing keys:", err)
+    }
+    if err := services.InitTwoFactor(); err != nil {
+        log.Fatal("Failed to seal TOTP secrets:", err)
     }
+    services.StartKeyRotation()
+    services.StartTokenCleanup(time.Hour)
+    services.StartRenamePush(time.Minute)
+    services.InitLoginGuard()
+    mailer.Init()
 
     // Setup HTTP routes with handlers (register/login/protected)
     routes.SetupRoutes()
@@ -31,7 +69,7 @@ func main() {
     // Setup CORS middleware only here
     c := cors.New(cors.Options{
         AllowedOrigins:   []string{"http://localhost:5173"}, // Your frontend origin here
-        AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+        AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
         AllowedHeaders:   []string{"Authorization", "Content-Type"},
         AllowCredentials: true,
     })
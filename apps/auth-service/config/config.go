@@ -4,6 +4,8 @@ import (
     "github.com/joho/godotenv"
     "log"
     "os"
+    "strconv"
+    "time"
 )
 
 func LoadEnv() {
@@ -16,3 +18,29 @@ func LoadEnv() {
 func GetEnv(key string) string {
     return os.Getenv(key)
 }
+
+// GetEnvDefault returns the value of key, or def when it is unset or empty
+func GetEnvDefault(key, def string) string {
+    if v := os.Getenv(key); v != "" {
+        return v
+    }
+    return def
+}
+
+// GetEnvInt64 parses key as an integer, returning def when it is unset or invalid
+func GetEnvInt64(key string, def int64) int64 {
+    v, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+    if err != nil {
+        return def
+    }
+    return v
+}
+
+// GetEnvDuration parses key as a time.Duration (e.g. "24h"), returning def when it is unset or invalid
+func GetEnvDuration(key string, def time.Duration) time.Duration {
+    v, err := time.ParseDuration(os.Getenv(key))
+    if err != nil {
+        return def
+    }
+    return v
+}
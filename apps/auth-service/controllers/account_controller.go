@@ -0,0 +1,121 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+
+    "auth-service/services"
+)
+
+type emailRequest struct {
+    Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+    Token    string `json:"token"`
+    Password string `json:"password"`
+}
+
+// inBackground runs a mail-sending job without holding up the response; this
+// also keeps response times from revealing whether an account exists
+func inBackground(what string, send func() error) {
+    go func() {
+        if err := send(); err != nil {
+            log.Printf("failed to send %s: %v", what, err)
+        }
+    }()
+}
+
+// VerifyEmail confirms an address from the emailed link (GET ?token=) or a
+// {"token"} POST
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+    token := r.URL.Query().Get("token")
+    switch r.Method {
+    case http.MethodGet:
+    case http.MethodPost:
+        var req resetPasswordRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Bad request", http.StatusBadRequest)
+            return
+        }
+        token = req.Token
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if token == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    err := services.VerifyEmail(token)
+    if errors.Is(err, services.ErrInvalidUserToken) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    w.Write([]byte(`{"message":"Email verified"}`))
+}
+
+// ResendVerification mails a new verification link to {"email"}. It always
+// answers 202 so it cannot be used to find out which addresses have accounts.
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req emailRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+    inBackground("verification email", func() error { return services.ResendVerification(req.Email) })
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// ForgotPassword mails a reset link to {"email"}. Like ResendVerification it
+// always answers 202.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req emailRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+    inBackground("password reset email", func() error { return services.RequestPasswordReset(req.Email) })
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword sets {"password"} using the {"token"} from a reset email and
+// logs the user out everywhere
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req resetPasswordRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    err := services.ResetPassword(req.Token, req.Password)
+    var weak *services.PasswordPolicyError
+    if errors.Is(err, services.ErrInvalidUserToken) || errors.As(err, &weak) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
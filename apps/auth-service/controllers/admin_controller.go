@@ -0,0 +1,167 @@
+package controllers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "net/http"
+    "strconv"
+
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/services"
+)
+
+type roleRequest struct {
+    Username string `json:"username"`
+}
+
+// AdminListUsers lists all users with their roles. Admin only.
+func AdminListUsers(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    rows, err := database.DB.Query("SELECT id, username, email, role FROM users ORDER BY username")
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    defer rows.Close()
+
+    users := []models.User{}
+    for rows.Next() {
+        var u models.User
+        if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.Role); err != nil {
+            http.Error(w, "DB error", http.StatusInternalServerError)
+            return
+        }
+        users = append(users, u)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(users)
+}
+
+// AdminPromoteUser makes {"username"} an admin. Admin only.
+func AdminPromoteUser(w http.ResponseWriter, r *http.Request) {
+    changeRole(w, r, models.RoleAdmin)
+}
+
+// AdminDemoteUser makes {"username"} a regular user again. The last admin
+// cannot be demoted. Admin only.
+func AdminDemoteUser(w http.ResponseWriter, r *http.Request) {
+    changeRole(w, r, models.RoleUser)
+}
+
+func changeRole(w http.ResponseWriter, r *http.Request, role string) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req roleRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    tx, err := database.DB.Begin()
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    defer tx.Rollback()
+
+    // Serialise role changes so two admins cannot demote each other at once
+    if _, err := tx.Exec("LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+
+    var user models.User
+    err = tx.QueryRow("SELECT id, username, email, role FROM users WHERE username = $1", req.Username).
+        Scan(&user.ID, &user.Username, &user.Email, &user.Role)
+    if err == sql.ErrNoRows {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+
+    if user.Role == models.RoleAdmin && role != models.RoleAdmin {
+        var admins int
+        if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE role = $1", models.RoleAdmin).Scan(&admins); err != nil {
+            http.Error(w, "DB error", http.StatusInternalServerError)
+            return
+        }
+        if admins <= 1 {
+            http.Error(w, "Cannot demote the last admin", http.StatusConflict)
+            return
+        }
+    }
+
+    if _, err := tx.Exec("UPDATE users SET role = $1 WHERE id = $2", role, user.ID); err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    user.Role = role
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(user)
+}
+
+// AdminUnlockUser lifts the login lockout of {"username"}. Admin only.
+func AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req roleRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    found, err := services.UnlockUser(req.Username)
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    if !found {
+        http.Error(w, "User not found", http.StatusNotFound)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminListLoginFailures lists recent failed logins, newest first, optionally
+// filtered by ?username=. ?limit= defaults to 100. Admin only.
+func AdminListLoginFailures(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    limit := 100
+    if v := r.URL.Query().Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > 1000 {
+            http.Error(w, "Invalid limit", http.StatusBadRequest)
+            return
+        }
+        limit = n
+    }
+
+    failures, err := services.ListLoginFailures(r.URL.Query().Get("username"), limit)
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(failures)
+}
@@ -2,10 +2,13 @@ package controllers
 
 import (
     "encoding/json"
+    "errors"
     "net/http"
     "strings"
     "auth-service/database"
+    "auth-service/middleware"
     "auth-service/models"
+    "auth-service/services"
     "auth-service/utils"
 )
 
@@ -13,7 +16,7 @@ import (
 func WithCORS(handler http.HandlerFunc) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Access-Control-Allow-Origin", "http://localhost:5173")
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
         w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 
         if r.Method == http.MethodOptions {
@@ -37,20 +40,36 @@ func Register(w http.ResponseWriter, r *http.Request) {
         http.Error(w, "Bad request", http.StatusBadRequest)
         return
     }
+    email, err := services.NormalizeEmail(req.Email)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err := services.CheckPasswordPolicy(req.Password, req.Username); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
     hashedPassword, err := utils.HashPassword(req.Password)
     if err != nil {
         http.Error(w, "Error hashing password", http.StatusInternalServerError)
         return
     }
 
+    // Names still being moved on the file service are not free yet
     var userID int
     err = database.DB.QueryRow(
-        "INSERT INTO users (username, email, password) VALUES ($1, $2, $3) RETURNING id",
-        req.Username, req.Email, hashedPassword).Scan(&userID)
+        `INSERT INTO users (username, email, password) SELECT $1, $2, $3
+         WHERE NOT EXISTS (SELECT 1 FROM pending_renames WHERE old_username = $1 OR new_username = $1)
+         RETURNING id`,
+        req.Username, email, hashedPassword).Scan(&userID)
     if err != nil {
         http.Error(w, "User already exists or DB error", http.StatusConflict)
         return
     }
+
+    user := models.User{ID: userID, Username: req.Username, Email: email}
+    inBackground("verification email", func() error { return services.SendVerificationEmail(user) })
+
     w.WriteHeader(http.StatusCreated)
     w.Write([]byte(`{"message":"Registration successful"}`))
 }
@@ -62,25 +81,132 @@ func Login(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    row := database.DB.QueryRow("SELECT id, username, password FROM users WHERE username = $1", req.Username)
-    var user models.User
-    err := row.Scan(&user.ID, &user.Username, &user.Password)
+    user, err := services.CheckCredentials(req.Username, req.Password, middleware.ClientIP(r))
     if err != nil {
-        http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+        credentialsError(w, err)
         return
     }
-    if !utils.CheckPasswordHash(req.Password, user.Password) {
-        http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+
+    // With 2FA on, the password only earns a challenge for /login/2fa
+    if user.TOTPEnabled {
+        challenge, err := services.StartLoginChallenge(user.ID)
+        if err != nil {
+            http.Error(w, "DB error", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "two_factor_required": true,
+            "challenge_token":     challenge,
+            "expires_in":          int64(services.LoginChallengeTTL().Seconds()),
+        })
         return
     }
 
-    token, err := utils.GenerateJWT(user.Username)
+    pair, err := services.IssueTokens(user)
     if err != nil {
         http.Error(w, "Could not generate token", http.StatusInternalServerError)
         return
     }
+    writeTokens(w, pair)
+}
+
+// credentialsError answers a failed services.CheckCredentials
+func credentialsError(w http.ResponseWriter, err error) {
+    var limited *services.RateLimitError
+    switch {
+    case errors.As(err, &limited):
+        middleware.TooManyRequests(w, limited.RetryAfter)
+    case errors.Is(err, services.ErrInvalidCredentials):
+        http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+    case errors.Is(err, services.ErrEmailNotVerified):
+        http.Error(w, err.Error(), http.StatusForbidden)
+    default:
+        http.Error(w, "DB error", http.StatusInternalServerError)
+    }
+}
+
+// writeTokens sends a token pair. "token" repeats the access token for
+// clients written before refresh tokens existed.
+func writeTokens(w http.ResponseWriter, pair services.TokenPair) {
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"token": token})
+    json.NewEncoder(w).Encode(struct {
+        Token string `json:"token"`
+        services.TokenPair
+    }{pair.AccessToken, pair})
+}
+
+type refreshRequest struct {
+    RefreshToken string `json:"refresh_token"`
+}
+
+// Refresh exchanges a refresh token for a new access/refresh pair. Each refresh
+// token works once; replaying a spent one revokes the whole session.
+func Refresh(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req refreshRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    pair, err := services.RotateRefreshToken(req.RefreshToken)
+    if errors.Is(err, services.ErrInvalidRefreshToken) || errors.Is(err, services.ErrRefreshTokenReused) {
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return
+    }
+    if err != nil {
+        http.Error(w, "Could not refresh token", http.StatusInternalServerError)
+        return
+    }
+    writeTokens(w, pair)
+}
+
+// Logout ends the session behind the bearer access token and/or the
+// refresh_token in the body. The access token is denylisted right away, so it
+// stops working in both services before it expires.
+func Logout(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req refreshRequest
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Bad request", http.StatusBadRequest)
+            return
+        }
+    }
+
+    var claims *utils.Claims
+    if authHeader := r.Header.Get("Authorization"); authHeader != "" {
+        claims, _ = utils.ValidateToken(strings.TrimPrefix(authHeader, "Bearer "))
+    }
+    if claims == nil && req.RefreshToken == "" {
+        http.Error(w, "Missing token", http.StatusUnauthorized)
+        return
+    }
+
+    if claims != nil {
+        if err := services.DenyAccessToken(claims); err != nil {
+            http.Error(w, "DB error", http.StatusInternalServerError)
+            return
+        }
+        if err := services.RevokeSession(claims.SessionID); err != nil {
+            http.Error(w, "DB error", http.StatusInternalServerError)
+            return
+        }
+    }
+    if req.RefreshToken != "" {
+        if err := services.RevokeRefreshToken(req.RefreshToken); err != nil {
+            http.Error(w, "DB error", http.StatusInternalServerError)
+            return
+        }
+    }
+    w.WriteHeader(http.StatusNoContent)
 }
 
 func Protected(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+
+    "auth-service/middleware"
+    "auth-service/services"
+)
+
+// InternalVerifyPassword checks {"username", "password"} for the file
+// service's password-based protocols (WebDAV and the like), with the same
+// rate limits and lockout as /login; "ip" is the end client's address, and
+// the per-IP limit applies to it.
+// Accounts with 2FA are refused: those clients cannot ask for a code, so
+// such users must use a personal access token instead.
+func InternalVerifyPassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req struct {
+        Username string `json:"username"`
+        Password string `json:"password"`
+        IP       string `json:"ip"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    // The file service forwards its client's address, which is where the
+    // per-IP login limit belongs; /login applies it in RateLimitByIP
+    ip := middleware.NormalizeIP(req.IP)
+    if ip == "" {
+        ip = middleware.ClientIP(r)
+    }
+    if ok, wait := services.LoginIPLimiter.Allow(ip); !ok {
+        log.Printf("rate limited %s on %s", ip, r.URL.Path)
+        middleware.TooManyRequests(w, wait)
+        return
+    }
+
+    user, err := services.CheckCredentials(req.Username, req.Password, ip)
+    if err != nil {
+        credentialsError(w, err)
+        return
+    }
+    if user.TOTPEnabled {
+        http.Error(w, "Two-factor accounts must sign in with a personal access token", http.StatusForbidden)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"username": user.Username, "role": user.Role})
+}
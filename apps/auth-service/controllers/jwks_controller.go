@@ -0,0 +1,35 @@
+package controllers
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "auth-service/services"
+)
+
+// JWKS publishes the public keys access tokens are signed with, so other
+// services can verify tokens without sharing a secret
+func JWKS(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "public, max-age=300")
+    json.NewEncoder(w).Encode(services.JWKS())
+}
+
+// AdminRotateKeys schedules the next signing key now instead of waiting for
+// JWT_KEY_ROTATION; it takes over after JWT_KEY_PUBLISH_DELAY. Admin only.
+func AdminRotateKeys(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    if err := services.RotateKeys(); err != nil {
+        http.Error(w, "Key rotation failed", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(services.JWKS())
+}
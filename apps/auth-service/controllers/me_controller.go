@@ -0,0 +1,145 @@
+package controllers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+
+    "auth-service/middleware"
+    "auth-service/models"
+    "auth-service/services"
+)
+
+// profileResponse is the user's profile, plus a new token pair when a
+// username change ended the old sessions
+type profileResponse struct {
+    models.User
+    *services.TokenPair
+}
+
+// accountError maps account service errors to responses
+func accountError(w http.ResponseWriter, err error) {
+    var weak *services.PasswordPolicyError
+    var limited *services.RateLimitError
+    switch {
+    case errors.As(err, &limited):
+        middleware.TooManyRequests(w, limited.RetryAfter)
+    case errors.As(err, &weak), errors.Is(err, services.ErrInvalidUsername), errors.Is(err, services.ErrInvalidEmail):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case errors.Is(err, services.ErrWrongPassword), errors.Is(err, services.ErrInvalidCode), errors.Is(err, services.ErrTwoFactorNotEnrolled):
+        http.Error(w, err.Error(), http.StatusForbidden)
+    case errors.Is(err, services.ErrUsernameTaken), errors.Is(err, services.ErrEmailTaken), errors.Is(err, services.ErrLastAdmin):
+        http.Error(w, err.Error(), http.StatusConflict)
+    case errors.Is(err, services.ErrFileService):
+        log.Println(err)
+        http.Error(w, "File service unavailable, try again later", http.StatusBadGateway)
+    default:
+        http.Error(w, "DB error", http.StatusInternalServerError)
+    }
+}
+
+// Me shows (GET), updates (PATCH {"username", "email"}) or deletes
+// (DELETE {"password", "code" or "recovery_code"}) the logged-in account
+func Me(w http.ResponseWriter, r *http.Request) {
+    username, _ := r.Context().Value(middleware.UsernameKey).(string)
+    user, err := services.GetUser(username)
+    if err == sql.ErrNoRows {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(user)
+
+    case http.MethodPatch:
+        var req struct {
+            Username *string `json:"username"`
+            Email    *string `json:"email"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Bad request", http.StatusBadRequest)
+            return
+        }
+
+        updated, renamed, emailChanged, err := services.UpdateProfile(user, services.ProfileUpdate{Username: req.Username, Email: req.Email})
+        if err != nil {
+            accountError(w, err)
+            return
+        }
+        if emailChanged {
+            inBackground("verification email", func() error { return services.SendVerificationEmail(updated) })
+        }
+
+        resp := profileResponse{User: updated}
+        if renamed {
+            pair, err := services.IssueTokens(updated)
+            if err != nil {
+                http.Error(w, "Could not generate token", http.StatusInternalServerError)
+                return
+            }
+            resp.TokenPair = &pair
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(resp)
+
+    case http.MethodDelete:
+        var req struct {
+            Password     string `json:"password"`
+            Code         string `json:"code"`
+            RecoveryCode string `json:"recovery_code"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            http.Error(w, "Bad request", http.StatusBadRequest)
+            return
+        }
+        if err := services.DeleteAccount(user, req.Password, req.Code, req.RecoveryCode, middleware.ClientIP(r)); err != nil {
+            accountError(w, err)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// ChangeMyPassword sets {"new_password"} after checking {"current_password"}.
+// Every session is revoked; the caller gets a fresh token pair.
+func ChangeMyPassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    user, err := currentUser(r)
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    var req struct {
+        CurrentPassword string `json:"current_password"`
+        NewPassword     string `json:"new_password"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewPassword == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    if err := services.ChangePassword(user, req.CurrentPassword, req.NewPassword, middleware.ClientIP(r)); err != nil {
+        accountError(w, err)
+        return
+    }
+    pair, err := services.IssueTokens(user)
+    if err != nil {
+        http.Error(w, "Could not generate token", http.StatusInternalServerError)
+        return
+    }
+    writeTokens(w, pair)
+}
@@ -0,0 +1,110 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "auth-service/database"
+    "auth-service/middleware"
+    "auth-service/models"
+    "auth-service/services"
+)
+
+// currentUser loads the user behind the request's access token
+func currentUser(r *http.Request) (models.User, error) {
+    username, _ := r.Context().Value(middleware.UsernameKey).(string)
+    var u models.User
+    err := database.DB.QueryRow("SELECT id, username, email, role FROM users WHERE username = $1", username).
+        Scan(&u.ID, &u.Username, &u.Email, &u.Role)
+    return u, err
+}
+
+// AccessTokens lists (GET) or creates (POST) the user's personal access tokens.
+// POST takes {"name", "scopes", "expires_at" (RFC 3339) or "expires_in"
+// (seconds)} and is the only response that includes the token itself.
+func AccessTokens(w http.ResponseWriter, r *http.Request) {
+    user, err := currentUser(r)
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        tokens, err := services.ListAccessTokens(user.ID)
+        if err != nil {
+            http.Error(w, "DB error", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(tokens)
+
+    case http.MethodPost:
+        var req struct {
+            Name      string     `json:"name"`
+            Scopes    []string   `json:"scopes"`
+            ExpiresAt *time.Time `json:"expires_at"`
+            ExpiresIn int64      `json:"expires_in"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ExpiresIn < 0 {
+            http.Error(w, "Bad request", http.StatusBadRequest)
+            return
+        }
+        if req.ExpiresIn > 0 {
+            t := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+            req.ExpiresAt = &t
+        }
+
+        token, err := services.CreateAccessToken(user, req.Name, req.Scopes, req.ExpiresAt)
+        switch {
+        case errors.Is(err, services.ErrScopeNotAllowed):
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        case errors.Is(err, services.ErrInvalidScope), errors.Is(err, services.ErrTokenNameRequired):
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        case err != nil:
+            http.Error(w, "DB error", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(token)
+
+    default:
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// RevokeAccessToken deletes the token in DELETE /tokens/{id}
+func RevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodDelete {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    user, err := currentUser(r)
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/tokens/"))
+    if err != nil {
+        http.Error(w, "Token not found", http.StatusNotFound)
+        return
+    }
+
+    err = services.RevokeAccessToken(user.ID, id)
+    if errors.Is(err, services.ErrTokenNotFound) {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,127 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+
+    "auth-service/middleware"
+    "auth-service/services"
+)
+
+type twoFactorRequest struct {
+    ChallengeToken string `json:"challenge_token"`
+    Code           string `json:"code"`
+    RecoveryCode   string `json:"recovery_code"`
+}
+
+// twoFactorError maps 2FA service errors to responses
+func twoFactorError(w http.ResponseWriter, err error) {
+    var limited *services.RateLimitError
+    switch {
+    case errors.As(err, &limited):
+        middleware.TooManyRequests(w, limited.RetryAfter)
+    case errors.Is(err, services.ErrTwoFactorEnabled):
+        http.Error(w, err.Error(), http.StatusConflict)
+    case errors.Is(err, services.ErrTwoFactorNotEnrolled):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case errors.Is(err, services.ErrInvalidCode), errors.Is(err, services.ErrInvalidChallenge):
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+    default:
+        http.Error(w, "DB error", http.StatusInternalServerError)
+    }
+}
+
+// EnrollTwoFactor starts TOTP setup and returns the secret and otpauth URI to
+// show as a QR code. 2FA is not on until ConfirmTwoFactor.
+func EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    user, err := currentUser(r)
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    enrollment, err := services.EnrollTOTP(user)
+    if err != nil {
+        twoFactorError(w, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(enrollment)
+}
+
+// ConfirmTwoFactor takes {"code"} from the authenticator app, turns 2FA on and
+// returns the one-time recovery codes
+func ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    user, err := currentUser(r)
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    var req twoFactorRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    codes, err := services.ConfirmTOTP(user.ID, req.Code)
+    if err != nil {
+        twoFactorError(w, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTwoFactor turns 2FA off given a current {"code"} or {"recovery_code"}
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    user, err := currentUser(r)
+    if err != nil {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    var req twoFactorRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    if err := services.DisableTOTP(user, req.Code, req.RecoveryCode, middleware.ClientIP(r)); err != nil {
+        twoFactorError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginTwoFactor is the second login step: {"challenge_token"} from /login
+// plus a TOTP {"code"} or a {"recovery_code"} gets the real tokens
+func LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    var req twoFactorRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChallengeToken == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    pair, err := services.CompleteLoginChallenge(req.ChallengeToken, req.Code, req.RecoveryCode, middleware.ClientIP(r))
+    if err != nil {
+        twoFactorError(w, err)
+        return
+    }
+    writeTokens(w, pair)
+}
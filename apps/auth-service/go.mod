@@ -10,4 +10,6 @@ require (
 	golang.org/x/crypto v0.42.0
 )
 
-require github.com/rs/cors v1.11.1 // indirect
+require github.com/rs/cors v1.11.1
+
+require golang.org/x/sys v0.36.0 // indirect
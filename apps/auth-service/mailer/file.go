@@ -0,0 +1,35 @@
+package mailer
+
+import (
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "time"
+
+    "auth-service/utils"
+)
+
+// FileMailer is for local development and tests: with Dir set each message is
+// written there as an .eml file, otherwise it is printed to the log.
+type FileMailer struct {
+    Dir  string
+    From string
+}
+
+func NewFile(dir, from string) (*FileMailer, error) {
+    if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+        return nil, err
+    }
+    return &FileMailer{Dir: dir, From: from}, nil
+}
+
+func (m *FileMailer) Send(msg Message) error {
+    data := format(m.From, msg)
+    if m.Dir == "" {
+        log.Printf("mail to %s:\n%s", msg.To, data)
+        return nil
+    }
+    name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), utils.NewTokenID()[:8])
+    return os.WriteFile(filepath.Join(m.Dir, name), data, 0o600)
+}
@@ -0,0 +1,84 @@
+package mailer
+
+import (
+    "errors"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+
+    "auth-service/config"
+)
+
+// Message is a plain-text email
+type Message struct {
+    To      string
+    Subject string
+    Body    string
+}
+
+// Mailer delivers messages. Implementations must be safe for concurrent use.
+type Mailer interface {
+    Send(msg Message) error
+}
+
+// Default is the mailer selected by MAIL_DRIVER.
+var Default Mailer
+
+// Init sets up Default. MAIL_DRIVER has no default: a deployment that forgot
+// it should not silently print reset links to the log instead of sending them.
+func Init() {
+    name := config.GetEnv("MAIL_DRIVER")
+    if name == "" {
+        log.Fatal("Failed to init mailer: MAIL_DRIVER is not set (smtp, file, or log for development)")
+    }
+    var err error
+    Default, err = New(name)
+    if err != nil {
+        log.Fatal("Failed to init mailer:", err)
+    }
+}
+
+// New builds a mailer by name from the MAIL_* / SMTP_* settings.
+func New(name string) (Mailer, error) {
+    from := config.GetEnvDefault("MAIL_FROM", "FileVault <no-reply@localhost>")
+    switch name {
+    case "log":
+        // Logged mail carries live verification and reset links
+        if config.GetEnv("MAIL_ALLOW_LOG") != "true" {
+            return nil, errors.New("MAIL_DRIVER=log prints account links to the log; set MAIL_ALLOW_LOG=true to use it in development")
+        }
+        return &FileMailer{From: from}, nil
+    case "file":
+        return NewFile(config.GetEnvDefault("MAIL_DIR", "./mail"), from)
+    case "smtp":
+        host := config.GetEnv("SMTP_HOST")
+        if host == "" {
+            return nil, errors.New("SMTP_HOST is required for MAIL_DRIVER=smtp")
+        }
+        return &SMTPMailer{
+            Host:     host,
+            Port:     config.GetEnvDefault("SMTP_PORT", "587"),
+            Username: config.GetEnv("SMTP_USERNAME"),
+            Password: config.GetEnv("SMTP_PASSWORD"),
+            From:     from,
+            Timeout:  config.GetEnvDuration("SMTP_TIMEOUT", 30*time.Second),
+        }, nil
+    }
+    return nil, errors.New("unknown mail driver " + strconv.Quote(name))
+}
+
+// format renders msg as an RFC 5322 message. Header values have line breaks
+// removed so user-supplied addresses cannot inject headers.
+func format(from string, msg Message) []byte {
+    clean := strings.NewReplacer("\r", "", "\n", "")
+    var b strings.Builder
+    b.WriteString("From: " + clean.Replace(from) + "\r\n")
+    b.WriteString("To: " + clean.Replace(msg.To) + "\r\n")
+    b.WriteString("Subject: " + clean.Replace(msg.Subject) + "\r\n")
+    b.WriteString("MIME-Version: 1.0\r\n")
+    b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+    b.WriteString("\r\n")
+    b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+    return []byte(b.String())
+}
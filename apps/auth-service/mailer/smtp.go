@@ -0,0 +1,78 @@
+package mailer
+
+import (
+    "crypto/tls"
+    "errors"
+    "net"
+    "net/mail"
+    "net/smtp"
+    "time"
+)
+
+// SMTPMailer sends through an SMTP relay. It upgrades to STARTTLS when the
+// server offers it, and net/smtp refuses PLAIN auth over an unencrypted
+// connection. Each message must be delivered within Timeout, so a relay that
+// stops answering cannot hold a request forever.
+type SMTPMailer struct {
+    Host     string
+    Port     string
+    Username string
+    Password string
+    From     string
+    Timeout  time.Duration
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+    from, err := mail.ParseAddress(m.From)
+    if err != nil {
+        return err
+    }
+
+    deadline := time.Now().Add(m.Timeout)
+    dialer := net.Dialer{Deadline: deadline}
+    conn, err := dialer.Dial("tcp", net.JoinHostPort(m.Host, m.Port))
+    if err != nil {
+        return err
+    }
+    if err := conn.SetDeadline(deadline); err != nil {
+        conn.Close()
+        return err
+    }
+    c, err := smtp.NewClient(conn, m.Host)
+    if err != nil {
+        conn.Close()
+        return err
+    }
+    defer c.Close()
+
+    if ok, _ := c.Extension("STARTTLS"); ok {
+        if err := c.StartTLS(&tls.Config{ServerName: m.Host}); err != nil {
+            return err
+        }
+    }
+    if m.Username != "" {
+        if ok, _ := c.Extension("AUTH"); !ok {
+            return errors.New("smtp: server does not support AUTH")
+        }
+        if err := c.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+            return err
+        }
+    }
+    if err := c.Mail(from.Address); err != nil {
+        return err
+    }
+    if err := c.Rcpt(msg.To); err != nil {
+        return err
+    }
+    w, err := c.Data()
+    if err != nil {
+        return err
+    }
+    if _, err := w.Write(format(m.From, msg)); err != nil {
+        return err
+    }
+    if err := w.Close(); err != nil {
+        return err
+    }
+    return c.Quit()
+}
@@ -0,0 +1,48 @@
+package mailer
+
+import (
+    "net"
+    "testing"
+    "time"
+)
+
+// A relay that accepts the connection and then says nothing must not hold
+// Send past its timeout
+func TestSMTPMailerTimesOut(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        <-done
+        conn.Close()
+    }()
+
+    host, port, _ := net.SplitHostPort(ln.Addr().String())
+    m := &SMTPMailer{Host: host, Port: port, From: "FileVault <no-reply@example.com>", Timeout: 200 * time.Millisecond}
+    start := time.Now()
+    if err := m.Send(Message{To: "user@example.com", Subject: "hi", Body: "hello"}); err == nil {
+        t.Fatal("Send to a silent relay succeeded")
+    }
+    if took := time.Since(start); took > 2*time.Second {
+        t.Fatalf("Send took %s, want about the 200ms timeout", took)
+    }
+}
+
+func TestLogDriverNeedsOptIn(t *testing.T) {
+    t.Setenv("MAIL_ALLOW_LOG", "")
+    if _, err := New("log"); err == nil {
+        t.Fatal("log driver allowed without MAIL_ALLOW_LOG")
+    }
+    t.Setenv("MAIL_ALLOW_LOG", "true")
+    if _, err := New("log"); err != nil {
+        t.Fatal(err)
+    }
+}
@@ -1,11 +1,21 @@
 package middleware
 
 import (
+    "context"
     "net/http"
     "strings"
+    "auth-service/services"
     "auth-service/utils"
 )
 
+// contextKey keeps our request context values from colliding with other packages'
+type contextKey string
+
+const (
+    UsernameKey contextKey = "username"
+    RoleKey     contextKey = "role"
+)
+
 func JWTAuth(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         authHeader := r.Header.Get("Authorization")
@@ -14,11 +24,35 @@ func JWTAuth(next http.Handler) http.Handler {
             return
         }
         token := strings.TrimPrefix(authHeader, "Bearer ")
-        _, err := utils.ValidateToken(token)
+        claims, err := utils.ValidateToken(token)
         if err != nil {
             http.Error(w, "Invalid token", http.StatusUnauthorized)
             return
         }
+        revoked, err := services.TokenRevoked(claims.ID, claims.SessionID)
+        if err != nil {
+            http.Error(w, "DB error", http.StatusInternalServerError)
+            return
+        }
+        if revoked {
+            http.Error(w, "Token revoked", http.StatusUnauthorized)
+            return
+        }
+
+        ctx := context.WithValue(r.Context(), UsernameKey, claims.Username)
+        ctx = context.WithValue(ctx, RoleKey, claims.Role)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// RequireRole only lets requests through whose token carries role. It must run
+// inside JWTAuth.
+func RequireRole(role string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if got, _ := r.Context().Value(RoleKey).(string); got != role {
+            http.Error(w, "Forbidden", http.StatusForbidden)
+            return
+        }
         next.ServeHTTP(w, r)
     })
 }
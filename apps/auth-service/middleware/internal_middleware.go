@@ -0,0 +1,26 @@
+package middleware
+
+import (
+    "crypto/subtle"
+    "net/http"
+
+    "auth-service/config"
+)
+
+// InternalAuth guards endpoints only the file service may call. The caller
+// must send INTERNAL_API_TOKEN in X-Internal-Token; with no token configured
+// the endpoints are disabled.
+func InternalAuth(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        want := config.GetEnv("INTERNAL_API_TOKEN")
+        if want == "" {
+            http.Error(w, "Internal API disabled", http.StatusForbidden)
+            return
+        }
+        if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Internal-Token")), []byte(want)) != 1 {
+            http.Error(w, "Unauthorized", http.StatusUnauthorized)
+            return
+        }
+        next(w, r)
+    }
+}
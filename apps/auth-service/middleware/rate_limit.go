@@ -0,0 +1,62 @@
+package middleware
+
+import (
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "auth-service/config"
+    "auth-service/utils"
+)
+
+// ClientIP is the caller's address. X-Forwarded-For is only believed with
+// TRUST_PROXY=true, since anyone can send it, and only if it holds an IP
+// address; otherwise the connection's own address is used.
+func ClientIP(r *http.Request) string {
+    if config.GetEnv("TRUST_PROXY") == "true" {
+        if ip := NormalizeIP(strings.Split(r.Header.Get("X-Forwarded-For"), ",")[0]); ip != "" {
+            return ip
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+// NormalizeIP returns s in canonical form if it is an IP address, else ""
+func NormalizeIP(s string) string {
+    ip := net.ParseIP(strings.TrimSpace(s))
+    if ip == nil {
+        return ""
+    }
+    return ip.String()
+}
+
+// TooManyRequests answers 429 with a Retry-After in whole seconds
+func TooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+    secs := int(math.Ceil(retryAfter.Seconds()))
+    if secs < 1 {
+        secs = 1
+    }
+    w.Header().Set("Retry-After", strconv.Itoa(secs))
+    http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// RateLimitByIP rejects callers that exceed limiter with 429
+func RateLimitByIP(limiter *utils.SlidingWindow, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        ip := ClientIP(r)
+        if ok, wait := limiter.Allow(ip); !ok {
+            log.Printf("rate limited %s on %s", ip, r.URL.Path)
+            TooManyRequests(w, wait)
+            return
+        }
+        next(w, r)
+    }
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+)
+
+func TestClientIP(t *testing.T) {
+    tests := []struct {
+        name      string
+        trust     string
+        forwarded string
+        want      string
+    }{
+        {"untrusted header is ignored", "", "198.51.100.7", "192.0.2.1"},
+        {"first forwarded address", "true", "198.51.100.7, 10.0.0.1", "198.51.100.7"},
+        {"ipv6 is canonicalised", "true", "2001:DB8:0:0::1", "2001:db8::1"},
+        {"garbage falls back", "true", "not-an-ip", "192.0.2.1"},
+        {"oversized falls back", "true", strings.Repeat("1", 100), "192.0.2.1"},
+        {"empty falls back", "true", "", "192.0.2.1"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            t.Setenv("TRUST_PROXY", tt.trust)
+            r := httptest.NewRequest("POST", "/login", nil)
+            r.RemoteAddr = "192.0.2.1:4242"
+            if tt.forwarded != "" {
+                r.Header.Set("X-Forwarded-For", tt.forwarded)
+            }
+            if got := ClientIP(r); got != tt.want {
+                t.Fatalf("ClientIP = %q, want %q", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+// Scopes a personal access token can be limited to.
+const (
+    ScopeFilesRead   = "files:read"
+    ScopeFilesWrite  = "files:write"
+    ScopeShareManage = "share:manage"
+    ScopeAdmin       = "admin"
+)
+
+// AccessTokenPrefix starts every personal access token, so services can tell
+// them apart from JWTs and secret scanners can spot leaked ones.
+const AccessTokenPrefix = "fvp_"
+
+// ValidScope reports whether scope is one of the known scopes
+func ValidScope(scope string) bool {
+    switch scope {
+    case ScopeFilesRead, ScopeFilesWrite, ScopeShareManage, ScopeAdmin:
+        return true
+    }
+    return false
+}
+
+// PersonalAccessToken is a long-lived token for scripts and CI. Only its
+// SHA-256 hash is stored; Hint is the first few characters, to tell tokens apart.
+type PersonalAccessToken struct {
+    ID         int        `json:"id"`
+    UserID     int        `json:"-"`
+    Name       string     `json:"name"`
+    Hint       string     `json:"hint"`
+    TokenHash  string     `json:"-"`
+    Scopes     []string   `json:"scopes"`
+    ExpiresAt  *time.Time `json:"expires_at"`
+    LastUsedAt *time.Time `json:"last_used_at"`
+    CreatedAt  time.Time  `json:"created_at"`
+    Token      string     `json:"token,omitempty"` // only set in the response that creates it
+}
+
+func AccessTokenTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS personal_access_tokens (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        name VARCHAR(100) NOT NULL,
+        hint VARCHAR(16) NOT NULL,
+        token_hash VARCHAR(64) NOT NULL UNIQUE,
+        scopes TEXT[] NOT NULL,
+        expires_at TIMESTAMP WITH TIME ZONE,
+        last_used_at TIMESTAMP WITH TIME ZONE,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
+    `
+}
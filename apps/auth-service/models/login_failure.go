@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// Reasons a login attempt is recorded as failed
+const (
+    LoginUnknownUser = "unknown_user"
+    LoginBadPassword = "bad_password"
+    LoginLocked      = "locked"
+    LoginBad2FACode  = "bad_2fa_code"
+)
+
+// LoginFailure is one failed login, kept for admins to spot brute-force attempts
+type LoginFailure struct {
+    ID        int       `json:"id"`
+    UserID    *int      `json:"user_id"`
+    Username  string    `json:"username"`
+    IP        string    `json:"ip"`
+    Reason    string    `json:"reason"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+func LoginFailureTableMigration() string {
+    return `
+    -- Consecutive failed logins and the lockout they caused; reset on success
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_logins INT NOT NULL DEFAULT 0;
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE;
+
+    CREATE TABLE IF NOT EXISTS login_failures (
+        id SERIAL PRIMARY KEY,
+        user_id INT REFERENCES users(id) ON DELETE SET NULL,
+        username VARCHAR(100) NOT NULL,
+        ip VARCHAR(45) NOT NULL,
+        reason VARCHAR(30) NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_login_failures_created_at ON login_failures(created_at);
+    CREATE INDEX IF NOT EXISTS idx_login_failures_username ON login_failures(username);
+    `
+}
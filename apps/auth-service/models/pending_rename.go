@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// PendingRename is a username change the file service has not applied yet.
+// It is written in the same transaction as the change, and removed once the
+// file service has moved the user's data to the new name.
+type PendingRename struct {
+    ID          int
+    OldUsername string
+    NewUsername string
+    Attempts    int
+    LastError   *string
+    CreatedAt   time.Time
+}
+
+func PendingRenameTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS pending_renames (
+        id SERIAL PRIMARY KEY,
+        old_username VARCHAR(50) NOT NULL,
+        new_username VARCHAR(50) NOT NULL,
+        attempts INT NOT NULL DEFAULT 0,
+        last_error TEXT,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+    `
+}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// SigningKey is an Ed25519 key the auth service signs access tokens with. A
+// new key is published in the JWKS before ActivatesAt and signs from then on;
+// its predecessor's RetiredAt is the same moment. Retired keys stay published
+// for an overlap window so tokens they signed keep verifying until they expire.
+type SigningKey struct {
+    Kid         string     `json:"kid"`
+    PrivateKey  []byte     `json:"-"` // Ed25519 seed, AES-GCM sealed with JWT_KEY_SECRET_PATH
+    CreatedAt   time.Time  `json:"created_at"`
+    ActivatesAt time.Time  `json:"activates_at"`
+    RetiredAt   *time.Time `json:"retired_at"`
+}
+
+func SigningKeyTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS signing_keys (
+        kid VARCHAR(64) PRIMARY KEY,
+        private_key BYTEA NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        retired_at TIMESTAMP WITH TIME ZONE
+    );
+
+    -- Keys made before activation was scheduled count as active from now
+    ALTER TABLE signing_keys ADD COLUMN IF NOT EXISTS activates_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now();
+
+    -- Only one key is without a retirement date: the newest, signing or about to
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_signing_keys_active ON signing_keys ((retired_at IS NULL)) WHERE retired_at IS NULL;
+    `
+}
@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// RefreshToken is one opaque refresh token, stored only as its SHA-256 hash.
+// Tokens issued from the same login share a FamilyID, which is also the "sid"
+// claim of the access tokens minted alongside them. Each token can be used
+// once; presenting a used token again revokes the whole family.
+type RefreshToken struct {
+    ID        int        `json:"id"`
+    UserID    int        `json:"user_id"`
+    FamilyID  string     `json:"family_id"`
+    TokenHash string     `json:"-"`
+    ExpiresAt time.Time  `json:"expires_at"`
+    UsedAt    *time.Time `json:"used_at"`
+    RevokedAt *time.Time `json:"revoked_at"`
+    CreatedAt time.Time  `json:"created_at"`
+}
+
+func RefreshTokenTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS refresh_tokens (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        family_id VARCHAR(64) NOT NULL,
+        token_hash VARCHAR(64) NOT NULL UNIQUE,
+        expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+        used_at TIMESTAMP WITH TIME ZONE,
+        revoked_at TIMESTAMP WITH TIME ZONE,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+    `
+}
+
+// TokenDenylistTableMigration creates the denylist both services consult in
+// JWTAuth. An id is either an access token's jti or a session (family) id;
+// rows can be dropped once expires_at passes, as no token outlives it.
+func TokenDenylistTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS token_denylist (
+        id VARCHAR(64) PRIMARY KEY,
+        expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+    );
+    `
+}
@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// LoginChallenge is the short-lived proof that a 2FA user got their password
+// right; it is exchanged for real tokens together with a TOTP or recovery code.
+type LoginChallenge struct {
+    ID        int
+    UserID    int
+    TokenHash string
+    Attempts  int
+    ExpiresAt time.Time
+    CreatedAt time.Time
+}
+
+func TwoFactorTableMigration() string {
+    return `
+    -- totp_secret_sealed is set at enrollment; 2FA only applies once totp_enabled.
+    -- totp_secret held the bare secret before secrets were sealed and is emptied at startup.
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret_sealed BYTEA;
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT false;
+    -- Last time step accepted, so a code cannot be replayed within its window
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+    CREATE TABLE IF NOT EXISTS recovery_codes (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        code_hash VARCHAR(64) NOT NULL,
+        used_at TIMESTAMP WITH TIME ZONE,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id);
+
+    CREATE TABLE IF NOT EXISTS login_challenges (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        token_hash VARCHAR(64) NOT NULL UNIQUE,
+        attempts INT NOT NULL DEFAULT 0,
+        expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+    `
+}
@@ -1,11 +1,21 @@
 package models
 
+// Roles a user can have. Every account starts as RoleUser; admins are
+// promoted through the admin API or BOOTSTRAP_ADMIN.
+const (
+    RoleUser  = "user"
+    RoleAdmin = "admin"
+)
+
 type User struct {
     ID       int    `json:"id"`
     Username string `json:"username"`
     Email    string `json:"email"`
     Password string `json:"-"`
     Role     string `json:"role"`
+
+    EmailVerified bool `json:"email_verified"`
+    TOTPEnabled   bool `json:"totp_enabled"`
 }
 
 func UserTableMigration() string {
@@ -16,5 +26,7 @@ func UserTableMigration() string {
         email VARCHAR(100) NOT NULL UNIQUE,
         password VARCHAR(255) NOT NULL
     );
+
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user';
     `
 }
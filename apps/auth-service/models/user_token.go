@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// What a UserToken can be spent on
+const (
+    PurposeVerifyEmail   = "verify_email"
+    PurposeResetPassword = "reset_password"
+)
+
+// UserToken is a single-use, time-limited token sent by email. Only its
+// SHA-256 hash is stored.
+type UserToken struct {
+    ID        int
+    UserID    int
+    Purpose   string
+    TokenHash string
+    ExpiresAt time.Time
+    UsedAt    *time.Time
+    CreatedAt time.Time
+}
+
+func UserTokenTableMigration() string {
+    return `
+    ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT false;
+
+    CREATE TABLE IF NOT EXISTS user_tokens (
+        id SERIAL PRIMARY KEY,
+        user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        purpose VARCHAR(20) NOT NULL,
+        token_hash VARCHAR(64) NOT NULL UNIQUE,
+        expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+        used_at TIMESTAMP WITH TIME ZONE,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_user_tokens_user_id ON user_tokens(user_id);
+    `
+}
@@ -3,10 +3,53 @@ package routes
 import (
     "net/http"
     "auth-service/controllers" // Import by package name, not filename
+    "auth-service/middleware"
+    "auth-service/models"
+    "auth-service/services"
 )
 
+// authenticated wraps a handler so it needs a valid access token
+func authenticated(handler http.HandlerFunc) http.HandlerFunc {
+    return controllers.WithCORS(middleware.JWTAuth(handler).ServeHTTP)
+}
+
+// adminOnly wraps a handler so it needs a valid token carrying the admin role
+func adminOnly(handler http.HandlerFunc) http.HandlerFunc {
+    return controllers.WithCORS(middleware.JWTAuth(middleware.RequireRole(models.RoleAdmin, handler)).ServeHTTP)
+}
+
 func SetupRoutes() {
-    http.HandleFunc("/register", controllers.WithCORS(controllers.Register))
-    http.HandleFunc("/login", controllers.WithCORS(controllers.Login))
+    // Unauthenticated endpoints that check passwords are rate limited per IP
+    http.HandleFunc("/register", controllers.WithCORS(middleware.RateLimitByIP(services.RegisterIPLimiter, controllers.Register)))
+    http.HandleFunc("/login", controllers.WithCORS(middleware.RateLimitByIP(services.LoginIPLimiter, controllers.Login)))
+    http.HandleFunc("/login/2fa", controllers.WithCORS(middleware.RateLimitByIP(services.LoginIPLimiter, controllers.LoginTwoFactor)))
+    http.HandleFunc("/verify-email", controllers.WithCORS(controllers.VerifyEmail))
+    http.HandleFunc("/verify-email/resend", controllers.WithCORS(middleware.RateLimitByIP(services.EmailIPLimiter, controllers.ResendVerification)))
+    http.HandleFunc("/password/forgot", controllers.WithCORS(middleware.RateLimitByIP(services.EmailIPLimiter, controllers.ForgotPassword)))
+    http.HandleFunc("/password/reset", controllers.WithCORS(middleware.RateLimitByIP(services.LoginIPLimiter, controllers.ResetPassword)))
+    http.HandleFunc("/refresh", controllers.WithCORS(controllers.Refresh))
+    http.HandleFunc("/logout", controllers.WithCORS(controllers.Logout))
     http.HandleFunc("/protected", controllers.WithCORS(controllers.Protected))
+
+    http.HandleFunc("/me", authenticated(controllers.Me))
+    http.HandleFunc("/me/password", authenticated(middleware.RateLimitByIP(services.LoginIPLimiter, controllers.ChangeMyPassword)))
+
+    http.HandleFunc("/2fa/enroll", authenticated(controllers.EnrollTwoFactor))
+    http.HandleFunc("/2fa/confirm", authenticated(controllers.ConfirmTwoFactor))
+    http.HandleFunc("/2fa/disable", authenticated(middleware.RateLimitByIP(services.LoginIPLimiter, controllers.DisableTwoFactor)))
+
+    http.HandleFunc("/tokens", authenticated(controllers.AccessTokens))
+    http.HandleFunc("/tokens/", authenticated(controllers.RevokeAccessToken))
+
+    // Service-to-service route for the file service's password-based protocols
+    http.HandleFunc("/internal/verify-password", middleware.InternalAuth(controllers.InternalVerifyPassword))
+
+    http.HandleFunc("/.well-known/jwks.json", controllers.WithCORS(controllers.JWKS))
+
+    http.HandleFunc("/admin/keys/rotate", adminOnly(controllers.AdminRotateKeys))
+    http.HandleFunc("/admin/users", adminOnly(controllers.AdminListUsers))
+    http.HandleFunc("/admin/users/promote", adminOnly(controllers.AdminPromoteUser))
+    http.HandleFunc("/admin/users/demote", adminOnly(controllers.AdminDemoteUser))
+    http.HandleFunc("/admin/users/unlock", adminOnly(controllers.AdminUnlockUser))
+    http.HandleFunc("/admin/login-failures", adminOnly(controllers.AdminListLoginFailures))
 }
@@ -0,0 +1,88 @@
+package services
+
+import (
+    "errors"
+    "strings"
+    "time"
+
+    "github.com/lib/pq"
+
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+var (
+    ErrInvalidScope      = errors.New("unknown scope")
+    ErrScopeNotAllowed   = errors.New("only admins can create tokens with the admin scope")
+    ErrTokenNameRequired = errors.New("token name is required")
+    ErrTokenNotFound     = errors.New("token not found")
+)
+
+// CreateAccessToken makes a new personal access token for user. The plain
+// token is only ever returned here.
+func CreateAccessToken(user models.User, name string, scopes []string, expiresAt *time.Time) (models.PersonalAccessToken, error) {
+    var t models.PersonalAccessToken
+    name = strings.TrimSpace(name)
+    if name == "" || len(name) > 100 {
+        return t, ErrTokenNameRequired
+    }
+    if len(scopes) == 0 {
+        return t, ErrInvalidScope
+    }
+    for _, s := range scopes {
+        if !models.ValidScope(s) {
+            return t, ErrInvalidScope
+        }
+        if s == models.ScopeAdmin && user.Role != models.RoleAdmin {
+            return t, ErrScopeNotAllowed
+        }
+    }
+
+    raw := models.AccessTokenPrefix + utils.NewOpaqueToken()
+    hint := raw[:len(models.AccessTokenPrefix)+4]
+    err := database.DB.QueryRow(
+        `INSERT INTO personal_access_tokens (user_id, name, hint, token_hash, scopes, expires_at)
+         VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at`,
+        user.ID, name, hint, utils.HashToken(raw), pq.Array(scopes), expiresAt,
+    ).Scan(&t.ID, &t.CreatedAt)
+    if err != nil {
+        return t, err
+    }
+    t.UserID, t.Name, t.Hint, t.Scopes, t.ExpiresAt, t.Token = user.ID, name, hint, scopes, expiresAt, raw
+    return t, nil
+}
+
+// ListAccessTokens returns userID's tokens, newest first
+func ListAccessTokens(userID int) ([]models.PersonalAccessToken, error) {
+    rows, err := database.DB.Query(
+        "SELECT id, name, hint, scopes, expires_at, last_used_at, created_at FROM personal_access_tokens WHERE user_id = $1 ORDER BY created_at DESC",
+        userID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    tokens := []models.PersonalAccessToken{}
+    for rows.Next() {
+        t := models.PersonalAccessToken{UserID: userID}
+        if err := rows.Scan(&t.ID, &t.Name, &t.Hint, pq.Array(&t.Scopes), &t.ExpiresAt, &t.LastUsedAt, &t.CreatedAt); err != nil {
+            return nil, err
+        }
+        tokens = append(tokens, t)
+    }
+    return tokens, rows.Err()
+}
+
+// RevokeAccessToken deletes one of userID's tokens; it stops working at once
+func RevokeAccessToken(userID, id int) error {
+    res, err := database.DB.Exec("DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2", id, userID)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrTokenNotFound
+    }
+    return nil
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+    "errors"
+    "strings"
+    "testing"
+
+    "github.com/lib/pq"
+
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+// Scope and name checks happen before anything is written, so they run
+// without a database
+func TestCreateAccessTokenValidation(t *testing.T) {
+    user := models.User{ID: 1, Username: "alice", Role: models.RoleUser}
+
+    cases := []struct {
+        name   string
+        user   models.User
+        token  string
+        scopes []string
+        want   error
+    }{
+        {"no name", user, " ", []string{models.ScopeFilesRead}, ErrTokenNameRequired},
+        {"long name", user, strings.Repeat("x", 101), []string{models.ScopeFilesRead}, ErrTokenNameRequired},
+        {"no scopes", user, "ci", nil, ErrInvalidScope},
+        {"unknown scope", user, "ci", []string{models.ScopeFilesRead, "files:delete"}, ErrInvalidScope},
+        {"admin scope for a user", user, "ci", []string{models.ScopeAdmin}, ErrScopeNotAllowed},
+    }
+    for _, c := range cases {
+        if _, err := CreateAccessToken(c.user, c.token, c.scopes, nil); !errors.Is(err, c.want) {
+            t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+        }
+    }
+}
+
+func TestValidScope(t *testing.T) {
+    for _, s := range []string{models.ScopeFilesRead, models.ScopeFilesWrite, models.ScopeShareManage, models.ScopeAdmin} {
+        if !models.ValidScope(s) {
+            t.Errorf("ValidScope(%q) = false", s)
+        }
+    }
+    for _, s := range []string{"", "files", "FILES:READ", "files:read "} {
+        if models.ValidScope(s) {
+            t.Errorf("ValidScope(%q) = true", s)
+        }
+    }
+}
+
+// Only the hash of a token is stored; the plain token is returned once
+func TestAccessTokenStoredHashed(t *testing.T) {
+    setupTestDB(t)
+    user := createTestUser(t, "scripter", "correct horse battery")
+    admin := createTestUser(t, "operator", "correct horse battery")
+    admin.Role = models.RoleAdmin
+
+    tok, err := CreateAccessToken(user, "ci", []string{models.ScopeFilesRead, models.ScopeFilesWrite}, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.HasPrefix(tok.Token, models.AccessTokenPrefix) || !strings.HasPrefix(tok.Token, tok.Hint) {
+        t.Fatalf("token %q with hint %q", tok.Token, tok.Hint)
+    }
+
+    var hash string
+    var scopes []string
+    err = database.DB.QueryRow("SELECT token_hash, scopes FROM personal_access_tokens WHERE id = $1", tok.ID).Scan(&hash, pq.Array(&scopes))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if hash != utils.HashToken(tok.Token) || strings.Contains(hash, tok.Token) {
+        t.Fatalf("stored %q, want the SHA-256 of the token", hash)
+    }
+    if strings.Join(scopes, ",") != "files:read,files:write" {
+        t.Fatalf("stored scopes %v", scopes)
+    }
+
+    listed, err := ListAccessTokens(user.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(listed) != 1 || listed[0].Token != "" {
+        t.Fatalf("ListAccessTokens = %+v, want one entry without the token", listed)
+    }
+
+    if _, err := CreateAccessToken(admin, "ops", []string{models.ScopeAdmin}, nil); err != nil {
+        t.Fatalf("admin creating an admin-scoped token: %v", err)
+    }
+
+    if err := RevokeAccessToken(admin.ID, tok.ID); !errors.Is(err, ErrTokenNotFound) {
+        t.Fatalf("revoking someone else's token = %v, want ErrTokenNotFound", err)
+    }
+    if err := RevokeAccessToken(user.ID, tok.ID); err != nil {
+        t.Fatal(err)
+    }
+}
@@ -0,0 +1,235 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "regexp"
+
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+var (
+    ErrInvalidUsername = errors.New("username must be 3-50 letters, digits, '.', '_' or '-'")
+    ErrUsernameTaken   = errors.New("username is already taken")
+    ErrEmailTaken      = errors.New("email is already in use")
+    ErrWrongPassword   = errors.New("current password is incorrect")
+    ErrLastAdmin       = errors.New("cannot delete the last admin")
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,50}$`)
+
+// GetUser loads the profile of username
+func GetUser(username string) (models.User, error) {
+    var u models.User
+    err := database.DB.QueryRow(
+        "SELECT id, username, email, role, email_verified, totp_enabled FROM users WHERE username = $1", username,
+    ).Scan(&u.ID, &u.Username, &u.Email, &u.Role, &u.EmailVerified, &u.TOTPEnabled)
+    return u, err
+}
+
+// ProfileUpdate lists the fields to change; nil means unchanged
+type ProfileUpdate struct {
+    Username *string
+    Email    *string
+}
+
+// UpdateProfile changes user's username and/or email. A new email must be
+// verified again. A new username ends every session, since their tokens carry
+// the old name, and is queued for the file service (which keys ownership by
+// name) in the same transaction; it is pushed once committed, and retried in
+// the background if the file service cannot be reached.
+func UpdateProfile(user models.User, upd ProfileUpdate) (updated models.User, renamed, emailChanged bool, err error) {
+    updated = user
+    if upd.Username != nil && *upd.Username != user.Username {
+        if !usernamePattern.MatchString(*upd.Username) {
+            return user, false, false, ErrInvalidUsername
+        }
+        updated.Username, renamed = *upd.Username, true
+    }
+    if upd.Email != nil {
+        email, err := NormalizeEmail(*upd.Email)
+        if err != nil {
+            return user, false, false, err
+        }
+        if email != user.Email {
+            updated.Email, updated.EmailVerified, emailChanged = email, false, true
+        }
+    }
+    if !renamed && !emailChanged {
+        return user, false, false, nil
+    }
+
+    err = database.WithTx(func(tx *sql.Tx) error {
+        var taken bool
+        if renamed {
+            // A name still being moved on the file service is not free yet
+            err := tx.QueryRow(
+                `SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)
+                     OR EXISTS (SELECT 1 FROM pending_renames WHERE old_username = $1 OR new_username = $1)`,
+                updated.Username,
+            ).Scan(&taken)
+            if err != nil {
+                return err
+            }
+            if taken {
+                return ErrUsernameTaken
+            }
+        }
+        if emailChanged {
+            if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = $1 AND id <> $2)", updated.Email, user.ID).Scan(&taken); err != nil {
+                return err
+            }
+            if taken {
+                return ErrEmailTaken
+            }
+        }
+
+        _, err := tx.Exec(
+            "UPDATE users SET username = $1, email = $2, email_verified = $3 WHERE id = $4",
+            updated.Username, updated.Email, updated.EmailVerified, user.ID,
+        )
+        if err != nil {
+            return err
+        }
+        if !renamed {
+            return nil
+        }
+        if err := RevokeUserSessionsTx(tx, user.ID); err != nil {
+            return err
+        }
+        _, err = tx.Exec("INSERT INTO pending_renames (old_username, new_username) VALUES ($1, $2)", user.Username, updated.Username)
+        return err
+    })
+    if err != nil {
+        return user, false, false, err
+    }
+    if renamed {
+        if err := PushPendingRenames(); err != nil {
+            log.Println("rename queued for retry:", err)
+        }
+    }
+    return updated, renamed, emailChanged, nil
+}
+
+// guardAccountChange applies the login limits before a password is checked
+// for a change made from a session, so a stolen session is no faster a way to
+// guess it. Wrong answers are recorded as failed logins and count towards the
+// lockout.
+func guardAccountChange(user models.User) error {
+    if err := AllowLoginAttempt(user.Username); err != nil {
+        return err
+    }
+    return CheckLockout(user.ID)
+}
+
+// ChangePassword replaces user's password after checking the current one,
+// and revokes every existing session
+func ChangePassword(user models.User, current, password, ip string) error {
+    if err := guardAccountChange(user); err != nil {
+        return err
+    }
+    var hash string
+    if err := database.DB.QueryRow("SELECT password FROM users WHERE id = $1", user.ID).Scan(&hash); err != nil {
+        return err
+    }
+    if !utils.CheckPasswordHash(current, hash) {
+        logLoginFailure(&user.ID, user.Username, ip, models.LoginBadPassword)
+        return ErrWrongPassword
+    }
+    if err := CheckPasswordPolicy(password, user.Username); err != nil {
+        return err
+    }
+    hashed, err := utils.HashPassword(password)
+    if err != nil {
+        return err
+    }
+    return database.WithTx(func(tx *sql.Tx) error {
+        // Only replace the hash that was checked
+        res, err := tx.Exec("UPDATE users SET password = $1 WHERE id = $2 AND password = $3", hashed, user.ID, hash)
+        if err != nil {
+            return err
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            return ErrWrongPassword
+        }
+        return RevokeUserSessionsTx(tx, user.ID)
+    })
+}
+
+// DeleteAccount removes user after checking their password (and 2FA code, if
+// enabled), with the same limits as a login. Sessions are revoked first so
+// nothing new is uploaded while the file service releases the user's files
+// and links; if that fails the account stays and deletion can be retried.
+func DeleteAccount(user models.User, password, code, recoveryCode, ip string) error {
+    if err := guardAccountChange(user); err != nil {
+        return err
+    }
+    failure := ""
+    err := database.WithTx(func(tx *sql.Tx) error {
+        // Serialise with role changes so the last admin cannot slip away
+        if _, err := tx.Exec("LOCK TABLE users IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+            return err
+        }
+        var hash, role string
+        var totp bool
+        err := tx.QueryRow("SELECT password, role, totp_enabled FROM users WHERE id = $1", user.ID).Scan(&hash, &role, &totp)
+        if err != nil {
+            return err
+        }
+        if !utils.CheckPasswordHash(password, hash) {
+            failure = models.LoginBadPassword
+            return ErrWrongPassword
+        }
+        if totp {
+            err := verifySecondFactorTx(tx, user.ID, code, recoveryCode)
+            if errors.Is(err, ErrInvalidCode) {
+                failure = models.LoginBad2FACode
+            }
+            if err != nil {
+                return err
+            }
+        }
+        if role == models.RoleAdmin {
+            var admins int
+            if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE role = $1", models.RoleAdmin).Scan(&admins); err != nil {
+                return err
+            }
+            if admins <= 1 {
+                return ErrLastAdmin
+            }
+        }
+        return RevokeUserSessionsTx(tx, user.ID)
+    })
+    // Recorded after the table lock is released, since counting updates users
+    if failure != "" {
+        logLoginFailure(&user.ID, user.Username, ip, failure)
+    }
+    if err != nil {
+        return err
+    }
+
+    // Files still filed under an earlier name would be missed
+    if err := PushPendingRenames(); err != nil {
+        log.Println("pushing renames before account deletion:", err)
+    }
+    var renaming bool
+    err = database.DB.QueryRow(
+        "SELECT EXISTS (SELECT 1 FROM pending_renames WHERE old_username = $1 OR new_username = $1)", user.Username,
+    ).Scan(&renaming)
+    if err != nil {
+        return err
+    }
+    if renaming {
+        return fmt.Errorf("%w: rename of %s not applied yet", ErrFileService, user.Username)
+    }
+    if err := releaseUserFiles(user.Username); err != nil {
+        return err
+    }
+    // Tokens, codes and challenges go with the row through ON DELETE CASCADE
+    _, err = database.DB.Exec("DELETE FROM users WHERE id = $1", user.ID)
+    return err
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "net/mail"
+    "strings"
+    "time"
+
+    "auth-service/config"
+    "auth-service/database"
+    "auth-service/mailer"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+var (
+    ErrInvalidEmail     = errors.New("invalid email address")
+    ErrInvalidUserToken = errors.New("invalid or expired link")
+)
+
+// NormalizeEmail validates a bare email address and lower-cases it
+func NormalizeEmail(email string) (string, error) {
+    addr, err := mail.ParseAddress(strings.TrimSpace(email))
+    if err != nil || addr.Name != "" || len(addr.Address) > 100 {
+        return "", ErrInvalidEmail
+    }
+    return strings.ToLower(addr.Address), nil
+}
+
+// RequireEmailVerification reports whether unverified users are refused at login
+func RequireEmailVerification() bool {
+    return config.GetEnv("REQUIRE_EMAIL_VERIFICATION") == "true"
+}
+
+// issueUserTokenTx makes a new emailed token for userID. Earlier unused tokens
+// for the same purpose stop working, so only the newest link is valid.
+func issueUserTokenTx(tx *sql.Tx, userID int, purpose string, ttl time.Duration) (string, error) {
+    if _, err := tx.Exec("DELETE FROM user_tokens WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL", userID, purpose); err != nil {
+        return "", err
+    }
+    raw := utils.NewOpaqueToken()
+    _, err := tx.Exec(
+        "INSERT INTO user_tokens (user_id, purpose, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+        userID, purpose, utils.HashToken(raw), time.Now().Add(ttl),
+    )
+    return raw, err
+}
+
+// consumeUserTokenTx spends a token and returns the user it belongs to
+func consumeUserTokenTx(tx *sql.Tx, raw, purpose string) (int, error) {
+    var t models.UserToken
+    err := tx.QueryRow(
+        "SELECT id, user_id, expires_at, used_at FROM user_tokens WHERE token_hash = $1 AND purpose = $2 FOR UPDATE",
+        utils.HashToken(raw), purpose,
+    ).Scan(&t.ID, &t.UserID, &t.ExpiresAt, &t.UsedAt)
+    if err == sql.ErrNoRows {
+        return 0, ErrInvalidUserToken
+    }
+    if err != nil {
+        return 0, err
+    }
+    if t.UsedAt != nil || time.Now().After(t.ExpiresAt) {
+        return 0, ErrInvalidUserToken
+    }
+    _, err = tx.Exec("UPDATE user_tokens SET used_at = now() WHERE id = $1", t.ID)
+    return t.UserID, err
+}
+
+// SendVerificationEmail mails user a link that confirms their address
+func SendVerificationEmail(user models.User) error {
+    var raw string
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var err error
+        raw, err = issueUserTokenTx(tx, user.ID, models.PurposeVerifyEmail, config.GetEnvDuration("EMAIL_VERIFY_TTL", 48*time.Hour))
+        return err
+    })
+    if err != nil {
+        return err
+    }
+
+    base := strings.TrimRight(config.GetEnvDefault("AUTH_PUBLIC_URL", "http://localhost:8000"), "/")
+    return mailer.Default.Send(mailer.Message{
+        To:      user.Email,
+        Subject: "Confirm your email address",
+        Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening this link:\n\n%s/verify-email?token=%s\n\nIf you did not sign up, you can ignore this message.\n",
+            user.Username, base, raw),
+    })
+}
+
+// VerifyEmail marks the address behind a verification token as confirmed
+func VerifyEmail(raw string) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        userID, err := consumeUserTokenTx(tx, raw, models.PurposeVerifyEmail)
+        if err != nil {
+            return err
+        }
+        _, err = tx.Exec("UPDATE users SET email_verified = true WHERE id = $1", userID)
+        return err
+    })
+}
+
+// findUserByEmail returns the user with email, or ok=false if there is none
+func findUserByEmail(email string) (models.User, bool, error) {
+    var u models.User
+    email, err := NormalizeEmail(email)
+    if err != nil {
+        return u, false, nil
+    }
+    err = database.DB.QueryRow(
+        "SELECT id, username, email, email_verified FROM users WHERE lower(email) = $1", email,
+    ).Scan(&u.ID, &u.Username, &u.Email, &u.EmailVerified)
+    if err == sql.ErrNoRows {
+        return u, false, nil
+    }
+    return u, err == nil, err
+}
+
+// ResendVerification sends a new verification link if email belongs to an
+// unverified account. It never reveals whether the account exists.
+func ResendVerification(email string) error {
+    user, ok, err := findUserByEmail(email)
+    if err != nil || !ok || user.EmailVerified {
+        return err
+    }
+    return SendVerificationEmail(user)
+}
+
+// RequestPasswordReset mails a reset link if email belongs to an account. It
+// never reveals whether the account exists.
+func RequestPasswordReset(email string) error {
+    user, ok, err := findUserByEmail(email)
+    if err != nil || !ok {
+        return err
+    }
+
+    var raw string
+    err = database.WithTx(func(tx *sql.Tx) error {
+        var err error
+        raw, err = issueUserTokenTx(tx, user.ID, models.PurposeResetPassword, config.GetEnvDuration("PASSWORD_RESET_TTL", time.Hour))
+        return err
+    })
+    if err != nil {
+        return err
+    }
+
+    base := strings.TrimRight(config.GetEnvDefault("APP_BASE_URL", "http://localhost:5173"), "/")
+    return mailer.Default.Send(mailer.Message{
+        To:      user.Email,
+        Subject: "Reset your password",
+        Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password for your account. To choose a new password, open:\n\n%s/reset-password?token=%s\n\nThe link works once and expires soon. If it was not you, ignore this message; your password has not changed.\n",
+            user.Username, base, raw),
+    })
+}
+
+// ResetPassword sets a new password with a reset token. Every existing
+// session is revoked, any lockout is lifted, and since the user proved they
+// read the mailbox, the address counts as verified.
+func ResetPassword(raw, password string) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        userID, err := consumeUserTokenTx(tx, raw, models.PurposeResetPassword)
+        if err != nil {
+            return err
+        }
+        // A refused password rolls back, so the link can be used again
+        var username string
+        if err := tx.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username); err != nil {
+            return err
+        }
+        if err := CheckPasswordPolicy(password, username); err != nil {
+            return err
+        }
+        hashed, err := utils.HashPassword(password)
+        if err != nil {
+            return err
+        }
+        _, err = tx.Exec(
+            "UPDATE users SET password = $1, email_verified = true, failed_logins = 0, locked_until = NULL WHERE id = $2",
+            hashed, userID,
+        )
+        if err != nil {
+            return err
+        }
+        return RevokeUserSessionsTx(tx, userID)
+    })
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "sync/atomic"
+    "testing"
+
+    "auth-service/database"
+)
+
+func TestChangePasswordCountsFailures(t *testing.T) {
+    setupTestDB(t)
+    t.Setenv("LOCKOUT_THRESHOLD", "2")
+    user := createTestUser(t, "changer", "correct horse battery")
+
+    for i := 0; i < 2; i++ {
+        if err := ChangePassword(user, "wrong", "a much better passphrase", "203.0.113.7"); !errors.Is(err, ErrWrongPassword) {
+            t.Fatalf("wrong password %d = %v, want ErrWrongPassword", i+1, err)
+        }
+    }
+    var limited *RateLimitError
+    if err := ChangePassword(user, "correct horse battery", "a much better passphrase", "203.0.113.7"); !errors.As(err, &limited) {
+        t.Fatalf("right password while locked = %v, want RateLimitError", err)
+    }
+    if err := DeleteAccount(user, "correct horse battery", "", "", "203.0.113.7"); !errors.As(err, &limited) {
+        t.Fatalf("deleting while locked = %v, want RateLimitError", err)
+    }
+}
+
+// A username change commits even when the file service is down, and reaches
+// it once it is back
+func TestRenameQueuedUntilFileServiceAnswers(t *testing.T) {
+    setupTestDB(t)
+    var up atomic.Bool
+    var renames atomic.Int32
+    files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !up.Load() {
+            http.Error(w, "down", http.StatusServiceUnavailable)
+            return
+        }
+        renames.Add(1)
+        w.WriteHeader(http.StatusNoContent)
+    }))
+    defer files.Close()
+    t.Setenv("FILE_SERVICE_URL", files.URL)
+
+    user := createTestUser(t, "before", "correct horse battery")
+    other := createTestUser(t, "bystander", "correct horse battery")
+    newName := "after"
+    updated, renamed, _, err := UpdateProfile(user, ProfileUpdate{Username: &newName})
+    if err != nil || !renamed || updated.Username != "after" {
+        t.Fatalf("UpdateProfile = %+v, %v, %v", updated, renamed, err)
+    }
+
+    var pending int
+    database.DB.QueryRow("SELECT count(*) FROM pending_renames").Scan(&pending)
+    if pending != 1 {
+        t.Fatalf("%d renames queued, want 1", pending)
+    }
+    // The old name is not free while its files may still be filed under it
+    oldName := "before"
+    if _, _, _, err := UpdateProfile(other, ProfileUpdate{Username: &oldName}); !errors.Is(err, ErrUsernameTaken) {
+        t.Fatalf("taking a name mid-rename = %v, want ErrUsernameTaken", err)
+    }
+
+    up.Store(true)
+    if err := PushPendingRenames(); err != nil {
+        t.Fatal(err)
+    }
+    database.DB.QueryRow("SELECT count(*) FROM pending_renames").Scan(&pending)
+    if pending != 0 || renames.Load() != 1 {
+        t.Fatalf("%d renames queued and %d sent after recovery, want 0 and 1", pending, renames.Load())
+    }
+}
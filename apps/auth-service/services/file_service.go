@@ -0,0 +1,135 @@
+package services
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "auth-service/config"
+    "auth-service/database"
+    "auth-service/models"
+)
+
+// ErrFileService wraps failures talking to the file service
+var ErrFileService = errors.New("file service request failed")
+
+// fileServiceClient is used for the file service's /internal routes; deleting
+// a large account can take a while, hence the long timeout
+var fileServiceClient = &http.Client{Timeout: 5 * time.Minute}
+
+// callFileService sends an authenticated internal request to the file service
+func callFileService(method, path string, body interface{}) error {
+    var payload io.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        payload = bytes.NewReader(data)
+    }
+
+    base := strings.TrimRight(config.GetEnvDefault("FILE_SERVICE_URL", "http://localhost:8001"), "/")
+    req, err := http.NewRequest(method, base+path, payload)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("X-Internal-Token", config.GetEnv("INTERNAL_API_TOKEN"))
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+
+    resp, err := fileServiceClient.Do(req)
+    if err != nil {
+        return fmt.Errorf("%w: %v", ErrFileService, err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("%w: %s %s: %s: %s", ErrFileService, method, path, resp.Status, strings.TrimSpace(string(msg)))
+    }
+    return nil
+}
+
+// releaseUserFiles asks the file service to delete everything username owns
+func releaseUserFiles(username string) error {
+    return callFileService(http.MethodDelete, "/internal/users/"+url.PathEscape(username), nil)
+}
+
+// renameUserFiles asks the file service to move username's data to newUsername.
+// Callers go through the pending_renames queue (see PushPendingRenames).
+func renameUserFiles(username, newUsername string) error {
+    return callFileService(http.MethodPost, "/internal/users/"+url.PathEscape(username)+"/rename",
+        map[string]string{"new_username": newUsername})
+}
+
+// renamePushMu keeps this instance from pushing the same rename twice at once;
+// the file service's rename is idempotent, so other instances are harmless
+var renamePushMu sync.Mutex
+
+// PushPendingRenames sends queued username changes to the file service in
+// the order they were made. A rename that fails holds back later ones
+// involving the same names and stays queued for the next push; the first
+// failure is returned.
+func PushPendingRenames() error {
+    renamePushMu.Lock()
+    defer renamePushMu.Unlock()
+
+    rows, err := database.DB.Query("SELECT id, old_username, new_username FROM pending_renames ORDER BY id")
+    if err != nil {
+        return err
+    }
+    var pending []models.PendingRename
+    for rows.Next() {
+        var p models.PendingRename
+        if err := rows.Scan(&p.ID, &p.OldUsername, &p.NewUsername); err != nil {
+            rows.Close()
+            return err
+        }
+        pending = append(pending, p)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    blocked := map[string]bool{}
+    var firstErr error
+    for _, p := range pending {
+        if blocked[p.OldUsername] || blocked[p.NewUsername] {
+            continue
+        }
+        if err := renameUserFiles(p.OldUsername, p.NewUsername); err != nil {
+            blocked[p.OldUsername], blocked[p.NewUsername] = true, true
+            if _, dbErr := database.DB.Exec("UPDATE pending_renames SET attempts = attempts + 1, last_error = $1 WHERE id = $2", err.Error(), p.ID); dbErr != nil {
+                log.Println("failed to note rename failure:", dbErr)
+            }
+            if firstErr == nil {
+                firstErr = err
+            }
+            continue
+        }
+        if _, err := database.DB.Exec("DELETE FROM pending_renames WHERE id = $1", p.ID); err != nil {
+            return err
+        }
+    }
+    return firstErr
+}
+
+// StartRenamePush retries queued renames every interval
+func StartRenamePush(interval time.Duration) {
+    go func() {
+        for range time.Tick(interval) {
+            if err := PushPendingRenames(); err != nil {
+                log.Println("pushing renames to the file service failed:", err)
+            }
+        }
+    }()
+}
@@ -0,0 +1,381 @@
+package services
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/ed25519"
+    "crypto/rand"
+    "database/sql"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "auth-service/config"
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+// KeyRotationInterval is how long a signing key is used before a new one takes over
+func KeyRotationInterval() time.Duration {
+    return config.GetEnvDuration("JWT_KEY_ROTATION", 30*24*time.Hour)
+}
+
+// KeyOverlap is how long a retired key stays published. It must be longer
+// than ACCESS_TOKEN_TTL, or tokens signed just before a rotation stop verifying.
+func KeyOverlap() time.Duration {
+    overlap := config.GetEnvDuration("JWT_KEY_OVERLAP", 24*time.Hour)
+    if ttl := utils.AccessTokenTTL(); overlap < ttl {
+        overlap = ttl
+    }
+    return overlap
+}
+
+// keyReloadInterval is how often every instance rereads signing_keys
+const keyReloadInterval = time.Minute
+
+// jwksMinRefetch mirrors the file service's JWKSCache.MinRefetch: the
+// longest it may go without refetching when it meets an unknown kid
+const jwksMinRefetch = 30 * time.Second
+
+// KeyPublishDelay is how long a new key is published in the JWKS before it
+// starts signing, so every auth-service instance has reloaded it and every
+// verifier can fetch it by the time tokens carry its kid
+func KeyPublishDelay() time.Duration {
+    delay := config.GetEnvDuration("JWT_KEY_PUBLISH_DELAY", 5*time.Minute)
+    if floor := keyReloadInterval + jwksMinRefetch; delay < floor {
+        delay = floor
+    }
+    return delay
+}
+
+// keySecretPath is the file holding the key that encrypts the signing keys at
+// rest. It never goes into the database, so other services sharing Postgres
+// cannot read the seeds; every auth-service instance needs the same file.
+func keySecretPath() string {
+    return config.GetEnvDefault("JWT_KEY_SECRET_PATH", "./jwt_key_secret")
+}
+
+// secretCipher seals the Ed25519 seeds stored in signing_keys and the users'
+// TOTP secrets
+var secretCipher cipher.AEAD
+
+// loadKeySecret reads the hex-encoded AES-256 key at path, generating and
+// saving one if there is none yet
+func loadKeySecret(path string) (cipher.AEAD, error) {
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        secret := make([]byte, 32)
+        if _, err := rand.Read(secret); err != nil {
+            return nil, err
+        }
+        if err := os.WriteFile(path, []byte(hex.EncodeToString(secret)+"\n"), 0600); err != nil {
+            return nil, err
+        }
+        log.Println("generated signing key secret at", path)
+        data = []byte(hex.EncodeToString(secret))
+    } else if err != nil {
+        return nil, err
+    }
+
+    secret, err := hex.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil || len(secret) != 32 {
+        return nil, fmt.Errorf("%s must hold 32 hex-encoded bytes", path)
+    }
+    block, err := aes.NewCipher(secret)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// sealSecret encrypts plain for storage as nonce then ciphertext. aad names
+// the row it belongs to, so a sealed value cannot be moved to another row.
+func sealSecret(aad string, plain []byte) ([]byte, error) {
+    nonce := make([]byte, secretCipher.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    return secretCipher.Seal(nonce, nonce, plain, []byte(aad)), nil
+}
+
+// openSecret decrypts a value sealed by sealSecret with the same aad
+func openSecret(aad string, sealed []byte) ([]byte, error) {
+    n := secretCipher.NonceSize()
+    if len(sealed) < n {
+        return nil, errors.New("is not sealed")
+    }
+    plain, err := secretCipher.Open(nil, sealed[:n], sealed[n:], []byte(aad))
+    if err != nil {
+        return nil, fmt.Errorf("does not decrypt with %s: %w", keySecretPath(), err)
+    }
+    return plain, nil
+}
+
+// sealSeed encrypts a seed for storage, bound to its kid
+func sealSeed(kid string, seed []byte) ([]byte, error) {
+    return sealSecret(kid, seed)
+}
+
+// openSeed decrypts a seed sealed by sealSeed
+func openSeed(kid string, sealed []byte) ([]byte, error) {
+    seed, err := openSecret(kid, sealed)
+    if err != nil {
+        return nil, fmt.Errorf("signing key %s %w", kid, err)
+    }
+    if len(seed) != ed25519.SeedSize {
+        return nil, fmt.Errorf("signing key %s has a bad seed length", kid)
+    }
+    return seed, nil
+}
+
+// sealPlaintextKeys encrypts seeds written before keys were sealed. A bare
+// seed is exactly SeedSize bytes; a sealed one carries a nonce and tag too.
+func sealPlaintextKeys() error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        rows, err := tx.Query("SELECT kid, private_key FROM signing_keys WHERE length(private_key) = $1 FOR UPDATE", ed25519.SeedSize)
+        if err != nil {
+            return err
+        }
+        plain := map[string][]byte{}
+        for rows.Next() {
+            var kid string
+            var seed []byte
+            if err := rows.Scan(&kid, &seed); err != nil {
+                rows.Close()
+                return err
+            }
+            plain[kid] = seed
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+
+        for kid, seed := range plain {
+            sealed, err := sealSeed(kid, seed)
+            if err != nil {
+                return err
+            }
+            if _, err := tx.Exec("UPDATE signing_keys SET private_key = $1 WHERE kid = $2", sealed, kid); err != nil {
+                return err
+            }
+        }
+        if len(plain) > 0 {
+            log.Printf("encrypted %d stored signing keys", len(plain))
+        }
+        return nil
+    })
+}
+
+// JWK is a public key in JSON Web Key form (RFC 8037 for Ed25519)
+type JWK struct {
+    Kty string `json:"kty"`
+    Crv string `json:"crv"`
+    X   string `json:"x"`
+    Kid string `json:"kid"`
+    Alg string `json:"alg"`
+    Use string `json:"use"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+    Keys []JWK `json:"keys"`
+}
+
+// keyring is the in-memory copy of signing_keys. It is reloaded periodically
+// so every auth-service instance sees rotations made by the others.
+type keyring struct {
+    mu      sync.RWMutex
+    entries []keyEntry // newest activation first
+    public  map[string]ed25519.PublicKey
+}
+
+// keyEntry is a loaded key and the span it signs in: from activatesAt until
+// retiredAt, which is nil while no successor is scheduled
+type keyEntry struct {
+    kid         string
+    private     ed25519.PrivateKey
+    activatesAt time.Time
+    retiredAt   *time.Time
+}
+
+var keys = &keyring{public: map[string]ed25519.PublicKey{}}
+
+// SigningKey returns the key whose span covers now. The choice is made per
+// call, so all instances switch at the scheduled time rather than at their
+// next reload.
+func (k *keyring) SigningKey() (string, ed25519.PrivateKey) {
+    k.mu.RLock()
+    defer k.mu.RUnlock()
+    now := time.Now()
+    for _, e := range k.entries {
+        if !e.activatesAt.After(now) && (e.retiredAt == nil || e.retiredAt.After(now)) {
+            return e.kid, e.private
+        }
+    }
+    return "", nil
+}
+
+func (k *keyring) PublicKey(kid string) (ed25519.PublicKey, bool) {
+    k.mu.RLock()
+    defer k.mu.RUnlock()
+    key, ok := k.public[kid]
+    return key, ok
+}
+
+// InitKeys loads the signing keys, creating the first one on a fresh install,
+// and installs them as utils.Keys
+func InitKeys() error {
+    aead, err := loadKeySecret(keySecretPath())
+    if err != nil {
+        return err
+    }
+    secretCipher = aead
+    if err := sealPlaintextKeys(); err != nil {
+        return err
+    }
+    if err := reloadKeys(); err != nil {
+        return err
+    }
+    if kid, _ := keys.SigningKey(); kid == "" {
+        if err := RotateKeys(); err != nil {
+            return err
+        }
+    }
+    utils.Keys = keys
+    return nil
+}
+
+// reloadKeys reads every key that is pending, signing or still inside its
+// overlap window
+func reloadKeys() error {
+    rows, err := database.DB.Query(
+        "SELECT kid, private_key, created_at, activates_at, retired_at FROM signing_keys WHERE retired_at IS NULL OR retired_at > $1 ORDER BY activates_at DESC",
+        time.Now().Add(-KeyOverlap()),
+    )
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    var entries []keyEntry
+    public := map[string]ed25519.PublicKey{}
+    for rows.Next() {
+        var sk models.SigningKey
+        if err := rows.Scan(&sk.Kid, &sk.PrivateKey, &sk.CreatedAt, &sk.ActivatesAt, &sk.RetiredAt); err != nil {
+            return err
+        }
+        seed, err := openSeed(sk.Kid, sk.PrivateKey)
+        if err != nil {
+            return err
+        }
+        priv := ed25519.NewKeyFromSeed(seed)
+        public[sk.Kid] = priv.Public().(ed25519.PublicKey)
+        entries = append(entries, keyEntry{kid: sk.Kid, private: priv, activatesAt: sk.ActivatesAt, retiredAt: sk.RetiredAt})
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    keys.mu.Lock()
+    keys.entries, keys.public = entries, public
+    keys.mu.Unlock()
+    return nil
+}
+
+// RotateKeys schedules a new signing key. It is published in the JWKS at
+// once but only signs after KeyPublishDelay; until then the current key
+// keeps signing, and afterwards it keeps verifying for KeyOverlap. On a fresh
+// install, with nothing to take over from, the new key signs immediately.
+func RotateKeys() error {
+    _, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return err
+    }
+    kid := utils.NewTokenID()
+    sealed, err := sealSeed(kid, priv.Seed())
+    if err != nil {
+        return err
+    }
+    err = database.WithTx(func(tx *sql.Tx) error {
+        if _, err := tx.Exec("LOCK TABLE signing_keys IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+            return err
+        }
+        activatesAt := time.Now()
+        res, err := tx.Exec("UPDATE signing_keys SET retired_at = $1 WHERE retired_at IS NULL", activatesAt.Add(KeyPublishDelay()))
+        if err != nil {
+            return err
+        }
+        if n, _ := res.RowsAffected(); n > 0 {
+            activatesAt = activatesAt.Add(KeyPublishDelay())
+        }
+        _, err = tx.Exec("INSERT INTO signing_keys (kid, private_key, activates_at) VALUES ($1, $2, $3)", kid, sealed, activatesAt)
+        return err
+    })
+    if err != nil {
+        return err
+    }
+    return reloadKeys()
+}
+
+// rotateIfDue rotates when the signing key is older than KeyRotationInterval
+// and drops keys whose overlap window has passed
+func rotateIfDue() error {
+    var due bool
+    err := database.DB.QueryRow(
+        "SELECT EXISTS (SELECT 1 FROM signing_keys WHERE retired_at IS NULL AND created_at < $1)",
+        time.Now().Add(-KeyRotationInterval()),
+    ).Scan(&due)
+    if err != nil {
+        return err
+    }
+    if due {
+        log.Println("rotating JWT signing key")
+        if err := RotateKeys(); err != nil {
+            return err
+        }
+    }
+    _, err = database.DB.Exec("DELETE FROM signing_keys WHERE retired_at < $1", time.Now().Add(-KeyOverlap()))
+    return err
+}
+
+// StartKeyRotation reloads keys and rotates them when due, every keyReloadInterval
+func StartKeyRotation() {
+    go func() {
+        for range time.Tick(keyReloadInterval) {
+            if err := rotateIfDue(); err != nil {
+                log.Println("key rotation failed:", err)
+            }
+            if err := reloadKeys(); err != nil {
+                log.Println("key reload failed:", err)
+            }
+        }
+    }()
+}
+
+// JWKS returns the public half of every key that may still have signed a
+// valid token, and of the next key before it starts signing
+func JWKS() JWKSet {
+    keys.mu.RLock()
+    defer keys.mu.RUnlock()
+
+    set := JWKSet{Keys: []JWK{}}
+    for _, e := range keys.entries {
+        set.Keys = append(set.Keys, JWK{
+            Kty: "OKP",
+            Crv: "Ed25519",
+            X:   base64.RawURLEncoding.EncodeToString(keys.public[e.kid]),
+            Kid: e.kid,
+            Alg: "EdDSA",
+            Use: "sig",
+        })
+    }
+    return set
+}
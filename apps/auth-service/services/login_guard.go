@@ -0,0 +1,255 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+
+    "auth-service/config"
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+var (
+    ErrInvalidCredentials = errors.New("invalid credentials")
+    ErrEmailNotVerified   = errors.New("email address not verified")
+)
+
+// RateLimitError is returned when a request must wait before trying again
+type RateLimitError struct {
+    RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+    return fmt.Sprintf("too many attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// Limiters for the unauthenticated endpoints, set up by InitLoginGuard once
+// the environment is loaded
+var (
+    LoginIPLimiter    *utils.SlidingWindow
+    RegisterIPLimiter *utils.SlidingWindow
+    EmailIPLimiter    *utils.SlidingWindow
+    loginUserLimiter  *utils.SlidingWindow
+)
+
+func InitLoginGuard() {
+    window := config.GetEnvDuration("RATE_LIMIT_WINDOW", time.Minute)
+    LoginIPLimiter = utils.NewSlidingWindow(int(config.GetEnvInt64("LOGIN_IP_LIMIT", 20)), window)
+    RegisterIPLimiter = utils.NewSlidingWindow(int(config.GetEnvInt64("REGISTER_IP_LIMIT", 5)), window)
+    EmailIPLimiter = utils.NewSlidingWindow(int(config.GetEnvInt64("EMAIL_IP_LIMIT", 5)), window)
+    loginUserLimiter = utils.NewSlidingWindow(int(config.GetEnvInt64("LOGIN_USER_LIMIT", 10)), window)
+}
+
+// AllowLoginAttempt applies the per-username rate limit. Unknown usernames
+// are limited too, so probing for accounts is no cheaper.
+func AllowLoginAttempt(username string) error {
+    if ok, wait := loginUserLimiter.Allow(strings.ToLower(username)); !ok {
+        return &RateLimitError{RetryAfter: wait}
+    }
+    return nil
+}
+
+// CheckCredentials is the password step of every login: it applies the
+// per-username rate limit and lockout, records failures from ip, and upgrades
+// outdated password hashes. Unknown users and wrong passwords both give
+// ErrInvalidCredentials. Second factors are the caller's business.
+func CheckCredentials(username, password, ip string) (models.User, error) {
+    if err := AllowLoginAttempt(username); err != nil {
+        return models.User{}, err
+    }
+
+    var user models.User
+    err := database.DB.QueryRow(
+        "SELECT id, username, email, password, role, email_verified, totp_enabled FROM users WHERE username = $1", username,
+    ).Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.Role, &user.EmailVerified, &user.TOTPEnabled)
+    if err == sql.ErrNoRows {
+        logLoginFailure(nil, username, ip, models.LoginUnknownUser)
+        return user, ErrInvalidCredentials
+    }
+    if err != nil {
+        return user, err
+    }
+
+    // A locked account is refused before the (slow) password check
+    if err := CheckLockout(user.ID); err != nil {
+        var limited *RateLimitError
+        if errors.As(err, &limited) {
+            logLoginFailure(&user.ID, user.Username, ip, models.LoginLocked)
+        }
+        return user, err
+    }
+
+    if !utils.CheckPasswordHash(password, user.Password) {
+        logLoginFailure(&user.ID, user.Username, ip, models.LoginBadPassword)
+        return user, ErrInvalidCredentials
+    }
+    // With 2FA on, the failure count stands until the code step succeeds too
+    if !user.TOTPEnabled {
+        if err := ResetLoginFailures(user.ID); err != nil {
+            return user, err
+        }
+    }
+    // Upgrade bcrypt and outdated argon2id hashes while we have the password
+    if utils.NeedsRehash(user.Password) {
+        if err := RehashPassword(user.ID, user.Password, password); err != nil {
+            log.Println("failed to rehash password:", err)
+        }
+    }
+    if !user.EmailVerified && RequireEmailVerification() {
+        return user, ErrEmailNotVerified
+    }
+    return user, nil
+}
+
+// logLoginFailure is RecordLoginFailure for callers that cannot do anything
+// about a failure to record
+func logLoginFailure(userID *int, username, ip, reason string) {
+    if err := RecordLoginFailure(userID, username, ip, reason); err != nil {
+        log.Println("failed to record login failure:", err)
+    }
+}
+
+// lockoutFor is how long an account is locked after failures consecutive
+// failed logins: nothing below LOCKOUT_THRESHOLD, then LOCKOUT_BASE doubling
+// with every further failure up to LOCKOUT_MAX.
+func lockoutFor(failures int) time.Duration {
+    threshold := int(config.GetEnvInt64("LOCKOUT_THRESHOLD", 5))
+    if failures < threshold {
+        return 0
+    }
+    base := config.GetEnvDuration("LOCKOUT_BASE", time.Minute)
+    max := config.GetEnvDuration("LOCKOUT_MAX", time.Hour)
+    d := base
+    for i := threshold; i < failures && d < max; i++ {
+        d *= 2
+    }
+    if d > max {
+        d = max
+    }
+    return d
+}
+
+// CheckLockout returns a RateLimitError while userID is locked out
+func CheckLockout(userID int) error {
+    return checkLockout(database.DB.QueryRow("SELECT locked_until FROM users WHERE id = $1", userID))
+}
+
+// checkLockoutTx is CheckLockout inside tx
+func checkLockoutTx(tx *sql.Tx, userID int) error {
+    return checkLockout(tx.QueryRow("SELECT locked_until FROM users WHERE id = $1", userID))
+}
+
+func checkLockout(row *sql.Row) error {
+    var lockedUntil *time.Time
+    if err := row.Scan(&lockedUntil); err != nil {
+        return err
+    }
+    if lockedUntil != nil && time.Now().Before(*lockedUntil) {
+        return &RateLimitError{RetryAfter: time.Until(*lockedUntil)}
+    }
+    return nil
+}
+
+// RecordLoginFailure counts a failed login towards a known user's lockout and
+// logs it for admins. The count is committed first and on its own, so a log
+// entry that cannot be written does not undo it.
+func RecordLoginFailure(userID *int, username, ip, reason string) error {
+    if userID != nil && reason != models.LoginLocked {
+        err := database.WithTx(func(tx *sql.Tx) error {
+            return countLoginFailureTx(tx, *userID)
+        })
+        if err != nil {
+            return err
+        }
+    }
+    return insertLoginFailure(userID, username, ip, reason)
+}
+
+// auditLoginFailure logs a failed login that has already been counted
+func auditLoginFailure(userID *int, username, ip, reason string) {
+    if err := insertLoginFailure(userID, username, ip, reason); err != nil {
+        log.Println("failed to record login failure:", err)
+    }
+}
+
+// countLoginFailureTx adds a failure to userID's count and locks the account
+// once the count calls for it
+func countLoginFailureTx(tx *sql.Tx, userID int) error {
+    var failures int
+    if err := tx.QueryRow("UPDATE users SET failed_logins = failed_logins + 1 WHERE id = $1 RETURNING failed_logins", userID).Scan(&failures); err != nil {
+        return err
+    }
+    if d := lockoutFor(failures); d > 0 {
+        _, err := tx.Exec("UPDATE users SET locked_until = $1 WHERE id = $2", time.Now().Add(d), userID)
+        return err
+    }
+    return nil
+}
+
+// insertLoginFailure adds an entry to the login_failures log. Callers pass
+// addresses from middleware.ClientIP, which always fit; the cut is a backstop.
+func insertLoginFailure(userID *int, username, ip, reason string) error {
+    if len(username) > 100 {
+        username = username[:100]
+    }
+    if len(ip) > 45 {
+        ip = ip[:45]
+    }
+    _, err := database.DB.Exec(
+        "INSERT INTO login_failures (user_id, username, ip, reason) VALUES ($1, $2, $3, $4)",
+        userID, username, ip, reason,
+    )
+    return err
+}
+
+// ResetLoginFailures clears userID's failure count after a successful login
+func ResetLoginFailures(userID int) error {
+    _, err := database.DB.Exec(resetLoginFailuresQuery, userID)
+    return err
+}
+
+const resetLoginFailuresQuery = "UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = $1 AND (failed_logins > 0 OR locked_until IS NOT NULL)"
+
+// UnlockUser lifts a lockout early. It reports false for unknown users.
+func UnlockUser(username string) (bool, error) {
+    res, err := database.DB.Exec("UPDATE users SET failed_logins = 0, locked_until = NULL WHERE username = $1", username)
+    if err != nil {
+        return false, err
+    }
+    n, _ := res.RowsAffected()
+    return n > 0, nil
+}
+
+// ListLoginFailures returns the newest failed logins, optionally for one username
+func ListLoginFailures(username string, limit int) ([]models.LoginFailure, error) {
+    rows, err := database.DB.Query(
+        `SELECT id, user_id, username, ip, reason, created_at FROM login_failures
+         WHERE $1 = '' OR username = $1
+         ORDER BY created_at DESC LIMIT $2`,
+        username, limit,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    failures := []models.LoginFailure{}
+    for rows.Next() {
+        var f models.LoginFailure
+        if err := rows.Scan(&f.ID, &f.UserID, &f.Username, &f.IP, &f.Reason, &f.CreatedAt); err != nil {
+            return nil, err
+        }
+        failures = append(failures, f)
+    }
+    return failures, rows.Err()
+}
+
+// LoginFailureRetention is how long failed-login events are kept
+func LoginFailureRetention() time.Duration {
+    return config.GetEnvDuration("LOGIN_FAILURE_RETENTION", 30*24*time.Hour)
+}
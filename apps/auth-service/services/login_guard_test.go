@@ -0,0 +1,98 @@
+package services
+
+import (
+    "errors"
+    "testing"
+    "time"
+
+    "auth-service/database"
+    "auth-service/models"
+)
+
+func TestLockoutFor(t *testing.T) {
+    t.Setenv("LOCKOUT_THRESHOLD", "3")
+    t.Setenv("LOCKOUT_BASE", "1m")
+    t.Setenv("LOCKOUT_MAX", "10m")
+    tests := []struct {
+        failures int
+        want     time.Duration
+    }{
+        {0, 0},
+        {2, 0},
+        {3, time.Minute},
+        {4, 2 * time.Minute},
+        {5, 4 * time.Minute},
+        {6, 8 * time.Minute},
+        {7, 10 * time.Minute},
+        {1000, 10 * time.Minute},
+    }
+    for _, tt := range tests {
+        if got := lockoutFor(tt.failures); got != tt.want {
+            t.Errorf("lockoutFor(%d) = %s, want %s", tt.failures, got, tt.want)
+        }
+    }
+}
+
+func TestCheckCredentialsLocksOut(t *testing.T) {
+    setupTestDB(t)
+    t.Setenv("LOCKOUT_THRESHOLD", "3")
+    createTestUser(t, "guarded", "correct horse battery")
+
+    for i := 0; i < 3; i++ {
+        if _, err := CheckCredentials("guarded", "wrong", "203.0.113.5"); !errors.Is(err, ErrInvalidCredentials) {
+            t.Fatalf("wrong password %d = %v, want ErrInvalidCredentials", i+1, err)
+        }
+    }
+    var limited *RateLimitError
+    if _, err := CheckCredentials("guarded", "correct horse battery", "203.0.113.5"); !errors.As(err, &limited) {
+        t.Fatalf("right password while locked = %v, want RateLimitError", err)
+    }
+
+    var reasons []string
+    rows, err := database.DB.Query("SELECT reason FROM login_failures WHERE username = 'guarded' ORDER BY id")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var r string
+        rows.Scan(&r)
+        reasons = append(reasons, r)
+    }
+    want := []string{models.LoginBadPassword, models.LoginBadPassword, models.LoginBadPassword, models.LoginLocked}
+    if len(reasons) != len(want) {
+        t.Fatalf("logged %v, want %v", reasons, want)
+    }
+    for i := range want {
+        if reasons[i] != want[i] {
+            t.Fatalf("logged %v, want %v", reasons, want)
+        }
+    }
+
+    if _, err := UnlockUser("guarded"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := CheckCredentials("guarded", "correct horse battery", "203.0.113.5"); err != nil {
+        t.Fatalf("after unlock: %v", err)
+    }
+}
+
+// A failure that cannot be logged must still count, or every guess that
+// breaks the log insert would be free
+func TestLoginFailureCountsWhenLogFails(t *testing.T) {
+    setupTestDB(t)
+    t.Setenv("LOCKOUT_THRESHOLD", "2")
+    user := createTestUser(t, "unlogged", "correct horse battery")
+
+    if _, err := database.DB.Exec("ALTER TABLE login_failures RENAME TO login_failures_gone"); err != nil {
+        t.Fatal(err)
+    }
+    for i := 0; i < 2; i++ {
+        if err := RecordLoginFailure(&user.ID, user.Username, "203.0.113.5", models.LoginBadPassword); err == nil {
+            t.Fatal("logging to a missing table succeeded")
+        }
+    }
+    if err := CheckLockout(user.ID); err == nil {
+        t.Fatal("failures were not counted")
+    }
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+    "bufio"
+    "crypto/sha1"
+    "encoding/hex"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "sync"
+    "unicode/utf8"
+
+    "auth-service/config"
+    "auth-service/database"
+    "auth-service/utils"
+)
+
+// PasswordPolicyError says why a new password was refused
+type PasswordPolicyError struct {
+    Reason string
+}
+
+func (e *PasswordPolicyError) Error() string {
+    return "password rejected: " + e.Reason
+}
+
+var (
+    breachedOnce sync.Once
+    breached     map[string]struct{} // upper-case hex SHA-1 of each listed password
+)
+
+// loadBreachedPasswords reads PASSWORD_BREACHED_FILE once. Each line is either
+// a plain password or, as in Have I Been Pwned downloads, an upper-case SHA-1
+// hash optionally followed by ":count". The whole list is held in memory, so
+// use a trimmed list (say, the most common million) rather than the full set.
+func loadBreachedPasswords() {
+    breached = map[string]struct{}{}
+    path := config.GetEnv("PASSWORD_BREACHED_FILE")
+    if path == "" {
+        return
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        log.Println("could not open breached password list:", err)
+        return
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" {
+            continue
+        }
+        if h, _, _ := strings.Cut(line, ":"); isSHA1Hex(h) {
+            breached[strings.ToUpper(h)] = struct{}{}
+            continue
+        }
+        breached[sha1Hex(line)] = struct{}{}
+    }
+    if err := scanner.Err(); err != nil {
+        log.Println("could not read breached password list:", err)
+    }
+    log.Printf("loaded %d breached passwords", len(breached))
+}
+
+func isSHA1Hex(s string) bool {
+    if len(s) != 40 {
+        return false
+    }
+    _, err := hex.DecodeString(s)
+    return err == nil
+}
+
+func sha1Hex(s string) string {
+    sum := sha1.Sum([]byte(s))
+    return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// CheckPasswordPolicy enforces PASSWORD_MIN_LENGTH and PASSWORD_MAX_LENGTH
+// (in characters), refuses the username itself and anything on the breached
+// password list
+func CheckPasswordPolicy(password, username string) error {
+    min := int(config.GetEnvInt64("PASSWORD_MIN_LENGTH", 10))
+    max := int(config.GetEnvInt64("PASSWORD_MAX_LENGTH", 256))
+    n := utf8.RuneCountInString(password)
+    if n < min {
+        return &PasswordPolicyError{Reason: fmt.Sprintf("must be at least %d characters", min)}
+    }
+    if n > max {
+        return &PasswordPolicyError{Reason: fmt.Sprintf("must be at most %d characters", max)}
+    }
+    if username != "" && strings.EqualFold(password, username) {
+        return &PasswordPolicyError{Reason: "must not be the username"}
+    }
+
+    breachedOnce.Do(loadBreachedPasswords)
+    if _, found := breached[sha1Hex(password)]; found {
+        return &PasswordPolicyError{Reason: "appears in a list of breached passwords"}
+    }
+    return nil
+}
+
+// RehashPassword replaces userID's stored hash with a current one. The update
+// only applies if the hash is still oldHash, so it cannot undo a password
+// change that raced with the login.
+func RehashPassword(userID int, oldHash, password string) error {
+    hashed, err := utils.HashPassword(password)
+    if err != nil {
+        return err
+    }
+    _, err = database.DB.Exec("UPDATE users SET password = $1 WHERE id = $2 AND password = $3", hashed, userID, oldHash)
+    return err
+}
@@ -0,0 +1,236 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "log"
+    "time"
+
+    "auth-service/config"
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+var (
+    ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+    ErrRefreshTokenReused  = errors.New("refresh token reuse detected; session revoked")
+)
+
+// TokenPair is what login and refresh hand back to the client
+type TokenPair struct {
+    AccessToken  string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+    TokenType    string `json:"token_type"`
+    ExpiresIn    int64  `json:"expires_in"` // access token lifetime in seconds
+}
+
+// RefreshTokenTTL is how long an unused refresh token stays valid
+func RefreshTokenTTL() time.Duration {
+    return config.GetEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+}
+
+// IssueTokens starts a new session for user and returns its first token pair
+func IssueTokens(user models.User) (TokenPair, error) {
+    var pair TokenPair
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var err error
+        pair, err = issueTokensTx(tx, user, utils.NewTokenID())
+        return err
+    })
+    return pair, err
+}
+
+func issueTokensTx(tx *sql.Tx, user models.User, familyID string) (TokenPair, error) {
+    refresh := utils.NewOpaqueToken()
+    _, err := tx.Exec(
+        "INSERT INTO refresh_tokens (user_id, family_id, token_hash, expires_at) VALUES ($1, $2, $3, $4)",
+        user.ID, familyID, utils.HashToken(refresh), time.Now().Add(RefreshTokenTTL()),
+    )
+    if err != nil {
+        return TokenPair{}, err
+    }
+
+    access, _, err := utils.GenerateJWT(user.Username, user.Role, familyID)
+    if err != nil {
+        return TokenPair{}, err
+    }
+    return TokenPair{
+        AccessToken:  access,
+        RefreshToken: refresh,
+        TokenType:    "Bearer",
+        ExpiresIn:    int64(utils.AccessTokenTTL().Seconds()),
+    }, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new pair in the same
+// session. The presented token is spent; if it had already been spent (or its
+// session revoked) the whole session is revoked, since someone else has a copy.
+func RotateRefreshToken(raw string) (TokenPair, error) {
+    var pair TokenPair
+    reused := false
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var t models.RefreshToken
+        err := tx.QueryRow(
+            "SELECT id, user_id, family_id, expires_at, used_at, revoked_at FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE",
+            utils.HashToken(raw),
+        ).Scan(&t.ID, &t.UserID, &t.FamilyID, &t.ExpiresAt, &t.UsedAt, &t.RevokedAt)
+        if err == sql.ErrNoRows {
+            return ErrInvalidRefreshToken
+        }
+        if err != nil {
+            return err
+        }
+
+        if t.UsedAt != nil || t.RevokedAt != nil {
+            // Commit the revocation rather than rolling it back with the error
+            reused = true
+            return RevokeSessionTx(tx, t.FamilyID)
+        }
+        if time.Now().After(t.ExpiresAt) {
+            return ErrInvalidRefreshToken
+        }
+
+        if _, err := tx.Exec("UPDATE refresh_tokens SET used_at = now() WHERE id = $1", t.ID); err != nil {
+            return err
+        }
+
+        // Re-read the user so role changes take effect on the next refresh
+        var user models.User
+        err = tx.QueryRow("SELECT id, username, role FROM users WHERE id = $1", t.UserID).Scan(&user.ID, &user.Username, &user.Role)
+        if err == sql.ErrNoRows {
+            return ErrInvalidRefreshToken
+        }
+        if err != nil {
+            return err
+        }
+        pair, err = issueTokensTx(tx, user, t.FamilyID)
+        return err
+    })
+    if err == nil && reused {
+        log.Println("refresh token reuse detected, session revoked")
+        return TokenPair{}, ErrRefreshTokenReused
+    }
+    return pair, err
+}
+
+// RevokeSessionTx kills a session: its refresh tokens stop working and its
+// access tokens are denylisted by session id until they would have expired.
+func RevokeSessionTx(tx *sql.Tx, familyID string) error {
+    if familyID == "" {
+        return nil
+    }
+    if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = now() WHERE family_id = $1 AND revoked_at IS NULL", familyID); err != nil {
+        return err
+    }
+    return denyTx(tx, familyID, time.Now().Add(utils.AccessTokenTTL()))
+}
+
+// RevokeSession is RevokeSessionTx in its own transaction
+func RevokeSession(familyID string) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        return RevokeSessionTx(tx, familyID)
+    })
+}
+
+// RevokeUserSessionsTx revokes every live session of userID, e.g. after a
+// password change
+func RevokeUserSessionsTx(tx *sql.Tx, userID int) error {
+    rows, err := tx.Query("SELECT DISTINCT family_id FROM refresh_tokens WHERE user_id = $1 AND revoked_at IS NULL", userID)
+    if err != nil {
+        return err
+    }
+    var families []string
+    for rows.Next() {
+        var f string
+        if err := rows.Scan(&f); err != nil {
+            rows.Close()
+            return err
+        }
+        families = append(families, f)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for _, f := range families {
+        if err := RevokeSessionTx(tx, f); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// RevokeRefreshToken revokes the session a refresh token belongs to. Unknown
+// tokens are ignored so logout never fails on a stale token.
+func RevokeRefreshToken(raw string) error {
+    var familyID string
+    err := database.DB.QueryRow("SELECT family_id FROM refresh_tokens WHERE token_hash = $1", utils.HashToken(raw)).Scan(&familyID)
+    if err == sql.ErrNoRows {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    return RevokeSession(familyID)
+}
+
+// DenyAccessToken denylists a single access token until it expires
+func DenyAccessToken(claims *utils.Claims) error {
+    if claims.ID == "" || claims.ExpiresAt == nil {
+        return nil
+    }
+    return database.WithTx(func(tx *sql.Tx) error {
+        return denyTx(tx, claims.ID, claims.ExpiresAt.Time)
+    })
+}
+
+func denyTx(tx *sql.Tx, id string, expiresAt time.Time) error {
+    _, err := tx.Exec(
+        `INSERT INTO token_denylist (id, expires_at) VALUES ($1, $2)
+         ON CONFLICT (id) DO UPDATE SET expires_at = GREATEST(token_denylist.expires_at, EXCLUDED.expires_at)`,
+        id, expiresAt,
+    )
+    return err
+}
+
+// TokenRevoked reports whether an access token, by jti or session id, is denylisted
+func TokenRevoked(jti, sessionID string) (bool, error) {
+    var revoked bool
+    err := database.DB.QueryRow(
+        "SELECT EXISTS (SELECT 1 FROM token_denylist WHERE id IN ($1, $2) AND id <> '' AND expires_at > now())",
+        jti, sessionID,
+    ).Scan(&revoked)
+    return revoked, err
+}
+
+// PurgeExpiredTokens drops denylist entries, refresh tokens, login challenges
+// and emailed tokens nobody can use any more, and old failed-login events
+func PurgeExpiredTokens() error {
+    if _, err := database.DB.Exec("DELETE FROM login_failures WHERE created_at < $1", time.Now().Add(-LoginFailureRetention())); err != nil {
+        return err
+    }
+    if _, err := database.DB.Exec("DELETE FROM token_denylist WHERE expires_at < now()"); err != nil {
+        return err
+    }
+    if _, err := database.DB.Exec("DELETE FROM login_challenges WHERE expires_at < now()"); err != nil {
+        return err
+    }
+    if _, err := database.DB.Exec("DELETE FROM user_tokens WHERE expires_at < now() - interval '1 day'"); err != nil {
+        return err
+    }
+    _, err := database.DB.Exec("DELETE FROM refresh_tokens WHERE expires_at < now() - interval '1 day'")
+    return err
+}
+
+// StartTokenCleanup runs PurgeExpiredTokens every interval
+func StartTokenCleanup(interval time.Duration) {
+    go func() {
+        for range time.Tick(interval) {
+            if err := PurgeExpiredTokens(); err != nil {
+                log.Println("token cleanup failed:", err)
+            }
+        }
+    }()
+}
@@ -0,0 +1,213 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+// The database tests run in a throwaway schema of the database named by
+// TEST_DB_NAME (with DB_HOST, DB_PORT, DB_USER and DB_PASSWORD as for the
+// service) and are skipped when it is unset.
+
+func testDSN(dbname string) string {
+    parts := []string{"sslmode=disable", "dbname=" + dbname}
+    for key, env := range map[string]string{"host": "DB_HOST", "port": "DB_PORT", "user": "DB_USER", "password": "DB_PASSWORD"} {
+        if v := os.Getenv(env); v != "" {
+            parts = append(parts, key+"="+v)
+        }
+    }
+    return strings.Join(parts, " ")
+}
+
+// setupTestDB points database.DB at a fresh schema with every auth-service
+// table, and loads signing keys into it
+func setupTestDB(t *testing.T) {
+    t.Helper()
+    dbname := os.Getenv("TEST_DB_NAME")
+    if dbname == "" {
+        t.Skip("TEST_DB_NAME not set, skipping Postgres tests")
+    }
+
+    admin, err := sql.Open("postgres", testDSN(dbname))
+    if err != nil {
+        t.Fatal(err)
+    }
+    schema := fmt.Sprintf("test_%d_%d", os.Getpid(), time.Now().UnixNano())
+    if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+        admin.Close()
+        t.Fatal(err)
+    }
+    db, err := sql.Open("postgres", testDSN(dbname)+" search_path="+schema)
+    if err != nil {
+        t.Fatal(err)
+    }
+    prevDB := database.DB
+    t.Cleanup(func() {
+        database.DB = prevDB
+        db.Close()
+        admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+        admin.Close()
+    })
+    database.DB = db
+
+    for _, migration := range []string{
+        models.UserTableMigration(),
+        models.RefreshTokenTableMigration(),
+        models.TokenDenylistTableMigration(),
+        models.SigningKeyTableMigration(),
+        models.AccessTokenTableMigration(),
+        models.TwoFactorTableMigration(),
+        models.LoginFailureTableMigration(),
+        models.UserTokenTableMigration(),
+        models.PendingRenameTableMigration(),
+    } {
+        if _, err := db.Exec(migration); err != nil {
+            t.Fatalf("migration failed: %v", err)
+        }
+    }
+
+    t.Setenv("JWT_KEY_SECRET_PATH", filepath.Join(t.TempDir(), "jwt_key_secret"))
+    if err := InitKeys(); err != nil {
+        t.Fatal(err)
+    }
+    InitLoginGuard()
+}
+
+// createTestUser adds a user with password and returns it
+func createTestUser(t *testing.T, username, password string) models.User {
+    t.Helper()
+    hash, err := utils.HashPassword(password)
+    if err != nil {
+        t.Fatal(err)
+    }
+    user := models.User{Username: username, Email: username + "@example.com", Role: models.RoleUser}
+    err = database.DB.QueryRow(
+        "INSERT INTO users (username, email, password) VALUES ($1, $2, $3) RETURNING id",
+        user.Username, user.Email, hash,
+    ).Scan(&user.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return user
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+    setupTestDB(t)
+    user := createTestUser(t, "rotor", "correct horse battery")
+
+    first, err := IssueTokens(user)
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := RotateRefreshToken(first.RefreshToken)
+    if err != nil {
+        t.Fatalf("rotating a fresh token: %v", err)
+    }
+    if second.RefreshToken == first.RefreshToken || second.AccessToken == "" {
+        t.Fatal("rotation did not hand out a new pair")
+    }
+
+    // Both pairs belong to one session
+    a, err := utils.ValidateToken(first.AccessToken)
+    if err != nil {
+        t.Fatal(err)
+    }
+    b, err := utils.ValidateToken(second.AccessToken)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if a.SessionID != b.SessionID || a.ID == b.ID {
+        t.Fatalf("sessions %q/%q, jtis %q/%q: want one session, two tokens", a.SessionID, b.SessionID, a.ID, b.ID)
+    }
+
+    if _, err := RotateRefreshToken(second.RefreshToken); err != nil {
+        t.Fatalf("rotating the new token: %v", err)
+    }
+    if _, err := RotateRefreshToken(second.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+        t.Fatalf("spending a token twice = %v, want ErrRefreshTokenReused", err)
+    }
+}
+
+// Replaying a spent refresh token revokes the whole session, including the
+// newest token the legitimate client holds and its access tokens
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+    setupTestDB(t)
+    user := createTestUser(t, "victim", "correct horse battery")
+
+    first, err := IssueTokens(user)
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := RotateRefreshToken(first.RefreshToken)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if _, err := RotateRefreshToken(first.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+        t.Fatalf("replaying a spent token = %v, want ErrRefreshTokenReused", err)
+    }
+    if _, err := RotateRefreshToken(second.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+        t.Fatalf("newest token after reuse = %v, want ErrRefreshTokenReused", err)
+    }
+
+    claims, err := utils.ValidateToken(second.AccessToken)
+    if err != nil {
+        t.Fatal(err)
+    }
+    revoked, err := TokenRevoked(claims.ID, claims.SessionID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !revoked {
+        t.Fatal("access token of the revoked session still accepted")
+    }
+}
+
+func TestRefreshTokenRejectsUnknownAndExpired(t *testing.T) {
+    setupTestDB(t)
+    user := createTestUser(t, "expired", "correct horse battery")
+
+    if _, err := RotateRefreshToken("not-a-token"); !errors.Is(err, ErrInvalidRefreshToken) {
+        t.Fatalf("unknown token = %v, want ErrInvalidRefreshToken", err)
+    }
+
+    pair, err := IssueTokens(user)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := database.DB.Exec("UPDATE refresh_tokens SET expires_at = now() - interval '1 minute' WHERE token_hash = $1", utils.HashToken(pair.RefreshToken)); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := RotateRefreshToken(pair.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+        t.Fatalf("expired token = %v, want ErrInvalidRefreshToken", err)
+    }
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+    setupTestDB(t)
+    user := createTestUser(t, "leaver", "correct horse battery")
+
+    pair, err := IssueTokens(user)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := RevokeRefreshToken(pair.RefreshToken); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := RotateRefreshToken(pair.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+        t.Fatalf("refresh after logout = %v, want the session revoked", err)
+    }
+    if err := RevokeRefreshToken("unknown"); err != nil {
+        t.Fatalf("logging out an unknown token: %v", err)
+    }
+}
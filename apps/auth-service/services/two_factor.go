@@ -0,0 +1,359 @@
+package services
+
+import (
+    "crypto/rand"
+    "crypto/subtle"
+    "database/sql"
+    "encoding/base32"
+    "errors"
+    "fmt"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+
+    "auth-service/config"
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+var (
+    ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+    ErrTwoFactorNotEnrolled = errors.New("two-factor authentication has not been set up")
+    ErrInvalidCode          = errors.New("invalid two-factor code")
+    ErrInvalidChallenge     = errors.New("invalid or expired login challenge")
+)
+
+const (
+    recoveryCodeCount    = 10
+    maxChallengeAttempts = 5
+)
+
+// LoginChallengeTTL is how long a user has to enter their code after the password step
+func LoginChallengeTTL() time.Duration {
+    return config.GetEnvDuration("LOGIN_CHALLENGE_TTL", 5*time.Minute)
+}
+
+// TOTPEnrollment is what an authenticator app needs to start generating codes
+type TOTPEnrollment struct {
+    Secret string `json:"secret"`
+    URI    string `json:"otpauth_uri"`
+}
+
+// totpSecretAAD binds a sealed TOTP secret to its user
+func totpSecretAAD(userID int) string {
+    return "totp:" + strconv.Itoa(userID)
+}
+
+// sealTOTPSecret encrypts userID's base32 secret for users.totp_secret_sealed
+func sealTOTPSecret(userID int, secret string) ([]byte, error) {
+    return sealSecret(totpSecretAAD(userID), []byte(secret))
+}
+
+// openTOTPSecret decrypts a secret sealed by sealTOTPSecret
+func openTOTPSecret(userID int, sealed []byte) (string, error) {
+    secret, err := openSecret(totpSecretAAD(userID), sealed)
+    if err != nil {
+        return "", fmt.Errorf("TOTP secret of user %d %w", userID, err)
+    }
+    return string(secret), nil
+}
+
+// InitTwoFactor seals TOTP secrets stored in the clear before secrets were
+// encrypted. It needs the cipher InitKeys loads.
+func InitTwoFactor() error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        rows, err := tx.Query("SELECT id, totp_secret FROM users WHERE totp_secret IS NOT NULL FOR UPDATE")
+        if err != nil {
+            return err
+        }
+        plain := map[int]string{}
+        for rows.Next() {
+            var id int
+            var secret string
+            if err := rows.Scan(&id, &secret); err != nil {
+                rows.Close()
+                return err
+            }
+            plain[id] = secret
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+
+        for id, secret := range plain {
+            sealed, err := sealTOTPSecret(id, secret)
+            if err != nil {
+                return err
+            }
+            if _, err := tx.Exec("UPDATE users SET totp_secret_sealed = $1, totp_secret = NULL WHERE id = $2", sealed, id); err != nil {
+                return err
+            }
+        }
+        if len(plain) > 0 {
+            log.Printf("encrypted %d stored TOTP secrets", len(plain))
+        }
+        return nil
+    })
+}
+
+// EnrollTOTP gives user a new TOTP secret. 2FA stays off until ConfirmTOTP
+// sees a code from it, so an abandoned enrollment cannot lock anyone out.
+func EnrollTOTP(user models.User) (TOTPEnrollment, error) {
+    secret := utils.NewTOTPSecret()
+    sealed, err := sealTOTPSecret(user.ID, secret)
+    if err != nil {
+        return TOTPEnrollment{}, err
+    }
+    res, err := database.DB.Exec(
+        "UPDATE users SET totp_secret_sealed = $1, totp_last_step = 0 WHERE id = $2 AND NOT totp_enabled",
+        sealed, user.ID,
+    )
+    if err != nil {
+        return TOTPEnrollment{}, err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return TOTPEnrollment{}, ErrTwoFactorEnabled
+    }
+    issuer := config.GetEnvDefault("TOTP_ISSUER", "FileVault")
+    return TOTPEnrollment{Secret: secret, URI: utils.TOTPURI(issuer, user.Username, secret)}, nil
+}
+
+// ConfirmTOTP turns 2FA on once code proves the user's app has the secret,
+// and returns a fresh set of recovery codes. They are only shown this once.
+func ConfirmTOTP(userID int, code string) ([]string, error) {
+    var codes []string
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var sealed []byte
+        var enabled bool
+        var lastStep int64
+        err := tx.QueryRow(
+            "SELECT totp_secret_sealed, totp_enabled, totp_last_step FROM users WHERE id = $1 FOR UPDATE", userID,
+        ).Scan(&sealed, &enabled, &lastStep)
+        if err != nil {
+            return err
+        }
+        if enabled {
+            return ErrTwoFactorEnabled
+        }
+        if sealed == nil {
+            return ErrTwoFactorNotEnrolled
+        }
+        secret, err := openTOTPSecret(userID, sealed)
+        if err != nil {
+            return err
+        }
+        if err := checkTOTPTx(tx, userID, secret, lastStep, code); err != nil {
+            return err
+        }
+        if _, err := tx.Exec("UPDATE users SET totp_enabled = true WHERE id = $1", userID); err != nil {
+            return err
+        }
+        codes, err = replaceRecoveryCodesTx(tx, userID)
+        return err
+    })
+    return codes, err
+}
+
+// DisableTOTP turns 2FA off after checking a current TOTP or recovery code.
+// It is guarded like a login: the per-username limit and lockout apply, and a
+// wrong code from ip counts towards the lockout, so a stolen session cannot
+// be used to guess its way past the second factor.
+func DisableTOTP(user models.User, code, recoveryCode, ip string) error {
+    if err := AllowLoginAttempt(user.Username); err != nil {
+        return err
+    }
+    wrongCode := false
+    err := database.WithTx(func(tx *sql.Tx) error {
+        if err := checkLockoutTx(tx, user.ID); err != nil {
+            return err
+        }
+        err := verifySecondFactorTx(tx, user.ID, code, recoveryCode)
+        if errors.Is(err, ErrInvalidCode) {
+            // Commit the failure rather than rolling it back with the error
+            wrongCode = true
+            return countLoginFailureTx(tx, user.ID)
+        }
+        if err != nil {
+            return err
+        }
+        if _, err := tx.Exec("UPDATE users SET totp_secret_sealed = NULL, totp_enabled = false, totp_last_step = 0 WHERE id = $1", user.ID); err != nil {
+            return err
+        }
+        _, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", user.ID)
+        return err
+    })
+    if err == nil && wrongCode {
+        auditLoginFailure(&user.ID, user.Username, ip, models.LoginBad2FACode)
+        return ErrInvalidCode
+    }
+    return err
+}
+
+// checkTOTPTx accepts code for the current time step or either neighbour, to
+// allow for clock drift. A step is only accepted once.
+func checkTOTPTx(tx *sql.Tx, userID int, secret string, lastStep int64, code string) error {
+    code = strings.TrimSpace(code)
+    now := utils.TOTPStep(time.Now())
+    for step := now - 1; step <= now+1; step++ {
+        if step <= lastStep {
+            continue
+        }
+        want, err := utils.TOTPCode(secret, step)
+        if err != nil {
+            return err
+        }
+        if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+            _, err := tx.Exec("UPDATE users SET totp_last_step = $1 WHERE id = $2", step, userID)
+            return err
+        }
+    }
+    return ErrInvalidCode
+}
+
+// verifySecondFactorTx checks a TOTP code or, failing that, spends a recovery code
+func verifySecondFactorTx(tx *sql.Tx, userID int, code, recoveryCode string) error {
+    var sealed []byte
+    var enabled bool
+    var lastStep int64
+    err := tx.QueryRow(
+        "SELECT totp_secret_sealed, totp_enabled, totp_last_step FROM users WHERE id = $1 FOR UPDATE", userID,
+    ).Scan(&sealed, &enabled, &lastStep)
+    if err != nil {
+        return err
+    }
+    if !enabled || sealed == nil {
+        return ErrTwoFactorNotEnrolled
+    }
+    if code != "" {
+        secret, err := openTOTPSecret(userID, sealed)
+        if err != nil {
+            return err
+        }
+        return checkTOTPTx(tx, userID, secret, lastStep, code)
+    }
+    if recoveryCode == "" {
+        return ErrInvalidCode
+    }
+
+    res, err := tx.Exec(
+        "UPDATE recovery_codes SET used_at = now() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL",
+        userID, hashRecoveryCode(recoveryCode),
+    )
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrInvalidCode
+    }
+    return nil
+}
+
+// replaceRecoveryCodesTx discards userID's recovery codes and makes a new set
+func replaceRecoveryCodesTx(tx *sql.Tx, userID int) ([]string, error) {
+    if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+        return nil, err
+    }
+    codes := make([]string, recoveryCodeCount)
+    for i := range codes {
+        codes[i] = newRecoveryCode()
+        if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, hashRecoveryCode(codes[i])); err != nil {
+            return nil, err
+        }
+    }
+    return codes, nil
+}
+
+// newRecoveryCode returns a random 50-bit code formatted like "abcde-fghij"
+func newRecoveryCode() string {
+    b := make([]byte, 10)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    s := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+    return s[:5] + "-" + s[5:10]
+}
+
+// hashRecoveryCode hashes a recovery code the way the user may type it back:
+// any case, with or without the dash
+func hashRecoveryCode(code string) string {
+    code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+    return utils.HashToken(code)
+}
+
+// StartLoginChallenge records that userID passed the password step and
+// returns the challenge token for the code step
+func StartLoginChallenge(userID int) (string, error) {
+    raw := utils.NewOpaqueToken()
+    _, err := database.DB.Exec(
+        "INSERT INTO login_challenges (user_id, token_hash, expires_at) VALUES ($1, $2, $3)",
+        userID, utils.HashToken(raw), time.Now().Add(LoginChallengeTTL()),
+    )
+    return raw, err
+}
+
+// CompleteLoginChallenge finishes a two-step login: with a valid challenge and
+// a TOTP or recovery code it starts a session. A challenge allows a few wrong
+// codes before it is burnt; each is recorded as a failed login from ip and
+// counts towards the account's lockout, which also stops pending challenges.
+// The failure count is only cleared here, once both factors have passed.
+func CompleteLoginChallenge(raw, code, recoveryCode, ip string) (TokenPair, error) {
+    var pair TokenPair
+    var user models.User
+    wrongCode := false
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var c models.LoginChallenge
+        err := tx.QueryRow(
+            "SELECT id, user_id, attempts, expires_at FROM login_challenges WHERE token_hash = $1 FOR UPDATE",
+            utils.HashToken(raw),
+        ).Scan(&c.ID, &c.UserID, &c.Attempts, &c.ExpiresAt)
+        if err == sql.ErrNoRows {
+            return ErrInvalidChallenge
+        }
+        if err != nil {
+            return err
+        }
+        if c.Attempts >= maxChallengeAttempts || time.Now().After(c.ExpiresAt) {
+            return ErrInvalidChallenge
+        }
+        if err := checkLockoutTx(tx, c.UserID); err != nil {
+            return err
+        }
+
+        err = verifySecondFactorTx(tx, c.UserID, code, recoveryCode)
+        if errors.Is(err, ErrInvalidCode) {
+            // Commit the attempt rather than rolling it back with the error
+            wrongCode = true
+            if _, err := tx.Exec("UPDATE login_challenges SET attempts = attempts + 1 WHERE id = $1", c.ID); err != nil {
+                return err
+            }
+            if err := tx.QueryRow("SELECT id, username FROM users WHERE id = $1", c.UserID).Scan(&user.ID, &user.Username); err != nil {
+                return err
+            }
+            return countLoginFailureTx(tx, c.UserID)
+        }
+        if err != nil {
+            return err
+        }
+        if _, err := tx.Exec(resetLoginFailuresQuery, c.UserID); err != nil {
+            return err
+        }
+
+        if _, err := tx.Exec("DELETE FROM login_challenges WHERE id = $1", c.ID); err != nil {
+            return err
+        }
+        err = tx.QueryRow("SELECT id, username, role FROM users WHERE id = $1", c.UserID).Scan(&user.ID, &user.Username, &user.Role)
+        if err != nil {
+            return err
+        }
+        pair, err = issueTokensTx(tx, user, utils.NewTokenID())
+        return err
+    })
+    if err == nil && wrongCode {
+        auditLoginFailure(&user.ID, user.Username, ip, models.LoginBad2FACode)
+        return TokenPair{}, ErrInvalidCode
+    }
+    return pair, err
+}
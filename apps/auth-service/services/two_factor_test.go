@@ -0,0 +1,160 @@
+package services
+
+import (
+    "bytes"
+    "errors"
+    "testing"
+    "time"
+
+    "auth-service/database"
+    "auth-service/models"
+    "auth-service/utils"
+)
+
+// enrollTestUser turns 2FA on for user and returns its secret. It starts
+// early in a time step, so the test has the rest of it to work with.
+func enrollTestUser(t *testing.T, user models.User) string {
+    t.Helper()
+    if left := utils.TOTPPeriod - time.Now().Unix()%utils.TOTPPeriod; left < 5 {
+        time.Sleep(time.Duration(left) * time.Second)
+    }
+    enrollment, err := EnrollTOTP(user)
+    if err != nil {
+        t.Fatal(err)
+    }
+    code, err := utils.TOTPCode(enrollment.Secret, utils.TOTPStep(time.Now())-1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := ConfirmTOTP(user.ID, code); err != nil {
+        t.Fatalf("confirming with the previous step's code: %v", err)
+    }
+    return enrollment.Secret
+}
+
+func TestTOTPSecretStoredSealed(t *testing.T) {
+    setupTestDB(t)
+    user := createTestUser(t, "sealed", "correct horse battery")
+    secret := enrollTestUser(t, user)
+
+    var plain *string
+    var sealed []byte
+    err := database.DB.QueryRow("SELECT totp_secret, totp_secret_sealed FROM users WHERE id = $1", user.ID).Scan(&plain, &sealed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if plain != nil || bytes.Contains(sealed, []byte(secret)) {
+        t.Fatal("the TOTP secret is stored in the clear")
+    }
+    // A sealed secret copied to another user does not open there
+    other := createTestUser(t, "other", "correct horse battery")
+    if _, err := openTOTPSecret(other.ID, sealed); err == nil {
+        t.Fatal("a sealed secret opened for another user")
+    }
+}
+
+func TestTOTPWindowAndReplay(t *testing.T) {
+    setupTestDB(t)
+    user := createTestUser(t, "window", "correct horse battery")
+    secret := enrollTestUser(t, user)
+    now := utils.TOTPStep(time.Now())
+
+    codeAt := func(step int64) string {
+        code, err := utils.TOTPCode(secret, step)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return code
+    }
+    verify := func(code string) error {
+        tx, err := database.DB.Begin()
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer tx.Commit()
+        return verifySecondFactorTx(tx, user.ID, code, "")
+    }
+
+    // Confirmation spent step now-1, so it cannot come back
+    if err := verify(codeAt(now - 1)); !errors.Is(err, ErrInvalidCode) {
+        t.Fatalf("replayed confirmation code = %v, want ErrInvalidCode", err)
+    }
+    if err := verify(codeAt(now + 2)); !errors.Is(err, ErrInvalidCode) {
+        t.Fatalf("code two steps ahead = %v, want ErrInvalidCode", err)
+    }
+    if err := verify(codeAt(now)); err != nil {
+        t.Fatalf("current code: %v", err)
+    }
+    if err := verify(codeAt(now)); !errors.Is(err, ErrInvalidCode) {
+        t.Fatalf("current code twice = %v, want ErrInvalidCode", err)
+    }
+    if err := verify(codeAt(now + 1)); err != nil {
+        t.Fatalf("next step's code: %v", err)
+    }
+    // Once a later step is used, earlier ones are gone too
+    if err := verify(codeAt(now)); !errors.Is(err, ErrInvalidCode) {
+        t.Fatalf("earlier code after a later one = %v, want ErrInvalidCode", err)
+    }
+}
+
+func TestDisableTOTPCountsWrongCodes(t *testing.T) {
+    setupTestDB(t)
+    t.Setenv("LOCKOUT_THRESHOLD", "3")
+    user := createTestUser(t, "disabler", "correct horse battery")
+    secret := enrollTestUser(t, user)
+
+    for i := 0; i < 3; i++ {
+        if err := DisableTOTP(user, "000000", "", "203.0.113.9"); !errors.Is(err, ErrInvalidCode) {
+            t.Fatalf("wrong code %d = %v, want ErrInvalidCode", i, err)
+        }
+    }
+    var failures int
+    if err := database.DB.QueryRow("SELECT count(*) FROM login_failures WHERE user_id = $1 AND reason = $2", user.ID, models.LoginBad2FACode).Scan(&failures); err != nil {
+        t.Fatal(err)
+    }
+    if failures != 3 {
+        t.Fatalf("recorded %d failures, want 3", failures)
+    }
+
+    // Locked now, so even the right code is refused
+    code, err := utils.TOTPCode(secret, utils.TOTPStep(time.Now()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var limited *RateLimitError
+    if err := DisableTOTP(user, code, "", "203.0.113.9"); !errors.As(err, &limited) {
+        t.Fatalf("disabling while locked = %v, want RateLimitError", err)
+    }
+
+    if _, err := UnlockUser(user.Username); err != nil {
+        t.Fatal(err)
+    }
+    if err := DisableTOTP(user, code, "", "203.0.113.9"); err != nil {
+        t.Fatalf("disabling with the right code: %v", err)
+    }
+}
+
+func TestInitTwoFactorSealsPlaintextSecrets(t *testing.T) {
+    setupTestDB(t)
+    user := createTestUser(t, "legacy", "correct horse battery")
+    secret := utils.NewTOTPSecret()
+    if _, err := database.DB.Exec("UPDATE users SET totp_secret = $1, totp_enabled = true WHERE id = $2", secret, user.ID); err != nil {
+        t.Fatal(err)
+    }
+    if err := InitTwoFactor(); err != nil {
+        t.Fatal(err)
+    }
+
+    code, err := utils.TOTPCode(secret, utils.TOTPStep(time.Now()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    tx, err := database.DB.Begin()
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer tx.Rollback()
+    if err := verifySecondFactorTx(tx, user.ID, code, ""); err != nil {
+        t.Fatalf("code for a migrated secret: %v", err)
+    }
+}
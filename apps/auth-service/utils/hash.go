@@ -1,15 +1,134 @@
 package utils
 
 import (
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "math"
+    "strings"
+
+    "golang.org/x/crypto/argon2"
     "golang.org/x/crypto/bcrypt"
+
+    "auth-service/config"
 )
 
+// Password hashes are self-describing, so the scheme and its parameters can
+// change without invalidating stored hashes:
+//
+//   $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>   (current)
+//   $2a$14$...                                     (bcrypt, verify only)
+//
+// Hashes that are not argon2id with the current parameters are upgraded on
+// the next successful login (see NeedsRehash).
+
+// Argon2Params are the tunable argon2id costs
+type Argon2Params struct {
+    Memory  uint32 // KiB
+    Time    uint32
+    Threads uint8
+}
+
+const (
+    argon2SaltLen = 16
+    argon2KeyLen  = 32
+)
+
+// CurrentArgon2Params reads ARGON2_MEMORY (KiB), ARGON2_TIME and
+// ARGON2_THREADS, which ValidateArgon2Params has checked at startup. The
+// defaults follow the OWASP recommendation.
+func CurrentArgon2Params() Argon2Params {
+    return Argon2Params{
+        Memory:  uint32(config.GetEnvInt64("ARGON2_MEMORY", 19*1024)),
+        Time:    uint32(config.GetEnvInt64("ARGON2_TIME", 2)),
+        Threads: uint8(config.GetEnvInt64("ARGON2_THREADS", 1)),
+    }
+}
+
+// ValidateArgon2Params checks the ARGON2_* settings before they are cast
+// down, so a value that would wrap or that argon2 rejects stops startup
+// rather than panicking on the first login
+func ValidateArgon2Params() error {
+    memory := config.GetEnvInt64("ARGON2_MEMORY", 19*1024)
+    passes := config.GetEnvInt64("ARGON2_TIME", 2)
+    threads := config.GetEnvInt64("ARGON2_THREADS", 1)
+    if threads < 1 || threads > math.MaxUint8 {
+        return fmt.Errorf("ARGON2_THREADS must be between 1 and %d, got %d", math.MaxUint8, threads)
+    }
+    if passes < 1 || passes > math.MaxUint32 {
+        return fmt.Errorf("ARGON2_TIME must be between 1 and %d, got %d", uint32(math.MaxUint32), passes)
+    }
+    if memory < 8*threads || memory > math.MaxUint32 {
+        return fmt.Errorf("ARGON2_MEMORY must be between 8*ARGON2_THREADS (%d) and %d KiB, got %d", 8*threads, uint32(math.MaxUint32), memory)
+    }
+    return nil
+}
+
+// valid reports whether argon2 can run with p; stored hashes are checked
+// against it, since argon2.IDKey panics on zero time or threads
+func (p Argon2Params) valid() bool {
+    return p.Time >= 1 && p.Threads >= 1 && p.Memory >= 8*uint32(p.Threads)
+}
+
+var errBadHash = errors.New("malformed password hash")
+
 func HashPassword(password string) (string, error) {
-    bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
-    return string(bytes), err
+    p := CurrentArgon2Params()
+    salt := make([]byte, argon2SaltLen)
+    if _, err := rand.Read(salt); err != nil {
+        return "", err
+    }
+    key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, argon2KeyLen)
+    return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+        argon2.Version, p.Memory, p.Time, p.Threads,
+        base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
 }
 
 func CheckPasswordHash(password, hash string) bool {
+    if strings.HasPrefix(hash, "$argon2id$") {
+        p, salt, key, err := parseArgon2(hash)
+        if err != nil {
+            return false
+        }
+        got := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+        return subtle.ConstantTimeCompare(got, key) == 1
+    }
     err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
     return err == nil
 }
+
+// NeedsRehash reports whether hash should be replaced by a fresh HashPassword:
+// it is bcrypt, or argon2id with other parameters than the current ones
+func NeedsRehash(hash string) bool {
+    if !strings.HasPrefix(hash, "$argon2id$") {
+        return true
+    }
+    p, _, key, err := parseArgon2(hash)
+    return err != nil || p != CurrentArgon2Params() || len(key) != argon2KeyLen
+}
+
+func parseArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+    var p Argon2Params
+    parts := strings.Split(hash, "$")
+    if len(parts) != 6 {
+        return p, nil, nil, errBadHash
+    }
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return p, nil, nil, errBadHash
+    }
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil || !p.valid() {
+        return p, nil, nil, errBadHash
+    }
+    salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil {
+        return p, nil, nil, errBadHash
+    }
+    key, err := base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil || len(key) == 0 {
+        return p, nil, nil, errBadHash
+    }
+    return p, salt, key, nil
+}
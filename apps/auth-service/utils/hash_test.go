@@ -0,0 +1,118 @@
+package utils
+
+import (
+    "strings"
+    "testing"
+
+    "golang.org/x/crypto/bcrypt"
+)
+
+// cheapArgon2 keeps the tests fast; the format is what is under test
+func cheapArgon2(t *testing.T) {
+    t.Setenv("ARGON2_MEMORY", "64")
+    t.Setenv("ARGON2_TIME", "1")
+    t.Setenv("ARGON2_THREADS", "1")
+}
+
+func TestArgon2RoundTrip(t *testing.T) {
+    cheapArgon2(t)
+    hash, err := HashPassword("correct horse battery")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+        t.Fatalf("hash %q does not record its parameters", hash)
+    }
+    if !CheckPasswordHash("correct horse battery", hash) {
+        t.Fatal("the right password does not verify")
+    }
+    if CheckPasswordHash("correct horse batterY", hash) {
+        t.Fatal("a wrong password verifies")
+    }
+    again, _ := HashPassword("correct horse battery")
+    if again == hash {
+        t.Fatal("two hashes share a salt")
+    }
+}
+
+func TestBcryptStillVerifies(t *testing.T) {
+    cheapArgon2(t)
+    legacy, err := bcrypt.GenerateFromPassword([]byte("hunter22"), bcrypt.MinCost)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !CheckPasswordHash("hunter22", string(legacy)) {
+        t.Fatal("a bcrypt hash does not verify")
+    }
+    if CheckPasswordHash("hunter23", string(legacy)) {
+        t.Fatal("a wrong password verifies against bcrypt")
+    }
+    if !NeedsRehash(string(legacy)) {
+        t.Fatal("bcrypt hashes are not upgraded")
+    }
+}
+
+func TestNeedsRehash(t *testing.T) {
+    cheapArgon2(t)
+    hash, err := HashPassword("correct horse battery")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if NeedsRehash(hash) {
+        t.Fatal("a current hash needs rehashing")
+    }
+    t.Setenv("ARGON2_TIME", "2")
+    if !NeedsRehash(hash) {
+        t.Fatal("a hash with old parameters is kept")
+    }
+    // It still verifies with the parameters it was made with
+    if !CheckPasswordHash("correct horse battery", hash) {
+        t.Fatal("changing the parameters broke an existing hash")
+    }
+}
+
+func TestMalformedHashes(t *testing.T) {
+    cheapArgon2(t)
+    for _, hash := range []string{
+        "",
+        "$argon2id$",
+        "$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+        "$argon2id$v=18$m=64,t=1,p=1$c2FsdHNhbHQ$aGFzaA",
+        "$argon2id$v=19$m=64,t=1,p=1$!!$aGFzaA",
+        "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$",
+        // Parameters argon2 would panic on
+        "$argon2id$v=19$m=64,t=0,p=1$c2FsdHNhbHQ$aGFzaA",
+        "$argon2id$v=19$m=64,t=1,p=0$c2FsdHNhbHQ$aGFzaA",
+    } {
+        if CheckPasswordHash("anything", hash) {
+            t.Errorf("%q verified", hash)
+        }
+        if !NeedsRehash(hash) {
+            t.Errorf("%q is not replaced", hash)
+        }
+    }
+}
+
+func TestValidateArgon2Params(t *testing.T) {
+    tests := []struct {
+        memory, time, threads string
+        ok                    bool
+    }{
+        {"19456", "2", "1", true},
+        {"64", "1", "8", true},
+        {"19456", "0", "1", false},
+        {"19456", "2", "0", false},
+        {"19456", "2", "256", false},
+        {"19456", "-1", "1", false},
+        {"4294967296", "2", "1", false},
+        {"7", "1", "1", false},
+    }
+    for _, tt := range tests {
+        t.Setenv("ARGON2_MEMORY", tt.memory)
+        t.Setenv("ARGON2_TIME", tt.time)
+        t.Setenv("ARGON2_THREADS", tt.threads)
+        if err := ValidateArgon2Params(); (err == nil) != tt.ok {
+            t.Errorf("m=%s t=%s p=%s: err = %v, want ok=%v", tt.memory, tt.time, tt.threads, err, tt.ok)
+        }
+    }
+}
@@ -1,33 +1,67 @@
 package utils
 
 import (
+    "crypto/ed25519"
+    "errors"
     "time"
     "github.com/golang-jwt/jwt/v5"
     "auth-service/config"
 )
 
 type Claims struct {
-    Username string `json:"username"`
+    Username  string `json:"username"`
+    Role      string `json:"role"`
+    SessionID string `json:"sid"`
     jwt.RegisteredClaims
 }
 
-func GenerateJWT(username string) (string, error) {
-    expTime := time.Now().Add(24 * time.Hour)
+// KeySource provides the key to sign with and the public keys to verify
+// against, by kid. services.InitKeys installs the database-backed one.
+type KeySource interface {
+    SigningKey() (kid string, key ed25519.PrivateKey)
+    PublicKey(kid string) (ed25519.PublicKey, bool)
+}
+
+var Keys KeySource
+
+// AccessTokenTTL is how long access tokens are valid; keep it short, refresh
+// tokens are for staying logged in
+func AccessTokenTTL() time.Duration {
+    return config.GetEnvDuration("ACCESS_TOKEN_TTL", 15*time.Minute)
+}
+
+// GenerateJWT issues a short-lived EdDSA access token for a session. The
+// header's kid names the signing key; every token gets its own jti so it can
+// be denylisted on logout.
+func GenerateJWT(username, role, sessionID string) (string, *Claims, error) {
+    now := time.Now()
     claims := &Claims{
-        Username: username,
+        Username:  username,
+        Role:      role,
+        SessionID: sessionID,
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(expTime),
+            ID:        NewTokenID(),
+            IssuedAt:  jwt.NewNumericDate(now),
+            ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL())),
         },
     }
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString([]byte(config.GetEnv("JWT_SECRET")))
+    kid, key := Keys.SigningKey()
+    token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+    token.Header["kid"] = kid
+    signed, err := token.SignedString(key)
+    return signed, claims, err
 }
 
 func ValidateToken(tokenStr string) (*Claims, error) {
     claims := &Claims{}
     token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-        return []byte(config.GetEnv("JWT_SECRET")), nil
-    })
+        kid, _ := token.Header["kid"].(string)
+        key, ok := Keys.PublicKey(kid)
+        if !ok {
+            return nil, errors.New("unknown signing key")
+        }
+        return key, nil
+    }, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}))
     if err != nil || !token.Valid {
         return nil, err
     }
@@ -0,0 +1,56 @@
+package utils
+
+import (
+    "sync"
+    "time"
+)
+
+// SlidingWindow allows at most Limit events per key in any Window-long span.
+// It keeps the timestamps of recent events per key, which is cheap at the
+// small limits used for login and registration. State is per process.
+type SlidingWindow struct {
+    Limit  int
+    Window time.Duration
+
+    mu        sync.Mutex
+    hits      map[string][]time.Time
+    lastSweep time.Time
+}
+
+func NewSlidingWindow(limit int, window time.Duration) *SlidingWindow {
+    return &SlidingWindow{Limit: limit, Window: window, hits: map[string][]time.Time{}}
+}
+
+// Allow records an event for key if it is within the limit. Otherwise it
+// returns false and how long until the oldest event leaves the window.
+func (s *SlidingWindow) Allow(key string) (bool, time.Duration) {
+    now := time.Now()
+    cutoff := now.Add(-s.Window)
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    // Forget idle keys once per window so the map does not grow forever
+    if now.Sub(s.lastSweep) > s.Window {
+        for k, times := range s.hits {
+            if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+                delete(s.hits, k)
+            }
+        }
+        s.lastSweep = now
+    }
+
+    times := s.hits[key]
+    i := 0
+    for i < len(times) && !times[i].After(cutoff) {
+        i++
+    }
+    times = times[i:]
+
+    if len(times) >= s.Limit {
+        s.hits[key] = times
+        return false, times[0].Sub(cutoff)
+    }
+    s.hits[key] = append(times, now)
+    return true, 0
+}
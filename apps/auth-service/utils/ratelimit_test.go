@@ -0,0 +1,79 @@
+package utils
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestSlidingWindowLimitsPerKey(t *testing.T) {
+    s := NewSlidingWindow(3, time.Minute)
+    for i := 0; i < 3; i++ {
+        if ok, _ := s.Allow("203.0.113.1"); !ok {
+            t.Fatalf("event %d refused below the limit", i+1)
+        }
+    }
+    ok, wait := s.Allow("203.0.113.1")
+    if ok {
+        t.Fatal("fourth event allowed")
+    }
+    if wait <= 0 || wait > time.Minute {
+        t.Fatalf("retry after %s, want within the window", wait)
+    }
+    if ok, _ := s.Allow("203.0.113.2"); !ok {
+        t.Fatal("limit leaked to another key")
+    }
+}
+
+func TestSlidingWindowSlides(t *testing.T) {
+    s := NewSlidingWindow(2, 40*time.Millisecond)
+    s.Allow("user")
+    time.Sleep(25 * time.Millisecond)
+    s.Allow("user")
+    if ok, _ := s.Allow("user"); ok {
+        t.Fatal("third event allowed inside the window")
+    }
+
+    // The first event has left the window, the second has not
+    time.Sleep(25 * time.Millisecond)
+    if ok, _ := s.Allow("user"); !ok {
+        t.Fatal("refused after the oldest event left the window")
+    }
+    if ok, _ := s.Allow("user"); ok {
+        t.Fatal("the window forgot an event still inside it")
+    }
+}
+
+func TestSlidingWindowRefusedEventsDoNotCount(t *testing.T) {
+    s := NewSlidingWindow(1, 30*time.Millisecond)
+    s.Allow("ip")
+    for i := 0; i < 10; i++ {
+        s.Allow("ip")
+    }
+    time.Sleep(40 * time.Millisecond)
+    if ok, _ := s.Allow("ip"); !ok {
+        t.Fatal("refused attempts extended the block")
+    }
+}
+
+func TestSlidingWindowConcurrent(t *testing.T) {
+    s := NewSlidingWindow(10, time.Minute)
+    var mu sync.Mutex
+    allowed := 0
+    var wg sync.WaitGroup
+    for i := 0; i < 50; i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            if ok, _ := s.Allow("ip"); ok {
+                mu.Lock()
+                allowed++
+                mu.Unlock()
+            }
+        }()
+    }
+    wg.Wait()
+    if allowed != 10 {
+        t.Fatalf("allowed %d of 50 concurrent events, want 10", allowed)
+    }
+}
@@ -0,0 +1,33 @@
+package utils
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+)
+
+// NewTokenID returns a random 128-bit hex id, used for jti and session ids
+func NewTokenID() string {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return hex.EncodeToString(b)
+}
+
+// NewOpaqueToken returns a random 256-bit URL-safe token for refresh tokens
+func NewOpaqueToken() string {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// HashToken is how opaque tokens are stored: hex SHA-256. They carry enough
+// entropy that a slow password hash is unnecessary.
+func HashToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestHashToken(t *testing.T) {
+    // SHA-256 of "abc" (FIPS 180-2 example), which the file service
+    // recomputes to look personal access tokens up
+    const want = "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+    if got := HashToken("abc"); got != want {
+        t.Fatalf("HashToken(abc) = %s, want %s", got, want)
+    }
+    if HashToken("fvp_a") == HashToken("fvp_b") {
+        t.Fatal("different tokens hash alike")
+    }
+}
+
+func TestNewOpaqueTokenIsURLSafeAndUnique(t *testing.T) {
+    seen := map[string]bool{}
+    for i := 0; i < 100; i++ {
+        tok := NewOpaqueToken()
+        if len(tok) != 43 || strings.ContainsAny(tok, "+/=") {
+            t.Fatalf("token %q is not 32 bytes of unpadded base64url", tok)
+        }
+        if seen[tok] {
+            t.Fatal("NewOpaqueToken repeated itself")
+        }
+        seen[tok] = true
+    }
+}
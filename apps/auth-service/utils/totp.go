@@ -0,0 +1,66 @@
+package utils
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "encoding/base32"
+    "encoding/binary"
+    "fmt"
+    "net/url"
+    "strings"
+    "time"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults every authenticator app
+// understands, so they are not configurable.
+const (
+    TOTPPeriod = 30
+    TOTPDigits = 6
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random 160-bit secret in unpadded base32
+func NewTOTPSecret() string {
+    b := make([]byte, 20)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return totpEncoding.EncodeToString(b)
+}
+
+// TOTPStep is the time step t falls in
+func TOTPStep(t time.Time) int64 {
+    return t.Unix() / TOTPPeriod
+}
+
+// TOTPCode computes the code for secret at a given time step (RFC 4226 HOTP
+// with the step as counter)
+func TOTPCode(secret string, step int64) (string, error) {
+    key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+    if err != nil {
+        return "", err
+    }
+    var msg [8]byte
+    binary.BigEndian.PutUint64(msg[:], uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(msg[:])
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", TOTPDigits, value%1000000), nil
+}
+
+// TOTPURI is the otpauth:// URI authenticator apps scan as a QR code
+func TOTPURI(issuer, account, secret string) string {
+    v := url.Values{}
+    v.Set("secret", secret)
+    v.Set("issuer", issuer)
+    v.Set("algorithm", "SHA1")
+    v.Set("digits", fmt.Sprint(TOTPDigits))
+    v.Set("period", fmt.Sprint(TOTPPeriod))
+    label := url.PathEscape(issuer + ":" + account)
+    return "otpauth://totp/" + label + "?" + v.Encode()
+}
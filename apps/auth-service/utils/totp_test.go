@@ -0,0 +1,64 @@
+package utils
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+// rfc6238Secret is the SHA-1 seed of RFC 6238 appendix B, "12345678901234567890"
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+    // The RFC's 8-digit values cut to the 6 digits apps use
+    tests := []struct {
+        unix int64
+        want string
+    }{
+        {59, "287082"},
+        {1111111109, "081804"},
+        {1111111111, "050471"},
+        {1234567890, "005924"},
+        {2000000000, "279037"},
+        {20000000000, "353130"},
+    }
+    for _, tt := range tests {
+        step := TOTPStep(time.Unix(tt.unix, 0))
+        got, err := TOTPCode(rfc6238Secret, step)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got != tt.want {
+            t.Errorf("TOTPCode at %d = %s, want %s", tt.unix, got, tt.want)
+        }
+    }
+}
+
+func TestTOTPCodeAcceptsLowercaseSecret(t *testing.T) {
+    got, err := TOTPCode(strings.ToLower(rfc6238Secret), 1)
+    if err != nil || got != "287082" {
+        t.Fatalf("TOTPCode(lowercase) = %q, %v", got, err)
+    }
+    if _, err := TOTPCode("not base32!", 1); err == nil {
+        t.Fatal("a malformed secret was accepted")
+    }
+}
+
+func TestTOTPStepBoundaries(t *testing.T) {
+    if TOTPStep(time.Unix(29, 0)) != 0 || TOTPStep(time.Unix(30, 0)) != 1 || TOTPStep(time.Unix(59, 0)) != 1 {
+        t.Fatal("steps are not 30 seconds long")
+    }
+}
+
+func TestNewTOTPSecret(t *testing.T) {
+    secret := NewTOTPSecret()
+    if len(secret) != 32 || strings.Contains(secret, "=") {
+        t.Fatalf("secret %q is not 160 bits of unpadded base32", secret)
+    }
+    if _, err := TOTPCode(secret, 0); err != nil {
+        t.Fatal(err)
+    }
+    if NewTOTPSecret() == secret {
+        t.Fatal("NewTOTPSecret repeated itself")
+    }
+}
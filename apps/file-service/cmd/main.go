@@ -3,11 +3,16 @@ package main
 import (
     "log"
     "net/http"
+    "time"
 
     "file-service/config"
+    "file-service/controllers"
     "file-service/database"
     "file-service/models"
     "file-service/routes"
+    "file-service/services"
+    "file-service/storage"
+    "file-service/utils"
 
     "github.com/rs/cors"
 )
@@ -15,11 +20,51 @@ import (
 func main() {
     config.LoadEnv()
     database.Init()
+    storage.Init()
 
-    // Run DB migrations for files table
-    _, err := database.DB.Exec(models.FileTableMigration())
-    if err != nil {
-        log.Fatal("Failed migration:", err)
+    // Access tokens are verified against the auth service's published keys
+    utils.JWKS = utils.NewJWKSCache(config.GetEnvDefault("JWKS_URL", "http://localhost:8000/.well-known/jwks.json"))
+    if err := utils.JWKS.Refresh(); err != nil {
+        log.Println("JWKS not available yet, will retry:", err)
+    }
+    utils.JWKS.Start(config.GetEnvDuration("JWKS_REFRESH_INTERVAL", 10*time.Minute))
+
+    // Run DB migrations for blob store and per-user files tables
+    for _, migration := range []string{
+        models.BlobTableMigration(),
+        models.FileTableMigration(),
+        models.FolderTableMigration(),
+        models.FileVersionTableMigration(),
+        models.TrashTableMigration(),
+        models.ShareLinkTableMigration(),
+        models.FileGrantTableMigration(),
+        models.TusUploadTableMigration(),
+        models.QuotaTableMigration(),
+        models.TokenDenylistTableMigration(),
+        models.S3TableMigration(),
+        models.LFSTableMigration(),
+        models.RegistryTableMigration(),
+        models.SSHKeyTableMigration(),
+    } {
+        if _, err := database.DB.Exec(migration); err != nil {
+            log.Fatal("Failed migration:", err)
+        }
+    }
+    if err := services.InitS3Keys(); err != nil {
+        log.Fatal("Failed to load S3 key secret:", err)
+    }
+    if err := controllers.IndexOCIManifests(); err != nil {
+        log.Fatal("Failed to index registry manifests:", err)
+    }
+
+    controllers.StartTusCleanup(time.Hour)
+    controllers.StartS3UploadCleanup(time.Hour)
+    controllers.StartOCIUploadCleanup(time.Hour)
+    services.StartVersionPruner(time.Hour)
+    services.StartTrashPurger(time.Hour)
+
+    if err := controllers.StartSFTPServer(); err != nil {
+        log.Fatal("Failed to start SFTP server:", err)
     }
 
     r := routes.Init()
@@ -27,8 +72,11 @@ func main() {
     // Setup CORS to allow frontend calls from http://localhost:3000
     c := cors.New(cors.Options{
         AllowedOrigins:   []string{"http://localhost:5173"},
-        AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-        AllowedHeaders:   []string{"Authorization", "Content-Type","Uploader"},
+        AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "HEAD", "DELETE", "OPTIONS"},
+        AllowedHeaders:   []string{"Authorization", "Content-Type","Uploader",
+            "X-Share-Password", "Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata", "Upload-Checksum"},
+        ExposedHeaders:   []string{"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+            "Upload-Offset", "Upload-Length", "Upload-Expires"},
         AllowCredentials: true,
     })
 
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+    "errors"
+    "testing"
+
+    "file-service/database"
+    "file-service/services"
+)
+
+// The auth service retries a rename until it hears back, so applying one
+// twice must leave the data where the first run put it
+func TestRenameUserIsIdempotent(t *testing.T) {
+    setupTestDB(t)
+    content, _ := randomContent(t)
+    file, err := uploadAs("alice", "notes.txt", content)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := database.DB.Exec("INSERT INTO user_quotas (username, quota_bytes) VALUES ('alice', 12345) ON CONFLICT (username) DO UPDATE SET quota_bytes = 12345"); err != nil {
+        t.Fatal(err)
+    }
+
+    for i := 0; i < 2; i++ {
+        if err := services.RenameUser("alice", "bob"); err != nil {
+            t.Fatalf("rename %d: %v", i+1, err)
+        }
+    }
+    var uploader string
+    if err := database.DB.QueryRow("SELECT uploader FROM user_files WHERE id = $1", file.ID).Scan(&uploader); err != nil {
+        t.Fatal(err)
+    }
+    if uploader != "bob" {
+        t.Fatalf("file owned by %q after rename, want bob", uploader)
+    }
+    var quota int64
+    if err := database.DB.QueryRow("SELECT quota_bytes FROM user_quotas WHERE username = 'bob'").Scan(&quota); err != nil {
+        t.Fatalf("quota lost by the repeated rename: %v", err)
+    }
+    if quota != 12345 {
+        t.Fatalf("quota %d after rename, want 12345", quota)
+    }
+
+    // Both names owning data is a real conflict
+    if _, err := uploadAs("alice", "other.txt", content); err != nil {
+        t.Fatal(err)
+    }
+    if err := services.RenameUser("alice", "bob"); !errors.Is(err, services.ErrUsernameInUse) {
+        t.Fatalf("rename onto a name with files = %v, want ErrUsernameInUse", err)
+    }
+}
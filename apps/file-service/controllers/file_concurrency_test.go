@@ -0,0 +1,376 @@
+package controllers
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/mux"
+
+    "file-service/database"
+    "file-service/middleware"
+    "file-service/models"
+    "file-service/services"
+    "file-service/storage"
+)
+
+// These tests hammer the upload and delete endpoints with identical content
+// against a real Postgres. They run in a throwaway schema of the database
+// named by TEST_DB_NAME (with DB_HOST, DB_PORT, DB_USER and DB_PASSWORD as
+// for the service) and are skipped when it is unset.
+
+func testDSN(dbname string) string {
+    parts := []string{"sslmode=disable", "dbname=" + dbname}
+    for key, env := range map[string]string{"host": "DB_HOST", "port": "DB_PORT", "user": "DB_USER", "password": "DB_PASSWORD"} {
+        if v := os.Getenv(env); v != "" {
+            parts = append(parts, key+"="+v)
+        }
+    }
+    return strings.Join(parts, " ")
+}
+
+// setupTestDB points database.DB at a fresh schema and storage.Store at a
+// temp dir for the duration of the test
+func setupTestDB(t *testing.T) {
+    t.Helper()
+    dbname := os.Getenv("TEST_DB_NAME")
+    if dbname == "" {
+        t.Skip("TEST_DB_NAME not set, skipping Postgres tests")
+    }
+
+    admin, err := sql.Open("postgres", testDSN(dbname))
+    if err != nil {
+        t.Fatal(err)
+    }
+    schema := fmt.Sprintf("test_%d_%d", os.Getpid(), time.Now().UnixNano())
+    for _, q := range []string{"CREATE EXTENSION IF NOT EXISTS pg_trgm", "CREATE SCHEMA " + schema} {
+        if _, err := admin.Exec(q); err != nil {
+            admin.Close()
+            t.Fatalf("%s: %v", q, err)
+        }
+    }
+
+    db, err := sql.Open("postgres", testDSN(dbname)+" search_path="+schema+",public")
+    if err != nil {
+        t.Fatal(err)
+    }
+    prevDB, prevStore := database.DB, storage.Store
+    t.Cleanup(func() {
+        database.DB, storage.Store = prevDB, prevStore
+        db.Close()
+        admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+        admin.Close()
+    })
+    database.DB = db
+
+    for _, migration := range []string{
+        models.BlobTableMigration(),
+        models.FileTableMigration(),
+        models.FolderTableMigration(),
+        models.FileVersionTableMigration(),
+        models.TrashTableMigration(),
+        models.ShareLinkTableMigration(),
+        models.FileGrantTableMigration(),
+        models.TusUploadTableMigration(),
+        models.QuotaTableMigration(),
+        models.S3TableMigration(),
+        models.RegistryTableMigration(),
+    } {
+        if _, err := db.Exec(migration); err != nil {
+            t.Fatalf("migration failed: %v", err)
+        }
+    }
+
+    store, err := storage.NewLocal(t.TempDir(), 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    storage.Store = store
+    t.Setenv("UPLOAD_TEMP_PATH", t.TempDir())
+}
+
+// randomContent returns content no other test run shares, and its hash
+func randomContent(t *testing.T) ([]byte, string) {
+    content := make([]byte, 64<<10)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    sum := sha256.Sum256(content)
+    return content, hex.EncodeToString(sum[:])
+}
+
+func asUser(r *http.Request, user string) *http.Request {
+    return r.WithContext(context.WithValue(r.Context(), middleware.UsernameKey, user))
+}
+
+// uploadAs sends content as filename through UploadFile
+func uploadAs(user, filename string, content []byte) (models.File, error) {
+    return uploadTo(user, "/upload", filename, content)
+}
+
+// uploadTo is uploadAs with a target such as "/upload?path=/a/b"
+func uploadTo(user, target, filename string, content []byte) (models.File, error) {
+    var body bytes.Buffer
+    mw := multipart.NewWriter(&body)
+    part, err := mw.CreateFormFile("files", filename)
+    if err != nil {
+        return models.File{}, err
+    }
+    part.Write(content)
+    mw.Close()
+
+    r := httptest.NewRequest(http.MethodPost, target, &body)
+    r.Header.Set("Content-Type", mw.FormDataContentType())
+    w := httptest.NewRecorder()
+    UploadFile(w, asUser(r, user))
+    if w.Code != http.StatusOK {
+        return models.File{}, fmt.Errorf("upload by %s: %d %s", user, w.Code, w.Body.String())
+    }
+
+    var files []models.File
+    if err := json.NewDecoder(w.Body).Decode(&files); err != nil || len(files) != 1 {
+        return models.File{}, fmt.Errorf("upload by %s: unexpected response %v", user, err)
+    }
+    return files[0], nil
+}
+
+// deleteAs trashes a file through DeleteFile and then purges it from the
+// trash, which is where its blob reference is released
+func deleteAs(user string, id int) error {
+    vars := map[string]string{"id": strconv.Itoa(id)}
+
+    w := httptest.NewRecorder()
+    DeleteFile(w, mux.SetURLVars(asUser(httptest.NewRequest(http.MethodDelete, "/files/"+vars["id"], nil), user), vars))
+    if w.Code != http.StatusNoContent {
+        return fmt.Errorf("delete %d by %s: %d %s", id, user, w.Code, w.Body.String())
+    }
+
+    w = httptest.NewRecorder()
+    PurgeTrashedFile(w, mux.SetURLVars(asUser(httptest.NewRequest(http.MethodDelete, "/trash/"+vars["id"], nil), user), vars))
+    if w.Code != http.StatusNoContent {
+        return fmt.Errorf("purge %d by %s: %d %s", id, user, w.Code, w.Body.String())
+    }
+    return nil
+}
+
+// parallel runs fn(i) for i in [0, n) at once and reports every error
+func parallel(t *testing.T, n int, fn func(i int) error) {
+    t.Helper()
+    var wg sync.WaitGroup
+    start := make(chan struct{})
+    errs := make(chan error, n)
+    for i := 0; i < n; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            <-start
+            if err := fn(i); err != nil {
+                errs <- err
+            }
+        }(i)
+    }
+    close(start)
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        t.Error(err)
+    }
+}
+
+// assertBlob checks the blob's reference count against the versions that
+// point at it, and that its bytes are stored exactly when it has references
+func assertBlob(t *testing.T, hash string, wantRefs int) {
+    t.Helper()
+    var refs int
+    err := database.DB.QueryRow("SELECT reference_count FROM blobs WHERE content_hash = $1", hash).Scan(&refs)
+    if err == sql.ErrNoRows {
+        refs = 0
+    } else if err != nil {
+        t.Fatal(err)
+    }
+
+    var versions int
+    if err := database.DB.QueryRow("SELECT COUNT(*) FROM file_versions WHERE content_hash = $1", hash).Scan(&versions); err != nil {
+        t.Fatal(err)
+    }
+
+    _, statErr := storage.Store.Stat(hash)
+    switch {
+    case refs != wantRefs:
+        t.Errorf("reference_count = %d, want %d", refs, wantRefs)
+    case versions != refs:
+        t.Errorf("reference_count = %d but %d versions point at the blob", refs, versions)
+    case refs > 0 && statErr != nil:
+        t.Errorf("blob has %d references but its bytes are gone: %v", refs, statErr)
+    case refs == 0 && !errors.Is(statErr, storage.ErrNotExist):
+        t.Errorf("blob has no references but its bytes are still stored (%v)", statErr)
+    }
+}
+
+func TestConcurrentIdenticalUploads(t *testing.T) {
+    setupTestDB(t)
+    content, hash := randomContent(t)
+
+    const n = 16
+    parallel(t, n, func(i int) error {
+        _, err := uploadAs(fmt.Sprintf("uploader%d", i), "same.bin", content)
+        return err
+    })
+
+    assertBlob(t, hash, n)
+    var files int
+    if err := database.DB.QueryRow("SELECT COUNT(*) FROM user_files WHERE content_hash = $1", hash).Scan(&files); err != nil {
+        t.Fatal(err)
+    }
+    if files != n {
+        t.Errorf("%d file entries, want %d", files, n)
+    }
+}
+
+func TestConcurrentUploadsAndDeletesKeepBlob(t *testing.T) {
+    setupTestDB(t)
+    content, hash := randomContent(t)
+
+    const existing, uploads = 12, 12
+    seeded := make([]models.File, existing)
+    for i := range seeded {
+        f, err := uploadAs(fmt.Sprintf("old%d", i), "shared.bin", content)
+        if err != nil {
+            t.Fatal(err)
+        }
+        seeded[i] = f
+    }
+
+    // Every old reference goes away while new ones arrive
+    parallel(t, existing+uploads, func(i int) error {
+        if i < existing {
+            return deleteAs(seeded[i].Uploader, seeded[i].ID)
+        }
+        _, err := uploadAs(fmt.Sprintf("new%d", i), "shared.bin", content)
+        return err
+    })
+
+    assertBlob(t, hash, uploads)
+}
+
+func TestConcurrentDeletesPurgeBlob(t *testing.T) {
+    setupTestDB(t)
+    content, hash := randomContent(t)
+
+    const n = 12
+    seeded := make([]models.File, n)
+    for i := range seeded {
+        f, err := uploadAs(fmt.Sprintf("owner%d", i), "gone.bin", content)
+        if err != nil {
+            t.Fatal(err)
+        }
+        seeded[i] = f
+    }
+
+    parallel(t, n, func(i int) error {
+        return deleteAs(seeded[i].Uploader, seeded[i].ID)
+    })
+
+    assertBlob(t, hash, 0)
+    var used int64
+    if err := database.DB.QueryRow("SELECT COALESCE(SUM(used_bytes), 0) FROM user_quotas").Scan(&used); err != nil {
+        t.Fatal(err)
+    }
+    if used != 0 {
+        t.Errorf("%d bytes still charged after every file was purged", used)
+    }
+}
+
+// The last reference being purged while the same content is uploaded again
+// is the race that used to lose the bytes of the new blob
+func TestReuploadRacesPurgeOfLastReference(t *testing.T) {
+    setupTestDB(t)
+
+    for round := 0; round < 20; round++ {
+        content, hash := randomContent(t)
+        first, err := uploadAs("purger", fmt.Sprintf("round%d.bin", round), content)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        parallel(t, 2, func(i int) error {
+            if i == 0 {
+                return deleteAs(first.Uploader, first.ID)
+            }
+            _, err := uploadAs("reuploader", fmt.Sprintf("round%d.bin", round), content)
+            return err
+        })
+
+        assertBlob(t, hash, 1)
+        if t.Failed() {
+            t.Fatalf("failed in round %d", round)
+        }
+    }
+}
+
+func TestConcurrentUploadsCreateOnePath(t *testing.T) {
+    setupTestDB(t)
+
+    const n = 12
+    content, _ := randomContent(t)
+    parallel(t, n, func(i int) error {
+        _, err := uploadTo("mkdirp", "/upload?path=/incoming/2025", fmt.Sprintf("part%d.bin", i), content)
+        return err
+    })
+
+    var folders int
+    if err := database.DB.QueryRow("SELECT COUNT(*) FROM folders WHERE owner = 'mkdirp'").Scan(&folders); err != nil {
+        t.Fatal(err)
+    }
+    if folders != 2 {
+        t.Errorf("%d folders created for /incoming/2025, want 2", folders)
+    }
+}
+
+// Moving A into B while B moves into A must not leave both inside each other
+func TestConcurrentCrossMovesCannotCycle(t *testing.T) {
+    setupTestDB(t)
+
+    for round := 0; round < 20; round++ {
+        a, err := services.CreateFolder(database.DB, "mover", nil, fmt.Sprintf("a%d", round))
+        if err != nil {
+            t.Fatal(err)
+        }
+        b, err := services.CreateFolder(database.DB, "mover", nil, fmt.Sprintf("b%d", round))
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        ids := [2]int{a.ID, b.ID}
+        parallel(t, 2, func(i int) error {
+            _, err := services.UpdateFolder("mover", ids[i], nil, true, &ids[1-i])
+            if errors.Is(err, services.ErrFolderCycle) {
+                return nil
+            }
+            return err
+        })
+
+        var rooted int
+        if err := database.DB.QueryRow("SELECT COUNT(*) FROM folders WHERE id IN ($1, $2) AND parent_id IS NULL", a.ID, b.ID).Scan(&rooted); err != nil {
+            t.Fatal(err)
+        }
+        if rooted != 1 {
+            t.Fatalf("round %d: %d of the two folders left at the root, want 1", round, rooted)
+        }
+    }
+}
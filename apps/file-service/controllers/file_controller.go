@@ -3,170 +3,235 @@ package controllers
 import (
     "database/sql"
     "encoding/json"
+    "errors"
     "fmt"
     "io"
-    "mime"
+    "log"
+    "math"
     "net/http"
-    "os"
-    "path"
-    "path/filepath"
+    "strconv"
     "time"
 
     "github.com/gorilla/mux"
 
+    "file-service/config"
     "file-service/database"
+    "file-service/middleware"
     "file-service/models"
-    "file-service/utils"
+    "file-service/services"
+    "file-service/storage"
 )
 
-const UploadPath = "./uploads"
-
-// UploadFile handles file uploads with deduplication and quota (simplified quota management)
+// UploadFile streams multipart uploads straight into storage with deduplication.
+// Each file is hashed while it is written to a temp file, so nothing is held in
+// memory or read twice; the request as a whole is capped at MAX_UPLOAD_SIZE.
+// The target folder comes from a "path" (created if missing) or "folder_id"
+// query parameter, or form fields of the same name sent before the files.
 func UploadFile(w http.ResponseWriter, r *http.Request) {
-    err := r.ParseMultipartForm(50 << 20) // 50MB per request limit
-    if err != nil {
-        http.Error(w, "Error parsing form data", http.StatusBadRequest)
+    uploader, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || uploader == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
 
-    files := r.MultipartForm.File["files"]
-    if len(files) == 0 {
-        http.Error(w, "No files uploaded", http.StatusBadRequest)
+    r.Body = http.MaxBytesReader(w, r.Body, config.GetEnvInt64("MAX_UPLOAD_SIZE", 2<<30)) // 2GB per request by default
+    reader, err := r.MultipartReader()
+    if err != nil {
+        http.Error(w, "Error parsing form data", http.StatusBadRequest)
         return
     }
 
-    // Ideally get uploader from JWT context, here use header for demo:
-    uploader := r.Header.Get("Uploader")
-    if uploader == "" {
-        http.Error(w, "Uploader info missing", http.StatusUnauthorized)
+    q := r.URL.Query()
+    folderID, err := targetFolder(uploader, q.Get("folder_id"), q.Get("path"))
+    if err != nil {
+        storeError(w, err)
         return
     }
 
-    if _, err := os.Stat(UploadPath); os.IsNotExist(err) {
-        os.MkdirAll(UploadPath, os.ModePerm)
-    }
-
     var uploadedFiles []models.File
 
-    for _, fileHeader := range files {
-        f, err := fileHeader.Open()
-        if err != nil {
-            http.Error(w, "Could not open uploaded file", http.StatusInternalServerError)
-            return
+    for {
+        part, err := reader.NextPart()
+        if err == io.EOF {
+            break
         }
-
-        // Compute SHA256
-        hash, err := utils.ComputeSHA256(f)
         if err != nil {
-            http.Error(w, "Error hashing file", http.StatusInternalServerError)
-            f.Close()
-            return
-        }
-        f.Close()
-
-        // Check for existing file with hash
-        var existingFile models.File
-        err = database.DB.QueryRow("SELECT id, filename, uploader, size, mime_type, content_hash, upload_date, reference_count, download_count, is_public, public_link FROM files WHERE content_hash = $1", hash).Scan(
-            &existingFile.ID, &existingFile.Filename, &existingFile.Uploader,
-            &existingFile.Size, &existingFile.MIMEType, &existingFile.ContentHash,
-            &existingFile.UploadDate, &existingFile.ReferenceCount,
-            &existingFile.DownloadCount, &existingFile.IsPublic, &existingFile.PublicLink,
-        )
-
-        if err != nil && err != sql.ErrNoRows {
-            http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
-
+            uploadReadError(w, err)
             return
         }
-
-        if err == nil {
-            // Duplicate - increment reference count
-            _, err = database.DB.Exec("UPDATE files SET reference_count = reference_count + 1 WHERE id = $1", existingFile.ID)
+        if name := part.FormName(); (name == "path" || name == "folder_id") && part.FileName() == "" {
+            value, _ := io.ReadAll(io.LimitReader(part, 4096))
+            part.Close()
+            if name == "path" {
+                folderID, err = targetFolder(uploader, "", string(value))
+            } else {
+                folderID, err = targetFolder(uploader, string(value), "")
+            }
             if err != nil {
-                http.Error(w, "DB error updating reference count", http.StatusInternalServerError)
+                storeError(w, err)
                 return
             }
-
-            // You should update user's quota usage here (omitted for brevity)
-
-            uploadedFiles = append(uploadedFiles, existingFile)
+            continue
+        }
+        if part.FormName() != "files" || part.FileName() == "" {
+            part.Close()
             continue
         }
 
-        // Save file to disk
-        src, err := fileHeader.Open()
+        blob, err := services.StageBlob(part)
+        part.Close()
         if err != nil {
-            http.Error(w, "Error reading file", http.StatusInternalServerError)
+            uploadReadError(w, err)
             return
         }
-        defer src.Close()
 
-        dstPath := filepath.Join(UploadPath, hash)
-        dst, err := os.Create(dstPath)
+        mimeType := services.DetectMIMEType(part.FileName(), part.Header.Get("Content-Type"))
+        file, err := services.StoreFile(uploader, part.FileName(), mimeType, folderID, blob)
+        blob.Discard()
         if err != nil {
-            http.Error(w, "Could not save file", http.StatusInternalServerError)
+            storeError(w, err)
             return
         }
-        defer dst.Close()
 
-        if _, err := io.Copy(dst, src); err != nil {
-            http.Error(w, "Could not write file", http.StatusInternalServerError)
-            return
-        }
+        uploadedFiles = append(uploadedFiles, file)
+    }
+
+    if len(uploadedFiles) == 0 {
+        http.Error(w, "No files uploaded", http.StatusBadRequest)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(uploadedFiles)
+}
+
+// uploadReadError reports a failure while reading the request body
+func uploadReadError(w http.ResponseWriter, err error) {
+    var maxBytesErr *http.MaxBytesError
+    if errors.As(err, &maxBytesErr) {
+        http.Error(w, "Upload exceeds size limit", http.StatusRequestEntityTooLarge)
+        return
+    }
+    http.Error(w, "Error reading uploaded file", http.StatusBadRequest)
+}
+
+// targetFolder resolves the folder an upload goes into: path wins and is created
+// if missing, otherwise folder_id must name one of the user's folders
+func targetFolder(owner, folderID, path string) (*int, error) {
+    if path != "" {
+        return services.ResolvePath(database.DB, owner, path, true)
+    }
+    if folderID == "" {
+        return nil, nil
+    }
+    id, err := strconv.Atoi(folderID)
+    if err != nil {
+        return nil, services.ErrFolderNotFound
+    }
+    if err := services.CheckFolder(database.DB, owner, &id); err != nil {
+        return nil, err
+    }
+    return &id, nil
+}
 
-        // Determine MIME type based on extension or headers (basic)
-        ext := filepath.Ext(fileHeader.Filename)
-        mimeType := mime.TypeByExtension(ext)
-        if mimeType == "" {
-            mimeType = fileHeader.Header.Get("Content-Type")
+// folderFilter reads the optional "parent" (folder id or "root") or "path"
+// query filter of ListFiles and SearchFiles
+func folderFilter(r *http.Request, owner string) (filtered bool, folderID *int, err error) {
+    q := r.URL.Query()
+    if path := q.Get("path"); path != "" {
+        folderID, err = services.ResolvePath(database.DB, owner, path, false)
+        return true, folderID, err
+    }
+    switch parent := q.Get("parent"); parent {
+    case "":
+        return false, nil, nil
+    case "root":
+        return true, nil, nil
+    default:
+        id, err := strconv.Atoi(parent)
+        if err != nil {
+            return true, nil, services.ErrFolderNotFound
         }
+        return true, &id, services.CheckFolder(database.DB, owner, &id)
+    }
+}
+
+// storeError reports a failure to store an uploaded file
+func storeError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, services.ErrNameTaken):
+        http.Error(w, err.Error(), http.StatusConflict)
+    case errors.Is(err, services.ErrInvalidName):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    case errors.Is(err, services.ErrFolderNotFound):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, services.ErrFileTooLarge):
+        http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+    case errors.Is(err, services.ErrQuotaExceeded):
+        http.Error(w, err.Error(), http.StatusInsufficientStorage)
+    default:
+        log.Println("DB error inserting file:", err)
+        http.Error(w, "DB error inserting file", http.StatusInternalServerError)
+    }
+}
 
-        var insertedID int
-err = database.DB.QueryRow(
-    `INSERT INTO files 
-    (filename, uploader, size, mime_type, content_hash, upload_date, reference_count, download_count, is_public, public_link) 
-     VALUES ($1, $2, $3, $4, $5, $6, 1, 0, FALSE, NULL) RETURNING id`,
-    fileHeader.Filename, uploader, fileHeader.Size, mimeType, hash, time.Now(),
-).Scan(&insertedID)
-if err != nil {
-    http.Error(w, "DB error inserting file", http.StatusInternalServerError)
-    return
+// dbError logs an unexpected database failure and answers 500 without
+// passing the driver's message on to the client
+func dbError(w http.ResponseWriter, err error) {
+    log.Println("DB error:", err)
+    http.Error(w, "DB error", http.StatusInternalServerError)
 }
 
-uploadedFiles = append(uploadedFiles, models.File{
-    ID:             insertedID, // <-- NOW you have the correct ID!
-    Filename:       fileHeader.Filename,
-    Uploader:       uploader,
-    Size:           fileHeader.Size,
-    MIMEType:       mimeType,
-    ContentHash:    hash,
-    UploadDate:     time.Now(),
-    ReferenceCount: 1,
-    DownloadCount:  0,
-    IsPublic:       false,
-})
+// serveBlob streams a blob to the client, or redirects to a presigned URL
+// when the backend supports it and STORAGE_PRESIGN_DOWNLOADS is enabled
+func serveBlob(w http.ResponseWriter, r *http.Request, filename, contentHash string) {
+    if presigner, ok := storage.Store.(storage.Presigner); ok && config.GetEnv("STORAGE_PRESIGN_DOWNLOADS") == "true" {
+        url, err := presigner.PresignGet(contentHash, 5*time.Minute)
+        if err == nil {
+            http.Redirect(w, r, url, http.StatusFound)
+            return
+        }
     }
 
+    info, err := storage.Store.Stat(contentHash)
+    if err != nil {
+        http.Error(w, "File content not found", http.StatusNotFound)
+        return
+    }
+    obj, err := storage.Store.Get(contentHash)
+    if err != nil {
+        http.Error(w, "File content not found", http.StatusNotFound)
+        return
+    }
+    defer obj.Close()
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(uploadedFiles)
+    http.ServeContent(w, r, filename, info.ModTime, obj)
 }
 
 // ListFiles lists all files by the logged-in user
 func ListFiles(w http.ResponseWriter, r *http.Request) {
-    user, ok := r.Context().Value("username").(string)
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
     if !ok || user == "" {
         http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
 
-    rows, err := database.DB.Query(
-        "SELECT id, filename, uploader, size, mime_type, content_hash, upload_date, reference_count, download_count, is_public, public_link FROM files WHERE uploader = $1",
-        user,
-    )
+    query := "SELECT " + models.FileColumns + " FROM user_files f JOIN blobs b ON b.content_hash = f.content_hash WHERE f.uploader = $1 AND f.trashed_at IS NULL"
+    args := []interface{}{user}
+
+    filtered, folderID, err := folderFilter(r, user)
     if err != nil {
-       http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
+        storeError(w, err)
+        return
+    }
+    if filtered {
+        query += " AND f.folder_id IS NOT DISTINCT FROM $2"
+        args = append(args, folderID)
+    }
 
+    rows, err := database.DB.Query(query+" ORDER BY f.upload_date DESC", args...)
+    if err != nil {
+        dbError(w, err)
         return
     }
     defer rows.Close()
@@ -174,7 +239,7 @@ func ListFiles(w http.ResponseWriter, r *http.Request) {
     var files []models.File
     for rows.Next() {
         var f models.File
-        err := rows.Scan(&f.ID, &f.Filename, &f.Uploader, &f.Size, &f.MIMEType, &f.ContentHash, &f.UploadDate, &f.ReferenceCount, &f.DownloadCount, &f.IsPublic, &f.PublicLink)
+        err := models.ScanFile(rows, &f)
         if err != nil {
             http.Error(w, "DB error reading file", http.StatusInternalServerError)
             return
@@ -186,135 +251,104 @@ func ListFiles(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(files)
 }
 
-// DownloadFile streams the file content and increments download count
+// DownloadFile streams the file content and increments download count. Besides
+// the owner, users granted downloader or editor access may download it.
+// Public share links are only served through /public/{token}/download.
 func DownloadFile(w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    fileID := vars["id"]
-
-    user, ok := r.Context().Value("username").(string)
-    if !ok || user == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
-    }
-
-    var f models.File
-    err := database.DB.QueryRow(
-        "SELECT filename, content_hash, uploader, is_public FROM files WHERE id = $1",
-        fileID,
-    ).Scan(&f.Filename, &f.ContentHash, &f.Uploader, &f.IsPublic)
-    if err != nil {
-        http.Error(w, "File not found", http.StatusNotFound)
-        return
-    }
-
-    if !f.IsPublic && f.Uploader != user {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    f, ok := authorizeFile(w, r, services.AccessDownloader)
+    if !ok {
         return
     }
 
     go func() {
-        _, _ = database.DB.Exec("UPDATE files SET download_count = download_count + 1 WHERE id = $1", fileID)
+        _, _ = database.DB.Exec("UPDATE user_files SET download_count = download_count + 1 WHERE id = $1", f.ID)
     }()
 
-    filePath := path.Join(UploadPath, f.ContentHash)
-    http.ServeFile(w, r, filePath)
+    serveBlob(w, r, f.Filename, f.ContentHash)
 }
 
-// DeleteFile deletes or decrements reference count for a file
+// DeleteFile moves the file to its owner's trash; the owner and editors may do
+// this. Blob references are released when the trash is emptied or purged.
 func DeleteFile(w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    fileID := vars["id"]
-
-    user, ok := r.Context().Value("username").(string)
-    if !ok || user == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    f, ok := authorizeFile(w, r, services.AccessEditor)
+    if !ok {
         return
     }
 
-    var refCount int
-    var uploader string
-    var contentHash string
-    err := database.DB.QueryRow(
-        "SELECT reference_count, uploader, content_hash FROM files WHERE id = $1",
-        fileID,
-    ).Scan(&refCount, &uploader, &contentHash)
-    if err != nil {
+    err := database.WithTx(func(tx *sql.Tx) error {
+        return services.TrashFileTx(tx, f.ID)
+    })
+    if err == sql.ErrNoRows {
         http.Error(w, "File not found", http.StatusNotFound)
         return
     }
-
-    if uploader != user {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    if err != nil {
+        http.Error(w, "Failed to delete record", http.StatusInternalServerError)
         return
     }
 
-    if refCount > 1 {
-        _, err = database.DB.Exec("UPDATE files SET reference_count = reference_count - 1 WHERE id = $1", fileID)
-        if err != nil {
-            http.Error(w, "Failed to decrement reference count", http.StatusInternalServerError)
-            return
-        }
-    } else {
-        _, err = database.DB.Exec("DELETE FROM files WHERE id = $1", fileID)
-        if err != nil {
-            http.Error(w, "Failed to delete record", http.StatusInternalServerError)
-            return
-        }
-        os.Remove(path.Join(UploadPath, contentHash))
-    }
-
     w.WriteHeader(http.StatusNoContent)
 }
 
 // SearchFiles supports filtering by filename, mime type, size range, date range, uploader (logged-in user)
 func SearchFiles(w http.ResponseWriter, r *http.Request) {
-    user, ok := r.Context().Value("username").(string)
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
     if !ok || user == "" {
         http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
 
-    query := "SELECT id, filename, uploader, size, mime_type, content_hash, upload_date, reference_count FROM files WHERE uploader = $1"
+    query := "SELECT " + models.FileColumns + " FROM user_files f JOIN blobs b ON b.content_hash = f.content_hash WHERE f.uploader = $1 AND f.trashed_at IS NULL"
     args := []interface{}{user}
     idx := 2
 
     q := r.URL.Query()
 
+    filtered, folderID, err := folderFilter(r, user)
+    if err != nil {
+        storeError(w, err)
+        return
+    }
+    if filtered {
+        query += fmt.Sprintf(" AND f.folder_id IS NOT DISTINCT FROM $%d", idx)
+        args = append(args, folderID)
+        idx++
+    }
+
     if filename := q.Get("filename"); filename != "" {
-        query += fmt.Sprintf(" AND filename ILIKE $%d", idx)
+        query += fmt.Sprintf(" AND f.filename ILIKE $%d", idx)
         args = append(args, "%"+filename+"%")
         idx++
     }
     if mime := q.Get("mime"); mime != "" {
-        query += fmt.Sprintf(" AND mime_type = $%d", idx)
+        query += fmt.Sprintf(" AND f.mime_type = $%d", idx)
         args = append(args, mime)
         idx++
     }
     if sizeMin := q.Get("size_min"); sizeMin != "" {
-        query += fmt.Sprintf(" AND size >= $%d", idx)
+        query += fmt.Sprintf(" AND f.size >= $%d", idx)
         args = append(args, sizeMin)
         idx++
     }
     if sizeMax := q.Get("size_max"); sizeMax != "" {
-        query += fmt.Sprintf(" AND size <= $%d", idx)
+        query += fmt.Sprintf(" AND f.size <= $%d", idx)
         args = append(args, sizeMax)
         idx++
     }
     if dateStart := q.Get("date_start"); dateStart != "" {
-        query += fmt.Sprintf(" AND upload_date >= $%d", idx)
+        query += fmt.Sprintf(" AND f.upload_date >= $%d", idx)
         args = append(args, dateStart)
         idx++
     }
     if dateEnd := q.Get("date_end"); dateEnd != "" {
-        query += fmt.Sprintf(" AND upload_date <= $%d", idx)
+        query += fmt.Sprintf(" AND f.upload_date <= $%d", idx)
         args = append(args, dateEnd)
         idx++
     }
 
     rows, err := database.DB.Query(query, args...)
     if err != nil {
-       http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
-
+        dbError(w, err)
         return
     }
     defer rows.Close()
@@ -322,7 +356,7 @@ func SearchFiles(w http.ResponseWriter, r *http.Request) {
     var files []models.File
     for rows.Next() {
         var f models.File
-        err := rows.Scan(&f.ID, &f.Filename, &f.Uploader, &f.Size, &f.MIMEType, &f.ContentHash, &f.UploadDate, &f.ReferenceCount)
+        err := models.ScanFile(rows, &f)
         if err != nil {
             http.Error(w, "DB error reading files", http.StatusInternalServerError)
             return
@@ -334,65 +368,59 @@ func SearchFiles(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(files)
 }
 
-// ShareFilePublic generates a public link string for sharing
+// ShareFilePublic creates a new public share link for a file. The optional JSON
+// body sets {"name", "password", "expires_at" (RFC 3339) or "expires_in"
+// (seconds), "max_downloads"}; with no body the link is unrestricted.
 func ShareFilePublic(w http.ResponseWriter, r *http.Request) {
-    vars := mux.Vars(r)
-    fileID := vars["id"]
-
-    user, ok := r.Context().Value("username").(string)
-    if !ok || user == "" {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    f, ok := authorizeFile(w, r, services.AccessEditor)
+    if !ok {
         return
     }
 
-    // Verify file ownership
-    var uploader string
-    err := database.DB.QueryRow("SELECT uploader FROM files WHERE id = $1", fileID).Scan(&uploader)
-    if err != nil {
-        http.Error(w, "File not found", http.StatusNotFound)
+    var req struct {
+        Name         string     `json:"name"`
+        Password     string     `json:"password"`
+        ExpiresAt    *time.Time `json:"expires_at"`
+        ExpiresIn    int64      `json:"expires_in"`
+        MaxDownloads *int       `json:"max_downloads"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        http.Error(w, "Bad request", http.StatusBadRequest)
         return
     }
-    if uploader != user {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+    if req.ExpiresIn < 0 || (req.MaxDownloads != nil && *req.MaxDownloads < 1) || len(req.Name) > 100 {
+        http.Error(w, "Bad request", http.StatusBadRequest)
         return
     }
+    if req.ExpiresIn > 0 {
+        t := time.Now().Add(time.Duration(req.ExpiresIn) * time.Second)
+        req.ExpiresAt = &t
+    }
 
-    // Generate random public link (example: use UUID or random string)
-    publicLink := utils.GenerateRandomString(20)
-
-    _, err = database.DB.Exec(
-        "UPDATE files SET public_link = $1, is_public = TRUE WHERE id = $2",
-        publicLink, fileID,
-    )
+    link, err := services.CreateShareLink(f.ID, services.ShareOptions{
+        Name:         req.Name,
+        Password:     req.Password,
+        ExpiresAt:    req.ExpiresAt,
+        MaxDownloads: req.MaxDownloads,
+    })
     if err != nil {
         http.Error(w, "Failed to update file for sharing", http.StatusInternalServerError)
         return
     }
 
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{
-        "public_link": publicLink,
-        "url":        fmt.Sprintf("http://localhost:8001/public/%s/download", publicLink),
-    })
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(link)
 }
 
-
-
 // AdminListFiles lists all files in the database with uploader and usage stats.
 // Only accessible by users with "admin" role.
 func AdminListFiles(w http.ResponseWriter, r *http.Request) {
-    // Make sure only admins can access
-    role, ok := r.Context().Value("role").(string)
-    if !ok || role != "admin" {
-        http.Error(w, "Forbidden", http.StatusForbidden)
-        return
-    }
-
     rows, err := database.DB.Query(
-        `SELECT id, filename, uploader, size, mime_type, content_hash, upload_date, reference_count, download_count, is_public, public_link
-         FROM files ORDER BY upload_date DESC`)
+        `SELECT ` + models.FileColumns + `
+         FROM user_files f JOIN blobs b ON b.content_hash = f.content_hash ORDER BY f.upload_date DESC`)
     if err != nil {
-        http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
+        dbError(w, err)
         return
     }
     defer rows.Close()
@@ -400,8 +428,7 @@ func AdminListFiles(w http.ResponseWriter, r *http.Request) {
     var files []models.File
     for rows.Next() {
         var f models.File
-        err := rows.Scan(&f.ID, &f.Filename, &f.Uploader, &f.Size, &f.MIMEType, &f.ContentHash,
-            &f.UploadDate, &f.ReferenceCount, &f.DownloadCount, &f.IsPublic, &f.PublicLink)
+        err := models.ScanFile(rows, &f)
         if err != nil {
             http.Error(w, "DB error reading file", http.StatusInternalServerError)
             return
@@ -412,19 +439,15 @@ func AdminListFiles(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(files)
 }
 
-
+// AdminUsageStats reports totals across all users. Admin only.
 func AdminUsageStats(w http.ResponseWriter, r *http.Request) {
-    role, ok := r.Context().Value("role").(string)
-    if !ok || role != "admin" {
-        http.Error(w, "Forbidden", http.StatusForbidden)
-        return
-    }
-    // Example: total files, total downloads, total size
-    var totalFiles, totalDownloads, totalSize int64
-    row := database.DB.QueryRow(`SELECT COUNT(*), COALESCE(SUM(download_count),0), COALESCE(SUM(size),0) FROM files`)
-    err := row.Scan(&totalFiles, &totalDownloads, &totalSize)
+    // Example: total files, total downloads, total size (logical and stored)
+    var totalFiles, totalDownloads, totalSize, storedSize int64
+    row := database.DB.QueryRow(`SELECT COUNT(*), COALESCE(SUM(download_count),0), COALESCE(SUM(size),0),
+        (SELECT COALESCE(SUM(size),0) FROM blobs) FROM user_files`)
+    err := row.Scan(&totalFiles, &totalDownloads, &totalSize, &storedSize)
     if err != nil {
-        http.Error(w, "DB error: "+err.Error(), http.StatusInternalServerError)
+        dbError(w, err)
         return
     }
     w.Header().Set("Content-Type", "application/json")
@@ -432,30 +455,49 @@ func AdminUsageStats(w http.ResponseWriter, r *http.Request) {
         "total_files":     totalFiles,
         "total_downloads": totalDownloads,
         "total_size":      totalSize,
+        "stored_size":     storedSize,
     })
 }
 
-
-
-// DownloadPublicFile serves a public file by link (no auth required), increments download count
+// DownloadPublicFile serves a file through a share link (no auth required).
+// Expired or revoked links get 410, a missing or wrong password 401, too
+// many wrong passwords 429 and an exhausted download limit 403. Every request that gets through counts as a
+// download, resumed ranges included. The password comes from the
+// X-Share-Password header or HTTP basic auth, so browsers can prompt for it.
 func DownloadPublicFile(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     publicLink := vars["link"]
 
-    var f models.File
-    err := database.DB.QueryRow(
-        "SELECT filename, content_hash FROM files WHERE public_link = $1 AND is_public = TRUE",
-        publicLink,
-    ).Scan(&f.Filename, &f.ContentHash)
-    if err != nil {
+    password := r.Header.Get("X-Share-Password")
+    if password == "" {
+        _, password, _ = r.BasicAuth()
+    }
+
+    f, err := services.OpenShareLink(publicLink, password, middleware.ClientIP(r))
+    var throttled *services.LinkThrottledError
+    switch {
+    case err == nil:
+    case errors.As(err, &throttled):
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+        http.Error(w, err.Error(), http.StatusTooManyRequests)
+        return
+    case errors.Is(err, services.ErrLinkNotFound):
         http.Error(w, "Public file not found", http.StatusNotFound)
         return
+    case errors.Is(err, services.ErrLinkGone):
+        http.Error(w, err.Error(), http.StatusGone)
+        return
+    case errors.Is(err, services.ErrLinkPassword):
+        w.Header().Set("WWW-Authenticate", `Basic realm="Shared file"`)
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return
+    case errors.Is(err, services.ErrLinkExhausted):
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    default:
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
     }
 
-    go func() {
-        _, _ = database.DB.Exec("UPDATE files SET download_count = download_count + 1 WHERE public_link = $1", publicLink)
-    }()
-
-    filePath := path.Join(UploadPath, f.ContentHash)
-    http.ServeFile(w, r, filePath)
+    serveBlob(w, r, f.Filename, f.ContentHash)
 }
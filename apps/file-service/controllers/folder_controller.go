@@ -0,0 +1,232 @@
+package controllers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+
+    "file-service/database"
+    "file-service/middleware"
+    "file-service/services"
+)
+
+// folderError maps folder and rename/move failures to HTTP responses
+func folderError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, services.ErrFolderNotFound):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, sql.ErrNoRows):
+        http.Error(w, "File not found", http.StatusNotFound)
+    case errors.Is(err, services.ErrNameTaken):
+        http.Error(w, err.Error(), http.StatusConflict)
+    case errors.Is(err, services.ErrInvalidName), errors.Is(err, services.ErrFolderCycle):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    default:
+        dbError(w, err)
+    }
+}
+
+// parseParentField reads an optional JSON folder reference: absent means "leave
+// as is", null means the root, a number is a folder id
+func parseParentField(raw json.RawMessage) (set bool, folderID *int, err error) {
+    if len(raw) == 0 {
+        return false, nil, nil
+    }
+    if string(raw) == "null" {
+        return true, nil, nil
+    }
+    var id int
+    if err := json.Unmarshal(raw, &id); err != nil {
+        return false, nil, err
+    }
+    return true, &id, nil
+}
+
+// ListRootFolder lists the root, or the folder named by the "path" query parameter
+func ListRootFolder(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    folderID, err := services.ResolvePath(database.DB, user, r.URL.Query().Get("path"), false)
+    if err != nil {
+        folderError(w, err)
+        return
+    }
+    listing, err := services.ListFolder(user, folderID)
+    if err != nil {
+        folderError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(listing)
+}
+
+// ListFolder lists a folder's direct children with breadcrumbs
+func ListFolder(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        http.Error(w, "Folder not found", http.StatusNotFound)
+        return
+    }
+
+    listing, err := services.ListFolder(user, &id)
+    if err != nil {
+        folderError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(listing)
+}
+
+// CreateFolder creates {"name", "parent_id"}, or every missing folder along {"path"}
+func CreateFolder(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req struct {
+        Name     string `json:"name"`
+        ParentID *int   `json:"parent_id"`
+        Path     string `json:"path"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    if req.Path != "" {
+        folderID, err := services.ResolvePath(database.DB, user, req.Path, true)
+        if err != nil {
+            folderError(w, err)
+            return
+        }
+        if folderID == nil {
+            http.Error(w, "Path must name a folder", http.StatusBadRequest)
+            return
+        }
+        req.ParentID = folderID
+    } else {
+        folder, err := services.CreateFolder(database.DB, user, req.ParentID, req.Name)
+        if err != nil {
+            folderError(w, err)
+            return
+        }
+        req.ParentID = &folder.ID
+    }
+
+    folder, err := services.GetFolder(database.DB, user, *req.ParentID)
+    if err != nil {
+        folderError(w, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(folder)
+}
+
+// UpdateFolder renames ({"name"}) and/or moves ({"parent_id"}, null for the root) a folder
+func UpdateFolder(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        http.Error(w, "Folder not found", http.StatusNotFound)
+        return
+    }
+
+    var req struct {
+        Name     *string         `json:"name"`
+        ParentID json.RawMessage `json:"parent_id"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+    move, parentID, err := parseParentField(req.ParentID)
+    if err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    folder, err := services.UpdateFolder(user, id, req.Name, move, parentID)
+    if err != nil {
+        folderError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(folder)
+}
+
+// DeleteFolder deletes a folder and everything inside it
+func DeleteFolder(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        http.Error(w, "Folder not found", http.StatusNotFound)
+        return
+    }
+
+    if err := services.DeleteFolder(user, id); err != nil {
+        folderError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateFile renames ({"filename"}) and/or moves ({"folder_id"}, null for the root) a file
+func UpdateFile(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return
+    }
+
+    var req struct {
+        Filename *string         `json:"filename"`
+        FolderID json.RawMessage `json:"folder_id"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+    move, folderID, err := parseParentField(req.FolderID)
+    if err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    if err := services.UpdateFile(user, id, req.Filename, move, folderID); err != nil {
+        folderError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
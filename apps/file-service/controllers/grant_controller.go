@@ -0,0 +1,149 @@
+package controllers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+
+    "file-service/database"
+    "file-service/middleware"
+    "file-service/models"
+    "file-service/services"
+)
+
+// authorizeFile loads the file named in the route and checks the logged-in user
+// has at least the need access level to it, as owner or through a grant.
+// It writes the error response itself and returns ok=false on failure.
+func authorizeFile(w http.ResponseWriter, r *http.Request, need services.Access) (models.File, bool) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return models.File{}, false
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return models.File{}, false
+    }
+
+    f, access, err := services.FileAccess(database.DB, user, id)
+    if err == sql.ErrNoRows {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return f, false
+    }
+    if err != nil {
+        dbError(w, err)
+        return f, false
+    }
+    // Files the user cannot see are reported missing, so ids do not reveal
+    // which files exist
+    if access == services.AccessNone {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return f, false
+    }
+    if access < need {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return f, false
+    }
+    return f, true
+}
+
+// ListFileGrants lists who the file is shared with. Only the owner may see this.
+func ListFileGrants(w http.ResponseWriter, r *http.Request) {
+    f, ok := authorizeFile(w, r, services.AccessOwner)
+    if !ok {
+        return
+    }
+
+    grants, err := services.ListGrants(f.ID)
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(grants)
+}
+
+// GrantFileAccess shares the file with {"username", "permission"}, where
+// permission is viewer, downloader or editor. Granting again changes the level.
+func GrantFileAccess(w http.ResponseWriter, r *http.Request) {
+    f, ok := authorizeFile(w, r, services.AccessOwner)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Username   string `json:"username"`
+        Permission string `json:"permission"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    grant, err := services.GrantAccess(f.ID, f.Uploader, req.Username, req.Permission)
+    if errors.Is(err, services.ErrInvalidPermission) || errors.Is(err, services.ErrInvalidGrantee) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if errors.Is(err, services.ErrUnknownGrantee) {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(grant)
+}
+
+// RevokeFileAccess stops sharing the file with a user. The owner can revoke any
+// grant; a grantee can remove their own to leave the share.
+func RevokeFileAccess(w http.ResponseWriter, r *http.Request) {
+    f, ok := authorizeFile(w, r, services.AccessViewer)
+    if !ok {
+        return
+    }
+    user, _ := r.Context().Value(middleware.UsernameKey).(string)
+    grantee := mux.Vars(r)["username"]
+    if f.Uploader != user && grantee != user {
+        http.Error(w, "Forbidden", http.StatusForbidden)
+        return
+    }
+
+    err := services.RevokeGrant(f.ID, grantee)
+    if errors.Is(err, services.ErrGrantNotFound) {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSharedWithMe lists files other users have shared with the logged-in user
+func ListSharedWithMe(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    files, err := services.ListSharedWithMe(user)
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(files)
+}
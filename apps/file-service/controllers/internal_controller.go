@@ -0,0 +1,53 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+
+    "github.com/gorilla/mux"
+    "file-service/services"
+)
+
+// InternalDeleteUser releases everything a deleted account owned: files and
+// their blob references, share links, grants, folders, quota and unfinished
+// uploads. Called by the auth service when a user deletes their account.
+func InternalDeleteUser(w http.ResponseWriter, r *http.Request) {
+    username := mux.Vars(r)["username"]
+
+    if err := deleteTusUploads("uploader = $1", username); err != nil {
+        http.Error(w, "DB error deleting uploads", http.StatusInternalServerError)
+        return
+    }
+    deleted, err := services.DeleteUserData(username)
+    if err != nil {
+        http.Error(w, "DB error deleting files", http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]int{"deleted_files": deleted})
+}
+
+// InternalRenameUser moves a user's data to {"new_username"} after a username
+// change in the auth service
+func InternalRenameUser(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        NewUsername string `json:"new_username"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.NewUsername == "" {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    err := services.RenameUser(mux.Vars(r)["username"], req.NewUsername)
+    if errors.Is(err, services.ErrUsernameInUse) {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    }
+    if err != nil {
+        http.Error(w, "DB error", http.StatusInternalServerError)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,419 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/url"
+    "slices"
+    "strconv"
+    "strings"
+
+    "github.com/gorilla/mux"
+
+    "file-service/config"
+    "file-service/middleware"
+    "file-service/models"
+    "file-service/services"
+)
+
+// Git LFS server (https://github.com/git-lfs/git-lfs/tree/main/docs/api) for
+// repositories at /lfs/<owner>/<repo>: the batch API with the basic transfer
+// adapter, and file locking. Objects live in the blob store under their
+// SHA-256, the same key LFS uses as the oid, so they share storage with
+// identical files and with other repositories. Point git at it with
+// `git config lfs.url <PUBLIC_BASE_URL>/lfs/<owner>/<repo>`.
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+// lfsMaxBatch caps the objects in one batch request
+const lfsMaxBatch = 1000
+
+// lfsRepo reads the repository from the route. Only its owner may use it;
+// anyone else is told it does not exist.
+func lfsRepo(w http.ResponseWriter, r *http.Request) (user, repo string, ok bool) {
+    user, _ = r.Context().Value(middleware.UsernameKey).(string)
+    vars := mux.Vars(r)
+    if user == "" || vars["owner"] != user {
+        lfsError(w, http.StatusNotFound, "Repository not found")
+        return "", "", false
+    }
+    return user, strings.TrimSuffix(vars["repo"], ".git"), true
+}
+
+func lfsError(w http.ResponseWriter, status int, message string) {
+    lfsWriteJSON(w, status, map[string]string{"message": message})
+}
+
+func lfsWriteJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", lfsMediaType)
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+// lfsObjectURL is the href the client uploads to or downloads from
+func lfsObjectURL(user, repo, oid string) string {
+    base := strings.TrimRight(config.GetEnvDefault("PUBLIC_BASE_URL", "http://localhost:8001"), "/")
+    return base + "/lfs/" + url.PathEscape(user) + "/" + url.PathEscape(repo) + "/objects/" + oid
+}
+
+// lfsAction carries no credentials: without "authenticated" the client signs
+// each transfer itself, so tokens are not copied into batch responses
+type lfsAction struct {
+    Href string `json:"href"`
+}
+
+type lfsObjectError struct {
+    Code    int    `json:"code"`
+    Message string `json:"message"`
+}
+
+type lfsBatchObject struct {
+    OID     string               `json:"oid"`
+    Size    int64                `json:"size"`
+    Actions map[string]lfsAction `json:"actions,omitempty"`
+    Error   *lfsObjectError      `json:"error,omitempty"`
+}
+
+// LFSBatch answers a batch request with, per object, where to upload or
+// download it. Uploads the repository already has, or that the user holds
+// elsewhere and can be linked, need no action.
+func LFSBatch(w http.ResponseWriter, r *http.Request) {
+    user, repo, ok := lfsRepo(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Operation string           `json:"operation"`
+        Transfers []string         `json:"transfers"`
+        Objects   []lfsBatchObject `json:"objects"`
+        HashAlgo  string           `json:"hash_algo"`
+    }
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+        lfsError(w, http.StatusUnprocessableEntity, "Malformed batch request")
+        return
+    }
+    if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+        lfsError(w, http.StatusConflict, "Unsupported hash algorithm: "+req.HashAlgo)
+        return
+    }
+    if len(req.Transfers) > 0 && !slices.Contains(req.Transfers, "basic") {
+        lfsError(w, http.StatusUnprocessableEntity, "Only the basic transfer adapter is supported")
+        return
+    }
+    if len(req.Objects) > lfsMaxBatch {
+        lfsError(w, http.StatusRequestEntityTooLarge, "Too many objects in one batch")
+        return
+    }
+    switch req.Operation {
+    case "download":
+    case "upload":
+        if !middleware.HasScope(r, middleware.ScopeFilesWrite) {
+            lfsError(w, http.StatusForbidden, "Token is missing the "+middleware.ScopeFilesWrite+" scope")
+            return
+        }
+    default:
+        lfsError(w, http.StatusUnprocessableEntity, "Operation must be upload or download")
+        return
+    }
+
+    objects := make([]lfsBatchObject, 0, len(req.Objects))
+    for _, o := range req.Objects {
+        res, err := lfsBatchEntry(user, repo, req.Operation, o)
+        if err != nil {
+            lfsError(w, http.StatusInternalServerError, "DB error")
+            return
+        }
+        objects = append(objects, res)
+    }
+
+    lfsWriteJSON(w, http.StatusOK, map[string]interface{}{
+        "transfer":  "basic",
+        "objects":   objects,
+        "hash_algo": "sha256",
+    })
+}
+
+// lfsBatchEntry works out the batch response for one object. Problems with
+// the object itself are reported in its error field; err is for server faults.
+func lfsBatchEntry(user, repo, operation string, o lfsBatchObject) (lfsBatchObject, error) {
+    res := lfsBatchObject{OID: o.OID, Size: o.Size}
+    if !services.ValidLFSOID(o.OID) || o.Size < 0 {
+        res.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: "Invalid object"}
+        return res, nil
+    }
+    href := lfsObjectURL(user, repo, o.OID)
+
+    if operation == "download" {
+        obj, err := services.GetLFSObject(user, repo, o.OID)
+        if errors.Is(err, services.ErrLFSObjectNotFound) {
+            res.Error = &lfsObjectError{Code: http.StatusNotFound, Message: err.Error()}
+            return res, nil
+        }
+        if err != nil {
+            return res, err
+        }
+        res.Size = obj.Size
+        res.Actions = map[string]lfsAction{"download": {Href: href}}
+        return res, nil
+    }
+
+    linked, err := services.LinkLFSObject(user, repo, o.OID, o.Size)
+    if errors.Is(err, services.ErrQuotaExceeded) || errors.Is(err, services.ErrFileTooLarge) {
+        res.Error = &lfsObjectError{Code: http.StatusInsufficientStorage, Message: err.Error()}
+        return res, nil
+    }
+    if err != nil || linked {
+        return res, err
+    }
+    res.Actions = map[string]lfsAction{
+        "upload": {Href: href},
+        "verify": {Href: href + "/verify"},
+    }
+    return res, nil
+}
+
+// LFSUpload receives an object's content for the basic transfer adapter. The
+// content must hash to the oid in the URL.
+func LFSUpload(w http.ResponseWriter, r *http.Request) {
+    user, repo, ok := lfsRepo(w, r)
+    if !ok {
+        return
+    }
+    oid := mux.Vars(r)["oid"]
+
+    blob, err := services.StageBlob(http.MaxBytesReader(w, r.Body, config.GetEnvInt64("MAX_UPLOAD_SIZE", 2<<30)))
+    if err != nil {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            lfsError(w, http.StatusRequestEntityTooLarge, "Object is too large")
+            return
+        }
+        lfsError(w, http.StatusBadRequest, "Failed to read object")
+        return
+    }
+    defer blob.Discard()
+
+    if blob.Hash != oid {
+        lfsError(w, http.StatusUnprocessableEntity, "Content does not match the object id")
+        return
+    }
+
+    _, err = services.StoreLFSObject(user, repo, blob)
+    if errors.Is(err, services.ErrQuotaExceeded) || errors.Is(err, services.ErrFileTooLarge) {
+        lfsError(w, http.StatusInsufficientStorage, err.Error())
+        return
+    }
+    if err != nil {
+        lfsError(w, http.StatusInternalServerError, "Failed to store object")
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+}
+
+// LFSDownload serves an object's content
+func LFSDownload(w http.ResponseWriter, r *http.Request) {
+    user, repo, ok := lfsRepo(w, r)
+    if !ok {
+        return
+    }
+
+    obj, err := services.GetLFSObject(user, repo, mux.Vars(r)["oid"])
+    if errors.Is(err, services.ErrLFSObjectNotFound) {
+        lfsError(w, http.StatusNotFound, err.Error())
+        return
+    }
+    if err != nil {
+        lfsError(w, http.StatusInternalServerError, "DB error")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    serveBlob(w, r, obj.OID, obj.OID)
+}
+
+// LFSDelete removes an object from the repository and credits its size back.
+// It is not part of the LFS API; git-lfs never calls it, but scripts pruning
+// old objects can.
+func LFSDelete(w http.ResponseWriter, r *http.Request) {
+    user, repo, ok := lfsRepo(w, r)
+    if !ok {
+        return
+    }
+
+    err := services.DeleteLFSObject(user, repo, mux.Vars(r)["oid"])
+    if errors.Is(err, services.ErrLFSObjectNotFound) {
+        lfsError(w, http.StatusNotFound, err.Error())
+        return
+    }
+    if err != nil {
+        lfsError(w, http.StatusInternalServerError, "DB error")
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// LFSVerify confirms after an upload that the object arrived with {"oid", "size"}
+func LFSVerify(w http.ResponseWriter, r *http.Request) {
+    user, repo, ok := lfsRepo(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        OID  string `json:"oid"`
+        Size int64  `json:"size"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.OID != mux.Vars(r)["oid"] {
+        lfsError(w, http.StatusUnprocessableEntity, "Malformed verify request")
+        return
+    }
+
+    obj, err := services.GetLFSObject(user, repo, req.OID)
+    if errors.Is(err, services.ErrLFSObjectNotFound) {
+        lfsError(w, http.StatusNotFound, err.Error())
+        return
+    }
+    if err != nil {
+        lfsError(w, http.StatusInternalServerError, "DB error")
+        return
+    }
+    if obj.Size != req.Size {
+        lfsError(w, http.StatusUnprocessableEntity, "Object size does not match")
+        return
+    }
+    lfsWriteJSON(w, http.StatusOK, map[string]string{"message": "ok"})
+}
+
+// lfsLockLimit reads a page size, defaulting to 100 and capped at 1000
+func lfsLockLimit(limit int) int {
+    if limit <= 0 {
+        return 100
+    }
+    if limit > 1000 {
+        return 1000
+    }
+    return limit
+}
+
+func lfsCursor(next int) string {
+    if next == 0 {
+        return ""
+    }
+    return strconv.Itoa(next)
+}
+
+// LFSCreateLock locks {"path"} for the user
+func LFSCreateLock(w http.ResponseWriter, r *http.Request) {
+    user, repo, ok := lfsRepo(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Path string `json:"path"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+        lfsError(w, http.StatusUnprocessableEntity, "A path is required")
+        return
+    }
+
+    lock, err := services.CreateLFSLock(user, repo, req.Path, user)
+    if errors.Is(err, services.ErrLFSLockExists) {
+        lfsWriteJSON(w, http.StatusConflict, map[string]interface{}{"lock": lock, "message": err.Error()})
+        return
+    }
+    if err != nil {
+        lfsError(w, http.StatusInternalServerError, "DB error")
+        return
+    }
+    lfsWriteJSON(w, http.StatusCreated, map[string]interface{}{"lock": lock})
+}
+
+// LFSListLocks lists locks, optionally by ?path= or ?id=, paged with ?cursor= and ?limit=
+func LFSListLocks(w http.ResponseWriter, r *http.Request) {
+    user, repo, ok := lfsRepo(w, r)
+    if !ok {
+        return
+    }
+
+    q := r.URL.Query()
+    filter := services.LFSLockFilter{Path: q.Get("path")}
+    filter.ID, _ = strconv.Atoi(q.Get("id"))
+    filter.Cursor, _ = strconv.Atoi(q.Get("cursor"))
+    limit, _ := strconv.Atoi(q.Get("limit"))
+    filter.Limit = lfsLockLimit(limit)
+
+    locks, next, err := services.ListLFSLocks(user, repo, filter)
+    if err != nil {
+        lfsError(w, http.StatusInternalServerError, "DB error")
+        return
+    }
+    lfsWriteJSON(w, http.StatusOK, map[string]interface{}{"locks": locks, "next_cursor": lfsCursor(next)})
+}
+
+// LFSVerifyLocks splits the repository's locks into the user's own and
+// everyone else's, which git-lfs checks before a push
+func LFSVerifyLocks(w http.ResponseWriter, r *http.Request) {
+    user, repo, ok := lfsRepo(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Cursor string `json:"cursor"`
+        Limit  int    `json:"limit"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        lfsError(w, http.StatusUnprocessableEntity, "Malformed request")
+        return
+    }
+    filter := services.LFSLockFilter{Limit: lfsLockLimit(req.Limit)}
+    filter.Cursor, _ = strconv.Atoi(req.Cursor)
+
+    locks, next, err := services.ListLFSLocks(user, repo, filter)
+    if err != nil {
+        lfsError(w, http.StatusInternalServerError, "DB error")
+        return
+    }
+    ours, theirs := []models.LFSLock{}, []models.LFSLock{}
+    for _, l := range locks {
+        if l.LockedBy.Name == user {
+            ours = append(ours, l)
+        } else {
+            theirs = append(theirs, l)
+        }
+    }
+    lfsWriteJSON(w, http.StatusOK, map[string]interface{}{"ours": ours, "theirs": theirs, "next_cursor": lfsCursor(next)})
+}
+
+// LFSUnlock releases a lock; {"force": true} releases one held by someone else
+func LFSUnlock(w http.ResponseWriter, r *http.Request) {
+    user, repo, ok := lfsRepo(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Force bool `json:"force"`
+    }
+    json.NewDecoder(r.Body).Decode(&req)
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        lfsError(w, http.StatusNotFound, services.ErrLFSLockNotFound.Error())
+        return
+    }
+
+    lock, err := services.UnlockLFS(user, repo, id, user, req.Force)
+    switch {
+    case errors.Is(err, services.ErrLFSLockNotFound):
+        lfsError(w, http.StatusNotFound, err.Error())
+    case errors.Is(err, services.ErrLFSLockNotOwned):
+        lfsError(w, http.StatusForbidden, err.Error())
+    case err != nil:
+        lfsError(w, http.StatusInternalServerError, "DB error")
+    default:
+        lfsWriteJSON(w, http.StatusOK, map[string]interface{}{"lock": lock})
+    }
+}
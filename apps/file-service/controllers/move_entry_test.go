@@ -0,0 +1,53 @@
+package controllers
+
+import (
+    "testing"
+
+    "file-service/database"
+    "file-service/services"
+)
+
+// Replacing a destination on MOVE (WebDAV) or rename (SFTP) happens in the
+// same transaction as the move, so a move that fails leaves it alone
+func TestMoveEntryReplacesAtomically(t *testing.T) {
+    setupTestDB(t)
+    content, _ := randomContent(t)
+    inner, err := uploadTo("alice", "/upload?path=/a/b", "x.txt", content)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lookup := func(p string) services.PathEntry {
+        t.Helper()
+        e, err := services.LookupPath(database.DB, "alice", p)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return e
+    }
+
+    // Replacing /a would take the source with it, so the move fails and /a stays
+    if err := services.MoveEntry("alice", lookup("/a/b/x.txt"), lookup("/a"), true); err == nil {
+        t.Fatal("moving a file over its own ancestor succeeded")
+    }
+    if e := lookup("/a/b/x.txt"); e.File == nil || e.File.ID != inner.ID {
+        t.Fatalf("/a/b/x.txt after the failed move: %+v", e)
+    }
+
+    outer, err := uploadAs("alice", "y.txt", content)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := services.MoveEntry("alice", lookup("/y.txt"), lookup("/a/b/x.txt"), true); err != nil {
+        t.Fatal(err)
+    }
+    if e := lookup("/a/b/x.txt"); e.File == nil || e.File.ID != outer.ID {
+        t.Fatalf("/a/b/x.txt after replacing it: %+v", e)
+    }
+    var trashed bool
+    if err := database.DB.QueryRow("SELECT trashed_at IS NOT NULL FROM user_files WHERE id = $1", inner.ID).Scan(&trashed); err != nil {
+        t.Fatal(err)
+    }
+    if !trashed {
+        t.Error("the replaced file was not moved to the trash")
+    }
+}
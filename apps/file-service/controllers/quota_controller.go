@@ -0,0 +1,71 @@
+package controllers
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "github.com/gorilla/mux"
+
+    "file-service/middleware"
+    "file-service/services"
+)
+
+// GetMyUsage reports the logged-in user's storage usage, quota and dedup savings
+func GetMyUsage(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    usage, err := services.GetUsage(user)
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(usage)
+}
+
+// AdminGetUserUsage reports any user's usage. Only accessible by users with "admin" role.
+func AdminGetUserUsage(w http.ResponseWriter, r *http.Request) {
+    usage, err := services.GetUsage(mux.Vars(r)["username"])
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(usage)
+}
+
+// AdminSetQuota overrides a user's quota; {"quota_bytes": null} restores the default.
+// Only accessible by users with "admin" role.
+func AdminSetQuota(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        QuotaBytes *int64 `json:"quota_bytes"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+    if req.QuotaBytes != nil && *req.QuotaBytes < 0 {
+        http.Error(w, "quota_bytes must not be negative", http.StatusBadRequest)
+        return
+    }
+
+    username := mux.Vars(r)["username"]
+    if err := services.SetQuota(username, req.QuotaBytes); err != nil {
+        dbError(w, err)
+        return
+    }
+
+    usage, err := services.GetUsage(username)
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,787 @@
+package controllers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/middleware"
+    "file-service/models"
+    "file-service/services"
+    "file-service/storage"
+    "file-service/utils"
+)
+
+// OCI distribution registry (https://github.com/opencontainers/distribution-spec)
+// at /v2/. Repositories are named <username>/<repo> and only their owner can
+// pull or push. Blobs and manifests go into the content-addressed store under
+// their sha256 digest, so layers shared between images, repositories and
+// plain files are stored once. Chunked blob uploads are staged on local disk
+// like tus uploads until the final PUT.
+
+const RegistryPrefix = "/v2/"
+
+// ociMaxManifestSize is the largest manifest accepted, as the spec recommends
+const ociMaxManifestSize = 4 << 20
+
+// ociMaxTags caps one page of the tag list
+const ociMaxTags = 1000
+
+var (
+    ociNameComponent = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*$`)
+    ociTagPattern    = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+    ociDigestPattern = regexp.MustCompile(`^sha256:([0-9a-f]{64})$`)
+)
+
+// ociUploadLocks serialises PATCH/PUT/DELETE on the same blob upload
+var ociUploadLocks sync.Map
+
+func ociUploadExpiry() time.Duration {
+    return config.GetEnvDuration("OCI_UPLOAD_EXPIRY", 24*time.Hour)
+}
+
+func ociMaxBlobSize() int64 {
+    return config.GetEnvInt64("OCI_MAX_BLOB_SIZE", 10<<30) // 10GB
+}
+
+// ociMaxOpenUploads is how many blob upload sessions one user may have open
+func ociMaxOpenUploads() int64 {
+    return config.GetEnvInt64("OCI_MAX_OPEN_UPLOADS", 100)
+}
+
+// lockOCIUpload loads the upload session like loadOCIUpload and locks it. The
+// session is looked up before taking a lock so ids from the URL cannot grow
+// ociUploadLocks, and again after in case it finished in the meantime.
+func lockOCIUpload(w http.ResponseWriter, r *http.Request, user, repo, id string) (models.OCIUpload, func(), bool) {
+    if _, ok := loadOCIUpload(w, r, user, repo, id); !ok {
+        return models.OCIUpload{}, nil, false
+    }
+    m, _ := ociUploadLocks.LoadOrStore(id, &sync.Mutex{})
+    mu := m.(*sync.Mutex)
+    mu.Lock()
+
+    upload, ok := loadOCIUpload(w, r, user, repo, id)
+    if !ok {
+        mu.Unlock()
+        ociUploadLocks.Delete(id)
+        return upload, nil, false
+    }
+    return upload, mu.Unlock, true
+}
+
+// ociError writes the spec's error body: {"errors": [{"code", "message"}]}
+func ociError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+    if r.Method == http.MethodHead {
+        w.WriteHeader(status)
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "errors": []map[string]string{{"code": code, "message": message}},
+    })
+}
+
+// ociStoreError maps errors from storing content to registry errors
+func ociStoreError(w http.ResponseWriter, r *http.Request, err error) {
+    switch {
+    case errors.Is(err, services.ErrOCIManifestBlobUnknown):
+        ociError(w, r, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", err.Error())
+    case errors.Is(err, services.ErrFileTooLarge):
+        ociError(w, r, http.StatusRequestEntityTooLarge, "SIZE_INVALID", err.Error())
+    case errors.Is(err, services.ErrQuotaExceeded):
+        ociError(w, r, http.StatusInsufficientStorage, "DENIED", err.Error())
+    default:
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+    }
+}
+
+// ociDigest returns the hex content hash of a "sha256:<hex>" digest
+func ociDigest(digest string) (string, bool) {
+    m := ociDigestPattern.FindStringSubmatch(digest)
+    if m == nil {
+        return "", false
+    }
+    return m[1], true
+}
+
+// ociRepoName splits <owner>/<repo> and checks the repo part against the
+// spec's name grammar
+func ociRepoName(name string) (owner, repo string, ok bool) {
+    owner, repo, ok = strings.Cut(name, "/")
+    if !ok || owner == "" || len(name) > 255 {
+        return "", "", false
+    }
+    for _, c := range strings.Split(repo, "/") {
+        if !ociNameComponent.MatchString(c) {
+            return "", "", false
+        }
+    }
+    return owner, repo, true
+}
+
+// Registry serves the distribution API. The repository name can contain
+// slashes, so the path is split on the last /blobs/, /manifests/ or
+// /tags/list rather than routed.
+func Registry(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        ociError(w, r, http.StatusUnauthorized, "UNAUTHORIZED", "Authentication required")
+        return
+    }
+
+    path := strings.TrimPrefix(r.URL.Path, RegistryPrefix)
+    if path == "" {
+        // API version check
+        w.Header().Set("Content-Type", "application/json")
+        w.Write([]byte("{}"))
+        return
+    }
+
+    scope := middleware.ScopeFilesWrite
+    if r.Method == http.MethodGet || r.Method == http.MethodHead {
+        scope = middleware.ScopeFilesRead
+    }
+    if !middleware.HasScope(r, scope) {
+        ociError(w, r, http.StatusForbidden, "DENIED", "Token is missing the "+scope+" scope")
+        return
+    }
+
+    var name, kind, ref string
+    switch {
+    case strings.HasSuffix(path, "/tags/list"):
+        name, kind = strings.TrimSuffix(path, "/tags/list"), "tags"
+    case strings.Contains(path, "/manifests/"):
+        i := strings.LastIndex(path, "/manifests/")
+        name, kind, ref = path[:i], "manifests", path[i+len("/manifests/"):]
+    case strings.Contains(path, "/blobs/uploads"):
+        i := strings.LastIndex(path, "/blobs/uploads")
+        name, kind, ref = path[:i], "uploads", strings.TrimPrefix(path[i+len("/blobs/uploads"):], "/")
+    case strings.Contains(path, "/blobs/"):
+        i := strings.LastIndex(path, "/blobs/")
+        name, kind, ref = path[:i], "blobs", path[i+len("/blobs/"):]
+    default:
+        ociError(w, r, http.StatusNotFound, "NAME_UNKNOWN", "Unknown endpoint")
+        return
+    }
+
+    owner, repo, ok := ociRepoName(name)
+    if !ok {
+        ociError(w, r, http.StatusBadRequest, "NAME_INVALID", "Invalid repository name")
+        return
+    }
+    if owner != user {
+        ociError(w, r, http.StatusForbidden, "DENIED", "Repositories can only be used under your own namespace, "+user+"/")
+        return
+    }
+
+    switch {
+    case kind == "tags" && r.Method == http.MethodGet:
+        ociListTags(w, r, name, user, repo)
+    case kind == "manifests" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+        ociGetManifest(w, r, user, repo, ref)
+    case kind == "manifests" && r.Method == http.MethodPut:
+        ociPutManifest(w, r, name, user, repo, ref)
+    case kind == "manifests" && r.Method == http.MethodDelete:
+        ociDeleteManifest(w, r, user, repo, ref)
+    case kind == "blobs" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+        ociGetBlob(w, r, user, repo, ref)
+    case kind == "blobs" && r.Method == http.MethodDelete:
+        ociDeleteBlob(w, r, user, repo, ref)
+    case kind == "uploads" && ref == "" && r.Method == http.MethodPost:
+        ociStartUpload(w, r, name, user, repo)
+    case kind == "uploads" && ref != "" && r.Method == http.MethodGet:
+        ociUploadStatus(w, r, name, user, repo, ref)
+    case kind == "uploads" && ref != "" && r.Method == http.MethodPatch:
+        ociPatchUpload(w, r, name, user, repo, ref)
+    case kind == "uploads" && ref != "" && r.Method == http.MethodPut:
+        ociFinishUpload(w, r, name, user, repo, ref)
+    case kind == "uploads" && ref != "" && r.Method == http.MethodDelete:
+        ociCancelUpload(w, r, user, repo, ref)
+    default:
+        ociError(w, r, http.StatusMethodNotAllowed, "UNSUPPORTED", "The operation is unsupported")
+    }
+}
+
+func ociBlobCreated(w http.ResponseWriter, name, contentHash string) {
+    w.Header().Set("Location", RegistryPrefix+name+"/blobs/sha256:"+contentHash)
+    w.Header().Set("Docker-Content-Digest", "sha256:"+contentHash)
+    w.WriteHeader(http.StatusCreated)
+}
+
+func ociGetBlob(w http.ResponseWriter, r *http.Request, user, repo, digest string) {
+    hash, ok := ociDigest(digest)
+    if !ok {
+        ociError(w, r, http.StatusBadRequest, "DIGEST_INVALID", "Only sha256 digests are supported")
+        return
+    }
+    blob, err := services.GetOCIBlob(user, repo, hash)
+    if errors.Is(err, services.ErrOCIBlobUnknown) {
+        ociError(w, r, http.StatusNotFound, "BLOB_UNKNOWN", err.Error())
+        return
+    }
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return
+    }
+
+    w.Header().Set("Docker-Content-Digest", digest)
+    w.Header().Set("Content-Type", "application/octet-stream")
+    serveBlob(w, r, digest, blob.ContentHash)
+}
+
+func ociDeleteBlob(w http.ResponseWriter, r *http.Request, user, repo, digest string) {
+    hash, ok := ociDigest(digest)
+    if !ok {
+        ociError(w, r, http.StatusBadRequest, "DIGEST_INVALID", "Only sha256 digests are supported")
+        return
+    }
+    err := services.DeleteOCIBlob(user, repo, hash)
+    if errors.Is(err, services.ErrOCIBlobUnknown) {
+        ociError(w, r, http.StatusNotFound, "BLOB_UNKNOWN", err.Error())
+        return
+    }
+    if errors.Is(err, services.ErrOCIBlobReferenced) {
+        ociError(w, r, http.StatusConflict, "DENIED", err.Error())
+        return
+    }
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return
+    }
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// ociStartUpload begins a blob upload. ?mount=&from= links a blob from
+// another of the user's repositories, ?digest= takes the whole blob in this
+// request, and otherwise an upload session is opened for PATCH and PUT.
+func ociStartUpload(w http.ResponseWriter, r *http.Request, name, user, repo string) {
+    q := r.URL.Query()
+
+    if mount := q.Get("mount"); mount != "" {
+        hash, ok := ociDigest(mount)
+        if !ok {
+            ociError(w, r, http.StatusBadRequest, "DIGEST_INVALID", "Only sha256 digests are supported")
+            return
+        }
+        // Mounting from another namespace just falls back to an upload
+        if fromOwner, fromRepo, ok := ociRepoName(q.Get("from")); ok && fromOwner == user {
+            _, mounted, err := services.MountOCIBlob(user, repo, fromRepo, hash)
+            if err != nil {
+                ociStoreError(w, r, err)
+                return
+            }
+            if mounted {
+                ociBlobCreated(w, name, hash)
+                return
+            }
+        }
+    } else if digest := q.Get("digest"); digest != "" {
+        hash, ok := ociDigest(digest)
+        if !ok {
+            ociError(w, r, http.StatusBadRequest, "DIGEST_INVALID", "Only sha256 digests are supported")
+            return
+        }
+        if r.ContentLength > 0 {
+            if err := services.CheckQuota(user, r.ContentLength); err != nil {
+                ociStoreError(w, r, err)
+                return
+            }
+        }
+        blob, err := services.StageBlob(http.MaxBytesReader(w, r.Body, ociMaxBlobSize()))
+        if err != nil {
+            ociReadError(w, r, err)
+            return
+        }
+        defer blob.Discard()
+        if blob.Hash != hash {
+            ociError(w, r, http.StatusBadRequest, "DIGEST_INVALID", "Content does not match the digest")
+            return
+        }
+        if _, err := services.StoreOCIBlob(user, repo, blob); err != nil {
+            ociStoreError(w, r, err)
+            return
+        }
+        ociBlobCreated(w, name, hash)
+        return
+    }
+
+    upload := models.OCIUpload{
+        ID:        utils.GenerateRandomString(32),
+        Owner:     user,
+        Repo:      repo,
+        ExpiresAt: time.Now().Add(ociUploadExpiry()),
+    }
+    if err := os.MkdirAll(services.OCIUploadPath(), os.ModePerm); err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "Could not create upload")
+        return
+    }
+    f, err := os.Create(filepath.Join(services.OCIUploadPath(), upload.ID))
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "Could not create upload")
+        return
+    }
+    f.Close()
+
+    res, err := database.DB.Exec(
+        `INSERT INTO oci_uploads (id, owner, repo, expires_at)
+         SELECT $1, $2, $3, $4
+         WHERE (SELECT COUNT(*) FROM oci_uploads WHERE owner = $2) < $5`,
+        upload.ID, upload.Owner, upload.Repo, upload.ExpiresAt, ociMaxOpenUploads(),
+    )
+    if err != nil {
+        os.Remove(filepath.Join(services.OCIUploadPath(), upload.ID))
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        os.Remove(filepath.Join(services.OCIUploadPath(), upload.ID))
+        ociError(w, r, http.StatusTooManyRequests, "TOOMANYREQUESTS", "Too many blob uploads in progress; finish or cancel some first")
+        return
+    }
+    ociUploadAccepted(w, name, upload)
+}
+
+// ociUploadAccepted reports an upload session's URL and how much of it has arrived
+func ociUploadAccepted(w http.ResponseWriter, name string, upload models.OCIUpload) {
+    w.Header().Set("Location", RegistryPrefix+name+"/blobs/uploads/"+upload.ID)
+    w.Header().Set("Docker-Upload-UUID", upload.ID)
+    w.Header().Set("Range", "0-"+strconv.FormatInt(max(upload.Size-1, 0), 10))
+    w.Header().Set("Content-Length", "0")
+    w.WriteHeader(http.StatusAccepted)
+}
+
+func ociReadError(w http.ResponseWriter, r *http.Request, err error) {
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        ociError(w, r, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "Blob is too large")
+        return
+    }
+    ociError(w, r, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", "Failed to read blob")
+}
+
+// loadOCIUpload fetches the upload session if it belongs to the repository,
+// answering BLOB_UPLOAD_UNKNOWN itself otherwise
+func loadOCIUpload(w http.ResponseWriter, r *http.Request, user, repo, id string) (models.OCIUpload, bool) {
+    var u models.OCIUpload
+    err := database.DB.QueryRow(
+        "SELECT id, owner, repo, size, created_at, expires_at FROM oci_uploads WHERE id = $1",
+        id,
+    ).Scan(&u.ID, &u.Owner, &u.Repo, &u.Size, &u.CreatedAt, &u.ExpiresAt)
+    if err == sql.ErrNoRows || (err == nil && (u.Owner != user || u.Repo != repo || time.Now().After(u.ExpiresAt))) {
+        ociError(w, r, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "Blob upload unknown to registry")
+        return u, false
+    }
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return u, false
+    }
+    return u, true
+}
+
+func ociUploadStatus(w http.ResponseWriter, r *http.Request, name, user, repo, id string) {
+    upload, ok := loadOCIUpload(w, r, user, repo, id)
+    if !ok {
+        return
+    }
+    w.Header().Set("Location", RegistryPrefix+name+"/blobs/uploads/"+upload.ID)
+    w.Header().Set("Docker-Upload-UUID", upload.ID)
+    w.Header().Set("Range", "0-"+strconv.FormatInt(max(upload.Size-1, 0), 10))
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// ociStagedBytes is the size of all of user's open blob uploads
+func ociStagedBytes(user string) (int64, error) {
+    var staged int64
+    err := database.DB.QueryRow("SELECT COALESCE(SUM(size), 0) FROM oci_uploads WHERE owner = $1", user).Scan(&staged)
+    return staged, err
+}
+
+// ociAppend writes the request body to the end of the staged upload and
+// records the new size. With Content-Range the chunk must start where the
+// upload currently ends. Staged bytes count against the quota, so open
+// uploads cannot hold more than it; the charge happens when the blob is stored.
+func ociAppend(w http.ResponseWriter, r *http.Request, upload *models.OCIUpload) bool {
+    if cr := r.Header.Get("Content-Range"); cr != "" {
+        start, _, _ := strings.Cut(strings.TrimPrefix(cr, "bytes="), "-")
+        if n, err := strconv.ParseInt(start, 10, 64); err != nil || n != upload.Size {
+            w.Header().Set("Location", r.URL.Path)
+            w.Header().Set("Range", "0-"+strconv.FormatInt(max(upload.Size-1, 0), 10))
+            ociError(w, r, http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "Chunk does not start at the end of the upload")
+            return false
+        }
+    }
+    staged, err := ociStagedBytes(upload.Owner)
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return false
+    }
+    if r.ContentLength > 0 {
+        if err := services.CheckStagedQuota(upload.Owner, staged, r.ContentLength); err != nil {
+            ociStoreError(w, r, err)
+            return false
+        }
+    }
+
+    file, err := os.OpenFile(filepath.Join(services.OCIUploadPath(), upload.ID), os.O_WRONLY, 0)
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "Staging file missing")
+        return false
+    }
+    defer file.Close()
+
+    // Drop anything left over from an interrupted chunk before appending
+    if err := file.Truncate(upload.Size); err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "Could not write chunk")
+        return false
+    }
+    if _, err := file.Seek(upload.Size, io.SeekStart); err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "Could not write chunk")
+        return false
+    }
+    n, copyErr := io.Copy(file, http.MaxBytesReader(w, r.Body, ociMaxBlobSize()-upload.Size))
+
+    var tooLarge *http.MaxBytesError
+    if errors.As(copyErr, &tooLarge) {
+        file.Truncate(upload.Size)
+        ociError(w, r, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "Blob is too large")
+        return false
+    }
+    if err := services.CheckStagedQuota(upload.Owner, staged, n); err != nil {
+        file.Truncate(upload.Size)
+        ociStoreError(w, r, err)
+        return false
+    }
+
+    // Whatever arrived before a disconnect is kept; the client can check the Range
+    upload.Size += n
+    upload.ExpiresAt = time.Now().Add(ociUploadExpiry())
+    _, err = database.DB.Exec(
+        "UPDATE oci_uploads SET size = $1, expires_at = $2 WHERE id = $3",
+        upload.Size, upload.ExpiresAt, upload.ID,
+    )
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return false
+    }
+    if copyErr != nil {
+        ociError(w, r, http.StatusBadRequest, "BLOB_UPLOAD_INVALID", "Upload interrupted")
+        return false
+    }
+    return true
+}
+
+func ociPatchUpload(w http.ResponseWriter, r *http.Request, name, user, repo, id string) {
+    upload, unlock, ok := lockOCIUpload(w, r, user, repo, id)
+    if !ok {
+        return
+    }
+    defer unlock()
+    if !ociAppend(w, r, &upload) {
+        return
+    }
+    ociUploadAccepted(w, name, upload)
+}
+
+// ociFinishUpload takes the last chunk, if any, checks the whole blob against
+// ?digest= and stores it through the usual dedup path
+func ociFinishUpload(w http.ResponseWriter, r *http.Request, name, user, repo, id string) {
+    hash, ok := ociDigest(r.URL.Query().Get("digest"))
+    if !ok {
+        ociError(w, r, http.StatusBadRequest, "DIGEST_INVALID", "A sha256 digest is required")
+        return
+    }
+
+    upload, unlock, ok := lockOCIUpload(w, r, user, repo, id)
+    if !ok {
+        return
+    }
+    defer unlock()
+    if !ociAppend(w, r, &upload) {
+        return
+    }
+
+    blob, err := services.StageFile(filepath.Join(services.OCIUploadPath(), upload.ID))
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "Could not read upload")
+        return
+    }
+    if blob.Hash != hash {
+        ociError(w, r, http.StatusBadRequest, "DIGEST_INVALID", "Content does not match the digest")
+        return
+    }
+    if _, err := services.StoreOCIBlob(user, repo, blob); err != nil {
+        ociStoreError(w, r, err)
+        return
+    }
+
+    if err := deleteOCIUploads("id = $1", upload.ID); err != nil {
+        log.Println("failed to clean up blob upload", upload.ID+":", err)
+    }
+    ociBlobCreated(w, name, hash)
+}
+
+func ociCancelUpload(w http.ResponseWriter, r *http.Request, user, repo, id string) {
+    upload, unlock, ok := lockOCIUpload(w, r, user, repo, id)
+    if !ok {
+        return
+    }
+    defer unlock()
+    if err := deleteOCIUploads("id = $1", upload.ID); err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// ociDescriptor is the part of a content descriptor the registry checks
+type ociDescriptor struct {
+    MediaType string `json:"mediaType"`
+    Digest    string `json:"digest"`
+}
+
+// ociManifestReferences lists the blobs (config and layers) and child
+// manifests (for an index) a manifest points at, as content hashes
+func ociManifestReferences(body []byte) (mediaType string, blobs, manifests []string, err error) {
+    var m struct {
+        MediaType string          `json:"mediaType"`
+        Config    *ociDescriptor  `json:"config"`
+        Layers    []ociDescriptor `json:"layers"`
+        Manifests []ociDescriptor `json:"manifests"`
+    }
+    if err := json.Unmarshal(body, &m); err != nil {
+        return "", nil, nil, err
+    }
+
+    descriptors := m.Layers
+    if m.Config != nil {
+        descriptors = append(descriptors, *m.Config)
+    }
+    for _, d := range descriptors {
+        hash, ok := ociDigest(d.Digest)
+        if !ok {
+            return "", nil, nil, errors.New("invalid digest " + d.Digest)
+        }
+        blobs = append(blobs, hash)
+    }
+    for _, d := range m.Manifests {
+        hash, ok := ociDigest(d.Digest)
+        if !ok {
+            return "", nil, nil, errors.New("invalid digest " + d.Digest)
+        }
+        manifests = append(manifests, hash)
+    }
+    return m.MediaType, blobs, manifests, nil
+}
+
+// ociPutManifest stores a manifest by tag or by digest
+func ociPutManifest(w http.ResponseWriter, r *http.Request, name, user, repo, reference string) {
+    var tag string
+    wantHash, byDigest := ociDigest(reference)
+    if !byDigest {
+        if !ociTagPattern.MatchString(reference) {
+            ociError(w, r, http.StatusBadRequest, "TAG_INVALID", "Invalid tag")
+            return
+        }
+        tag = reference
+    }
+
+    blob, err := services.StageBlob(http.MaxBytesReader(w, r.Body, ociMaxManifestSize))
+    if err != nil {
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            ociError(w, r, http.StatusRequestEntityTooLarge, "SIZE_INVALID", "Manifest is too large")
+            return
+        }
+        ociError(w, r, http.StatusBadRequest, "MANIFEST_INVALID", "Failed to read manifest")
+        return
+    }
+    defer blob.Discard()
+    if byDigest && blob.Hash != wantHash {
+        ociError(w, r, http.StatusBadRequest, "DIGEST_INVALID", "Manifest does not match the digest")
+        return
+    }
+
+    body, err := os.ReadFile(blob.Path)
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "Could not read manifest")
+        return
+    }
+    mediaType, blobs, manifests, err := ociManifestReferences(body)
+    if err != nil {
+        ociError(w, r, http.StatusBadRequest, "MANIFEST_INVALID", "Invalid manifest: "+err.Error())
+        return
+    }
+    if ct := r.Header.Get("Content-Type"); ct != "" {
+        mediaType = ct
+    }
+    if mediaType == "" {
+        ociError(w, r, http.StatusBadRequest, "MANIFEST_INVALID", "The manifest media type is required")
+        return
+    }
+
+    if _, err := services.PutOCIManifest(user, repo, tag, mediaType, blob, blobs, manifests); err != nil {
+        ociStoreError(w, r, err)
+        return
+    }
+    w.Header().Set("Location", RegistryPrefix+name+"/manifests/sha256:"+blob.Hash)
+    w.Header().Set("Docker-Content-Digest", "sha256:"+blob.Hash)
+    w.WriteHeader(http.StatusCreated)
+}
+
+// ociResolveManifest finds the manifest a tag or digest refers to
+func ociResolveManifest(user, repo, reference string) (models.OCIManifest, error) {
+    hash, ok := ociDigest(reference)
+    if !ok {
+        var err error
+        if hash, err = services.ResolveOCITag(user, repo, reference); err != nil {
+            return models.OCIManifest{}, err
+        }
+    }
+    return services.GetOCIManifest(user, repo, hash)
+}
+
+func ociGetManifest(w http.ResponseWriter, r *http.Request, user, repo, reference string) {
+    manifest, err := ociResolveManifest(user, repo, reference)
+    if errors.Is(err, services.ErrOCIManifestUnknown) {
+        ociError(w, r, http.StatusNotFound, "MANIFEST_UNKNOWN", err.Error())
+        return
+    }
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return
+    }
+
+    obj, err := storage.Store.Get(manifest.ContentHash)
+    if err != nil {
+        ociError(w, r, http.StatusNotFound, "MANIFEST_UNKNOWN", "Manifest content not found")
+        return
+    }
+    defer obj.Close()
+
+    w.Header().Set("Content-Type", manifest.MediaType)
+    w.Header().Set("Docker-Content-Digest", "sha256:"+manifest.ContentHash)
+    w.Header().Set("ETag", `"sha256:`+manifest.ContentHash+`"`)
+    http.ServeContent(w, r, "", manifest.CreatedAt, obj)
+}
+
+// ociDeleteManifest deletes a manifest by digest, or just a tag
+func ociDeleteManifest(w http.ResponseWriter, r *http.Request, user, repo, reference string) {
+    var err error
+    if hash, ok := ociDigest(reference); ok {
+        err = services.DeleteOCIManifest(user, repo, hash)
+    } else {
+        err = services.DeleteOCITag(user, repo, reference)
+    }
+    if errors.Is(err, services.ErrOCIManifestUnknown) {
+        ociError(w, r, http.StatusNotFound, "MANIFEST_UNKNOWN", err.Error())
+        return
+    }
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return
+    }
+    w.WriteHeader(http.StatusAccepted)
+}
+
+// ociListTags lists tags, paged with ?n= and ?last=
+func ociListTags(w http.ResponseWriter, r *http.Request, name, user, repo string) {
+    exists, err := services.OCIRepositoryExists(user, repo)
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return
+    }
+    if !exists {
+        ociError(w, r, http.StatusNotFound, "NAME_UNKNOWN", "Repository name not known to registry")
+        return
+    }
+
+    q := r.URL.Query()
+    n := ociMaxTags
+    if v, err := strconv.Atoi(q.Get("n")); err == nil && v >= 0 && v < n {
+        n = v
+    }
+    tags, err := services.ListOCITags(user, repo, q.Get("last"), n)
+    if err != nil {
+        ociError(w, r, http.StatusInternalServerError, "UNKNOWN", "DB error")
+        return
+    }
+    if n > 0 && len(tags) == n {
+        next := url.Values{"n": {strconv.Itoa(n)}, "last": {tags[len(tags)-1]}}
+        w.Header().Set("Link", "<"+RegistryPrefix+name+"/tags/list?"+next.Encode()+`>; rel="next"`)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "tags": tags})
+}
+
+// PurgeExpiredOCIUploads removes abandoned blob uploads and their staged bytes
+func PurgeExpiredOCIUploads() error {
+    return deleteOCIUploads("expires_at < now()")
+}
+
+// deleteOCIUploads removes the blob uploads matching where, and their staged bytes
+func deleteOCIUploads(where string, args ...interface{}) error {
+    ids, err := services.DeleteOCIUploads(where, args...)
+    for _, id := range ids {
+        ociUploadLocks.Delete(id)
+    }
+    return err
+}
+
+// IndexOCIManifests records the blobs of manifests pushed before their
+// references were tracked, so DeleteOCIBlob keeps those blobs as well.
+// Manifests whose content cannot be read are logged and left for next time.
+func IndexOCIManifests() error {
+    manifests, err := services.UnindexedOCIManifests()
+    if err != nil {
+        return err
+    }
+    for _, m := range manifests {
+        obj, err := storage.Store.Get(m.ContentHash)
+        if err != nil {
+            log.Println("cannot index manifest", m.ContentHash+":", err)
+            continue
+        }
+        body, err := io.ReadAll(io.LimitReader(obj, ociMaxManifestSize))
+        obj.Close()
+        if err != nil {
+            log.Println("cannot index manifest", m.ContentHash+":", err)
+            continue
+        }
+        _, blobs, _, err := ociManifestReferences(body)
+        if err != nil {
+            log.Println("cannot index manifest", m.ContentHash+":", err)
+            continue
+        }
+        if err := services.IndexOCIManifest(m, blobs); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// StartOCIUploadCleanup runs PurgeExpiredOCIUploads every interval in the background
+func StartOCIUploadCleanup(interval time.Duration) {
+    go func() {
+        for range time.Tick(interval) {
+            if err := PurgeExpiredOCIUploads(); err != nil {
+                log.Println("registry upload cleanup failed:", err)
+            }
+        }
+    }()
+}
@@ -0,0 +1,158 @@
+package controllers
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "file-service/database"
+    "file-service/services"
+)
+
+// setupRegistry is setupTestDB plus a staging dir for blob uploads
+func setupRegistry(t *testing.T) {
+    t.Helper()
+    setupTestDB(t)
+    t.Setenv("OCI_UPLOAD_PATH", t.TempDir())
+}
+
+// ociDo sends an already authenticated request through Registry
+func ociDo(user, method, target, contentType string, body []byte) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, bytes.NewReader(body))
+    if contentType != "" {
+        r.Header.Set("Content-Type", contentType)
+    }
+    w := httptest.NewRecorder()
+    Registry(w, asUser(r, user))
+    return w
+}
+
+// ociErrorCode is the first error code of a registry error body
+func ociErrorCode(w *httptest.ResponseRecorder) string {
+    var body struct {
+        Errors []struct {
+            Code string `json:"code"`
+        } `json:"errors"`
+    }
+    json.Unmarshal(w.Body.Bytes(), &body)
+    if len(body.Errors) == 0 {
+        return ""
+    }
+    return body.Errors[0].Code
+}
+
+func ociDigestOf(content []byte) string {
+    sum := sha256.Sum256(content)
+    return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestOCIBlobReferencedByManifest(t *testing.T) {
+    setupRegistry(t)
+    const repo = "/v2/alice/app"
+    layer, _ := randomContent(t)
+    config := []byte(`{"architecture":"amd64","os":"linux"}`)
+
+    for _, blob := range [][]byte{layer, config} {
+        w := ociDo("alice", http.MethodPost, repo+"/blobs/uploads/?digest="+ociDigestOf(blob), "application/octet-stream", blob)
+        if w.Code != http.StatusCreated {
+            t.Fatalf("push blob: %d %s", w.Code, w.Body.String())
+        }
+    }
+    manifest := []byte(fmt.Sprintf(
+        `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":%q,"size":%d},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":%q,"size":%d}]}`,
+        ociDigestOf(config), len(config), ociDigestOf(layer), len(layer),
+    ))
+    if w := ociDo("alice", http.MethodPut, repo+"/manifests/v1", "application/vnd.oci.image.manifest.v1+json", manifest); w.Code != http.StatusCreated {
+        t.Fatalf("push manifest: %d %s", w.Code, w.Body.String())
+    }
+
+    for _, blob := range [][]byte{layer, config} {
+        w := ociDo("alice", http.MethodDelete, repo+"/blobs/"+ociDigestOf(blob), "", nil)
+        if w.Code != http.StatusConflict || ociErrorCode(w) != "DENIED" {
+            t.Fatalf("deleting a referenced blob: %d %s", w.Code, w.Body.String())
+        }
+    }
+    if w := ociDo("alice", http.MethodGet, repo+"/blobs/"+ociDigestOf(layer), "", nil); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), layer) {
+        t.Fatalf("layer after refused delete: %d", w.Code)
+    }
+
+    if w := ociDo("alice", http.MethodDelete, repo+"/manifests/"+ociDigestOf(manifest), "", nil); w.Code != http.StatusAccepted {
+        t.Fatalf("delete manifest: %d %s", w.Code, w.Body.String())
+    }
+    if w := ociDo("alice", http.MethodDelete, repo+"/blobs/"+ociDigestOf(layer), "", nil); w.Code != http.StatusAccepted {
+        t.Fatalf("delete blob after its manifest: %d %s", w.Code, w.Body.String())
+    }
+}
+
+// Staged chunks count against the quota, sessions are capped, unknown
+// session ids leave no lock behind, and deleting the account drops the rest
+func TestOCIUploadLimits(t *testing.T) {
+    setupRegistry(t)
+    const repo = "/v2/alice/app"
+    chunk, _ := randomContent(t)
+
+    start := func() (*httptest.ResponseRecorder, string) {
+        w := ociDo("alice", http.MethodPost, repo+"/blobs/uploads/", "", nil)
+        return w, w.Header().Get("Docker-Upload-UUID")
+    }
+
+    if _, err := database.DB.Exec("INSERT INTO user_quotas (username, quota_bytes) VALUES ('alice', $1)", len(chunk)*3/2); err != nil {
+        t.Fatal(err)
+    }
+    w, id := start()
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("start upload: %d %s", w.Code, w.Body.String())
+    }
+    if w := ociDo("alice", http.MethodPatch, repo+"/blobs/uploads/"+id, "application/octet-stream", chunk); w.Code != http.StatusAccepted {
+        t.Fatalf("first chunk: %d %s", w.Code, w.Body.String())
+    }
+    w = ociDo("alice", http.MethodPatch, repo+"/blobs/uploads/"+id, "application/octet-stream", chunk)
+    if w.Code != http.StatusInsufficientStorage || ociErrorCode(w) != "DENIED" {
+        t.Fatalf("chunk past the quota: %d %s", w.Code, w.Body.String())
+    }
+    var size int64
+    if err := database.DB.QueryRow("SELECT size FROM oci_uploads WHERE id = $1", id).Scan(&size); err != nil {
+        t.Fatal(err)
+    }
+    if size != int64(len(chunk)) {
+        t.Fatalf("upload is %d bytes after the refused chunk, want %d", size, len(chunk))
+    }
+
+    t.Setenv("OCI_MAX_OPEN_UPLOADS", "2")
+    if w, _ := start(); w.Code != http.StatusAccepted {
+        t.Fatalf("second upload: %d %s", w.Code, w.Body.String())
+    }
+    if w, _ := start(); w.Code != http.StatusTooManyRequests {
+        t.Fatalf("upload past OCI_MAX_OPEN_UPLOADS: %d %s", w.Code, w.Body.String())
+    }
+
+    unknown := strings.Repeat("x", 32)
+    if w := ociDo("alice", http.MethodPatch, repo+"/blobs/uploads/"+unknown, "application/octet-stream", chunk); w.Code != http.StatusNotFound {
+        t.Fatalf("unknown upload: %d %s", w.Code, w.Body.String())
+    }
+    if _, ok := ociUploadLocks.Load(unknown); ok {
+        t.Error("a lock was created for an unknown upload id")
+    }
+
+    if _, err := services.DeleteUserData("alice"); err != nil {
+        t.Fatal(err)
+    }
+    var open int
+    if err := database.DB.QueryRow("SELECT COUNT(*) FROM oci_uploads WHERE owner = 'alice'").Scan(&open); err != nil {
+        t.Fatal(err)
+    }
+    if open != 0 {
+        t.Errorf("%d uploads left after deleting the account", open)
+    }
+    if _, err := os.Stat(filepath.Join(services.OCIUploadPath(), id)); !os.IsNotExist(err) {
+        t.Errorf("upload still staged after deleting the account (%v)", err)
+    }
+}
@@ -0,0 +1,677 @@
+package controllers
+
+import (
+    "crypto/md5"
+    "database/sql"
+    "encoding/base64"
+    "encoding/xml"
+    "errors"
+    "io"
+    "net/http"
+    "net/url"
+    "path"
+    "strconv"
+    "strings"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/middleware"
+    "file-service/services"
+    "file-service/storage"
+    "file-service/utils"
+)
+
+// An S3-compatible subset over the user's files, for tooling that only speaks
+// S3 (aws cli, rclone, SDKs). Buckets are top-level folders and keys are file
+// paths below them; requests are path-style, e.g. /s3/photos/2025/a.jpg, and
+// signed with the user's S3 access keys (see S3Auth). Objects are stored
+// through the same dedup path as /upload, so overwriting a key adds a version
+// and deleting one moves it to the trash. ETags are the SHA-256 of the content.
+
+// S3Prefix is where the S3 gateway is mounted
+const S3Prefix = "/s3"
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3TimeFormat is how S3 formats timestamps in XML bodies
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// s3MaxKeys is the most entries one list request returns, as on S3
+const s3MaxKeys = 1000
+
+// S3Gateway dispatches S3 API requests. Reading needs the files:read scope
+// and everything else files:write; read-only keys only carry the former.
+func S3Gateway(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        utils.WriteS3Error(w, r, http.StatusForbidden, "AccessDenied", "Access denied")
+        return
+    }
+    scope := middleware.ScopeFilesWrite
+    if r.Method == http.MethodGet || r.Method == http.MethodHead {
+        scope = middleware.ScopeFilesRead
+    }
+    if !middleware.HasScope(r, scope) {
+        utils.WriteS3Error(w, r, http.StatusForbidden, "AccessDenied", "This access key is read-only")
+        return
+    }
+
+    bucket, key, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, S3Prefix), "/"), "/")
+    q := r.URL.Query()
+
+    if bucket == "" {
+        if r.Method != http.MethodGet {
+            utils.WriteS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "Only GET is allowed on the service")
+            return
+        }
+        s3ListBuckets(w, r, user)
+        return
+    }
+
+    if key == "" {
+        switch {
+        case r.Method == http.MethodPut && s3OnlyParams(q):
+            s3CreateBucket(w, r, user, bucket)
+        case r.Method == http.MethodHead:
+            s3HeadBucket(w, r, user, bucket)
+        case r.Method == http.MethodDelete && s3OnlyParams(q):
+            s3DeleteBucket(w, r, user, bucket)
+        case r.Method == http.MethodPost && q.Has("delete"):
+            s3DeleteObjects(w, r, user, bucket)
+        case r.Method == http.MethodGet && q.Has("location"):
+            s3GetBucketLocation(w, r, user, bucket)
+        case r.Method == http.MethodGet && q.Has("uploads"):
+            s3ListMultipartUploads(w, r, user, bucket)
+        case r.Method == http.MethodGet && s3OnlyParams(q, "list-type", "prefix", "delimiter", "max-keys", "continuation-token", "start-after", "encoding-type", "fetch-owner", "marker"):
+            s3ListObjects(w, r, user, bucket)
+        default:
+            utils.WriteS3Error(w, r, http.StatusNotImplemented, "NotImplemented", "This bucket operation is not supported")
+        }
+        return
+    }
+
+    switch {
+    case r.Method == http.MethodPut && q.Has("uploadId"):
+        s3UploadPart(w, r, user, bucket, key)
+    case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+        s3CopyObject(w, r, user, bucket, key)
+    case r.Method == http.MethodPut:
+        s3PutObject(w, r, user, bucket, key)
+    case r.Method == http.MethodPost && q.Has("uploads"):
+        s3CreateMultipartUpload(w, r, user, bucket, key)
+    case r.Method == http.MethodPost && q.Has("uploadId"):
+        s3CompleteMultipartUpload(w, r, user, bucket, key)
+    case r.Method == http.MethodGet && q.Has("uploadId"):
+        s3ListParts(w, r, user, bucket, key)
+    case r.Method == http.MethodDelete && q.Has("uploadId"):
+        s3AbortMultipartUpload(w, r, user, bucket, key)
+    case (r.Method == http.MethodGet || r.Method == http.MethodHead) && !q.Has("acl") && !q.Has("tagging"):
+        s3GetObject(w, r, user, bucket, key)
+    case r.Method == http.MethodDelete:
+        s3DeleteObject(w, r, user, bucket, key)
+    default:
+        utils.WriteS3Error(w, r, http.StatusNotImplemented, "NotImplemented", "This object operation is not supported")
+    }
+}
+
+// s3OnlyParams reports whether q has no parameters besides allowed (and the
+// X-Amz-* ones of presigned URLs)
+func s3OnlyParams(q url.Values, allowed ...string) bool {
+    for name := range q {
+        if strings.HasPrefix(name, "X-Amz-") {
+            continue
+        }
+        known := false
+        for _, a := range allowed {
+            if name == a {
+                known = true
+                break
+            }
+        }
+        if !known {
+            return false
+        }
+    }
+    return true
+}
+
+// s3Error maps service failures to S3 error codes
+func s3Error(w http.ResponseWriter, r *http.Request, err error) {
+    var maxBytesErr *http.MaxBytesError
+    switch {
+    case errors.Is(err, services.ErrNoSuchBucket):
+        utils.WriteS3Error(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+    case errors.Is(err, sql.ErrNoRows), errors.Is(err, services.ErrFolderNotFound):
+        utils.WriteS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+    case errors.Is(err, services.ErrNameTaken):
+        utils.WriteS3Error(w, r, http.StatusConflict, "InvalidArgument", "A file and a folder cannot share a name along the key's path")
+    case errors.Is(err, services.ErrInvalidName):
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Key segments must not be empty, '.' or '..', longer than 255 bytes or contain backslashes")
+    case errors.Is(err, services.ErrBucketNotEmpty):
+        utils.WriteS3Error(w, r, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty")
+    case errors.Is(err, services.ErrFileTooLarge), errors.As(err, &maxBytesErr):
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed size")
+    case errors.Is(err, services.ErrQuotaExceeded):
+        utils.WriteS3Error(w, r, http.StatusForbidden, "QuotaExceeded", err.Error())
+    case errors.Is(err, utils.ErrChunkSignature):
+        utils.WriteS3Error(w, r, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+    case errors.Is(err, utils.ErrChunkFormat):
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "IncompleteBody", err.Error())
+    case errors.Is(err, utils.ErrChecksumMismatch):
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "BadDigest", err.Error())
+    default:
+        utils.WriteS3Error(w, r, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.")
+    }
+}
+
+func s3WriteXML(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(status)
+    w.Write([]byte(xml.Header))
+    xml.NewEncoder(w).Encode(v)
+}
+
+func s3ETag(contentHash string) string {
+    return `"` + contentHash + `"`
+}
+
+// s3ObjectPath is the vault path of key in bucket
+func s3ObjectPath(bucket, key string) string {
+    return "/" + bucket + "/" + strings.TrimSuffix(key, "/")
+}
+
+// s3StageBody stages an upload body, checking the Content-MD5 and a literal
+// x-amz-content-sha256 when the client sent them
+func s3StageBody(w http.ResponseWriter, r *http.Request, limit int64) (*services.StagedBlob, bool) {
+    wantMD5 := r.Header.Get("Content-MD5")
+    hasher := md5.New()
+    body := io.TeeReader(http.MaxBytesReader(w, r.Body, limit), hasher)
+
+    blob, err := services.StageBlob(body)
+    if err != nil {
+        s3Error(w, r, err)
+        return nil, false
+    }
+    if wantMD5 != "" && wantMD5 != base64.StdEncoding.EncodeToString(hasher.Sum(nil)) {
+        blob.Discard()
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+        return nil, false
+    }
+    if sum := r.Header.Get("X-Amz-Content-Sha256"); len(sum) == 64 && !strings.EqualFold(sum, blob.Hash) {
+        blob.Discard()
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed")
+        return nil, false
+    }
+    return blob, true
+}
+
+type s3Owner struct {
+    ID          string `xml:"ID"`
+    DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+    Name         string `xml:"Name"`
+    CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+    XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+    Xmlns   string     `xml:"xmlns,attr"`
+    Owner   s3Owner    `xml:"Owner"`
+    Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+func s3ListBuckets(w http.ResponseWriter, r *http.Request, user string) {
+    folders, err := services.ListBuckets(user)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    res := s3ListAllMyBucketsResult{Xmlns: s3Namespace, Owner: s3Owner{ID: user, DisplayName: user}, Buckets: []s3Bucket{}}
+    for _, f := range folders {
+        res.Buckets = append(res.Buckets, s3Bucket{Name: f.Name, CreationDate: f.CreatedAt.UTC().Format(s3TimeFormat)})
+    }
+    s3WriteXML(w, http.StatusOK, res)
+}
+
+func s3CreateBucket(w http.ResponseWriter, r *http.Request, user, bucket string) {
+    _, err := services.CreateFolder(database.DB, user, nil, bucket)
+    if errors.Is(err, services.ErrNameTaken) {
+        if _, err := services.GetBucket(database.DB, user, bucket); err == nil {
+            utils.WriteS3Error(w, r, http.StatusConflict, "BucketAlreadyOwnedByYou", "Your previous request to create the named bucket succeeded and you already own it")
+        } else {
+            utils.WriteS3Error(w, r, http.StatusConflict, "BucketAlreadyExists", "A file with that name already exists at the top level")
+        }
+        return
+    }
+    if errors.Is(err, services.ErrInvalidName) {
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidBucketName", "The specified bucket is not valid")
+        return
+    }
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    w.Header().Set("Location", "/"+bucket)
+    w.WriteHeader(http.StatusOK)
+}
+
+func s3HeadBucket(w http.ResponseWriter, r *http.Request, user, bucket string) {
+    if _, err := services.GetBucket(database.DB, user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    w.WriteHeader(http.StatusOK)
+}
+
+func s3DeleteBucket(w http.ResponseWriter, r *http.Request, user, bucket string) {
+    if err := services.DeleteBucket(user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func s3GetBucketLocation(w http.ResponseWriter, r *http.Request, user, bucket string) {
+    if _, err := services.GetBucket(database.DB, user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    // An empty constraint means us-east-1, which every client accepts
+    s3WriteXML(w, http.StatusOK, struct {
+        XMLName xml.Name `xml:"LocationConstraint"`
+        Xmlns   string   `xml:"xmlns,attr"`
+    }{Xmlns: s3Namespace})
+}
+
+type s3Object struct {
+    Key          string `xml:"Key"`
+    LastModified string `xml:"LastModified"`
+    ETag         string `xml:"ETag"`
+    Size         int64  `xml:"Size"`
+    StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+    Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+    XMLName               xml.Name         `xml:"ListBucketResult"`
+    Xmlns                 string           `xml:"xmlns,attr"`
+    Name                  string           `xml:"Name"`
+    Prefix                string           `xml:"Prefix"`
+    Delimiter             string           `xml:"Delimiter,omitempty"`
+    MaxKeys               int              `xml:"MaxKeys"`
+    EncodingType          string           `xml:"EncodingType,omitempty"`
+    IsTruncated           bool             `xml:"IsTruncated"`
+    Marker                *string          `xml:"Marker"`
+    NextMarker            string           `xml:"NextMarker,omitempty"`
+    KeyCount              *int             `xml:"KeyCount"`
+    ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+    NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+    StartAfter            string           `xml:"StartAfter,omitempty"`
+    Contents              []s3Object       `xml:"Contents"`
+    CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+// s3ListObjects serves ListObjectsV2 (list-type=2) and the original ListObjects
+func s3ListObjects(w http.ResponseWriter, r *http.Request, user, bucket string) {
+    q := r.URL.Query()
+    b, err := services.GetBucket(database.DB, user, bucket)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+
+    maxKeys := s3MaxKeys
+    if v := q.Get("max-keys"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 0 {
+            utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer")
+            return
+        }
+        maxKeys = min(n, s3MaxKeys)
+    }
+    if et := q.Get("encoding-type"); et != "" && et != "url" {
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request")
+        return
+    }
+    encode := func(s string) string {
+        if q.Get("encoding-type") == "url" {
+            return utils.SigV4URIEncode(s, false)
+        }
+        return s
+    }
+
+    prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+    v2 := q.Get("list-type") == "2"
+
+    // Resuming after a common prefix must skip the rest of it; a plain
+    // start-after is just a key to list after
+    after, resumed := q.Get("start-after"), false
+    if v2 && q.Get("continuation-token") != "" {
+        token, err := base64.RawURLEncoding.DecodeString(q.Get("continuation-token"))
+        if err != nil {
+            utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect")
+            return
+        }
+        after, resumed = string(token), true
+    } else if !v2 {
+        after, resumed = q.Get("marker"), true
+    }
+
+    res := s3ListBucketResult{
+        Xmlns:        s3Namespace,
+        Name:         bucket,
+        Prefix:       encode(prefix),
+        Delimiter:    encode(delimiter),
+        MaxKeys:      maxKeys,
+        EncodingType: q.Get("encoding-type"),
+    }
+
+    count, lastPrefix, next := 0, "", ""
+    err = services.ListBucketObjects(user, b.ID, prefix, after, func(obj services.BucketObject) bool {
+        if resumed && delimiter != "" && strings.HasSuffix(after, delimiter) && strings.HasPrefix(obj.Key, after) {
+            return true
+        }
+        entry, isPrefix := obj.Key, false
+        if delimiter != "" {
+            if i := strings.Index(obj.Key[len(prefix):], delimiter); i >= 0 {
+                entry, isPrefix = obj.Key[:len(prefix)+i+len(delimiter)], true
+                if entry == lastPrefix {
+                    return true
+                }
+            }
+        }
+        if count == maxKeys {
+            res.IsTruncated = true
+            return false
+        }
+        count++
+        next = entry
+        if isPrefix {
+            lastPrefix = entry
+            res.CommonPrefixes = append(res.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry)})
+        } else {
+            res.Contents = append(res.Contents, s3Object{
+                Key:          encode(obj.Key),
+                LastModified: obj.File.UploadDate.UTC().Format(s3TimeFormat),
+                ETag:         s3ETag(obj.File.ContentHash),
+                Size:         obj.File.Size,
+                StorageClass: "STANDARD",
+            })
+        }
+        return true
+    })
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+
+    if v2 {
+        res.KeyCount = &count
+        res.ContinuationToken = q.Get("continuation-token")
+        res.StartAfter = encode(q.Get("start-after"))
+        if res.IsTruncated {
+            res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(next))
+        }
+    } else {
+        marker := encode(q.Get("marker"))
+        res.Marker = &marker
+        if res.IsTruncated && delimiter != "" {
+            res.NextMarker = encode(next)
+        }
+    }
+    s3WriteXML(w, http.StatusOK, res)
+}
+
+// s3ResponseOverrides are the query parameters a (presigned) GET may use to
+// set response headers
+var s3ResponseOverrides = map[string]string{
+    "response-content-type":        "Content-Type",
+    "response-content-disposition": "Content-Disposition",
+    "response-content-language":    "Content-Language",
+    "response-content-encoding":    "Content-Encoding",
+    "response-cache-control":       "Cache-Control",
+    "response-expires":             "Expires",
+}
+
+// s3GetObject serves GetObject and HeadObject, with Range and conditional requests
+func s3GetObject(w http.ResponseWriter, r *http.Request, user, bucket, key string) {
+    if _, err := services.GetBucket(database.DB, user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    entry, err := services.LookupPath(database.DB, user, s3ObjectPath(bucket, key))
+    if err != nil && !errors.Is(err, services.ErrFolderNotFound) && !errors.Is(err, services.ErrInvalidName) {
+        s3Error(w, r, err)
+        return
+    }
+    if entry.File == nil || strings.HasSuffix(key, "/") {
+        s3Error(w, r, sql.ErrNoRows)
+        return
+    }
+    f := entry.File
+
+    obj, err := storage.Store.Get(f.ContentHash)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    defer obj.Close()
+
+    w.Header().Set("ETag", s3ETag(f.ContentHash))
+    w.Header().Set("Content-Type", f.MIMEType)
+    w.Header().Set("Accept-Ranges", "bytes")
+    for param, header := range s3ResponseOverrides {
+        if v := r.URL.Query().Get(param); v != "" {
+            w.Header().Set(header, v)
+        }
+    }
+    http.ServeContent(w, r, "", f.UploadDate, obj)
+}
+
+func s3PutObject(w http.ResponseWriter, r *http.Request, user, bucket, key string) {
+    if _, err := services.GetBucket(database.DB, user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+
+    // A zero-byte "dir/" key is how S3 tools create an empty folder
+    if strings.HasSuffix(key, "/") {
+        io.Copy(io.Discard, io.LimitReader(r.Body, 1))
+        if _, err := services.ResolvePath(database.DB, user, s3ObjectPath(bucket, key), true); err != nil {
+            s3Error(w, r, err)
+            return
+        }
+        w.Header().Set("ETag", s3ETag(utils.EmptyPayloadHash))
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    dir, name := path.Split(s3ObjectPath(bucket, key))
+    if !services.ValidName(name) {
+        s3Error(w, r, services.ErrInvalidName)
+        return
+    }
+
+    blob, ok := s3StageBody(w, r, config.GetEnvInt64("MAX_UPLOAD_SIZE", 2<<30))
+    if !ok {
+        return
+    }
+    defer blob.Discard()
+
+    folderID, err := services.ResolvePath(database.DB, user, dir, true)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    file, err := services.StoreFile(user, name, services.DetectMIMEType(name, r.Header.Get("Content-Type")), folderID, blob)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+
+    w.Header().Set("ETag", s3ETag(file.ContentHash))
+    w.WriteHeader(http.StatusOK)
+}
+
+// s3CopyObject copies an object within the user's buckets. The copy shares
+// the source's blob; an existing destination goes to the trash first.
+func s3CopyObject(w http.ResponseWriter, r *http.Request, user, bucket, key string) {
+    source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+    if err != nil {
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+        return
+    }
+    source, _, _ = strings.Cut(source, "?")
+    srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+    if srcKey == "" || strings.HasSuffix(key, "/") {
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid copy source")
+        return
+    }
+    for _, b := range []string{srcBucket, bucket} {
+        if _, err := services.GetBucket(database.DB, user, b); err != nil {
+            s3Error(w, r, err)
+            return
+        }
+    }
+
+    src, err := services.LookupPath(database.DB, user, s3ObjectPath(srcBucket, srcKey))
+    if err == nil && src.File == nil {
+        err = sql.ErrNoRows
+    }
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+
+    file := *src.File
+    if s3ObjectPath(srcBucket, srcKey) != s3ObjectPath(bucket, key) {
+        dir, name := path.Split(s3ObjectPath(bucket, key))
+        folderID, err := services.ResolvePath(database.DB, user, dir, true)
+        if err != nil {
+            s3Error(w, r, err)
+            return
+        }
+        dst, err := services.LookupPath(database.DB, user, s3ObjectPath(bucket, key))
+        if err != nil {
+            s3Error(w, r, err)
+            return
+        }
+        if dst.File != nil {
+            err := database.WithTx(func(tx *sql.Tx) error {
+                return services.TrashFileTx(tx, dst.File.ID)
+            })
+            if err != nil {
+                s3Error(w, r, err)
+                return
+            }
+        }
+        if file, err = services.CopyFile(user, src.File.ID, folderID, name); err != nil {
+            s3Error(w, r, err)
+            return
+        }
+    }
+
+    s3WriteXML(w, http.StatusOK, struct {
+        XMLName      xml.Name `xml:"CopyObjectResult"`
+        Xmlns        string   `xml:"xmlns,attr"`
+        LastModified string   `xml:"LastModified"`
+        ETag         string   `xml:"ETag"`
+    }{Xmlns: s3Namespace, LastModified: file.UploadDate.UTC().Format(s3TimeFormat), ETag: s3ETag(file.ContentHash)})
+}
+
+// s3RemoveObject deletes one key: a file goes to the trash, and a "dir/"
+// marker removes its folder if nothing is left in it. Missing keys are not
+// an error, as on S3.
+func s3RemoveObject(user, bucket, key string) error {
+    entry, err := services.LookupPath(database.DB, user, s3ObjectPath(bucket, key))
+    if errors.Is(err, services.ErrFolderNotFound) || errors.Is(err, services.ErrInvalidName) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    switch {
+    case entry.File != nil && !strings.HasSuffix(key, "/"):
+        err := database.WithTx(func(tx *sql.Tx) error {
+            return services.TrashFileTx(tx, entry.File.ID)
+        })
+        if err == sql.ErrNoRows {
+            return nil
+        }
+        return err
+    case entry.Folder != nil && strings.HasSuffix(key, "/"):
+        listing, err := services.ListFolder(user, &entry.Folder.ID)
+        if err != nil || len(listing.Folders) > 0 || len(listing.Files) > 0 {
+            return err
+        }
+        return services.DeleteFolder(user, entry.Folder.ID)
+    }
+    return nil
+}
+
+func s3DeleteObject(w http.ResponseWriter, r *http.Request, user, bucket, key string) {
+    if _, err := services.GetBucket(database.DB, user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    if err := s3RemoveObject(user, bucket, key); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+type s3DeleteRequest struct {
+    Quiet   bool `xml:"Quiet"`
+    Objects []struct {
+        Key string `xml:"Key"`
+    } `xml:"Object"`
+}
+
+type s3DeleteError struct {
+    Key     string `xml:"Key"`
+    Code    string `xml:"Code"`
+    Message string `xml:"Message"`
+}
+
+type s3DeleteResult struct {
+    XMLName xml.Name `xml:"DeleteResult"`
+    Xmlns   string   `xml:"xmlns,attr"`
+    Deleted []struct {
+        Key string `xml:"Key"`
+    } `xml:"Deleted"`
+    Errors []s3DeleteError `xml:"Error"`
+}
+
+// s3DeleteObjects deletes up to 1000 keys in one request
+func s3DeleteObjects(w http.ResponseWriter, r *http.Request, user, bucket string) {
+    if _, err := services.GetBucket(database.DB, user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    var req s3DeleteRequest
+    if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil || len(req.Objects) == 0 || len(req.Objects) > s3MaxKeys {
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
+        return
+    }
+
+    res := s3DeleteResult{Xmlns: s3Namespace}
+    for _, obj := range req.Objects {
+        if err := s3RemoveObject(user, bucket, obj.Key); err != nil {
+            res.Errors = append(res.Errors, s3DeleteError{Key: obj.Key, Code: "InternalError", Message: err.Error()})
+            continue
+        }
+        if !req.Quiet {
+            res.Deleted = append(res.Deleted, struct {
+                Key string `xml:"Key"`
+            }{obj.Key})
+        }
+    }
+    s3WriteXML(w, http.StatusOK, res)
+}
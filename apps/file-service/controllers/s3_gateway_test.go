@@ -0,0 +1,265 @@
+package controllers
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/xml"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+
+    "file-service/database"
+    "file-service/services"
+    "file-service/utils"
+)
+
+// setupS3 is setupTestDB plus a multipart staging dir and a bucket for user
+func setupS3(t *testing.T, user, bucket string) {
+    t.Helper()
+    setupTestDB(t)
+    t.Setenv("S3_MULTIPART_PATH", t.TempDir())
+    if w := s3Do(user, http.MethodPut, "/s3/"+bucket, nil); w.Code != http.StatusOK {
+        t.Fatalf("create bucket: %d %s", w.Code, w.Body.String())
+    }
+}
+
+// s3Do sends an already authenticated request through S3Gateway
+func s3Do(user, method, target string, body []byte) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, bytes.NewReader(body))
+    w := httptest.NewRecorder()
+    S3Gateway(w, asUser(r, user))
+    return w
+}
+
+// s3ErrorCode is the Code of an S3 error body, or "" when there is none
+func s3ErrorCode(w *httptest.ResponseRecorder) string {
+    var e utils.S3Error
+    xml.Unmarshal(w.Body.Bytes(), &e)
+    return e.Code
+}
+
+// s3StartUpload creates a multipart upload and returns its id
+func s3StartUpload(t *testing.T, user, target string) string {
+    t.Helper()
+    w := s3Do(user, http.MethodPost, target+"?uploads", nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("create upload: %d %s", w.Code, w.Body.String())
+    }
+    var res struct {
+        UploadID string `xml:"UploadId"`
+    }
+    if err := xml.Unmarshal(w.Body.Bytes(), &res); err != nil || res.UploadID == "" {
+        t.Fatalf("create upload: bad response %q (%v)", w.Body.String(), err)
+    }
+    return res.UploadID
+}
+
+// s3PutPart uploads one part and returns its ETag
+func s3PutPart(t *testing.T, user, target, id string, n int, content []byte) string {
+    t.Helper()
+    w := s3Do(user, http.MethodPut, fmt.Sprintf("%s?uploadId=%s&partNumber=%d", target, id, n), content)
+    if w.Code != http.StatusOK {
+        t.Fatalf("upload part %d: %d %s", n, w.Code, w.Body.String())
+    }
+    return w.Header().Get("ETag")
+}
+
+func s3CompleteBody(parts ...interface{}) []byte {
+    var b strings.Builder
+    b.WriteString("<CompleteMultipartUpload>")
+    for i := 0; i < len(parts); i += 2 {
+        fmt.Fprintf(&b, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", parts[i], parts[i+1])
+    }
+    b.WriteString("</CompleteMultipartUpload>")
+    return []byte(b.String())
+}
+
+func TestS3CompleteMultipartUpload(t *testing.T) {
+    setupS3(t, "alice", "photos")
+    const target = "/s3/photos/2025/big.bin"
+    part1, _ := randomContent(t)
+    part2, _ := randomContent(t)
+
+    id := s3StartUpload(t, "alice", target)
+    etag1 := s3PutPart(t, "alice", target, id, 1, part1)
+    etag2 := s3PutPart(t, "alice", target, id, 2, part2)
+
+    for _, tc := range []struct {
+        name string
+        body []byte
+        code string
+    }{
+        {"no parts", s3CompleteBody(), "MalformedXML"},
+        {"descending order", s3CompleteBody(2, etag2, 1, etag1), "InvalidPartOrder"},
+        {"repeated part", s3CompleteBody(1, etag1, 1, etag1), "InvalidPartOrder"},
+        {"unknown part", s3CompleteBody(1, etag1, 3, etag2), "InvalidPart"},
+        {"wrong etag", s3CompleteBody(1, etag2, 2, etag2), "InvalidPart"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            w := s3Do("alice", http.MethodPost, target+"?uploadId="+id, tc.body)
+            if w.Code != http.StatusBadRequest || s3ErrorCode(w) != tc.code {
+                t.Fatalf("got %d %s, want 400 %s", w.Code, w.Body.String(), tc.code)
+            }
+        })
+    }
+
+    // Someone else's upload id is not found
+    if w := s3Do("bob", http.MethodPost, target+"?uploadId="+id, s3CompleteBody(1, etag1)); s3ErrorCode(w) != "NoSuchUpload" {
+        t.Fatalf("completing another user's upload: %d %s", w.Code, w.Body.String())
+    }
+
+    w := s3Do("alice", http.MethodPost, target+"?uploadId="+id, s3CompleteBody(1, etag1, 2, etag2))
+    if w.Code != http.StatusOK {
+        t.Fatalf("complete: %d %s", w.Code, w.Body.String())
+    }
+    whole := append(append([]byte{}, part1...), part2...)
+    sum := sha256.Sum256(whole)
+    var res struct {
+        ETag string `xml:"ETag"`
+    }
+    if err := xml.Unmarshal(w.Body.Bytes(), &res); err != nil || res.ETag != `"`+hex.EncodeToString(sum[:])+`"` {
+        t.Fatalf("complete returned ETag %q (%v), want the SHA-256 of both parts", res.ETag, err)
+    }
+
+    w = s3Do("alice", http.MethodGet, target, nil)
+    if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), whole) {
+        t.Fatalf("object after completion: %d, %d bytes, want %d", w.Code, w.Body.Len(), len(whole))
+    }
+    var open int
+    if err := database.DB.QueryRow("SELECT COUNT(*) FROM s3_multipart_uploads").Scan(&open); err != nil {
+        t.Fatal(err)
+    }
+    if open != 0 {
+        t.Errorf("%d uploads left after completion", open)
+    }
+    if _, err := os.Stat(filepath.Join(services.S3MultipartPath(), id)); !os.IsNotExist(err) {
+        t.Errorf("parts still staged after completion (%v)", err)
+    }
+
+    // Completing twice finds nothing
+    if w := s3Do("alice", http.MethodPost, target+"?uploadId="+id, s3CompleteBody(1, etag1, 2, etag2)); s3ErrorCode(w) != "NoSuchUpload" {
+        t.Fatalf("second completion: %d %s", w.Code, w.Body.String())
+    }
+}
+
+// Parts not completed yet still count against the quota, and every upload
+// goes when the account does
+func TestS3MultipartLimits(t *testing.T) {
+    setupS3(t, "alice", "photos")
+    const target = "/s3/photos/big.bin"
+    content, _ := randomContent(t)
+
+    if _, err := database.DB.Exec("INSERT INTO user_quotas (username, quota_bytes) VALUES ('alice', $1)", len(content)*3/2); err != nil {
+        t.Fatal(err)
+    }
+    id := s3StartUpload(t, "alice", target)
+    s3PutPart(t, "alice", target, id, 1, content)
+    w := s3Do("alice", http.MethodPut, target+"?uploadId="+id+"&partNumber=2", content)
+    if w.Code != http.StatusForbidden || s3ErrorCode(w) != "QuotaExceeded" {
+        t.Fatalf("part past the quota: %d %s", w.Code, w.Body.String())
+    }
+    // Re-sending a part replaces it rather than adding to it
+    s3PutPart(t, "alice", target, id, 1, content)
+
+    t.Setenv("S3_MAX_OPEN_UPLOADS", "2")
+    s3StartUpload(t, "alice", target)
+    w = s3Do("alice", http.MethodPost, target+"?uploads", nil)
+    if w.Code != http.StatusForbidden || s3ErrorCode(w) != "QuotaExceeded" {
+        t.Fatalf("upload past S3_MAX_OPEN_UPLOADS: %d %s", w.Code, w.Body.String())
+    }
+
+    if _, err := services.DeleteUserData("alice"); err != nil {
+        t.Fatal(err)
+    }
+    var open int
+    if err := database.DB.QueryRow("SELECT COUNT(*) FROM s3_multipart_uploads WHERE username = 'alice'").Scan(&open); err != nil {
+        t.Fatal(err)
+    }
+    if open != 0 {
+        t.Errorf("%d uploads left after deleting the account", open)
+    }
+    if _, err := os.Stat(filepath.Join(services.S3MultipartPath(), id)); !os.IsNotExist(err) {
+        t.Errorf("parts still staged after deleting the account (%v)", err)
+    }
+}
+
+func TestS3ListObjectsV2(t *testing.T) {
+    setupS3(t, "alice", "docs")
+    keys := []string{"a.txt", "dir/b.txt", "dir/c.txt", "dir/sub/d.txt", "e.txt"}
+    for _, key := range keys {
+        if w := s3Do("alice", http.MethodPut, "/s3/docs/"+key, []byte(key)); w.Code != http.StatusOK {
+            t.Fatalf("put %s: %d %s", key, w.Code, w.Body.String())
+        }
+    }
+
+    // list follows continuation tokens and returns each page's keys and common prefixes
+    list := func(t *testing.T, params url.Values) [][]string {
+        t.Helper()
+        params.Set("list-type", "2")
+        var pages [][]string
+        for page := 0; page < 10; page++ {
+            w := s3Do("alice", http.MethodGet, "/s3/docs?"+params.Encode(), nil)
+            if w.Code != http.StatusOK {
+                t.Fatalf("list %s: %d %s", params.Encode(), w.Code, w.Body.String())
+            }
+            var res s3ListBucketResult
+            if err := xml.Unmarshal(w.Body.Bytes(), &res); err != nil {
+                t.Fatal(err)
+            }
+            var entries []string
+            for _, c := range res.Contents {
+                entries = append(entries, c.Key)
+            }
+            for _, p := range res.CommonPrefixes {
+                entries = append(entries, p.Prefix)
+            }
+            if res.KeyCount == nil || *res.KeyCount != len(entries) {
+                t.Fatalf("KeyCount %v for %d entries", res.KeyCount, len(entries))
+            }
+            pages = append(pages, entries)
+            if !res.IsTruncated {
+                return pages
+            }
+            params.Set("continuation-token", res.NextContinuationToken)
+        }
+        t.Fatal("listing did not finish")
+        return nil
+    }
+
+    for _, tc := range []struct {
+        name   string
+        params url.Values
+        want   [][]string
+    }{
+        {"everything", url.Values{}, [][]string{keys}},
+        {"delimiter", url.Values{"delimiter": {"/"}}, [][]string{{"a.txt", "e.txt", "dir/"}}},
+        {"prefix and delimiter", url.Values{"prefix": {"dir/"}, "delimiter": {"/"}}, [][]string{{"dir/b.txt", "dir/c.txt", "dir/sub/"}}},
+        {"prefix", url.Values{"prefix": {"dir/s"}}, [][]string{{"dir/sub/d.txt"}}},
+        {"no match", url.Values{"prefix": {"x"}}, [][]string{nil}},
+        {"start after", url.Values{"start-after": {"dir/c.txt"}}, [][]string{{"dir/sub/d.txt", "e.txt"}}},
+        {"pages", url.Values{"max-keys": {"2"}}, [][]string{{"a.txt", "dir/b.txt"}, {"dir/c.txt", "dir/sub/d.txt"}, {"e.txt"}}},
+        // A page ending in a common prefix resumes after everything under it
+        {"pages with delimiter", url.Values{"max-keys": {"2"}, "delimiter": {"/"}}, [][]string{{"a.txt", "dir/"}, {"e.txt"}}},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            if got := list(t, tc.params); !reflect.DeepEqual(got, tc.want) {
+                t.Fatalf("got %q, want %q", got, tc.want)
+            }
+        })
+    }
+
+    w := s3Do("alice", http.MethodGet, "/s3/docs?list-type=2&continuation-token=%25%25", nil)
+    if w.Code != http.StatusBadRequest || s3ErrorCode(w) != "InvalidArgument" {
+        t.Fatalf("bad continuation token: %d %s", w.Code, w.Body.String())
+    }
+    if w := s3Do("alice", http.MethodGet, "/s3/missing?list-type=2", nil); s3ErrorCode(w) != "NoSuchBucket" {
+        t.Fatalf("listing a missing bucket: %d %s", w.Code, w.Body.String())
+    }
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+
+    "file-service/middleware"
+    "file-service/services"
+)
+
+// ListS3Keys lists the logged-in user's S3 access keys, without their secrets
+func ListS3Keys(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    keys, err := services.ListS3Keys(user)
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(keys)
+}
+
+// CreateS3Key issues an S3 access key from {"name", "read_only"}. The secret
+// is only ever returned here.
+func CreateS3Key(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req struct {
+        Name     string `json:"name"`
+        ReadOnly bool   `json:"read_only"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    key, err := services.CreateS3Key(user, req.Name, req.ReadOnly)
+    if errors.Is(err, services.ErrS3KeyNameRequired) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(key)
+}
+
+// DeleteS3Key revokes one of the logged-in user's S3 access keys
+func DeleteS3Key(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        http.Error(w, "Access key not found", http.StatusNotFound)
+        return
+    }
+
+    err = services.DeleteS3Key(user, id)
+    if errors.Is(err, services.ErrS3KeyNotFound) {
+        http.Error(w, "Access key not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
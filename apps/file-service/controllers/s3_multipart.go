@@ -0,0 +1,491 @@
+package controllers
+
+import (
+    "crypto/md5"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/xml"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/models"
+    "file-service/services"
+    "file-service/utils"
+)
+
+// S3 multipart uploads. Parts are staged on local disk like tus uploads, one
+// file per part under S3_MULTIPART_PATH/<upload id>/, and only become a File
+// when the upload is completed; abandoned uploads are purged after
+// S3_MULTIPART_EXPIRY.
+
+// s3MaxPartSize is the largest part S3 accepts
+const s3MaxPartSize = 5 << 30
+
+// s3UploadLocks serialises completing or aborting an upload against its part uploads
+var s3UploadLocks sync.Map
+
+func s3MultipartExpiry() time.Duration {
+    return config.GetEnvDuration("S3_MULTIPART_EXPIRY", 7*24*time.Hour)
+}
+
+// s3MaxOpenUploads is how many multipart uploads one user may have in progress
+func s3MaxOpenUploads() int64 {
+    return config.GetEnvInt64("S3_MAX_OPEN_UPLOADS", 100)
+}
+
+func s3UploadLock(id string) func() {
+    m, _ := s3UploadLocks.LoadOrStore(id, &sync.Mutex{})
+    mu := m.(*sync.Mutex)
+    mu.Lock()
+    return mu.Unlock
+}
+
+// loadS3Upload finds the user's upload id for bucket/key, answering
+// NoSuchUpload itself when there is none
+func loadS3Upload(w http.ResponseWriter, r *http.Request, user, bucket, key string) (models.S3MultipartUpload, bool) {
+    var u models.S3MultipartUpload
+    err := database.DB.QueryRow(
+        "SELECT id, username, bucket, object_key, mime_type, created_at FROM s3_multipart_uploads WHERE id = $1",
+        r.URL.Query().Get("uploadId"),
+    ).Scan(&u.ID, &u.Username, &u.Bucket, &u.Key, &u.MIMEType, &u.CreatedAt)
+    if err == sql.ErrNoRows || (err == nil && (u.Username != user || u.Bucket != bucket || u.Key != key)) {
+        utils.WriteS3Error(w, r, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+        return u, false
+    }
+    if err != nil {
+        s3Error(w, r, err)
+        return u, false
+    }
+    return u, true
+}
+
+func s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request, user, bucket, key string) {
+    if _, err := services.GetBucket(database.DB, user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    for _, seg := range strings.Split(key, "/") {
+        if !services.ValidName(seg) {
+            s3Error(w, r, services.ErrInvalidName)
+            return
+        }
+    }
+
+    upload := models.S3MultipartUpload{
+        ID:       utils.GenerateRandomString(32),
+        Username: user,
+        Bucket:   bucket,
+        Key:      key,
+        MIMEType: services.DetectMIMEType(path.Base(key), r.Header.Get("Content-Type")),
+    }
+    if err := os.MkdirAll(filepath.Join(services.S3MultipartPath(), upload.ID), os.ModePerm); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    res, err := database.DB.Exec(
+        `INSERT INTO s3_multipart_uploads (id, username, bucket, object_key, mime_type)
+         SELECT $1, $2, $3, $4, $5
+         WHERE (SELECT COUNT(*) FROM s3_multipart_uploads WHERE username = $2) < $6`,
+        upload.ID, upload.Username, upload.Bucket, upload.Key, upload.MIMEType, s3MaxOpenUploads(),
+    )
+    if err != nil {
+        os.RemoveAll(filepath.Join(services.S3MultipartPath(), upload.ID))
+        s3Error(w, r, err)
+        return
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        os.RemoveAll(filepath.Join(services.S3MultipartPath(), upload.ID))
+        utils.WriteS3Error(w, r, http.StatusForbidden, "QuotaExceeded", "Too many multipart uploads in progress; complete or abort some first")
+        return
+    }
+
+    s3WriteXML(w, http.StatusOK, struct {
+        XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+        Xmlns    string   `xml:"xmlns,attr"`
+        Bucket   string   `xml:"Bucket"`
+        Key      string   `xml:"Key"`
+        UploadID string   `xml:"UploadId"`
+    }{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: upload.ID})
+}
+
+// s3UploadPart stages one part. Re-sending a part number replaces it.
+func s3UploadPart(w http.ResponseWriter, r *http.Request, user, bucket, key string) {
+    if r.Header.Get("X-Amz-Copy-Source") != "" {
+        utils.WriteS3Error(w, r, http.StatusNotImplemented, "NotImplemented", "UploadPartCopy is not supported")
+        return
+    }
+    partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+    if err != nil || partNumber < 1 || partNumber > 10000 {
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive")
+        return
+    }
+    upload, ok := loadS3Upload(w, r, user, bucket, key)
+    if !ok {
+        return
+    }
+
+    // Staged parts count against the quota as well, so open uploads cannot
+    // hold more than it; the charge itself happens on completion
+    staged, err := s3StagedBytes(user, upload.ID, partNumber)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    if r.ContentLength > 0 {
+        if err := services.CheckStagedQuota(user, staged, r.ContentLength); err != nil {
+            s3Error(w, r, err)
+            return
+        }
+    }
+
+    dir := filepath.Join(services.S3MultipartPath(), upload.ID)
+    tmp, err := os.CreateTemp(dir, "part-*")
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    defer os.Remove(tmp.Name())
+
+    sha, md := sha256.New(), md5.New()
+    size, err := io.Copy(io.MultiWriter(tmp, sha, md), http.MaxBytesReader(w, r.Body, s3MaxPartSize))
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    hash := hex.EncodeToString(sha.Sum(nil))
+    if want := r.Header.Get("Content-MD5"); want != "" && want != base64.StdEncoding.EncodeToString(md.Sum(nil)) {
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received")
+        return
+    }
+    if sum := r.Header.Get("X-Amz-Content-Sha256"); len(sum) == 64 && !strings.EqualFold(sum, hash) {
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed")
+        return
+    }
+    if err := services.CheckStagedQuota(user, staged, size); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+
+    unlock := s3UploadLock(upload.ID)
+    defer unlock()
+
+    // The upload may have been completed or aborted while the part streamed in
+    var exists bool
+    if err := database.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM s3_multipart_uploads WHERE id = $1)", upload.ID).Scan(&exists); err != nil || !exists {
+        if err == nil {
+            utils.WriteS3Error(w, r, http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+            return
+        }
+        s3Error(w, r, err)
+        return
+    }
+    if err := os.Rename(tmp.Name(), filepath.Join(dir, strconv.Itoa(partNumber))); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    _, err = database.DB.Exec(
+        `INSERT INTO s3_upload_parts (upload_id, part_number, size, content_hash) VALUES ($1, $2, $3, $4)
+         ON CONFLICT (upload_id, part_number) DO UPDATE SET size = EXCLUDED.size, content_hash = EXCLUDED.content_hash, uploaded_at = now()`,
+        upload.ID, partNumber, size, hash,
+    )
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+
+    w.Header().Set("ETag", s3ETag(hash))
+    w.WriteHeader(http.StatusOK)
+}
+
+// s3StagedBytes is the size of all parts staged in user's open uploads,
+// leaving out the part a re-sent partNumber would replace
+func s3StagedBytes(user, uploadID string, partNumber int) (int64, error) {
+    var staged int64
+    err := database.DB.QueryRow(
+        `SELECT COALESCE(SUM(p.size), 0) FROM s3_upload_parts p
+         JOIN s3_multipart_uploads u ON u.id = p.upload_id
+         WHERE u.username = $1 AND NOT (p.upload_id = $2 AND p.part_number = $3)`,
+        user, uploadID, partNumber,
+    ).Scan(&staged)
+    return staged, err
+}
+
+// listS3Parts returns an upload's parts in part number order
+func listS3Parts(uploadID string) ([]models.S3UploadPart, error) {
+    rows, err := database.DB.Query(
+        "SELECT upload_id, part_number, size, content_hash, uploaded_at FROM s3_upload_parts WHERE upload_id = $1 ORDER BY part_number",
+        uploadID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var parts []models.S3UploadPart
+    for rows.Next() {
+        var p models.S3UploadPart
+        if err := rows.Scan(&p.UploadID, &p.PartNumber, &p.Size, &p.ContentHash, &p.UploadedAt); err != nil {
+            return nil, err
+        }
+        parts = append(parts, p)
+    }
+    return parts, rows.Err()
+}
+
+type s3CompleteRequest struct {
+    Parts []struct {
+        PartNumber int    `xml:"PartNumber"`
+        ETag       string `xml:"ETag"`
+    } `xml:"Part"`
+}
+
+// s3CompleteMultipartUpload joins the listed parts into one object, stored
+// through the same dedup path as PutObject
+func s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request, user, bucket, key string) {
+    var req s3CompleteRequest
+    if err := xml.NewDecoder(io.LimitReader(r.Body, 2<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+        utils.WriteS3Error(w, r, http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema")
+        return
+    }
+    upload, ok := loadS3Upload(w, r, user, bucket, key)
+    if !ok {
+        return
+    }
+
+    unlock := s3UploadLock(upload.ID)
+    defer unlock()
+
+    parts, err := listS3Parts(upload.ID)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    uploaded := map[int]models.S3UploadPart{}
+    for _, p := range parts {
+        uploaded[p.PartNumber] = p
+    }
+
+    dir := filepath.Join(services.S3MultipartPath(), upload.ID)
+    var readers []io.Reader
+    var files []*os.File
+    defer func() {
+        for _, f := range files {
+            f.Close()
+        }
+    }()
+    for i, p := range req.Parts {
+        if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+            utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+            return
+        }
+        part, ok := uploaded[p.PartNumber]
+        if !ok || strings.Trim(p.ETag, `"`) != part.ContentHash {
+            utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found or its entity tag did not match")
+            return
+        }
+        f, err := os.Open(filepath.Join(dir, strconv.Itoa(p.PartNumber)))
+        if err != nil {
+            s3Error(w, r, err)
+            return
+        }
+        files = append(files, f)
+        readers = append(readers, f)
+    }
+
+    blob, err := services.StageBlob(io.MultiReader(readers...))
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    defer blob.Discard()
+
+    dirPath, name := path.Split(s3ObjectPath(bucket, key))
+    if _, err := services.GetBucket(database.DB, user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    folderID, err := services.ResolvePath(database.DB, user, dirPath, true)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    file, err := services.StoreFile(user, name, upload.MIMEType, folderID, blob)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+
+    if err := deleteS3Uploads("id = $1", upload.ID); err != nil {
+        log.Println("failed to clean up multipart upload", upload.ID+":", err)
+    }
+
+    s3WriteXML(w, http.StatusOK, struct {
+        XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+        Xmlns    string   `xml:"xmlns,attr"`
+        Location string   `xml:"Location"`
+        Bucket   string   `xml:"Bucket"`
+        Key      string   `xml:"Key"`
+        ETag     string   `xml:"ETag"`
+    }{Xmlns: s3Namespace, Location: r.URL.Path, Bucket: bucket, Key: key, ETag: s3ETag(file.ContentHash)})
+}
+
+func s3AbortMultipartUpload(w http.ResponseWriter, r *http.Request, user, bucket, key string) {
+    upload, ok := loadS3Upload(w, r, user, bucket, key)
+    if !ok {
+        return
+    }
+    unlock := s3UploadLock(upload.ID)
+    defer unlock()
+
+    if err := deleteS3Uploads("id = $1", upload.ID); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+type s3Part struct {
+    PartNumber   int    `xml:"PartNumber"`
+    LastModified string `xml:"LastModified"`
+    ETag         string `xml:"ETag"`
+    Size         int64  `xml:"Size"`
+}
+
+func s3ListParts(w http.ResponseWriter, r *http.Request, user, bucket, key string) {
+    upload, ok := loadS3Upload(w, r, user, bucket, key)
+    if !ok {
+        return
+    }
+    q := r.URL.Query()
+    marker, _ := strconv.Atoi(q.Get("part-number-marker"))
+    maxParts := s3MaxKeys
+    if n, err := strconv.Atoi(q.Get("max-parts")); err == nil && n >= 0 && n < maxParts {
+        maxParts = n
+    }
+
+    parts, err := listS3Parts(upload.ID)
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+
+    res := struct {
+        XMLName              xml.Name `xml:"ListPartsResult"`
+        Xmlns                string   `xml:"xmlns,attr"`
+        Bucket               string   `xml:"Bucket"`
+        Key                  string   `xml:"Key"`
+        UploadID             string   `xml:"UploadId"`
+        PartNumberMarker     int      `xml:"PartNumberMarker"`
+        NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+        MaxParts             int      `xml:"MaxParts"`
+        IsTruncated          bool     `xml:"IsTruncated"`
+        Parts                []s3Part `xml:"Part"`
+    }{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadID: upload.ID, PartNumberMarker: marker, MaxParts: maxParts}
+    for _, p := range parts {
+        if p.PartNumber <= marker {
+            continue
+        }
+        if len(res.Parts) == maxParts {
+            res.IsTruncated = true
+            break
+        }
+        res.Parts = append(res.Parts, s3Part{
+            PartNumber:   p.PartNumber,
+            LastModified: p.UploadedAt.UTC().Format(s3TimeFormat),
+            ETag:         s3ETag(p.ContentHash),
+            Size:         p.Size,
+        })
+        res.NextPartNumberMarker = p.PartNumber
+    }
+    s3WriteXML(w, http.StatusOK, res)
+}
+
+// s3ListMultipartUploads lists the bucket's unfinished uploads, oldest first
+func s3ListMultipartUploads(w http.ResponseWriter, r *http.Request, user, bucket string) {
+    if _, err := services.GetBucket(database.DB, user, bucket); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    prefix := r.URL.Query().Get("prefix")
+    rows, err := database.DB.Query(
+        `SELECT id, object_key, created_at FROM s3_multipart_uploads
+         WHERE username = $1 AND bucket = $2 AND left(object_key, length($3)) = $3
+         ORDER BY object_key COLLATE "C", created_at LIMIT $4`,
+        user, bucket, prefix, s3MaxKeys,
+    )
+    if err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    defer rows.Close()
+
+    type s3Upload struct {
+        Key       string `xml:"Key"`
+        UploadID  string `xml:"UploadId"`
+        Initiated string `xml:"Initiated"`
+    }
+    res := struct {
+        XMLName     xml.Name   `xml:"ListMultipartUploadsResult"`
+        Xmlns       string     `xml:"xmlns,attr"`
+        Bucket      string     `xml:"Bucket"`
+        Prefix      string     `xml:"Prefix"`
+        MaxUploads  int        `xml:"MaxUploads"`
+        IsTruncated bool       `xml:"IsTruncated"`
+        Uploads     []s3Upload `xml:"Upload"`
+    }{Xmlns: s3Namespace, Bucket: bucket, Prefix: prefix, MaxUploads: s3MaxKeys}
+    for rows.Next() {
+        var u s3Upload
+        var initiated time.Time
+        if err := rows.Scan(&u.UploadID, &u.Key, &initiated); err != nil {
+            s3Error(w, r, err)
+            return
+        }
+        u.Initiated = initiated.UTC().Format(s3TimeFormat)
+        res.Uploads = append(res.Uploads, u)
+    }
+    if err := rows.Err(); err != nil {
+        s3Error(w, r, err)
+        return
+    }
+    s3WriteXML(w, http.StatusOK, res)
+}
+
+// PurgeExpiredS3Uploads removes multipart uploads older than S3_MULTIPART_EXPIRY and their parts
+func PurgeExpiredS3Uploads() error {
+    return deleteS3Uploads("created_at < $1", time.Now().Add(-s3MultipartExpiry()))
+}
+
+// deleteS3Uploads removes the multipart uploads matching where, and their staged parts
+func deleteS3Uploads(where string, args ...interface{}) error {
+    ids, err := services.DeleteS3Uploads(where, args...)
+    for _, id := range ids {
+        s3UploadLocks.Delete(id)
+    }
+    return err
+}
+
+// StartS3UploadCleanup runs PurgeExpiredS3Uploads every interval in the background
+func StartS3UploadCleanup(interval time.Duration) {
+    go func() {
+        for range time.Tick(interval) {
+            if err := PurgeExpiredS3Uploads(); err != nil {
+                log.Println("S3 multipart cleanup failed:", err)
+            }
+        }
+    }()
+}
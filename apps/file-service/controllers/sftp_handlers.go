@@ -0,0 +1,363 @@
+package controllers
+
+import (
+    "database/sql"
+    "errors"
+    "io"
+    "os"
+    "path"
+    "sync"
+    "time"
+
+    "github.com/pkg/sftp"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/models"
+    "file-service/services"
+    "file-service/storage"
+)
+
+// sftpFS serves one signed-in user's folders to the SFTP request server.
+// Paths map onto folders the same way WebDAV does, so "/a/b.txt" is b.txt in
+// the user's folder a.
+type sftpFS struct {
+    user     string
+    readOnly bool
+}
+
+// sftpError maps service failures to the status codes SFTP clients understand
+func sftpError(err error) error {
+    switch {
+    case err == nil:
+        return nil
+    case errors.Is(err, services.ErrFolderNotFound), errors.Is(err, sql.ErrNoRows):
+        return sftp.ErrSSHFxNoSuchFile
+    case errors.Is(err, services.ErrInvalidName), errors.Is(err, services.ErrFolderCycle):
+        return sftp.ErrSSHFxPermissionDenied
+    case errors.Is(err, services.ErrNameTaken), errors.Is(err, services.ErrQuotaExceeded), errors.Is(err, services.ErrFileTooLarge):
+        return err
+    default:
+        return sftp.ErrSSHFxFailure
+    }
+}
+
+func (fs *sftpFS) lookup(p string) (services.PathEntry, error) {
+    entry, err := services.LookupPath(database.DB, fs.user, p)
+    if errors.Is(err, services.ErrInvalidName) {
+        return entry, sftp.ErrSSHFxNoSuchFile
+    }
+    if err != nil {
+        return entry, sftpError(err)
+    }
+    return entry, nil
+}
+
+// Fileread opens a file's content for reading
+func (fs *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+    entry, err := fs.lookup(r.Filepath)
+    if err != nil {
+        return nil, err
+    }
+    if entry.File == nil {
+        return nil, sftp.ErrSSHFxNoSuchFile
+    }
+
+    content, err := storage.Store.Get(entry.File.ContentHash)
+    if err != nil {
+        return nil, sftp.ErrSSHFxFailure
+    }
+    if ra, ok := content.(io.ReaderAt); ok {
+        return ra, nil
+    }
+    return &sftpSeekReader{src: content}, nil
+}
+
+// sftpSeekReader turns a backend's ReadSeekCloser into the ReaderAt the
+// request server wants. Clients read sequentially, so the seeks are cheap.
+type sftpSeekReader struct {
+    mu  sync.Mutex
+    src io.ReadSeekCloser
+}
+
+func (s *sftpSeekReader) ReadAt(p []byte, off int64) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, err := s.src.Seek(off, io.SeekStart); err != nil {
+        return 0, err
+    }
+    n, err := io.ReadFull(s.src, p)
+    if err == io.ErrUnexpectedEOF {
+        err = io.EOF
+    }
+    return n, err
+}
+
+func (s *sftpSeekReader) Close() error {
+    return s.src.Close()
+}
+
+// Filewrite collects an upload in a temp file; it is stored when the client
+// closes the handle, through the same dedup path as UploadFile. Overwriting
+// an existing file adds a new version.
+func (fs *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+    if fs.readOnly {
+        return nil, sftp.ErrSSHFxPermissionDenied
+    }
+    flags := r.Pflags()
+    if flags.Append {
+        return nil, sftp.ErrSSHFxOpUnsupported
+    }
+
+    entry, err := fs.lookup(r.Filepath)
+    if err != nil {
+        return nil, err
+    }
+    if entry.IsRoot() || entry.Folder != nil {
+        return nil, sftp.ErrSSHFxFailure
+    }
+    if entry.File != nil && flags.Creat && flags.Excl {
+        return nil, sftp.ErrSSHFxFailure
+    }
+
+    tempDir := config.GetEnvDefault("UPLOAD_TEMP_PATH", "./upload-staging")
+    if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
+        return nil, sftp.ErrSSHFxFailure
+    }
+    tmp, err := os.CreateTemp(tempDir, "sftp-*")
+    if err != nil {
+        return nil, sftp.ErrSSHFxFailure
+    }
+    w := &sftpUpload{fs: fs, entry: entry, tmp: tmp, max: config.GetEnvInt64("MAX_UPLOAD_SIZE", 2<<30)}
+
+    // Without O_TRUNC the client is patching the existing content
+    if entry.File != nil && !flags.Trunc {
+        if err := w.copyExisting(entry.File.ContentHash); err != nil {
+            tmp.Close()
+            os.Remove(tmp.Name())
+            return nil, sftp.ErrSSHFxFailure
+        }
+    }
+    return w, nil
+}
+
+// sftpUpload is an open write handle
+type sftpUpload struct {
+    fs    *sftpFS
+    entry services.PathEntry
+    tmp   *os.File
+    max   int64
+}
+
+func (u *sftpUpload) copyExisting(hash string) error {
+    content, err := storage.Store.Get(hash)
+    if err != nil {
+        return err
+    }
+    defer content.Close()
+    _, err = io.Copy(u.tmp, content)
+    return err
+}
+
+func (u *sftpUpload) WriteAt(p []byte, off int64) (int, error) {
+    if off+int64(len(p)) > u.max {
+        return 0, services.ErrFileTooLarge
+    }
+    return u.tmp.WriteAt(p, off)
+}
+
+// Close stores the upload. Its error is what the client sees for the close.
+func (u *sftpUpload) Close() error {
+    defer os.Remove(u.tmp.Name())
+    if err := u.tmp.Close(); err != nil {
+        return sftp.ErrSSHFxFailure
+    }
+
+    blob, err := services.StageFile(u.tmp.Name())
+    if err != nil {
+        return sftp.ErrSSHFxFailure
+    }
+    defer blob.Discard()
+
+    mimeType := services.DetectMIMEType(u.entry.Name, "application/octet-stream")
+    if _, err := services.StoreFile(u.fs.user, u.entry.Name, mimeType, u.entry.ParentID, blob); err != nil {
+        return sftpError(err)
+    }
+    return nil
+}
+
+// Filecmd handles everything that changes the tree
+func (fs *sftpFS) Filecmd(r *sftp.Request) error {
+    if fs.readOnly {
+        return sftp.ErrSSHFxPermissionDenied
+    }
+
+    switch r.Method {
+    case "Setstat":
+        // Permissions and times are not stored; accept them so clients
+        // that preserve attributes after an upload don't fail
+        return nil
+    case "Rename":
+        return fs.rename(r.Filepath, r.Target, false)
+    case "Mkdir":
+        entry, err := fs.lookup(r.Filepath)
+        if err != nil {
+            return err
+        }
+        if entry.IsRoot() || entry.Exists() {
+            return sftp.ErrSSHFxFailure
+        }
+        _, err = services.CreateFolder(database.DB, fs.user, entry.ParentID, entry.Name)
+        return sftpError(err)
+    case "Rmdir":
+        entry, err := fs.lookup(r.Filepath)
+        if err != nil {
+            return err
+        }
+        if entry.IsRoot() || entry.Folder == nil {
+            return sftp.ErrSSHFxNoSuchFile
+        }
+        listing, err := services.ListFolder(fs.user, &entry.Folder.ID)
+        if err != nil {
+            return sftpError(err)
+        }
+        if len(listing.Folders) > 0 || len(listing.Files) > 0 {
+            return errors.New("directory not empty")
+        }
+        return sftpError(services.DeleteFolder(fs.user, entry.Folder.ID))
+    case "Remove":
+        entry, err := fs.lookup(r.Filepath)
+        if err != nil {
+            return err
+        }
+        if entry.File == nil {
+            return sftp.ErrSSHFxNoSuchFile
+        }
+        return sftpError(davRemove(fs.user, entry))
+    default:
+        return sftp.ErrSSHFxOpUnsupported
+    }
+}
+
+// PosixRename is the posix-rename@openssh.com extension, which replaces the
+// target where a plain SFTP rename refuses to
+func (fs *sftpFS) PosixRename(r *sftp.Request) error {
+    if fs.readOnly {
+        return sftp.ErrSSHFxPermissionDenied
+    }
+    return fs.rename(r.Filepath, r.Target, true)
+}
+
+func (fs *sftpFS) rename(from, to string, overwrite bool) error {
+    src, err := fs.lookup(from)
+    if err != nil {
+        return err
+    }
+    if src.IsRoot() || !src.Exists() {
+        return sftp.ErrSSHFxNoSuchFile
+    }
+    from, to = path.Clean("/"+from), path.Clean("/"+to)
+    if from == to {
+        return nil
+    }
+    if src.Folder != nil && davIsDescendant(to, from) {
+        return sftp.ErrSSHFxPermissionDenied
+    }
+
+    dst, err := fs.lookup(to)
+    if err != nil {
+        return err
+    }
+    if dst.IsRoot() {
+        return sftp.ErrSSHFxPermissionDenied
+    }
+    if dst.Exists() && !overwrite {
+        return sftp.ErrSSHFxFailure
+    }
+    return sftpError(services.MoveEntry(fs.user, src, dst, dst.Exists()))
+}
+
+// Filelist answers directory listings and stat calls
+func (fs *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+    entry, err := fs.lookup(r.Filepath)
+    if err != nil {
+        return nil, err
+    }
+
+    switch r.Method {
+    case "List":
+        if !entry.IsRoot() && entry.Folder == nil {
+            return nil, sftp.ErrSSHFxNoSuchFile
+        }
+        var folderID *int
+        if entry.Folder != nil {
+            folderID = &entry.Folder.ID
+        }
+        listing, err := services.ListFolder(fs.user, folderID)
+        if err != nil {
+            return nil, sftpError(err)
+        }
+        infos := make(sftpListing, 0, len(listing.Folders)+len(listing.Files))
+        for i := range listing.Folders {
+            infos = append(infos, sftpFolderInfo(&listing.Folders[i]))
+        }
+        for i := range listing.Files {
+            infos = append(infos, sftpFileInfo(&listing.Files[i]))
+        }
+        return infos, nil
+    case "Stat", "Lstat":
+        switch {
+        case entry.IsRoot():
+            return sftpListing{&sftpInfo{name: "/", dir: true}}, nil
+        case entry.Folder != nil:
+            return sftpListing{sftpFolderInfo(entry.Folder)}, nil
+        case entry.File != nil:
+            return sftpListing{sftpFileInfo(entry.File)}, nil
+        }
+        return nil, sftp.ErrSSHFxNoSuchFile
+    default:
+        return nil, sftp.ErrSSHFxOpUnsupported
+    }
+}
+
+type sftpListing []os.FileInfo
+
+func (l sftpListing) ListAt(dst []os.FileInfo, offset int64) (int, error) {
+    if offset >= int64(len(l)) {
+        return 0, io.EOF
+    }
+    n := copy(dst, l[offset:])
+    if n < len(dst) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+// sftpInfo is the os.FileInfo of a folder or file
+type sftpInfo struct {
+    name    string
+    size    int64
+    modTime time.Time
+    dir     bool
+}
+
+func sftpFolderInfo(f *models.Folder) *sftpInfo {
+    return &sftpInfo{name: f.Name, modTime: f.CreatedAt, dir: true}
+}
+
+func sftpFileInfo(f *models.File) *sftpInfo {
+    return &sftpInfo{name: f.Filename, size: f.Size, modTime: f.UploadDate}
+}
+
+func (i *sftpInfo) Name() string       { return i.name }
+func (i *sftpInfo) Size() int64        { return i.size }
+func (i *sftpInfo) ModTime() time.Time { return i.modTime }
+func (i *sftpInfo) IsDir() bool        { return i.dir }
+func (i *sftpInfo) Sys() any           { return nil }
+
+func (i *sftpInfo) Mode() os.FileMode {
+    if i.dir {
+        return os.ModeDir | 0755
+    }
+    return 0644
+}
@@ -0,0 +1,213 @@
+package controllers
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "os"
+    "slices"
+    "strings"
+    "time"
+
+    "github.com/pkg/sftp"
+    "golang.org/x/crypto/ssh"
+
+    "file-service/config"
+    "file-service/middleware"
+    "file-service/services"
+)
+
+// Embedded SFTP server over the user's folders, for partners and scripts that
+// can only push files over SFTP. Users sign in with their password, a
+// personal access token as the password, or a public key registered at
+// /me/ssh-keys. It only starts when SFTP_ADDR is set.
+
+// sftpHostKeyPath is where the server's host key is kept; one is generated on first start
+func sftpHostKeyPath() string {
+    return config.GetEnvDefault("SFTP_HOST_KEY_PATH", "./sftp_host_ed25519_key")
+}
+
+// sftpHandshakeTimeout bounds how long a client may take to connect and sign
+// in, so idle or half-open connections do not pile up
+func sftpHandshakeTimeout() time.Duration {
+    return config.GetEnvDuration("SFTP_HANDSHAKE_TIMEOUT", 30*time.Second)
+}
+
+// Permission extensions set at login and read back by the session
+const (
+    sftpUserExt     = "username"
+    sftpReadOnlyExt = "read-only"
+)
+
+// StartSFTPServer listens on SFTP_ADDR (e.g. ":2022") in the background.
+// It does nothing when SFTP_ADDR is unset.
+func StartSFTPServer() error {
+    addr := config.GetEnv("SFTP_ADDR")
+    if addr == "" {
+        return nil
+    }
+
+    hostKey, err := loadSFTPHostKey(sftpHostKeyPath())
+    if err != nil {
+        return fmt.Errorf("SFTP host key: %w", err)
+    }
+    cfg := &ssh.ServerConfig{
+        PasswordCallback:  sftpPasswordAuth,
+        PublicKeyCallback: sftpPublicKeyAuth,
+        ServerVersion:     "SSH-2.0-FileVault",
+    }
+    cfg.AddHostKey(hostKey)
+
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    log.Println("SFTP server started on", addr, "with host key", ssh.FingerprintSHA256(hostKey.PublicKey()))
+
+    go serveSFTP(listener, cfg)
+    return nil
+}
+
+// serveSFTP accepts connections until the listener is closed. Other accept
+// errors, such as running out of file descriptors, are retried with a
+// growing delay like net/http does.
+func serveSFTP(listener net.Listener, cfg *ssh.ServerConfig) {
+    var delay time.Duration
+    for {
+        conn, err := listener.Accept()
+        if errors.Is(err, net.ErrClosed) {
+            return
+        }
+        if err != nil {
+            delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+            log.Printf("SFTP accept failed, retrying in %v: %v", delay, err)
+            time.Sleep(delay)
+            continue
+        }
+        delay = 0
+        go serveSFTPConn(conn, cfg)
+    }
+}
+
+// loadSFTPHostKey reads the host key, generating and saving an ed25519 key
+// if there is none yet so the fingerprint stays stable across restarts
+func loadSFTPHostKey(path string) (ssh.Signer, error) {
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        _, priv, err := ed25519.GenerateKey(rand.Reader)
+        if err != nil {
+            return nil, err
+        }
+        block, err := ssh.MarshalPrivateKey(priv, "file-service sftp")
+        if err != nil {
+            return nil, err
+        }
+        data = pem.EncodeToMemory(block)
+        if err := os.WriteFile(path, data, 0600); err != nil {
+            return nil, err
+        }
+        log.Println("Generated SFTP host key at", path)
+    } else if err != nil {
+        return nil, err
+    }
+    return ssh.ParsePrivateKey(data)
+}
+
+func sftpPermissions(username string, readOnly bool) *ssh.Permissions {
+    ext := map[string]string{sftpUserExt: username}
+    if readOnly {
+        ext[sftpReadOnlyExt] = "true"
+    }
+    return &ssh.Permissions{Extensions: ext}
+}
+
+// sftpPasswordAuth accepts the account password, checked by the auth service
+// with its rate limits and lockout, or a personal access token belonging to
+// the user. Tokens without files:write get a read-only session.
+func sftpPasswordAuth(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+    username, secret := meta.User(), string(password)
+
+    if strings.HasPrefix(secret, "fvp_") {
+        owner, err := services.LookupAccessToken(secret)
+        if err != nil || owner.Username != username || !slices.Contains(owner.Scopes, middleware.ScopeFilesRead) {
+            return nil, errors.New("invalid credentials")
+        }
+        return sftpPermissions(owner.Username, !slices.Contains(owner.Scopes, middleware.ScopeFilesWrite)), nil
+    }
+
+    host, _, _ := net.SplitHostPort(meta.RemoteAddr().String())
+    owner, err := services.VerifyPassword(username, secret, host)
+    if err != nil {
+        log.Printf("SFTP password login for %s from %s refused: %v", username, host, err)
+        return nil, errors.New("invalid credentials")
+    }
+    return sftpPermissions(owner.Username, false), nil
+}
+
+func sftpPublicKeyAuth(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+    k, err := services.LookupSSHKey(meta.User(), key)
+    if err != nil {
+        if err != services.ErrSSHKeyNotFound {
+            log.Println("SFTP key lookup failed:", err)
+        }
+        return nil, errors.New("unknown public key")
+    }
+    return sftpPermissions(k.Username, false), nil
+}
+
+// serveSFTPConn runs one SSH connection. The only thing offered on it is
+// the sftp subsystem; shells and port forwarding are refused.
+func serveSFTPConn(conn net.Conn, cfg *ssh.ServerConfig) {
+    defer conn.Close()
+
+    conn.SetDeadline(time.Now().Add(sftpHandshakeTimeout()))
+    sconn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+    if err != nil {
+        return
+    }
+    defer sconn.Close()
+    conn.SetDeadline(time.Time{})
+    go ssh.DiscardRequests(reqs)
+
+    fs := &sftpFS{
+        user:     sconn.Permissions.Extensions[sftpUserExt],
+        readOnly: sconn.Permissions.Extensions[sftpReadOnlyExt] == "true",
+    }
+    for newChan := range chans {
+        if newChan.ChannelType() != "session" {
+            newChan.Reject(ssh.UnknownChannelType, "only sftp sessions are supported")
+            continue
+        }
+        channel, requests, err := newChan.Accept()
+        if err != nil {
+            continue
+        }
+        go serveSFTPSession(channel, requests, fs)
+    }
+}
+
+func serveSFTPSession(channel ssh.Channel, requests <-chan *ssh.Request, fs *sftpFS) {
+    defer channel.Close()
+
+    for req := range requests {
+        // The payload of a subsystem request is the length-prefixed name
+        ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+        req.Reply(ok, nil)
+        if !ok {
+            continue
+        }
+
+        go ssh.DiscardRequests(requests)
+        server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+        if err := server.Serve(); err != nil && !errors.Is(err, io.EOF) {
+            log.Println("SFTP session for", fs.user, "ended:", err)
+        }
+        server.Close()
+        return
+    }
+}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "net"
+    "testing"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+)
+
+func testSFTPConfig(t *testing.T) *ssh.ServerConfig {
+    t.Helper()
+    _, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signer, err := ssh.NewSignerFromKey(priv)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cfg := &ssh.ServerConfig{NoClientAuth: true}
+    cfg.AddHostKey(signer)
+    return cfg
+}
+
+// waitDone fails the test unless done is closed within d
+func waitDone(t *testing.T, done <-chan struct{}, d time.Duration, what string) {
+    t.Helper()
+    select {
+    case <-done:
+    case <-time.After(d):
+        t.Fatalf("%s did not return within %v", what, d)
+    }
+}
+
+func TestSFTPServeStopsWhenListenerCloses(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    done := make(chan struct{})
+    go func() {
+        serveSFTP(listener, testSFTPConfig(t))
+        close(done)
+    }()
+    listener.Close()
+    waitDone(t, done, 2*time.Second, "serveSFTP")
+}
+
+// A client that connects and never speaks is dropped after the handshake timeout
+func TestSFTPHandshakeTimeout(t *testing.T) {
+    t.Setenv("SFTP_HANDSHAKE_TIMEOUT", "100ms")
+    server, client := net.Pipe()
+    defer client.Close()
+
+    done := make(chan struct{})
+    go func() {
+        serveSFTPConn(server, testSFTPConfig(t))
+        close(done)
+    }()
+    waitDone(t, done, 2*time.Second, "serveSFTPConn")
+}
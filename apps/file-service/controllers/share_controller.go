@@ -0,0 +1,53 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+
+    "file-service/services"
+)
+
+// ListShareLinks lists a file's share links, including revoked ones
+func ListShareLinks(w http.ResponseWriter, r *http.Request) {
+    f, ok := authorizeFile(w, r, services.AccessEditor)
+    if !ok {
+        return
+    }
+
+    links, err := services.ListShareLinks(f.ID)
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(links)
+}
+
+// RevokeShareLink turns off one of a file's share links for good
+func RevokeShareLink(w http.ResponseWriter, r *http.Request) {
+    f, ok := authorizeFile(w, r, services.AccessEditor)
+    if !ok {
+        return
+    }
+    linkID, err := strconv.Atoi(mux.Vars(r)["linkID"])
+    if err != nil {
+        http.Error(w, "Share link not found", http.StatusNotFound)
+        return
+    }
+
+    err = services.RevokeShareLink(f.ID, linkID)
+    if errors.Is(err, services.ErrLinkNotFound) {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+
+    "file-service/middleware"
+    "file-service/services"
+)
+
+// ListSSHKeys lists the public keys the logged-in user can sign in to SFTP with
+func ListSSHKeys(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    keys, err := services.ListSSHKeys(user)
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(keys)
+}
+
+// AddSSHKey registers {"public_key", "name"}, where public_key is a line from
+// an authorized_keys or .pub file and name defaults to the key's comment
+func AddSSHKey(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    var req struct {
+        Name      string `json:"name"`
+        PublicKey string `json:"public_key"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+
+    key, err := services.AddSSHKey(user, req.Name, req.PublicKey)
+    if errors.Is(err, services.ErrSSHKeyInvalid) || errors.Is(err, services.ErrSSHKeyNameRequired) {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if errors.Is(err, services.ErrSSHKeyInUse) {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    }
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(key)
+}
+
+// DeleteSSHKey removes one of the logged-in user's SSH keys
+func DeleteSSHKey(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        http.Error(w, "SSH key not found", http.StatusNotFound)
+        return
+    }
+
+    err = services.DeleteSSHKey(user, id)
+    if errors.Is(err, services.ErrSSHKeyNotFound) {
+        http.Error(w, "SSH key not found", http.StatusNotFound)
+        return
+    }
+    if err != nil {
+        dbError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+
+    "file-service/middleware"
+    "file-service/services"
+)
+
+// trashError maps trash failures to HTTP responses
+func trashError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, services.ErrNotInTrash):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, services.ErrNameTaken):
+        http.Error(w, err.Error(), http.StatusConflict)
+    default:
+        dbError(w, err)
+    }
+}
+
+// ListTrash lists the logged-in user's trashed files with when each will be purged
+func ListTrash(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    items, err := services.ListTrash(user)
+    if err != nil {
+        trashError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(items)
+}
+
+// RestoreTrashedFile puts a trashed file back in its original folder.
+// It fails with 409 if a live file has taken the name meanwhile.
+func RestoreTrashedFile(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return
+    }
+
+    file, err := services.RestoreFile(user, id)
+    if err != nil {
+        trashError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(file)
+}
+
+// PurgeTrashedFile permanently deletes a single trashed file
+func PurgeTrashedFile(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    id, err := strconv.Atoi(mux.Vars(r)["id"])
+    if err != nil {
+        http.Error(w, "File not found", http.StatusNotFound)
+        return
+    }
+
+    if err := services.PurgeTrashedFile(user, id); err != nil {
+        trashError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// EmptyTrash permanently deletes everything in the logged-in user's trash
+func EmptyTrash(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    purged, err := services.EmptyTrash(user)
+    if err != nil {
+        trashError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
@@ -0,0 +1,497 @@
+package controllers
+
+import (
+    "crypto/md5"
+    "crypto/sha1"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/base64"
+    "errors"
+    "hash"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/gorilla/mux"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/middleware"
+    "file-service/models"
+    "file-service/services"
+    "file-service/utils"
+)
+
+// Resumable uploads following the tus 1.0.0 protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, expiration, checksum and termination extensions.
+
+const TusVersion = "1.0.0"
+
+// StatusChecksumMismatch is the tus-specific status for a failed Upload-Checksum.
+const StatusChecksumMismatch = 460
+
+// tusStoreSuffix names the link a finished upload is stored from
+const tusStoreSuffix = ".store"
+
+// tusLocks serialises PATCH/DELETE on the same upload within this process
+var tusLocks sync.Map
+
+func tusStagingPath() string {
+    return config.GetEnvDefault("TUS_STAGING_PATH", "./tus-staging")
+}
+
+func tusMaxSize() int64 {
+    return config.GetEnvInt64("TUS_MAX_SIZE", 10<<30) // 10GB
+}
+
+func tusExpiry() time.Duration {
+    return config.GetEnvDuration("TUS_UPLOAD_EXPIRY", 24*time.Hour)
+}
+
+func tusLock(id string) func() {
+    m, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+    mu := m.(*sync.Mutex)
+    mu.Lock()
+    return mu.Unlock
+}
+
+// tusPrecheck sets the Tus-Resumable response header and rejects clients speaking another version
+func tusPrecheck(w http.ResponseWriter, r *http.Request) bool {
+    w.Header().Set("Tus-Resumable", TusVersion)
+    if r.Header.Get("Tus-Resumable") != TusVersion {
+        w.Header().Set("Tus-Version", TusVersion)
+        http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+        return false
+    }
+    return true
+}
+
+// TusOptions advertises the server's tus capabilities (no auth required)
+func TusOptions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Tus-Resumable", TusVersion)
+    w.Header().Set("Tus-Version", TusVersion)
+    w.Header().Set("Tus-Extension", "creation,expiration,checksum,termination")
+    w.Header().Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize(), 10))
+    w.Header().Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// TusCreate starts a new upload of Upload-Length bytes
+func TusCreate(w http.ResponseWriter, r *http.Request) {
+    if !tusPrecheck(w, r) {
+        return
+    }
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+    if err != nil || length < 0 {
+        http.Error(w, "Invalid or missing Upload-Length", http.StatusBadRequest)
+        return
+    }
+    if length > tusMaxSize() {
+        http.Error(w, "Upload exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+        return
+    }
+    if err := services.CheckQuota(user, length); err != nil {
+        storeError(w, err)
+        return
+    }
+
+    meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+    filename := filepath.Base(meta["filename"])
+    if filename == "" || filename == "." || filename == "/" {
+        filename = "upload"
+    }
+
+    folderID, err := targetFolder(user, meta["folder_id"], meta["path"])
+    if err != nil {
+        storeError(w, err)
+        return
+    }
+
+    upload := models.TusUpload{
+        ID:           utils.GenerateRandomString(32),
+        Uploader:     user,
+        Filename:     filename,
+        MIMEType:     services.DetectMIMEType(filename, meta["filetype"]),
+        UploadLength: length,
+        FolderID:     folderID,
+        ExpiresAt:    time.Now().Add(tusExpiry()),
+    }
+
+    if err := os.MkdirAll(tusStagingPath(), os.ModePerm); err != nil {
+        http.Error(w, "Could not create staging area", http.StatusInternalServerError)
+        return
+    }
+    staged, err := os.Create(filepath.Join(tusStagingPath(), upload.ID))
+    if err != nil {
+        http.Error(w, "Could not create staging file", http.StatusInternalServerError)
+        return
+    }
+    staged.Close()
+
+    _, err = database.DB.Exec(
+        `INSERT INTO tus_uploads (id, uploader, filename, mime_type, upload_length, upload_offset, folder_id, expires_at)
+         VALUES ($1, $2, $3, $4, $5, 0, $6, $7)`,
+        upload.ID, upload.Uploader, upload.Filename, upload.MIMEType, upload.UploadLength, upload.FolderID, upload.ExpiresAt,
+    )
+    if err != nil {
+        os.Remove(filepath.Join(tusStagingPath(), upload.ID))
+        http.Error(w, "DB error creating upload", http.StatusInternalServerError)
+        return
+    }
+
+    // An empty file is complete as soon as it is created
+    if length == 0 {
+        if _, err := finishTusUpload(upload); err != nil {
+            storeError(w, err)
+            return
+        }
+    }
+
+    w.Header().Set("Location", "/tus/"+upload.ID)
+    w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+    w.WriteHeader(http.StatusCreated)
+}
+
+// TusHead reports how many bytes of an upload the server has, so the client can resume
+func TusHead(w http.ResponseWriter, r *http.Request) {
+    if !tusPrecheck(w, r) {
+        return
+    }
+    upload, status := loadTusUpload(r)
+    if status != http.StatusOK {
+        w.WriteHeader(status)
+        return
+    }
+
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+    w.Header().Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+    w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+    w.WriteHeader(http.StatusOK)
+}
+
+// TusPatch appends a chunk at Upload-Offset and completes the upload once all bytes are in
+func TusPatch(w http.ResponseWriter, r *http.Request) {
+    if !tusPrecheck(w, r) {
+        return
+    }
+    if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+        http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+        return
+    }
+
+    unlock := tusLock(mux.Vars(r)["id"])
+    defer unlock()
+
+    upload, status := loadTusUpload(r)
+    if status != http.StatusOK {
+        http.Error(w, http.StatusText(status), status)
+        return
+    }
+
+    offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+    if err != nil || offset < 0 {
+        http.Error(w, "Invalid or missing Upload-Offset", http.StatusBadRequest)
+        return
+    }
+    if offset != upload.UploadOffset {
+        http.Error(w, "Upload-Offset does not match current offset", http.StatusConflict)
+        return
+    }
+
+    var checksum hash.Hash
+    var expected []byte
+    if header := r.Header.Get("Upload-Checksum"); header != "" {
+        checksum, expected, err = parseTusChecksum(header)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    stagedPath := filepath.Join(tusStagingPath(), upload.ID)
+    staged, err := os.OpenFile(stagedPath, os.O_WRONLY, 0)
+    if err != nil {
+        http.Error(w, "Staging file missing", http.StatusInternalServerError)
+        return
+    }
+    defer staged.Close()
+
+    // Drop anything left over from an interrupted chunk before appending
+    if err := staged.Truncate(offset); err != nil {
+        http.Error(w, "Could not write chunk", http.StatusInternalServerError)
+        return
+    }
+    if _, err := staged.Seek(offset, io.SeekStart); err != nil {
+        http.Error(w, "Could not write chunk", http.StatusInternalServerError)
+        return
+    }
+
+    var body io.Reader = http.MaxBytesReader(w, r.Body, upload.UploadLength-offset)
+    if checksum != nil {
+        body = io.TeeReader(body, checksum)
+    }
+    n, copyErr := io.Copy(staged, body)
+
+    var maxBytesErr *http.MaxBytesError
+    if errors.As(copyErr, &maxBytesErr) {
+        staged.Truncate(offset)
+        http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+        return
+    }
+    if checksum != nil {
+        // With a checksum the chunk is all-or-nothing
+        if copyErr != nil || string(checksum.Sum(nil)) != string(expected) {
+            staged.Truncate(offset)
+            if copyErr != nil {
+                http.Error(w, "Could not read chunk", http.StatusInternalServerError)
+                return
+            }
+            http.Error(w, "Checksum Mismatch", StatusChecksumMismatch)
+            return
+        }
+    }
+
+    // Without a checksum whatever arrived before a disconnect is kept for resuming
+    upload.UploadOffset = offset + n
+    upload.ExpiresAt = time.Now().Add(tusExpiry())
+    _, err = database.DB.Exec(
+        "UPDATE tus_uploads SET upload_offset = $1, expires_at = $2 WHERE id = $3",
+        upload.UploadOffset, upload.ExpiresAt, upload.ID,
+    )
+    if err != nil {
+        http.Error(w, "DB error updating upload", http.StatusInternalServerError)
+        return
+    }
+    if copyErr != nil {
+        http.Error(w, "Upload interrupted", http.StatusInternalServerError)
+        return
+    }
+
+    if upload.UploadOffset == upload.UploadLength {
+        if _, err := finishTusUpload(upload); err != nil {
+            storeError(w, err)
+            return
+        }
+    }
+
+    w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+    w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// TusDelete terminates an unfinished upload and frees its staged bytes
+func TusDelete(w http.ResponseWriter, r *http.Request) {
+    if !tusPrecheck(w, r) {
+        return
+    }
+
+    unlock := tusLock(mux.Vars(r)["id"])
+    defer unlock()
+
+    upload, status := loadTusUpload(r)
+    if status != http.StatusOK && status != http.StatusGone {
+        http.Error(w, http.StatusText(status), status)
+        return
+    }
+
+    if _, err := database.DB.Exec("DELETE FROM tus_uploads WHERE id = $1", upload.ID); err != nil {
+        http.Error(w, "DB error deleting upload", http.StatusInternalServerError)
+        return
+    }
+    os.Remove(filepath.Join(tusStagingPath(), upload.ID))
+    tusLocks.Delete(upload.ID)
+
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// loadTusUpload fetches the upload named in the URL if it belongs to the logged-in user.
+// Expired uploads are reported as 410 Gone.
+func loadTusUpload(r *http.Request) (models.TusUpload, int) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        return models.TusUpload{}, http.StatusUnauthorized
+    }
+
+    var u models.TusUpload
+    err := database.DB.QueryRow(
+        `SELECT id, uploader, filename, mime_type, upload_length, upload_offset, folder_id, created_at, expires_at
+         FROM tus_uploads WHERE id = $1`,
+        mux.Vars(r)["id"],
+    ).Scan(&u.ID, &u.Uploader, &u.Filename, &u.MIMEType, &u.UploadLength, &u.UploadOffset, &u.FolderID, &u.CreatedAt, &u.ExpiresAt)
+    if err == sql.ErrNoRows || (err == nil && u.Uploader != user) {
+        return u, http.StatusNotFound
+    }
+    if err != nil {
+        return u, http.StatusInternalServerError
+    }
+    if time.Now().After(u.ExpiresAt) {
+        return u, http.StatusGone
+    }
+    return u, http.StatusOK
+}
+
+// finishTusUpload hashes the staged bytes and hands them to the same dedup
+// and insert path as /upload, then drops the staging state. StoreFile may
+// move the file it is given into storage before its transaction commits, so
+// it gets a second name for the bytes; the upload's own file is only removed
+// once the file entry exists, and a failed attempt can be retried.
+func finishTusUpload(upload models.TusUpload) (models.File, error) {
+    stagedPath := filepath.Join(tusStagingPath(), upload.ID)
+
+    blob, err := stageTusFile(stagedPath)
+    if err != nil {
+        return models.File{}, err
+    }
+    defer blob.Discard()
+
+    file, err := services.StoreFile(upload.Uploader, upload.Filename, upload.MIMEType, upload.FolderID, blob)
+    if err != nil {
+        return models.File{}, err
+    }
+
+    database.DB.Exec("DELETE FROM tus_uploads WHERE id = $1", upload.ID)
+    os.Remove(stagedPath)
+    return file, nil
+}
+
+// stageTusFile hard-links the finished upload next to itself, or copies it
+// when the filesystem cannot link, and stages that
+func stageTusFile(stagedPath string) (*services.StagedBlob, error) {
+    linkPath := stagedPath + tusStoreSuffix
+    os.Remove(linkPath)
+    if err := os.Link(stagedPath, linkPath); err == nil {
+        return services.StageFile(linkPath)
+    }
+
+    f, err := os.Open(stagedPath)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    return services.StageBlob(f)
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2"
+func parseTusMetadata(header string) map[string]string {
+    meta := map[string]string{}
+    for _, pair := range strings.Split(header, ",") {
+        parts := strings.SplitN(strings.TrimSpace(pair), " ", 2)
+        if parts[0] == "" {
+            continue
+        }
+        value := ""
+        if len(parts) == 2 {
+            decoded, err := base64.StdEncoding.DecodeString(parts[1])
+            if err != nil {
+                continue
+            }
+            value = string(decoded)
+        }
+        meta[parts[0]] = value
+    }
+    return meta
+}
+
+// parseTusChecksum decodes "algorithm base64digest" from Upload-Checksum
+func parseTusChecksum(header string) (hash.Hash, []byte, error) {
+    parts := strings.SplitN(header, " ", 2)
+    if len(parts) != 2 {
+        return nil, nil, errors.New("Invalid Upload-Checksum")
+    }
+    expected, err := base64.StdEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, nil, errors.New("Invalid Upload-Checksum")
+    }
+    switch parts[0] {
+    case "md5":
+        return md5.New(), expected, nil
+    case "sha1":
+        return sha1.New(), expected, nil
+    case "sha256":
+        return sha256.New(), expected, nil
+    }
+    return nil, nil, errors.New("Unsupported checksum algorithm")
+}
+
+// PurgeExpiredTusUploads removes expired partial uploads and their staged bytes
+func PurgeExpiredTusUploads() error {
+    if err := deleteTusUploads("expires_at < now()"); err != nil {
+        return err
+    }
+    return purgeOrphanedTusFiles()
+}
+
+// purgeOrphanedTusFiles removes staged files whose upload row is gone without
+// going through deleteTusUploads: deleting a folder aborts the uploads into
+// it by cascade, and a crash can leave a half-finished link behind. Files
+// touched within the expiry period are left alone, so an upload that is
+// still being created is never caught.
+func purgeOrphanedTusFiles() error {
+    entries, err := os.ReadDir(tusStagingPath())
+    if errors.Is(err, os.ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    cutoff := time.Now().Add(-tusExpiry())
+    for _, e := range entries {
+        info, err := e.Info()
+        if err != nil || e.IsDir() || info.ModTime().After(cutoff) {
+            continue
+        }
+        id := strings.TrimSuffix(e.Name(), tusStoreSuffix)
+        var exists bool
+        if err := database.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM tus_uploads WHERE id = $1)", id).Scan(&exists); err != nil {
+            return err
+        }
+        if !exists || id != e.Name() {
+            os.Remove(filepath.Join(tusStagingPath(), e.Name()))
+        }
+    }
+    return nil
+}
+
+// deleteTusUploads removes the partial uploads matching where, and their staged bytes
+func deleteTusUploads(where string, args ...interface{}) error {
+    rows, err := database.DB.Query("DELETE FROM tus_uploads WHERE "+where+" RETURNING id", args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return err
+        }
+        os.Remove(filepath.Join(tusStagingPath(), id))
+        tusLocks.Delete(id)
+    }
+    return rows.Err()
+}
+
+// StartTusCleanup runs PurgeExpiredTusUploads every interval in the background
+func StartTusCleanup(interval time.Duration) {
+    go func() {
+        for range time.Tick(interval) {
+            if err := PurgeExpiredTusUploads(); err != nil {
+                log.Println("tus cleanup failed:", err)
+            }
+        }
+    }()
+}
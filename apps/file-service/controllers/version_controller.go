@@ -0,0 +1,128 @@
+package controllers
+
+import (
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+
+    "github.com/gorilla/mux"
+
+    "file-service/database"
+    "file-service/services"
+)
+
+// versionError maps version history failures to HTTP responses
+func versionError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, sql.ErrNoRows):
+        http.Error(w, "File not found", http.StatusNotFound)
+    case errors.Is(err, services.ErrVersionNotFound):
+        http.Error(w, err.Error(), http.StatusNotFound)
+    case errors.Is(err, services.ErrFileTooLarge):
+        http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+    case errors.Is(err, services.ErrQuotaExceeded):
+        http.Error(w, err.Error(), http.StatusInsufficientStorage)
+    default:
+        dbError(w, err)
+    }
+}
+
+// routeVersion parses the {version} route variable
+func routeVersion(w http.ResponseWriter, r *http.Request) (int, bool) {
+    version, err := strconv.Atoi(mux.Vars(r)["version"])
+    if err != nil {
+        http.Error(w, "Version not found", http.StatusNotFound)
+        return 0, false
+    }
+    return version, true
+}
+
+// ListFileVersions lists every stored version of a file, newest first
+func ListFileVersions(w http.ResponseWriter, r *http.Request) {
+    f, ok := authorizeFile(w, r, services.AccessViewer)
+    if !ok {
+        return
+    }
+
+    versions, err := services.ListVersions(database.DB, f.ID)
+    if err != nil {
+        versionError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(versions)
+}
+
+// DownloadFileVersion serves the content of one specific version
+func DownloadFileVersion(w http.ResponseWriter, r *http.Request) {
+    f, ok := authorizeFile(w, r, services.AccessDownloader)
+    if !ok {
+        return
+    }
+    version, ok := routeVersion(w, r)
+    if !ok {
+        return
+    }
+
+    v, err := services.GetVersion(database.DB, f.ID, version)
+    if err != nil {
+        versionError(w, err)
+        return
+    }
+    serveBlob(w, r, f.Filename, v.ContentHash)
+}
+
+// RestoreFileVersion makes an old version current by adding it as a new version
+func RestoreFileVersion(w http.ResponseWriter, r *http.Request) {
+    f, ok := authorizeFile(w, r, services.AccessEditor)
+    if !ok {
+        return
+    }
+    version, ok := routeVersion(w, r)
+    if !ok {
+        return
+    }
+
+    restored, err := services.RestoreVersion(f.ID, version)
+    if err != nil {
+        versionError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(restored)
+}
+
+// PruneFileVersions deletes old versions outside {"keep_last": n, "keep_days": d}.
+// The current version is never deleted.
+func PruneFileVersions(w http.ResponseWriter, r *http.Request) {
+    f, ok := authorizeFile(w, r, services.AccessOwner)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        KeepLast int `json:"keep_last"`
+        KeepDays int `json:"keep_days"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.KeepLast < 0 || req.KeepDays < 0 {
+        http.Error(w, "Bad request", http.StatusBadRequest)
+        return
+    }
+    if req.KeepLast == 0 && req.KeepDays == 0 {
+        http.Error(w, "keep_last or keep_days is required", http.StatusBadRequest)
+        return
+    }
+
+    removed, err := services.PruneVersions(f.ID, req.KeepLast, req.KeepDays)
+    if err != nil {
+        versionError(w, err)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]int{"removed": removed})
+}
@@ -0,0 +1,788 @@
+package controllers
+
+import (
+    "database/sql"
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/middleware"
+    "file-service/models"
+    "file-service/services"
+)
+
+// WebDAV class 1 and 2 (RFC 4918) over the user's folders and files, so the
+// vault can be mounted from Finder, Windows Explorer, davfs2 or rclone.
+// Collections are folders and resources are files; PUT goes through the same
+// staging and dedup path as /upload, DELETE moves files to the trash.
+
+// WebDAVPrefix is where the WebDAV tree is mounted
+const WebDAVPrefix = "/webdav"
+
+const davNS = "DAV:"
+
+// davAllowed lists the methods advertised by OPTIONS
+const davAllowed = "OPTIONS, PROPFIND, PROPPATCH, GET, HEAD, PUT, DELETE, MKCOL, MOVE, COPY, LOCK, UNLOCK"
+
+// WebDAVOptions advertises WebDAV support (no auth required, some clients probe first)
+func WebDAVOptions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("DAV", "1, 2")
+    w.Header().Set("MS-Author-Via", "DAV")
+    w.Header().Set("Allow", davAllowed)
+    w.WriteHeader(http.StatusOK)
+}
+
+// WebDAV serves every authenticated WebDAV method. Reading needs the
+// files:read scope and everything else files:write.
+func WebDAV(w http.ResponseWriter, r *http.Request) {
+    user, ok := r.Context().Value(middleware.UsernameKey).(string)
+    if !ok || user == "" {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    scope := middleware.ScopeFilesWrite
+    switch r.Method {
+    case "PROPFIND", http.MethodGet, http.MethodHead:
+        scope = middleware.ScopeFilesRead
+    }
+    if !middleware.HasScope(r, scope) {
+        http.Error(w, "Token is missing the "+scope+" scope", http.StatusForbidden)
+        return
+    }
+
+    p, ok := davPath(r.URL.Path)
+    if !ok {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    }
+
+    switch r.Method {
+    case "PROPFIND":
+        davPropfind(w, r, user, p)
+    case "PROPPATCH":
+        davProppatch(w, r, user, p)
+    case http.MethodGet, http.MethodHead:
+        davGet(w, r, user, p)
+    case http.MethodPut:
+        davPut(w, r, user, p)
+    case http.MethodDelete:
+        davDelete(w, r, user, p)
+    case "MKCOL":
+        davMkcol(w, r, user, p)
+    case "MOVE", "COPY":
+        davMoveCopy(w, r, user, p, r.Method == "MOVE")
+    case "LOCK":
+        davLockResource(w, r, user, p)
+    case "UNLOCK":
+        davUnlockResource(w, r, user, p)
+    default:
+        w.Header().Set("Allow", davAllowed)
+        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+// davPath turns a request path under WebDAVPrefix into a cleaned path in the
+// user's tree, "/" being the root
+func davPath(urlPath string) (string, bool) {
+    if urlPath != WebDAVPrefix && !strings.HasPrefix(urlPath, WebDAVPrefix+"/") {
+        return "", false
+    }
+    return path.Clean("/" + strings.TrimPrefix(urlPath, WebDAVPrefix)), true
+}
+
+// davHref is the URL path of p, with a trailing slash for collections
+func davHref(p string, collection bool) string {
+    var b strings.Builder
+    b.WriteString(WebDAVPrefix)
+    for _, seg := range strings.Split(strings.Trim(p, "/"), "/") {
+        if seg != "" {
+            b.WriteString("/" + url.PathEscape(seg))
+        }
+    }
+    if collection {
+        b.WriteString("/")
+    }
+    return b.String()
+}
+
+// davError maps service failures to WebDAV status codes. A missing folder
+// along the path is a 409, as RFC 4918 asks for a missing parent collection.
+func davError(w http.ResponseWriter, err error) {
+    switch {
+    case errors.Is(err, services.ErrFolderNotFound):
+        http.Error(w, "Parent collection does not exist", http.StatusConflict)
+    case errors.Is(err, sql.ErrNoRows):
+        http.Error(w, "Not found", http.StatusNotFound)
+    case errors.Is(err, services.ErrNameTaken):
+        http.Error(w, err.Error(), http.StatusPreconditionFailed)
+    case errors.Is(err, services.ErrInvalidName), errors.Is(err, services.ErrFolderCycle):
+        http.Error(w, err.Error(), http.StatusForbidden)
+    case errors.Is(err, services.ErrQuotaExceeded), errors.Is(err, services.ErrFileTooLarge):
+        http.Error(w, err.Error(), http.StatusInsufficientStorage)
+    default:
+        http.Error(w, "DB error", http.StatusInternalServerError)
+    }
+}
+
+// davLookup resolves p, answering the request itself when that fails
+func davLookup(w http.ResponseWriter, user, p string) (services.PathEntry, bool) {
+    entry, err := services.LookupPath(database.DB, user, p)
+    if errors.Is(err, services.ErrInvalidName) {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return entry, false
+    }
+    if err != nil {
+        davError(w, err)
+        return entry, false
+    }
+    return entry, true
+}
+
+// davCheckLocks answers 423 unless the request holds the locks on p
+func davCheckLocks(w http.ResponseWriter, r *http.Request, user, p string, recursive bool) bool {
+    if davLocks.Allowed(user, p, recursive, davSubmittedTokens(r.Header.Get("If"))) {
+        return true
+    }
+    http.Error(w, "Locked", http.StatusLocked)
+    return false
+}
+
+// davRemove deletes whatever entry names: files go to the trash, folders
+// with everything in them
+func davRemove(user string, entry services.PathEntry) error {
+    if entry.File != nil {
+        return database.WithTx(func(tx *sql.Tx) error {
+            return services.TrashFileTx(tx, entry.File.ID)
+        })
+    }
+    return services.DeleteFolder(user, entry.Folder.ID)
+}
+
+func davETag(f *models.File) string {
+    return `"` + f.ContentHash + `"`
+}
+
+func davGet(w http.ResponseWriter, r *http.Request, user, p string) {
+    entry, ok := davLookup(w, user, p)
+    if !ok {
+        return
+    }
+    if entry.File == nil {
+        if entry.Exists() {
+            http.Error(w, "Collections cannot be downloaded, use PROPFIND", http.StatusMethodNotAllowed)
+        } else {
+            http.Error(w, "Not found", http.StatusNotFound)
+        }
+        return
+    }
+
+    w.Header().Set("ETag", davETag(entry.File))
+    w.Header().Set("Content-Type", entry.File.MIMEType)
+    serveBlob(w, r, entry.File.Filename, entry.File.ContentHash)
+}
+
+func davPut(w http.ResponseWriter, r *http.Request, user, p string) {
+    entry, ok := davLookup(w, user, p)
+    if !ok {
+        return
+    }
+    if entry.IsRoot() || entry.Folder != nil {
+        http.Error(w, "Cannot PUT to a collection", http.StatusMethodNotAllowed)
+        return
+    }
+    if !davCheckLocks(w, r, user, p, false) {
+        return
+    }
+
+    body := http.MaxBytesReader(w, r.Body, config.GetEnvInt64("MAX_UPLOAD_SIZE", 2<<30))
+    blob, err := services.StageBlob(body)
+    if err != nil {
+        uploadReadError(w, err)
+        return
+    }
+    defer blob.Discard()
+
+    mimeType := services.DetectMIMEType(entry.Name, r.Header.Get("Content-Type"))
+    file, err := services.StoreFile(user, entry.Name, mimeType, entry.ParentID, blob)
+    if err != nil {
+        davError(w, err)
+        return
+    }
+
+    w.Header().Set("ETag", davETag(&file))
+    if entry.File == nil {
+        w.WriteHeader(http.StatusCreated)
+    } else {
+        w.WriteHeader(http.StatusNoContent)
+    }
+}
+
+func davDelete(w http.ResponseWriter, r *http.Request, user, p string) {
+    entry, ok := davLookup(w, user, p)
+    if !ok {
+        return
+    }
+    if entry.IsRoot() {
+        http.Error(w, "Cannot delete the root collection", http.StatusForbidden)
+        return
+    }
+    if !entry.Exists() {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    }
+    if !davCheckLocks(w, r, user, p, true) {
+        return
+    }
+
+    if err := davRemove(user, entry); err != nil {
+        davError(w, err)
+        return
+    }
+    davLocks.Remove(user, p)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func davMkcol(w http.ResponseWriter, r *http.Request, user, p string) {
+    if r.ContentLength > 0 {
+        http.Error(w, "MKCOL with a body is not supported", http.StatusUnsupportedMediaType)
+        return
+    }
+    entry, ok := davLookup(w, user, p)
+    if !ok {
+        return
+    }
+    if entry.Exists() {
+        http.Error(w, "Already exists", http.StatusMethodNotAllowed)
+        return
+    }
+    if !davCheckLocks(w, r, user, p, false) {
+        return
+    }
+
+    if _, err := services.CreateFolder(database.DB, user, entry.ParentID, entry.Name); err != nil {
+        davError(w, err)
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+}
+
+// davMoveCopy handles MOVE and COPY. Locks are not carried along: the moved
+// resource's locks are dropped, and a copy starts unlocked.
+func davMoveCopy(w http.ResponseWriter, r *http.Request, user, p string, move bool) {
+    dest, err := url.Parse(r.Header.Get("Destination"))
+    if err != nil || dest.Path == "" {
+        http.Error(w, "Missing or invalid Destination header", http.StatusBadRequest)
+        return
+    }
+    if dest.Host != "" && dest.Host != r.Host {
+        http.Error(w, "Destination is on another server", http.StatusBadGateway)
+        return
+    }
+    destPath, ok := davPath(dest.Path)
+    if !ok {
+        http.Error(w, "Destination is outside the WebDAV tree", http.StatusBadGateway)
+        return
+    }
+    overwrite := !strings.EqualFold(r.Header.Get("Overwrite"), "F")
+
+    recursive := true
+    switch r.Header.Get("Depth") {
+    case "", "infinity":
+    case "0":
+        recursive = false
+    default:
+        http.Error(w, "Invalid Depth", http.StatusBadRequest)
+        return
+    }
+    if move && !recursive {
+        http.Error(w, "MOVE requires Depth: infinity", http.StatusBadRequest)
+        return
+    }
+
+    src, ok := davLookup(w, user, p)
+    if !ok {
+        return
+    }
+    if src.IsRoot() {
+        http.Error(w, "Cannot move or copy the root collection", http.StatusForbidden)
+        return
+    }
+    if !src.Exists() {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    }
+    if destPath == p || (src.Folder != nil && davIsDescendant(destPath, p)) {
+        http.Error(w, "Source and destination overlap", http.StatusForbidden)
+        return
+    }
+    dst, ok := davLookup(w, user, destPath)
+    if !ok {
+        return
+    }
+    if dst.IsRoot() {
+        http.Error(w, "Cannot replace the root collection", http.StatusForbidden)
+        return
+    }
+
+    if move && !davCheckLocks(w, r, user, p, true) {
+        return
+    }
+    if !davCheckLocks(w, r, user, destPath, true) {
+        return
+    }
+
+    existed := dst.Exists()
+    if existed && !overwrite {
+        http.Error(w, "Destination exists", http.StatusPreconditionFailed)
+        return
+    }
+
+    // The destination is replaced in the same transaction, so it survives a
+    // move or copy that fails
+    if move {
+        err = services.MoveEntry(user, src, dst, existed)
+    } else {
+        err = services.CopyEntry(user, src, dst, existed, recursive)
+    }
+    if err != nil {
+        davError(w, err)
+        return
+    }
+    if existed {
+        davLocks.Remove(user, destPath)
+    }
+    if move {
+        davLocks.Remove(user, p)
+    }
+
+    if existed {
+        w.WriteHeader(http.StatusNoContent)
+    } else {
+        w.WriteHeader(http.StatusCreated)
+    }
+}
+
+// davAnyElement captures the name of an arbitrary XML element
+type davAnyElement struct {
+    XMLName xml.Name
+}
+
+type davPropNames struct {
+    Names []davAnyElement `xml:",any"`
+}
+
+type davPropfindRequest struct {
+    XMLName  xml.Name      `xml:"DAV: propfind"`
+    AllProp  *struct{}     `xml:"DAV: allprop"`
+    PropName *struct{}     `xml:"DAV: propname"`
+    Prop     *davPropNames `xml:"DAV: prop"`
+}
+
+// davProps are the live properties served for every resource, in allprop order
+var davProps = []string{
+    "displayname", "resourcetype", "getcontentlength", "getcontenttype", "getlastmodified",
+    "creationdate", "getetag", "supportedlock", "lockdiscovery", "quota-available-bytes", "quota-used-bytes",
+}
+
+// davResource is what PROPFIND reports on
+type davResource struct {
+    Path     string
+    Name     string
+    Folder   bool
+    File     *models.File
+    Created  time.Time
+    Modified time.Time
+}
+
+func davFolderResource(p string, f models.Folder) davResource {
+    return davResource{Path: p, Name: f.Name, Folder: true, Created: f.CreatedAt, Modified: f.CreatedAt}
+}
+
+func davFileResource(p string, f models.File) davResource {
+    return davResource{Path: p, Name: f.Filename, File: &f, Created: f.UploadDate, Modified: f.UploadDate}
+}
+
+func davPropfind(w http.ResponseWriter, r *http.Request, user, p string) {
+    depth := r.Header.Get("Depth")
+    switch depth {
+    case "0", "1":
+    case "", "infinity":
+        davWriteError(w, http.StatusForbidden, "propfind-finite-depth")
+        return
+    default:
+        http.Error(w, "Invalid Depth", http.StatusBadRequest)
+        return
+    }
+
+    var req davPropfindRequest
+    if err := xml.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+        http.Error(w, "Malformed PROPFIND body", http.StatusBadRequest)
+        return
+    }
+
+    entry, ok := davLookup(w, user, p)
+    if !ok {
+        return
+    }
+    var resources []davResource
+    switch {
+    case entry.IsRoot():
+        resources = append(resources, davResource{Path: "/", Folder: true})
+    case entry.Folder != nil:
+        resources = append(resources, davFolderResource(p, *entry.Folder))
+    case entry.File != nil:
+        resources = append(resources, davFileResource(p, *entry.File))
+    default:
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    }
+
+    if depth == "1" && resources[0].Folder {
+        var folderID *int
+        if entry.Folder != nil {
+            folderID = &entry.Folder.ID
+        }
+        listing, err := services.ListFolder(user, folderID)
+        if err != nil {
+            davError(w, err)
+            return
+        }
+        for _, f := range listing.Folders {
+            resources = append(resources, davFolderResource(path.Join(p, f.Name), f))
+        }
+        for _, f := range listing.Files {
+            resources = append(resources, davFileResource(path.Join(p, f.Filename), f))
+        }
+    }
+
+    // Quota is the same for every collection, so it is only looked up once
+    var usage *models.Usage
+    quota := func() *models.Usage {
+        if usage == nil {
+            u, err := services.GetUsage(user)
+            if err != nil {
+                return nil
+            }
+            usage = &u
+        }
+        return usage
+    }
+
+    var b strings.Builder
+    b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:">`)
+    for _, res := range resources {
+        b.WriteString("<D:response><D:href>" + davEscape(davHref(res.Path, res.Folder)) + "</D:href>")
+
+        var found, missing strings.Builder
+        switch {
+        case req.PropName != nil:
+            for _, name := range davProps {
+                if davPropValue(user, res, name, quota) != nil {
+                    found.WriteString("<D:" + name + "/>")
+                }
+            }
+        case req.Prop != nil:
+            for _, el := range req.Prop.Names {
+                var value *string
+                if el.XMLName.Space == davNS {
+                    value = davPropValue(user, res, el.XMLName.Local, quota)
+                }
+                if value == nil {
+                    missing.WriteString(davEmptyElement(el.XMLName))
+                    continue
+                }
+                found.WriteString(davElement(el.XMLName.Local, *value))
+            }
+        default:
+            // allprop, which is also what an empty body asks for
+            for _, name := range davProps {
+                if value := davPropValue(user, res, name, quota); value != nil {
+                    found.WriteString(davElement(name, *value))
+                }
+            }
+        }
+
+        if found.Len() > 0 || missing.Len() == 0 {
+            b.WriteString("<D:propstat><D:prop>" + found.String() + "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+        }
+        if missing.Len() > 0 {
+            b.WriteString("<D:propstat><D:prop>" + missing.String() + "</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>")
+        }
+        b.WriteString("</D:response>")
+    }
+    b.WriteString("</D:multistatus>")
+
+    davWriteXML(w, http.StatusMultiStatus, b.String())
+}
+
+// davPropValue renders the inner XML of a live DAV: property, or returns nil
+// when res does not have it
+func davPropValue(user string, res davResource, name string, quota func() *models.Usage) *string {
+    var v string
+    switch name {
+    case "displayname":
+        v = davEscape(res.Name)
+    case "resourcetype":
+        if res.Folder {
+            v = "<D:collection/>"
+        }
+    case "getcontentlength":
+        if res.File == nil {
+            return nil
+        }
+        v = strconv.FormatInt(res.File.Size, 10)
+    case "getcontenttype":
+        if res.File == nil {
+            return nil
+        }
+        v = davEscape(res.File.MIMEType)
+    case "getetag":
+        if res.File == nil {
+            return nil
+        }
+        v = davEscape(davETag(res.File))
+    case "getlastmodified":
+        if res.Modified.IsZero() {
+            return nil
+        }
+        v = res.Modified.UTC().Format(http.TimeFormat)
+    case "creationdate":
+        if res.Created.IsZero() {
+            return nil
+        }
+        v = res.Created.UTC().Format(time.RFC3339)
+    case "supportedlock":
+        v = "<D:lockentry><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>" +
+            "<D:lockentry><D:lockscope><D:shared/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockentry>"
+    case "lockdiscovery":
+        for _, l := range davLocks.Active(user, res.Path) {
+            v += davActiveLock(l)
+        }
+    case "quota-available-bytes", "quota-used-bytes":
+        if !res.Folder {
+            return nil
+        }
+        usage := quota()
+        if usage == nil {
+            return nil
+        }
+        if name == "quota-used-bytes" {
+            v = strconv.FormatInt(usage.UsedBytes, 10)
+        } else {
+            v = strconv.FormatInt(max(usage.LimitBytes-usage.UsedBytes, 0), 10)
+        }
+    default:
+        return nil
+    }
+    return &v
+}
+
+type davPropertyUpdate struct {
+    XMLName xml.Name       `xml:"DAV: propertyupdate"`
+    Set     []davPropNames `xml:"DAV: set>prop"`
+    Remove  []davPropNames `xml:"DAV: remove>prop"`
+}
+
+// davProppatch accepts no dead properties. Windows insists on setting its
+// Win32 timestamps after every upload and gives up on a failure, so those
+// are answered with 200 and dropped; everything else is refused with 403.
+func davProppatch(w http.ResponseWriter, r *http.Request, user, p string) {
+    var req davPropertyUpdate
+    if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+        http.Error(w, "Malformed PROPPATCH body", http.StatusBadRequest)
+        return
+    }
+    entry, ok := davLookup(w, user, p)
+    if !ok {
+        return
+    }
+    if !entry.Exists() {
+        http.Error(w, "Not found", http.StatusNotFound)
+        return
+    }
+    if !davCheckLocks(w, r, user, p, false) {
+        return
+    }
+
+    var accepted, refused strings.Builder
+    for _, props := range append(req.Set, req.Remove...) {
+        for _, el := range props.Names {
+            if el.XMLName.Space == "urn:schemas-microsoft-com:" {
+                accepted.WriteString(davEmptyElement(el.XMLName))
+            } else {
+                refused.WriteString(davEmptyElement(el.XMLName))
+            }
+        }
+    }
+
+    var b strings.Builder
+    b.WriteString(`<?xml version="1.0" encoding="utf-8"?>` + "\n" + `<D:multistatus xmlns:D="DAV:"><D:response>`)
+    b.WriteString("<D:href>" + davEscape(davHref(p, entry.File == nil)) + "</D:href>")
+    if accepted.Len() > 0 {
+        b.WriteString("<D:propstat><D:prop>" + accepted.String() + "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+    }
+    if refused.Len() > 0 {
+        b.WriteString("<D:propstat><D:prop>" + refused.String() + "</D:prop><D:status>HTTP/1.1 403 Forbidden</D:status></D:propstat>")
+    }
+    b.WriteString("</D:response></D:multistatus>")
+    davWriteXML(w, http.StatusMultiStatus, b.String())
+}
+
+type davLockInfo struct {
+    XMLName   xml.Name `xml:"DAV: lockinfo"`
+    Exclusive *struct{} `xml:"DAV: lockscope>exclusive"`
+    Shared    *struct{} `xml:"DAV: lockscope>shared"`
+    Owner     *struct {
+        Inner string `xml:",innerxml"`
+    } `xml:"DAV: owner"`
+}
+
+// davLockResource takes a new lock, or refreshes one when the body is empty. Locking
+// a path that does not exist yet creates an empty file there, which is what
+// clients expect before they PUT the real content.
+func davLockResource(w http.ResponseWriter, r *http.Request, user, p string) {
+    timeout := davLockTimeout(r.Header.Get("Timeout"))
+
+    body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+    if err != nil {
+        http.Error(w, "Error reading request", http.StatusBadRequest)
+        return
+    }
+    if len(strings.TrimSpace(string(body))) == 0 {
+        l, err := davLocks.Refresh(user, p, davSubmittedTokens(r.Header.Get("If")), timeout)
+        if err != nil {
+            davWriteError(w, http.StatusPreconditionFailed, "lock-token-submitted")
+            return
+        }
+        davWriteXML(w, http.StatusOK, davLockDiscovery(*l))
+        return
+    }
+
+    var info davLockInfo
+    if err := xml.Unmarshal(body, &info); err != nil || (info.Exclusive == nil) == (info.Shared == nil) {
+        http.Error(w, "Malformed LOCK body", http.StatusBadRequest)
+        return
+    }
+    infinite := true
+    switch r.Header.Get("Depth") {
+    case "", "infinity":
+    case "0":
+        infinite = false
+    default:
+        http.Error(w, "Invalid Depth", http.StatusBadRequest)
+        return
+    }
+    ownerXML := ""
+    if info.Owner != nil {
+        ownerXML = info.Owner.Inner
+    }
+
+    entry, ok := davLookup(w, user, p)
+    if !ok {
+        return
+    }
+    l, err := davLocks.Lock(user, p, infinite, info.Shared != nil, ownerXML, timeout)
+    if err != nil {
+        davWriteError(w, http.StatusLocked, "no-conflicting-lock")
+        return
+    }
+
+    status := http.StatusOK
+    if !entry.Exists() {
+        blob, err := services.StageBlob(strings.NewReader(""))
+        if err == nil {
+            _, err = services.StoreFile(user, entry.Name, services.DetectMIMEType(entry.Name, ""), entry.ParentID, blob)
+            blob.Discard()
+        }
+        if err != nil {
+            davLocks.Unlock(user, p, l.Token)
+            davError(w, err)
+            return
+        }
+        status = http.StatusCreated
+    }
+
+    w.Header().Set("Lock-Token", "<"+l.Token+">")
+    davWriteXML(w, status, davLockDiscovery(*l))
+}
+
+func davUnlockResource(w http.ResponseWriter, r *http.Request, user, p string) {
+    token := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(r.Header.Get("Lock-Token")), "<"), ">")
+    if token == "" {
+        http.Error(w, "Missing Lock-Token header", http.StatusBadRequest)
+        return
+    }
+    if err := davLocks.Unlock(user, p, token); err != nil {
+        davWriteError(w, http.StatusConflict, "lock-token-matches-request-uri")
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// davActiveLock renders one lock for lockdiscovery
+func davActiveLock(l davLock) string {
+    scope, depth := "<D:exclusive/>", "0"
+    if l.Shared {
+        scope = "<D:shared/>"
+    }
+    if l.Infinite {
+        depth = "infinity"
+    }
+    owner := ""
+    if l.OwnerXML != "" {
+        owner = "<D:owner>" + l.OwnerXML + "</D:owner>"
+    }
+    return fmt.Sprintf(
+        "<D:activelock><D:locktype><D:write/></D:locktype><D:lockscope>%s</D:lockscope><D:depth>%s</D:depth>%s"+
+            "<D:timeout>Second-%d</D:timeout><D:locktoken><D:href>%s</D:href></D:locktoken>"+
+            "<D:lockroot><D:href>%s</D:href></D:lockroot></D:activelock>",
+        scope, depth, owner, int(l.Timeout.Seconds()), davEscape(l.Token), davEscape(davHref(l.Root, false)),
+    )
+}
+
+func davLockDiscovery(l davLock) string {
+    return `<?xml version="1.0" encoding="utf-8"?>` + "\n" +
+        `<D:prop xmlns:D="DAV:"><D:lockdiscovery>` + davActiveLock(l) + `</D:lockdiscovery></D:prop>`
+}
+
+// davWriteError answers status with a DAV:error body naming the failed precondition
+func davWriteError(w http.ResponseWriter, status int, condition string) {
+    davWriteXML(w, status, `<?xml version="1.0" encoding="utf-8"?>`+"\n"+`<D:error xmlns:D="DAV:"><D:`+condition+`/></D:error>`)
+}
+
+func davWriteXML(w http.ResponseWriter, status int, body string) {
+    w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+    w.WriteHeader(status)
+    io.WriteString(w, body)
+}
+
+func davEscape(s string) string {
+    var b strings.Builder
+    xml.EscapeText(&b, []byte(s))
+    return b.String()
+}
+
+// davElement renders a DAV: property with already escaped inner XML
+func davElement(name, inner string) string {
+    if inner == "" {
+        return "<D:" + name + "/>"
+    }
+    return "<D:" + name + ">" + inner + "</D:" + name + ">"
+}
+
+// davEmptyElement renders an empty element in any namespace, for property names
+func davEmptyElement(name xml.Name) string {
+    if name.Space == davNS {
+        return "<D:" + name.Local + "/>"
+    }
+    return "<x:" + name.Local + ` xmlns:x="` + davEscape(name.Space) + `"/>`
+}
@@ -0,0 +1,244 @@
+package controllers
+
+import (
+    "crypto/rand"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// WebDAV locks (RFC 4918 section 6). They only exist to keep WebDAV clients
+// such as Office and Finder from overwriting each other's work, so they live
+// in memory: a restart drops them and clients simply lock again. The REST
+// API does not look at them.
+
+const (
+    davLockDefaultTimeout = time.Hour
+    davLockMaxTimeout     = 24 * time.Hour
+)
+
+var (
+    errDavLocked       = errors.New("resource is locked")
+    errDavLockNotFound = errors.New("no such lock")
+)
+
+// davLock is one active lock. Root is a cleaned path inside Owner's tree.
+type davLock struct {
+    Token    string
+    Owner    string // the user holding it
+    Root     string
+    Infinite bool // depth infinity, i.e. the lock covers Root's descendants too
+    Shared   bool
+    OwnerXML string // the client's <owner> element, echoed back in lockdiscovery
+    Timeout  time.Duration
+    Expires  time.Time
+}
+
+// covers reports whether the lock applies to path
+func (l *davLock) covers(path string) bool {
+    return l.Root == path || (l.Infinite && davIsDescendant(path, l.Root))
+}
+
+type davLockManager struct {
+    mu    sync.Mutex
+    locks map[string]*davLock // by token
+}
+
+var davLocks = &davLockManager{locks: map[string]*davLock{}}
+
+// davIsDescendant reports whether path lies strictly below dir
+func davIsDescendant(path, dir string) bool {
+    if dir == "/" {
+        return path != "/"
+    }
+    return strings.HasPrefix(path, dir+"/")
+}
+
+// expire drops locks whose timeout has passed. m.mu must be held.
+func (m *davLockManager) expire() {
+    now := time.Now()
+    for token, l := range m.locks {
+        if now.After(l.Expires) {
+            delete(m.locks, token)
+        }
+    }
+}
+
+// Lock takes a new lock. It fails with errDavLocked when an exclusive lock
+// is in the way, or when an exclusive lock is asked for where any lock is.
+func (m *davLockManager) Lock(owner, root string, infinite, shared bool, ownerXML string, timeout time.Duration) (*davLock, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.expire()
+
+    for _, l := range m.locks {
+        if l.Owner != owner {
+            continue
+        }
+        overlaps := l.covers(root) || (infinite && davIsDescendant(l.Root, root))
+        if overlaps && (!shared || !l.Shared) {
+            return nil, errDavLocked
+        }
+    }
+
+    l := &davLock{
+        Token:    newDavLockToken(),
+        Owner:    owner,
+        Root:     root,
+        Infinite: infinite,
+        Shared:   shared,
+        OwnerXML: ownerXML,
+        Timeout:  timeout,
+        Expires:  time.Now().Add(timeout),
+    }
+    m.locks[l.Token] = l
+    return l, nil
+}
+
+// Refresh restarts the timeout of one of the tokens that covers path
+func (m *davLockManager) Refresh(owner, path string, tokens []string, timeout time.Duration) (*davLock, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.expire()
+
+    for _, token := range tokens {
+        if l, ok := m.locks[token]; ok && l.Owner == owner && l.covers(path) {
+            l.Timeout = timeout
+            l.Expires = time.Now().Add(timeout)
+            copied := *l
+            return &copied, nil
+        }
+    }
+    return nil, errDavLockNotFound
+}
+
+// Unlock removes the lock with token, which must cover path
+func (m *davLockManager) Unlock(owner, path, token string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.expire()
+
+    l, ok := m.locks[token]
+    if !ok || l.Owner != owner || !l.covers(path) {
+        return errDavLockNotFound
+    }
+    delete(m.locks, token)
+    return nil
+}
+
+// Allowed reports whether a request presenting tokens may change path. With
+// recursive, locks held anywhere below path count too (DELETE and MOVE of a
+// collection change everything inside it).
+func (m *davLockManager) Allowed(owner, path string, recursive bool, tokens []string) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.expire()
+
+    for _, l := range m.locks {
+        if l.Owner != owner {
+            continue
+        }
+        if !l.covers(path) && !(recursive && davIsDescendant(l.Root, path)) {
+            continue
+        }
+        held := false
+        for _, token := range tokens {
+            if token == l.Token {
+                held = true
+                break
+            }
+        }
+        if !held {
+            return false
+        }
+    }
+    return true
+}
+
+// Active returns copies of the locks that cover path
+func (m *davLockManager) Active(owner, path string) []davLock {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.expire()
+
+    var active []davLock
+    for _, l := range m.locks {
+        if l.Owner == owner && l.covers(path) {
+            active = append(active, *l)
+        }
+    }
+    return active
+}
+
+// Remove drops every lock rooted at path or below it, after the resource
+// was deleted or moved away
+func (m *davLockManager) Remove(owner, path string) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    for token, l := range m.locks {
+        if l.Owner == owner && (l.Root == path || davIsDescendant(l.Root, path)) {
+            delete(m.locks, token)
+        }
+    }
+}
+
+func newDavLockToken() string {
+    var b [16]byte
+    rand.Read(b[:])
+    b[6] = b[6]&0x0f | 0x40 // version 4
+    b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+    return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// davLockTimeout reads the Timeout header ("Second-600", "Infinite", or a
+// list of both), capped at davLockMaxTimeout
+func davLockTimeout(header string) time.Duration {
+    for _, v := range strings.Split(header, ",") {
+        v = strings.TrimSpace(v)
+        if strings.EqualFold(v, "Infinite") {
+            return davLockMaxTimeout
+        }
+        if secs, err := strconv.ParseInt(strings.TrimPrefix(v, "Second-"), 10, 64); err == nil && strings.HasPrefix(v, "Second-") && secs > 0 {
+            if d := time.Duration(secs) * time.Second; d < davLockMaxTimeout {
+                return d
+            }
+            return davLockMaxTimeout
+        }
+    }
+    return davLockDefaultTimeout
+}
+
+// davSubmittedTokens collects the lock tokens a request presents in its If
+// header. The header's conditions are not evaluated beyond that: a token is
+// taken as held whichever resource tag it appears under.
+func davSubmittedTokens(ifHeader string) []string {
+    var tokens []string
+    inList := false
+    for i := 0; i < len(ifHeader); i++ {
+        switch ifHeader[i] {
+        case '(':
+            inList = true
+        case ')':
+            inList = false
+        case '<':
+            end := strings.IndexByte(ifHeader[i:], '>')
+            if end < 0 {
+                return tokens
+            }
+            if inList {
+                tokens = append(tokens, ifHeader[i+1:i+end])
+            }
+            i += end
+        case '[':
+            // Entity tags may contain '<' or ')', skip them whole
+            if end := strings.IndexByte(ifHeader[i:], ']'); end >= 0 {
+                i += end
+            }
+        }
+    }
+    return tokens
+}
@@ -30,3 +30,17 @@ func Init() {
     }
     log.Println("Connected to DB successfully")
 }
+
+// WithTx runs fn inside a transaction, committing if it returns nil and rolling back otherwise
+func WithTx(fn func(tx *sql.Tx) error) error {
+    tx, err := DB.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if err := fn(tx); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
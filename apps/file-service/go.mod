@@ -7,5 +7,12 @@ require (
 	github.com/gorilla/mux v1.8.1
 	github.com/joho/godotenv v1.5.1
 	github.com/lib/pq v1.10.9
+	github.com/pkg/sftp v1.13.10
 	github.com/rs/cors v1.11.1
+	golang.org/x/crypto v0.42.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
 )
@@ -3,10 +3,32 @@ package middleware
 import (
     "context"
     "net/http"
+    "slices"
     "strings"
+    "file-service/services"
     "file-service/utils"
 )
 
+// contextKey keeps our request context values from colliding with other packages'
+type contextKey string
+
+const (
+    UsernameKey contextKey = "username"
+    RoleKey     contextKey = "role"
+    ScopesKey   contextKey = "scopes" // only set for personal access tokens
+)
+
+// Scopes a personal access token can be limited to; they match the auth service's.
+const (
+    ScopeFilesRead   = "files:read"
+    ScopeFilesWrite  = "files:write"
+    ScopeShareManage = "share:manage"
+    ScopeAdmin       = "admin"
+)
+
+// accessTokenPrefix marks personal access tokens, as opposed to JWTs
+const accessTokenPrefix = "fvp_"
+
 func JWTAuth(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         authHeader := r.Header.Get("Authorization")
@@ -14,15 +36,96 @@ func JWTAuth(next http.Handler) http.Handler {
             http.Error(w, "No Authorization header provided", http.StatusUnauthorized)
             return
         }
-        tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-        claims, err := utils.ValidateToken(tokenStr)
+        ctx, status, msg := bearerContext(r, strings.TrimPrefix(authHeader, "Bearer "))
+        if status != 0 {
+            http.Error(w, msg, status)
+            return
+        }
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// bearerContext resolves a JWT or personal access token to a request context
+// carrying its username, role and (for access tokens) scopes. On failure it
+// returns the status and message to answer with.
+func bearerContext(r *http.Request, tokenStr string) (context.Context, int, string) {
+    if strings.HasPrefix(tokenStr, accessTokenPrefix) {
+        owner, err := services.LookupAccessToken(tokenStr)
+        if err == services.ErrInvalidAccessToken {
+            return nil, http.StatusUnauthorized, "Invalid token"
+        }
         if err != nil {
-            http.Error(w, "Invalid token", http.StatusUnauthorized)
+            return nil, http.StatusInternalServerError, "DB error"
+        }
+        return accessTokenContext(r, owner), 0, ""
+    }
+
+    claims, err := utils.ValidateToken(tokenStr)
+    if err != nil {
+        return nil, http.StatusUnauthorized, "Invalid token"
+    }
+    // Logged-out tokens and revoked sessions are denylisted by the auth service
+    revoked, err := services.TokenRevoked(claims.ID, claims.SessionID)
+    if err != nil {
+        return nil, http.StatusInternalServerError, "DB error"
+    }
+    if revoked {
+        return nil, http.StatusUnauthorized, "Token revoked"
+    }
+
+    // Add username and role to context for handlers downstream
+    ctx := context.WithValue(r.Context(), UsernameKey, claims.Username)
+    ctx = context.WithValue(ctx, RoleKey, claims.Role)
+    return ctx, 0, ""
+}
+
+func accessTokenContext(r *http.Request, owner services.AccessTokenOwner) context.Context {
+    ctx := context.WithValue(r.Context(), UsernameKey, owner.Username)
+    ctx = context.WithValue(ctx, RoleKey, owner.Role)
+    return context.WithValue(ctx, ScopesKey, owner.Scopes)
+}
+
+// RequireRole only lets requests through whose token carries role. It must run
+// inside JWTAuth.
+func RequireRole(role string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if got, _ := r.Context().Value(RoleKey).(string); got != role {
+            http.Error(w, "Forbidden", http.StatusForbidden)
             return
         }
+        next.ServeHTTP(w, r)
+    })
+}
 
-        // Add username to context for handlers downstream
-        ctx := context.WithValue(r.Context(), "username", claims.Username)
-        next.ServeHTTP(w, r.WithContext(ctx))
+// RequireScope only lets personal access tokens through that carry scope.
+// Login sessions (JWTs) have no scopes and are never restricted. It must run
+// inside JWTAuth.
+func RequireScope(scope string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !HasScope(r, scope) {
+            http.Error(w, "Token is missing the "+scope+" scope", http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r)
     })
 }
+
+// RequireSession only lets login sessions through. Personal access tokens
+// and S3 keys are turned away whatever their scopes, so a leaked token
+// cannot mint credentials that outlive it. It must run inside JWTAuth.
+func RequireSession(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if _, limited := r.Context().Value(ScopesKey).([]string); limited {
+            http.Error(w, "This needs a login session, not an access token", http.StatusForbidden)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// HasScope reports whether the request may act with scope: always for login
+// sessions, and for personal access tokens only when they carry it
+func HasScope(r *http.Request, scope string) bool {
+    scopes, limited := r.Context().Value(ScopesKey).([]string)
+    return !limited || slices.Contains(scopes, scope)
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+    "context"
+    "errors"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "file-service/config"
+    "file-service/services"
+)
+
+// ClientAuth authenticates desktop and command-line clients (WebDAV and the
+// like) that cannot run the browser login. Besides everything JWTAuth takes,
+// it accepts HTTP basic auth with either a personal access token or the
+// account password as the password; passwords are checked by the auth
+// service, which applies its rate limits and lockout. Failures answer 401
+// with a basic auth challenge so clients prompt for credentials.
+func ClientAuth(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+            ctx, status, msg := bearerContext(r, strings.TrimPrefix(authHeader, "Bearer "))
+            if status != 0 {
+                http.Error(w, msg, status)
+                return
+            }
+            next.ServeHTTP(w, r.WithContext(ctx))
+            return
+        }
+
+        username, password, ok := r.BasicAuth()
+        if !ok || username == "" {
+            basicChallenge(w, "Authentication required")
+            return
+        }
+
+        if strings.HasPrefix(password, accessTokenPrefix) {
+            owner, err := services.LookupAccessToken(password)
+            if err == services.ErrInvalidAccessToken || (err == nil && owner.Username != username) {
+                basicChallenge(w, "Invalid credentials")
+                return
+            }
+            if err != nil {
+                http.Error(w, "DB error", http.StatusInternalServerError)
+                return
+            }
+            next.ServeHTTP(w, r.WithContext(accessTokenContext(r, owner)))
+            return
+        }
+
+        owner, err := services.VerifyPassword(username, password, ClientIP(r))
+        var refused *services.PasswordCheckError
+        switch {
+        case err == nil:
+        case errors.As(err, &refused) && refused.RetryAfter > 0:
+            secs := int(math.Ceil(refused.RetryAfter.Seconds()))
+            w.Header().Set("Retry-After", strconv.Itoa(secs))
+            http.Error(w, refused.Message, http.StatusTooManyRequests)
+            return
+        case errors.As(err, &refused):
+            basicChallenge(w, refused.Message)
+            return
+        default:
+            http.Error(w, "Authentication service unavailable", http.StatusServiceUnavailable)
+            return
+        }
+
+        ctx := context.WithValue(r.Context(), UsernameKey, owner.Username)
+        ctx = context.WithValue(ctx, RoleKey, owner.Role)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+func basicChallenge(w http.ResponseWriter, msg string) {
+    w.Header().Set("WWW-Authenticate", `Basic realm="FileVault", charset="UTF-8"`)
+    http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// ClientIP is the caller's address. X-Forwarded-For is only believed with
+// TRUST_PROXY=true, since anyone can send it.
+func ClientIP(r *http.Request) string {
+    if config.GetEnv("TRUST_PROXY") == "true" {
+        if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+            return strings.TrimSpace(strings.Split(fwd, ",")[0])
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
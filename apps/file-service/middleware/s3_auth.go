@@ -0,0 +1,185 @@
+package middleware
+
+import (
+    "context"
+    "crypto/hmac"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "file-service/services"
+    "file-service/utils"
+)
+
+// s3MaxSkew is how far a signed request's X-Amz-Date may be from our clock
+const s3MaxSkew = 15 * time.Minute
+
+// s3Signature is what a SigV4 signed request claims about itself, from the
+// Authorization header or a presigned URL's query
+type s3Signature struct {
+    AccessKey     string
+    Date          string
+    Region        string
+    Service       string
+    SignedHeaders []string
+    Signature     string
+    Time          time.Time
+    Expires       time.Duration // presigned URLs only
+    Presigned     bool
+}
+
+// S3Auth verifies AWS Signature Version 4 requests against the user's S3
+// access keys, from the Authorization header or a presigned URL. aws-chunked
+// bodies are decoded (and their chunk signatures checked) so handlers see
+// the plain content. Read-only keys act as a token with only files:read.
+func S3Auth(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        sig, ok := parseS3Signature(r)
+        if !ok {
+            utils.WriteS3Error(w, r, http.StatusForbidden, "AccessDenied", "Requests must be signed with AWS Signature Version 4")
+            return
+        }
+        if sig.Service != "s3" || sig.Date != sig.Time.Format(utils.SigV4DateFormat) || len(sig.SignedHeaders) == 0 {
+            utils.WriteS3Error(w, r, http.StatusBadRequest, "AuthorizationHeaderMalformed", "Invalid credential scope")
+            return
+        }
+
+        now := time.Now()
+        if sig.Presigned {
+            if sig.Expires <= 0 || sig.Expires > 7*24*time.Hour {
+                utils.WriteS3Error(w, r, http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be between 1 second and 7 days")
+                return
+            }
+            if now.After(sig.Time.Add(sig.Expires)) || sig.Time.After(now.Add(s3MaxSkew)) {
+                utils.WriteS3Error(w, r, http.StatusForbidden, "AccessDenied", "Request has expired")
+                return
+            }
+        } else if d := now.Sub(sig.Time); d > s3MaxSkew || d < -s3MaxSkew {
+            utils.WriteS3Error(w, r, http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large")
+            return
+        }
+
+        payloadHash := utils.UnsignedPayload
+        if !sig.Presigned {
+            payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+            if payloadHash == "" {
+                utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256")
+                return
+            }
+        }
+
+        key, err := services.LookupS3Key(sig.AccessKey)
+        if err == services.ErrS3KeyNotFound {
+            utils.WriteS3Error(w, r, http.StatusForbidden, "InvalidAccessKeyId", "The access key id does not exist")
+            return
+        }
+        if err != nil {
+            utils.WriteS3Error(w, r, http.StatusInternalServerError, "InternalError", "DB error")
+            return
+        }
+
+        cred := utils.SigV4Credentials{AccessKey: key.AccessKeyID, SecretKey: key.SecretKey, Region: sig.Region, Service: sig.Service}
+        canonical := utils.SigV4CanonicalRequest(r, sig.SignedHeaders, payloadHash)
+        want := utils.SigV4Signature(cred, sig.Time, utils.SigV4StringToSign(cred, sig.Time, canonical))
+        if !hmac.Equal([]byte(want), []byte(sig.Signature)) {
+            utils.WriteS3Error(w, r, http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided")
+            return
+        }
+
+        switch payloadHash {
+        case utils.StreamingPayload, utils.StreamingPayloadTrailer, utils.StreamingUnsignedPayloadTrailer:
+            var chunkCred *utils.SigV4Credentials
+            if payloadHash != utils.StreamingUnsignedPayloadTrailer {
+                chunkCred = &cred
+            }
+            decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+            if err != nil || decoded < 0 {
+                utils.WriteS3Error(w, r, http.StatusLengthRequired, "MissingContentLength", "You must provide the x-amz-decoded-content-length header for aws-chunked uploads")
+                return
+            }
+            trailer := r.Header.Get("X-Amz-Trailer")
+            if (payloadHash == utils.StreamingPayload) != (trailer == "") {
+                utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidRequest", "x-amz-trailer does not match x-amz-content-sha256")
+                return
+            }
+            chunked, err := utils.NewChunkedPayloadReader(r.Body, chunkCred, sig.Time, sig.Signature, decoded, trailer)
+            if err != nil {
+                utils.WriteS3Error(w, r, http.StatusBadRequest, "InvalidRequest", err.Error())
+                return
+            }
+            // The server still closes the original body itself
+            r.Body = io.NopCloser(chunked)
+            r.ContentLength = decoded
+        }
+
+        scopes := []string{ScopeFilesRead, ScopeFilesWrite}
+        if key.ReadOnly {
+            scopes = []string{ScopeFilesRead}
+        }
+        ctx := context.WithValue(r.Context(), UsernameKey, key.Username)
+        ctx = context.WithValue(ctx, ScopesKey, scopes)
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// parseS3Signature reads the SigV4 parameters from the Authorization header
+// or, for presigned URLs, the X-Amz-* query parameters
+func parseS3Signature(r *http.Request) (s3Signature, bool) {
+    var sig s3Signature
+    var credential, signedHeaders, amzDate string
+
+    q := r.URL.Query()
+    if auth := r.Header.Get("Authorization"); auth != "" {
+        rest, ok := strings.CutPrefix(auth, utils.SigV4Algorithm+" ")
+        if !ok {
+            return sig, false
+        }
+        for _, field := range strings.Split(rest, ",") {
+            name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+            switch name {
+            case "Credential":
+                credential = value
+            case "SignedHeaders":
+                signedHeaders = value
+            case "Signature":
+                sig.Signature = value
+            }
+        }
+        amzDate = r.Header.Get("X-Amz-Date")
+    } else if q.Get("X-Amz-Algorithm") == utils.SigV4Algorithm {
+        sig.Presigned = true
+        credential = q.Get("X-Amz-Credential")
+        signedHeaders = q.Get("X-Amz-SignedHeaders")
+        sig.Signature = q.Get("X-Amz-Signature")
+        amzDate = q.Get("X-Amz-Date")
+        secs, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+        if err != nil {
+            return sig, false
+        }
+        sig.Expires = time.Duration(secs) * time.Second
+    } else {
+        return sig, false
+    }
+
+    // Credential is AKID/20250101/us-east-1/s3/aws4_request
+    parts := strings.Split(credential, "/")
+    if len(parts) != 5 || parts[4] != "aws4_request" || sig.Signature == "" {
+        return sig, false
+    }
+    sig.AccessKey, sig.Date, sig.Region, sig.Service = parts[0], parts[1], parts[2], parts[3]
+
+    t, err := time.Parse(utils.SigV4TimeFormat, amzDate)
+    if err != nil {
+        return sig, false
+    }
+    sig.Time = t
+
+    for _, h := range strings.Split(signedHeaders, ";") {
+        if h != "" {
+            sig.SignedHeaders = append(sig.SignedHeaders, strings.ToLower(h))
+        }
+    }
+    return sig, true
+}
@@ -3,38 +3,99 @@ package models
 import "time"
 import "database/sql"
 
-type File struct {
-    ID             int       `json:"id"`
-    Filename       string    `json:"filename"`
-    Uploader       string    `json:"uploader"`
-    Size           int64     `json:"size"`
-    MIMEType       string    `json:"mime_type"`
+// Blob is a piece of deduplicated content stored once under its SHA-256 hash.
+// ReferenceCount is the number of file versions pointing at it.
+type Blob struct {
     ContentHash    string    `json:"content_hash"`
-    UploadDate     time.Time `json:"upload_date"`
+    Size           int64     `json:"size"`
     ReferenceCount int       `json:"reference_count"`
-    DownloadCount  int       `json:"download_count"`  // New: number of downloads
-   PublicLink     sql.NullString `json:"public_link"` // New: unique public URL token
-    IsPublic       bool      `json:"is_public"`       // New: whether file is publicly shared
+    CreatedAt      time.Time `json:"created_at"`
+}
+
+// File is a user's own entry for a blob: every uploader gets their own row,
+// filename, upload date and sharing state even when the bytes are shared.
+// ContentHash, Size and MIMEType describe the current version.
+type File struct {
+    ID             int            `json:"id"`
+    Filename       string         `json:"filename"`
+    Uploader       string         `json:"uploader"`
+    Size           int64          `json:"size"`
+    MIMEType       string         `json:"mime_type"`
+    ContentHash    string         `json:"content_hash"`
+    UploadDate     time.Time      `json:"upload_date"`
+    ReferenceCount int            `json:"reference_count"`      // references to the underlying blob
+    DownloadCount  int            `json:"download_count"`       // New: number of downloads
+    PublicLink     sql.NullString `json:"public_link"`          // New: unique public URL token
+    IsPublic       bool           `json:"is_public"`            // New: whether file is publicly shared
+    FolderID       *int           `json:"folder_id"`            // nil when the file is at the root
+    Version        int            `json:"version"`              // current version number
+    TrashedAt      *time.Time     `json:"trashed_at,omitempty"` // set while the file is in the trash
+}
+
+// FileColumns is the column list matching ScanFile, for queries on user_files f JOIN blobs b.
+const FileColumns = "f.id, f.filename, f.uploader, f.size, f.mime_type, f.content_hash, f.upload_date, b.reference_count, f.download_count, f.is_public, f.public_link, f.folder_id, f.current_version, f.trashed_at"
+
+// FileScanner is satisfied by both *sql.Row and *sql.Rows.
+type FileScanner interface {
+    Scan(dest ...interface{}) error
+}
+
+// FileDest returns scan destinations matching FileColumns, for queries that
+// select extra columns after them.
+func FileDest(f *File) []interface{} {
+    return []interface{}{&f.ID, &f.Filename, &f.Uploader, &f.Size, &f.MIMEType, &f.ContentHash,
+        &f.UploadDate, &f.ReferenceCount, &f.DownloadCount, &f.IsPublic, &f.PublicLink, &f.FolderID, &f.Version, &f.TrashedAt}
+}
+
+// ScanFile reads a row selected with FileColumns.
+func ScanFile(s FileScanner, f *File) error {
+    return s.Scan(FileDest(f)...)
+}
+
+func BlobTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS blobs (
+        content_hash VARCHAR(64) PRIMARY KEY,
+        size BIGINT NOT NULL,
+        reference_count INT NOT NULL DEFAULT 0,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+    `
 }
 
 func FileTableMigration() string {
     return `
-    CREATE TABLE IF NOT EXISTS files (
+    CREATE TABLE IF NOT EXISTS user_files (
         id SERIAL PRIMARY KEY,
         filename VARCHAR(255) NOT NULL,
         uploader VARCHAR(100) NOT NULL,
         size BIGINT NOT NULL,
         mime_type VARCHAR(100) NOT NULL,
-        content_hash VARCHAR(64) NOT NULL UNIQUE,
+        content_hash VARCHAR(64) NOT NULL REFERENCES blobs(content_hash),
         upload_date TIMESTAMP WITH TIME ZONE DEFAULT now(),
-        reference_count INT NOT NULL DEFAULT 1,
         download_count INT NOT NULL DEFAULT 0,
         public_link VARCHAR(255) UNIQUE,
         is_public BOOLEAN DEFAULT FALSE
     );
 
-    CREATE INDEX IF NOT EXISTS idx_filename ON files USING gin (filename gin_trgm_ops);
-    CREATE INDEX IF NOT EXISTS idx_content_hash ON files(content_hash);
-    CREATE INDEX IF NOT EXISTS idx_uploader ON files(uploader);
+    CREATE INDEX IF NOT EXISTS idx_user_files_filename ON user_files USING gin (filename gin_trgm_ops);
+    CREATE INDEX IF NOT EXISTS idx_user_files_content_hash ON user_files(content_hash);
+    CREATE INDEX IF NOT EXISTS idx_user_files_uploader ON user_files(uploader);
+
+    -- One-off import of the old single-table layout, where files.content_hash
+    -- was globally unique and only the first uploader owned a row.
+    DO $$
+    BEGIN
+        IF to_regclass('files') IS NOT NULL THEN
+            INSERT INTO blobs (content_hash, size, reference_count, created_at)
+            SELECT content_hash, size, 1, upload_date FROM files
+            ON CONFLICT (content_hash) DO NOTHING;
+
+            INSERT INTO user_files (filename, uploader, size, mime_type, content_hash, upload_date, download_count, public_link, is_public)
+            SELECT filename, uploader, size, mime_type, content_hash, upload_date, download_count, public_link, is_public FROM files;
+
+            ALTER TABLE files RENAME TO files_legacy;
+        END IF;
+    END $$;
     `
 }
@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// Folder is a node in a user's folder tree. A nil ParentID is the root.
+type Folder struct {
+    ID        int       `json:"id"`
+    Name      string    `json:"name"`
+    Owner     string    `json:"owner"`
+    ParentID  *int      `json:"parent_id"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// FolderListing is a folder's direct children plus the path leading to it.
+type FolderListing struct {
+    Folder      *Folder  `json:"folder"`      // nil for the root
+    Breadcrumbs []Folder `json:"breadcrumbs"` // root-most first, ending with Folder
+    Folders     []Folder `json:"folders"`
+    Files       []File   `json:"files"`
+}
+
+func FolderTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS folders (
+        id SERIAL PRIMARY KEY,
+        name VARCHAR(255) NOT NULL,
+        owner VARCHAR(100) NOT NULL,
+        parent_id INT REFERENCES folders(id) ON DELETE CASCADE,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_unique_name ON folders (owner, (COALESCE(parent_id, 0)), name);
+    CREATE INDEX IF NOT EXISTS idx_folders_parent_id ON folders(parent_id);
+
+    ALTER TABLE user_files ADD COLUMN IF NOT EXISTS folder_id INT REFERENCES folders(id);
+    CREATE INDEX IF NOT EXISTS idx_user_files_folder_id ON user_files(folder_id);
+
+    -- Names must be unique per folder. Entries uploaded before that rule get
+    -- their id appended ("report (12).pdf") so the index can be built.
+    DO $$
+    BEGIN
+        IF to_regclass('idx_user_files_unique_name') IS NULL THEN
+            UPDATE user_files f
+            SET filename = regexp_replace(f.filename, '(\.[^./]*)?$', ' (' || f.id || ')\1')
+            WHERE EXISTS (
+                SELECT 1 FROM user_files o
+                WHERE o.uploader = f.uploader AND COALESCE(o.folder_id, 0) = COALESCE(f.folder_id, 0)
+                  AND o.filename = f.filename AND o.id < f.id
+            );
+            CREATE UNIQUE INDEX idx_user_files_unique_name ON user_files (uploader, (COALESCE(folder_id, 0)), filename);
+        END IF;
+    END $$;
+    `
+}
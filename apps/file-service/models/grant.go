@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// Permission levels a file can be shared with, from least to most access.
+// Viewers see the file and its history, downloaders can also fetch the content,
+// editors can additionally restore versions, manage share links and delete it.
+const (
+    PermissionViewer     = "viewer"
+    PermissionDownloader = "downloader"
+    PermissionEditor     = "editor"
+)
+
+// FileGrant gives one user access to another user's file.
+type FileGrant struct {
+    ID         int       `json:"id"`
+    FileID     int       `json:"file_id"`
+    Grantee    string    `json:"grantee"`
+    Permission string    `json:"permission"`
+    GrantedBy  string    `json:"granted_by"`
+    CreatedAt  time.Time `json:"created_at"`
+}
+
+// SharedFile is a file listed under "Shared with me"; Uploader is its owner.
+type SharedFile struct {
+    File
+    Permission string    `json:"permission"`
+    SharedAt   time.Time `json:"shared_at"`
+}
+
+func FileGrantTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS file_grants (
+        id SERIAL PRIMARY KEY,
+        file_id INT NOT NULL REFERENCES user_files(id) ON DELETE CASCADE,
+        grantee VARCHAR(100) NOT NULL,
+        permission VARCHAR(20) NOT NULL CHECK (permission IN ('viewer', 'downloader', 'editor')),
+        granted_by VARCHAR(100) NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        UNIQUE (file_id, grantee)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_file_grants_grantee ON file_grants(grantee);
+    `
+}
@@ -0,0 +1,53 @@
+package models
+
+import "time"
+
+// LFSObject is a Git LFS object stored in one of Owner's repositories. The
+// oid is the SHA-256 of the content, so it is also the blob's content hash.
+type LFSObject struct {
+    Owner     string    `json:"-"`
+    Repo      string    `json:"-"`
+    OID       string    `json:"oid"`
+    Size      int64     `json:"size"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// LFSLockOwner is who holds a lock, as the LFS locking API reports it
+type LFSLockOwner struct {
+    Name string `json:"name"`
+}
+
+// LFSLock is a Git LFS file lock on Path in one of Owner's repositories
+type LFSLock struct {
+    ID       int          `json:"id,string"`
+    Owner    string       `json:"-"`
+    Repo     string       `json:"-"`
+    Path     string       `json:"path"`
+    LockedBy LFSLockOwner `json:"owner"`
+    LockedAt time.Time    `json:"locked_at"`
+}
+
+func LFSTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS lfs_objects (
+        owner VARCHAR(100) NOT NULL,
+        repo VARCHAR(100) NOT NULL,
+        oid VARCHAR(64) NOT NULL,
+        size BIGINT NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        PRIMARY KEY (owner, repo, oid)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_lfs_objects_owner_oid ON lfs_objects(owner, oid);
+
+    CREATE TABLE IF NOT EXISTS lfs_locks (
+        id SERIAL PRIMARY KEY,
+        owner VARCHAR(100) NOT NULL,
+        repo VARCHAR(100) NOT NULL,
+        path TEXT NOT NULL,
+        locked_by VARCHAR(100) NOT NULL,
+        locked_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        UNIQUE (owner, repo, path)
+    );
+    `
+}
@@ -0,0 +1,63 @@
+package models
+
+import (
+    "database/sql"
+    "time"
+)
+
+// UserQuota holds a user's running usage balance and optional quota override.
+// A NULL QuotaBytes means the default from DEFAULT_QUOTA_BYTES applies.
+type UserQuota struct {
+    Username   string        `json:"username"`
+    QuotaBytes sql.NullInt64 `json:"quota_bytes"`
+    UsedBytes  int64         `json:"used_bytes"`
+    UpdatedAt  time.Time     `json:"updated_at"`
+}
+
+// UsageLedgerEntry records one change to a user's logical usage.
+type UsageLedgerEntry struct {
+    ID         int           `json:"id"`
+    Username   string        `json:"username"`
+    FileID     sql.NullInt64 `json:"file_id"`
+    DeltaBytes int64         `json:"delta_bytes"`
+    Reason     string        `json:"reason"`
+    CreatedAt  time.Time     `json:"created_at"`
+}
+
+// Usage is the report returned by GET /me/usage.
+type Usage struct {
+    Username      string `json:"username"`
+    FileCount     int64  `json:"file_count"`
+    UsedBytes     int64  `json:"used_bytes"`     // logical bytes across all of the user's files
+    LimitBytes    int64  `json:"limit_bytes"`
+    PhysicalBytes int64  `json:"physical_bytes"` // distinct blobs the user references from files, LFS and the registry
+    DedupSavings  int64  `json:"dedup_savings"`  // used_bytes - physical_bytes
+    TrashBytes    int64  `json:"trash_bytes"`    // part of used_bytes held by trashed files
+}
+
+func QuotaTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS user_quotas (
+        username VARCHAR(100) PRIMARY KEY,
+        quota_bytes BIGINT,
+        used_bytes BIGINT NOT NULL DEFAULT 0,
+        updated_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE TABLE IF NOT EXISTS usage_ledger (
+        id SERIAL PRIMARY KEY,
+        username VARCHAR(100) NOT NULL,
+        file_id INT,
+        delta_bytes BIGINT NOT NULL,
+        reason VARCHAR(50) NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_usage_ledger_username ON usage_ledger(username);
+
+    -- Seed balances for users who uploaded before quotas existed
+    INSERT INTO user_quotas (username, used_bytes)
+    SELECT uploader, SUM(size) FROM user_files GROUP BY uploader
+    ON CONFLICT (username) DO NOTHING;
+    `
+}
@@ -0,0 +1,94 @@
+package models
+
+import "time"
+
+// OCIBlob is a layer or config blob pushed to one of Owner's registry
+// repositories. Repo is the repository name without the owner namespace.
+type OCIBlob struct {
+    Owner       string    `json:"owner"`
+    Repo        string    `json:"repo"`
+    ContentHash string    `json:"content_hash"` // hex SHA-256; the digest is "sha256:" + ContentHash
+    Size        int64     `json:"size"`
+    CreatedAt   time.Time `json:"created_at"`
+}
+
+// OCIManifest is a manifest or index pushed to a repository. Its bytes are
+// kept in the blob store like any other content.
+type OCIManifest struct {
+    Owner       string    `json:"owner"`
+    Repo        string    `json:"repo"`
+    ContentHash string    `json:"content_hash"`
+    MediaType   string    `json:"media_type"`
+    Size        int64     `json:"size"`
+    CreatedAt   time.Time `json:"created_at"`
+}
+
+// OCIUpload is a chunked blob upload in progress, staged on local disk
+type OCIUpload struct {
+    ID        string    `json:"id"`
+    Owner     string    `json:"owner"`
+    Repo      string    `json:"repo"`
+    Size      int64     `json:"size"`
+    CreatedAt time.Time `json:"created_at"`
+    ExpiresAt time.Time `json:"expires_at"`
+}
+
+func RegistryTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS oci_blobs (
+        owner VARCHAR(100) NOT NULL,
+        repo VARCHAR(255) NOT NULL,
+        content_hash VARCHAR(64) NOT NULL,
+        size BIGINT NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        PRIMARY KEY (owner, repo, content_hash)
+    );
+
+    CREATE TABLE IF NOT EXISTS oci_manifests (
+        owner VARCHAR(100) NOT NULL,
+        repo VARCHAR(255) NOT NULL,
+        content_hash VARCHAR(64) NOT NULL,
+        media_type VARCHAR(255) NOT NULL,
+        size BIGINT NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        PRIMARY KEY (owner, repo, content_hash)
+    );
+
+    CREATE TABLE IF NOT EXISTS oci_tags (
+        owner VARCHAR(100) NOT NULL,
+        repo VARCHAR(255) NOT NULL,
+        tag VARCHAR(128) NOT NULL,
+        content_hash VARCHAR(64) NOT NULL,
+        updated_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        PRIMARY KEY (owner, repo, tag),
+        FOREIGN KEY (owner, repo, content_hash) REFERENCES oci_manifests(owner, repo, content_hash) ON DELETE CASCADE ON UPDATE CASCADE
+    );
+
+    -- Blobs a manifest points at, so they cannot be deleted while it exists.
+    -- Manifests pushed before this table are indexed at startup.
+    CREATE TABLE IF NOT EXISTS oci_manifest_blobs (
+        owner VARCHAR(100) NOT NULL,
+        repo VARCHAR(255) NOT NULL,
+        manifest_hash VARCHAR(64) NOT NULL,
+        blob_hash VARCHAR(64) NOT NULL,
+        PRIMARY KEY (owner, repo, manifest_hash, blob_hash),
+        FOREIGN KEY (owner, repo, manifest_hash) REFERENCES oci_manifests(owner, repo, content_hash) ON DELETE CASCADE ON UPDATE CASCADE
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_oci_manifest_blobs_blob ON oci_manifest_blobs(owner, repo, blob_hash);
+
+    ALTER TABLE oci_manifests ADD COLUMN IF NOT EXISTS blobs_indexed BOOLEAN NOT NULL DEFAULT FALSE;
+
+    CREATE TABLE IF NOT EXISTS oci_uploads (
+        id VARCHAR(64) PRIMARY KEY,
+        owner VARCHAR(100) NOT NULL,
+        repo VARCHAR(255) NOT NULL,
+        size BIGINT NOT NULL DEFAULT 0,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_oci_uploads_expires_at ON oci_uploads(expires_at);
+    CREATE INDEX IF NOT EXISTS idx_oci_uploads_owner ON oci_uploads(owner);
+    `
+}
@@ -0,0 +1,80 @@
+package models
+
+import "time"
+
+// S3AccessKey lets S3 clients sign requests (SigV4) as Username. SigV4 is an
+// HMAC over the secret, so unlike other credentials the secret itself has to
+// be kept; it is stored encrypted (secret_key_sealed) and only shown to the
+// user once, when the key is created.
+type S3AccessKey struct {
+    ID          int        `json:"id"`
+    Username    string     `json:"username"`
+    Name        string     `json:"name"`
+    AccessKeyID string     `json:"access_key_id"`
+    SecretKey   string     `json:"secret_access_key,omitempty"` // only set in the response that creates it
+    ReadOnly    bool       `json:"read_only"`
+    LastUsedAt  *time.Time `json:"last_used_at"`
+    CreatedAt   time.Time  `json:"created_at"`
+}
+
+// S3MultipartUpload is a multipart upload in progress. Parts are staged on
+// local disk until it is completed, then the object becomes a File.
+type S3MultipartUpload struct {
+    ID        string    `json:"id"`
+    Username  string    `json:"username"`
+    Bucket    string    `json:"bucket"`
+    Key       string    `json:"key"`
+    MIMEType  string    `json:"mime_type"`
+    CreatedAt time.Time `json:"created_at"`
+}
+
+// S3UploadPart is one uploaded part of a multipart upload
+type S3UploadPart struct {
+    UploadID    string    `json:"upload_id"`
+    PartNumber  int       `json:"part_number"`
+    Size        int64     `json:"size"`
+    ContentHash string    `json:"content_hash"` // SHA-256 of the part, also its ETag
+    UploadedAt  time.Time `json:"uploaded_at"`
+}
+
+func S3TableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS s3_access_keys (
+        id SERIAL PRIMARY KEY,
+        username VARCHAR(100) NOT NULL,
+        name VARCHAR(100) NOT NULL,
+        access_key_id VARCHAR(32) NOT NULL UNIQUE,
+        secret_key VARCHAR(64) NOT NULL,
+        read_only BOOLEAN NOT NULL DEFAULT FALSE,
+        last_used_at TIMESTAMP WITH TIME ZONE,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_s3_access_keys_username ON s3_access_keys(username);
+
+    -- Secrets are sealed with S3_KEY_SECRET_PATH; InitS3Keys moves plain text
+    -- ones from secret_key over
+    ALTER TABLE s3_access_keys ADD COLUMN IF NOT EXISTS secret_key_sealed BYTEA;
+    ALTER TABLE s3_access_keys ALTER COLUMN secret_key DROP NOT NULL;
+
+    CREATE TABLE IF NOT EXISTS s3_multipart_uploads (
+        id VARCHAR(64) PRIMARY KEY,
+        username VARCHAR(100) NOT NULL,
+        bucket VARCHAR(255) NOT NULL,
+        object_key TEXT NOT NULL,
+        mime_type VARCHAR(100) NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_s3_multipart_uploads_username ON s3_multipart_uploads(username);
+
+    CREATE TABLE IF NOT EXISTS s3_upload_parts (
+        upload_id VARCHAR(64) NOT NULL REFERENCES s3_multipart_uploads(id) ON DELETE CASCADE,
+        part_number INT NOT NULL,
+        size BIGINT NOT NULL,
+        content_hash VARCHAR(64) NOT NULL,
+        uploaded_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        PRIMARY KEY (upload_id, part_number)
+    );
+    `
+}
@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// ShareLink is one named public link to a file. A file can have several, each
+// with its own optional password, expiry and download limit.
+type ShareLink struct {
+    ID            int        `json:"id"`
+    FileID        int        `json:"file_id"`
+    Name          string     `json:"name"`
+    Token         string     `json:"token"`
+    PasswordHash  string     `json:"-"`
+    HasPassword   bool       `json:"has_password"`
+    ExpiresAt     *time.Time `json:"expires_at"`
+    MaxDownloads  *int       `json:"max_downloads"`
+    DownloadCount int        `json:"download_count"`
+    RevokedAt     *time.Time `json:"revoked_at"`
+    CreatedAt     time.Time  `json:"created_at"`
+    URL           string     `json:"url,omitempty"`
+}
+
+func ShareLinkTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS share_links (
+        id SERIAL PRIMARY KEY,
+        file_id INT NOT NULL REFERENCES user_files(id) ON DELETE CASCADE,
+        name VARCHAR(100) NOT NULL,
+        token VARCHAR(64) NOT NULL UNIQUE,
+        password_hash VARCHAR(100),
+        expires_at TIMESTAMP WITH TIME ZONE,
+        max_downloads INT,
+        download_count INT NOT NULL DEFAULT 0,
+        revoked_at TIMESTAMP WITH TIME ZONE,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_share_links_file_id ON share_links(file_id);
+
+    -- Links made before share_links existed keep working as unrestricted links
+    INSERT INTO share_links (file_id, name, token)
+    SELECT id, 'Public link', public_link FROM user_files
+    WHERE is_public AND public_link IS NOT NULL
+    ON CONFLICT (token) DO NOTHING;
+    UPDATE user_files SET public_link = NULL WHERE public_link IS NOT NULL;
+    `
+}
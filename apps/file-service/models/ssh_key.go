@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// SSHKey is a public key Username registered for signing in to the SFTP server
+type SSHKey struct {
+    ID          int        `json:"id"`
+    Username    string     `json:"username"`
+    Name        string     `json:"name"`
+    PublicKey   string     `json:"public_key"`  // authorized_keys format, without the comment
+    Fingerprint string     `json:"fingerprint"` // SHA256:..., as ssh-keygen -l prints it
+    LastUsedAt  *time.Time `json:"last_used_at"`
+    CreatedAt   time.Time  `json:"created_at"`
+}
+
+func SSHKeyTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS ssh_keys (
+        id SERIAL PRIMARY KEY,
+        username VARCHAR(100) NOT NULL,
+        name VARCHAR(100) NOT NULL,
+        public_key TEXT NOT NULL,
+        fingerprint VARCHAR(100) NOT NULL UNIQUE,
+        last_used_at TIMESTAMP WITH TIME ZONE,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_ssh_keys_username ON ssh_keys(username);
+    `
+}
@@ -0,0 +1,12 @@
+package models
+
+// TokenDenylistTableMigration mirrors the auth service's token_denylist, which
+// both services share, so JWTAuth works whichever service migrates first.
+func TokenDenylistTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS token_denylist (
+        id VARCHAR(64) PRIMARY KEY,
+        expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+    );
+    `
+}
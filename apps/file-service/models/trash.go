@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// TrashedFile is a soft-deleted file as listed by GET /trash. OriginalPath is
+// the folder it was deleted from; PurgeAt is when the purger removes it for good.
+type TrashedFile struct {
+    File
+    OriginalPath string    `json:"original_path"`
+    PurgeAt      time.Time `json:"purge_at"`
+}
+
+func TrashTableMigration() string {
+    return `
+    ALTER TABLE user_files ADD COLUMN IF NOT EXISTS trashed_at TIMESTAMP WITH TIME ZONE;
+    ALTER TABLE user_files ADD COLUMN IF NOT EXISTS original_path TEXT;
+    CREATE INDEX IF NOT EXISTS idx_user_files_trashed_at ON user_files(trashed_at) WHERE trashed_at IS NOT NULL;
+
+    -- Trashed entries must not hold on to their name, so the unique name
+    -- index only covers live files.
+    DO $$
+    BEGIN
+        IF NOT EXISTS (SELECT 1 FROM pg_indexes WHERE indexname = 'idx_user_files_unique_name' AND indexdef LIKE '%WHERE%') THEN
+            DROP INDEX IF EXISTS idx_user_files_unique_name;
+            CREATE UNIQUE INDEX idx_user_files_unique_name ON user_files (uploader, (COALESCE(folder_id, 0)), filename) WHERE trashed_at IS NULL;
+        END IF;
+    END $$;
+    `
+}
@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// TusUpload is a resumable upload in progress. Its bytes are staged on local
+// disk until UploadOffset reaches UploadLength, then it becomes a File.
+type TusUpload struct {
+    ID           string    `json:"id"`
+    Uploader     string    `json:"uploader"`
+    Filename     string    `json:"filename"`
+    MIMEType     string    `json:"mime_type"`
+    UploadLength int64     `json:"upload_length"`
+    UploadOffset int64     `json:"upload_offset"`
+    FolderID     *int      `json:"folder_id"`
+    CreatedAt    time.Time `json:"created_at"`
+    ExpiresAt    time.Time `json:"expires_at"`
+}
+
+func TusUploadTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS tus_uploads (
+        id VARCHAR(64) PRIMARY KEY,
+        uploader VARCHAR(100) NOT NULL,
+        filename VARCHAR(255) NOT NULL,
+        mime_type VARCHAR(100) NOT NULL,
+        upload_length BIGINT NOT NULL,
+        upload_offset BIGINT NOT NULL DEFAULT 0,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_tus_uploads_expires_at ON tus_uploads(expires_at);
+
+    -- Deleting the folder aborts the upload; the tus cleanup removes the
+    -- staged bytes the dropped row leaves behind
+    ALTER TABLE tus_uploads ADD COLUMN IF NOT EXISTS folder_id INT REFERENCES folders(id) ON DELETE CASCADE;
+    `
+}
@@ -0,0 +1,40 @@
+package models
+
+import "time"
+
+// FileVersion is one revision of a user's file. Every version holds its own
+// reference on the blob, so old revisions share storage with identical content.
+type FileVersion struct {
+    ID          int       `json:"id"`
+    FileID      int       `json:"file_id"`
+    Version     int       `json:"version"`
+    Size        int64     `json:"size"`
+    MIMEType    string    `json:"mime_type"`
+    ContentHash string    `json:"content_hash"`
+    CreatedAt   time.Time `json:"created_at"`
+    IsCurrent   bool      `json:"is_current"`
+}
+
+func FileVersionTableMigration() string {
+    return `
+    CREATE TABLE IF NOT EXISTS file_versions (
+        id SERIAL PRIMARY KEY,
+        file_id INT NOT NULL REFERENCES user_files(id) ON DELETE CASCADE,
+        version INT NOT NULL,
+        content_hash VARCHAR(64) NOT NULL REFERENCES blobs(content_hash),
+        size BIGINT NOT NULL,
+        mime_type VARCHAR(100) NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+        UNIQUE (file_id, version)
+    );
+
+    CREATE INDEX IF NOT EXISTS idx_file_versions_content_hash ON file_versions(content_hash);
+
+    ALTER TABLE user_files ADD COLUMN IF NOT EXISTS current_version INT NOT NULL DEFAULT 1;
+
+    -- Files from before versioning become their own version 1
+    INSERT INTO file_versions (file_id, version, content_hash, size, mime_type, created_at)
+    SELECT f.id, 1, f.content_hash, f.size, f.mime_type, f.upload_date FROM user_files f
+    WHERE NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.file_id = f.id);
+    `
+}
@@ -4,35 +4,131 @@ import (
     "net/http"
 
     "github.com/gorilla/mux"
+
     "file-service/controllers"
     "file-service/middleware"
 )
 
-func Init() *mux.Router {
-    r := mux.NewRouter()
-
-    r.HandleFunc("/upload", controllers.UploadFile).Methods("POST")
-    // r.Handle("/files", middleware.JWTAuth(http.HandlerFunc(controllers.ListFiles))).Methods("GET")
-
-
-	 r.Handle("/upload", middleware.JWTAuth(http.HandlerFunc(controllers.UploadFile))).Methods("POST")
-
-    r.Handle("/files", middleware.JWTAuth(http.HandlerFunc(controllers.ListFiles))).Methods("GET")
-
-    r.Handle("/files/search", middleware.JWTAuth(http.HandlerFunc(controllers.SearchFiles))).Methods("GET")
-
-    r.Handle("/files/{id}/download", middleware.JWTAuth(http.HandlerFunc(controllers.DownloadFile))).Methods("GET")
-
-    r.Handle("/files/{id}", middleware.JWTAuth(http.HandlerFunc(controllers.DeleteFile))).Methods("DELETE")
+// authed wraps a handler so it needs a login session or a personal access
+// token carrying scope
+func authed(scope string, handler http.HandlerFunc) http.Handler {
+    return middleware.JWTAuth(middleware.RequireScope(scope, handler))
+}
 
-    r.Handle("/files/{id}/share", middleware.JWTAuth(http.HandlerFunc(controllers.ShareFilePublic))).Methods("POST")
+// adminOnly wraps a handler so it needs the admin role and, for personal
+// access tokens, the admin scope
+func adminOnly(handler http.HandlerFunc) http.Handler {
+    return middleware.JWTAuth(middleware.RequireScope(middleware.ScopeAdmin, middleware.RequireRole("admin", handler)))
+}
 
-    r.HandleFunc("/public/{link}/download", controllers.DownloadPublicFile).Methods("GET") // Public route, no auth\
+// sessionOnly wraps a handler that creates long-lived credentials, so it
+// needs an interactive login and refuses personal access tokens
+func sessionOnly(handler http.HandlerFunc) http.Handler {
+    return middleware.JWTAuth(middleware.RequireSession(handler))
+}
 
-    r.Handle("/admin/files", middleware.JWTAuth(http.HandlerFunc(controllers.AdminListFiles))).Methods("GET")
-r.Handle("/admin/stats", middleware.JWTAuth(http.HandlerFunc(controllers.AdminUsageStats))).Methods("GET")
+// lfs wraps a Git LFS handler: git sends basic auth from its credential
+// helper, so it takes the same credentials as WebDAV
+func lfs(scope string, handler http.HandlerFunc) http.Handler {
+    return middleware.ClientAuth(middleware.RequireScope(scope, handler))
+}
 
+func Init() *mux.Router {
+    r := mux.NewRouter()
 
+    r.Handle("/upload", authed(middleware.ScopeFilesWrite, controllers.UploadFile)).Methods("POST")
+
+    r.Handle("/files", authed(middleware.ScopeFilesRead, controllers.ListFiles)).Methods("GET")
+
+    r.Handle("/files/search", authed(middleware.ScopeFilesRead, controllers.SearchFiles)).Methods("GET")
+
+    r.Handle("/files/{id}/download", authed(middleware.ScopeFilesRead, controllers.DownloadFile)).Methods("GET")
+
+    r.Handle("/files/{id}", authed(middleware.ScopeFilesWrite, controllers.DeleteFile)).Methods("DELETE")
+
+    r.Handle("/files/{id}", authed(middleware.ScopeFilesWrite, controllers.UpdateFile)).Methods("PATCH")
+
+    r.Handle("/files/{id}/share", authed(middleware.ScopeShareManage, controllers.ShareFilePublic)).Methods("POST")
+    r.Handle("/files/{id}/shares", authed(middleware.ScopeShareManage, controllers.ListShareLinks)).Methods("GET")
+    r.Handle("/files/{id}/shares/{linkID}", authed(middleware.ScopeShareManage, controllers.RevokeShareLink)).Methods("DELETE")
+
+    r.Handle("/files/{id}/grants", authed(middleware.ScopeShareManage, controllers.ListFileGrants)).Methods("GET")
+    r.Handle("/files/{id}/grants", authed(middleware.ScopeShareManage, controllers.GrantFileAccess)).Methods("POST")
+    r.Handle("/files/{id}/grants/{username}", authed(middleware.ScopeShareManage, controllers.RevokeFileAccess)).Methods("DELETE")
+    r.Handle("/shared", authed(middleware.ScopeFilesRead, controllers.ListSharedWithMe)).Methods("GET")
+
+    r.Handle("/files/{id}/versions", authed(middleware.ScopeFilesRead, controllers.ListFileVersions)).Methods("GET")
+    r.Handle("/files/{id}/versions/prune", authed(middleware.ScopeFilesWrite, controllers.PruneFileVersions)).Methods("POST")
+    r.Handle("/files/{id}/versions/{version:[0-9]+}/download", authed(middleware.ScopeFilesRead, controllers.DownloadFileVersion)).Methods("GET")
+    r.Handle("/files/{id}/versions/{version:[0-9]+}/restore", authed(middleware.ScopeFilesWrite, controllers.RestoreFileVersion)).Methods("POST")
+
+    r.Handle("/folders", authed(middleware.ScopeFilesRead, controllers.ListRootFolder)).Methods("GET")
+    r.Handle("/folders", authed(middleware.ScopeFilesWrite, controllers.CreateFolder)).Methods("POST")
+    r.Handle("/folders/{id}", authed(middleware.ScopeFilesRead, controllers.ListFolder)).Methods("GET")
+    r.Handle("/folders/{id}", authed(middleware.ScopeFilesWrite, controllers.UpdateFolder)).Methods("PATCH")
+    r.Handle("/folders/{id}", authed(middleware.ScopeFilesWrite, controllers.DeleteFolder)).Methods("DELETE")
+
+    r.Handle("/trash", authed(middleware.ScopeFilesRead, controllers.ListTrash)).Methods("GET")
+    r.Handle("/trash", authed(middleware.ScopeFilesWrite, controllers.EmptyTrash)).Methods("DELETE")
+    r.Handle("/trash/{id}/restore", authed(middleware.ScopeFilesWrite, controllers.RestoreTrashedFile)).Methods("POST")
+    r.Handle("/trash/{id}", authed(middleware.ScopeFilesWrite, controllers.PurgeTrashedFile)).Methods("DELETE")
+
+    r.Handle("/me/usage", authed(middleware.ScopeFilesRead, controllers.GetMyUsage)).Methods("GET")
+
+    r.Handle("/me/s3-keys", authed(middleware.ScopeFilesRead, controllers.ListS3Keys)).Methods("GET")
+    r.Handle("/me/s3-keys", sessionOnly(controllers.CreateS3Key)).Methods("POST")
+    r.Handle("/me/s3-keys/{id}", authed(middleware.ScopeFilesWrite, controllers.DeleteS3Key)).Methods("DELETE")
+    r.Handle("/me/ssh-keys", authed(middleware.ScopeFilesRead, controllers.ListSSHKeys)).Methods("GET")
+    r.Handle("/me/ssh-keys", sessionOnly(controllers.AddSSHKey)).Methods("POST")
+    r.Handle("/me/ssh-keys/{id}", authed(middleware.ScopeFilesWrite, controllers.DeleteSSHKey)).Methods("DELETE")
+
+    // Resumable uploads (tus 1.0.0)
+    r.HandleFunc("/tus", controllers.TusOptions).Methods("OPTIONS")
+    r.HandleFunc("/tus/{id}", controllers.TusOptions).Methods("OPTIONS")
+    r.Handle("/tus", authed(middleware.ScopeFilesWrite, controllers.TusCreate)).Methods("POST")
+    r.Handle("/tus/{id}", authed(middleware.ScopeFilesWrite, controllers.TusHead)).Methods("HEAD")
+    r.Handle("/tus/{id}", authed(middleware.ScopeFilesWrite, controllers.TusPatch)).Methods("PATCH")
+    r.Handle("/tus/{id}", authed(middleware.ScopeFilesWrite, controllers.TusDelete)).Methods("DELETE")
+
+    // WebDAV over the user's folders; scopes are checked per method inside
+    webdav := middleware.ClientAuth(http.HandlerFunc(controllers.WebDAV))
+    r.HandleFunc(controllers.WebDAVPrefix, controllers.WebDAVOptions).Methods("OPTIONS")
+    r.PathPrefix(controllers.WebDAVPrefix + "/").HandlerFunc(controllers.WebDAVOptions).Methods("OPTIONS")
+    r.Handle(controllers.WebDAVPrefix, webdav)
+    r.PathPrefix(controllers.WebDAVPrefix + "/").Handler(webdav)
+
+    // S3-compatible gateway, signed with the user's S3 access keys
+    s3 := middleware.S3Auth(http.HandlerFunc(controllers.S3Gateway))
+    r.Handle(controllers.S3Prefix, s3)
+    r.PathPrefix(controllers.S3Prefix + "/").Handler(s3)
+
+    // Git LFS batch and locking APIs; upload batches also check files:write inside
+    const lfsRepo = "/lfs/{owner}/{repo:[A-Za-z0-9._-]{1,100}}"
+    const lfsObject = lfsRepo + "/objects/{oid:[0-9a-f]{64}}"
+    r.Handle(lfsRepo+"/objects/batch", lfs(middleware.ScopeFilesRead, controllers.LFSBatch)).Methods("POST")
+    r.Handle(lfsObject, lfs(middleware.ScopeFilesWrite, controllers.LFSUpload)).Methods("PUT")
+    r.Handle(lfsObject, lfs(middleware.ScopeFilesRead, controllers.LFSDownload)).Methods("GET")
+    r.Handle(lfsObject, lfs(middleware.ScopeFilesWrite, controllers.LFSDelete)).Methods("DELETE")
+    r.Handle(lfsObject+"/verify", lfs(middleware.ScopeFilesRead, controllers.LFSVerify)).Methods("POST")
+    r.Handle(lfsRepo+"/locks", lfs(middleware.ScopeFilesRead, controllers.LFSListLocks)).Methods("GET")
+    r.Handle(lfsRepo+"/locks", lfs(middleware.ScopeFilesWrite, controllers.LFSCreateLock)).Methods("POST")
+    r.Handle(lfsRepo+"/locks/verify", lfs(middleware.ScopeFilesRead, controllers.LFSVerifyLocks)).Methods("POST")
+    r.Handle(lfsRepo+"/locks/{id:[0-9]+}/unlock", lfs(middleware.ScopeFilesWrite, controllers.LFSUnlock)).Methods("POST")
+
+    // OCI distribution registry; scopes are checked per method inside
+    r.PathPrefix(controllers.RegistryPrefix).Handler(middleware.ClientAuth(http.HandlerFunc(controllers.Registry)))
+
+    r.HandleFunc("/public/{link}/download", controllers.DownloadPublicFile).Methods("GET") // Public route, no auth
+
+    // Admin-only routes: the role comes from the token's claims or its owner
+    r.Handle("/admin/files", adminOnly(controllers.AdminListFiles)).Methods("GET")
+    r.Handle("/admin/stats", adminOnly(controllers.AdminUsageStats)).Methods("GET")
+    r.Handle("/admin/users/{username}/usage", adminOnly(controllers.AdminGetUserUsage)).Methods("GET")
+    r.Handle("/admin/users/{username}/quota", adminOnly(controllers.AdminSetQuota)).Methods("PUT")
+
+    // Service-to-service routes for the auth service's account management
+    r.Handle("/internal/users/{username}", middleware.InternalAuth(http.HandlerFunc(controllers.InternalDeleteUser))).Methods("DELETE")
+    r.Handle("/internal/users/{username}/rename", middleware.InternalAuth(http.HandlerFunc(controllers.InternalRenameUser))).Methods("POST")
 
     return r
 }
@@ -0,0 +1,156 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+
+    "file-service/database"
+)
+
+// ErrUsernameInUse is returned when renaming onto a username that still owns data
+var ErrUsernameInUse = errors.New("username already owns files")
+
+// DeleteUserData removes everything username owns: unfinished S3 multipart
+// and registry blob uploads, files (live and trashed) with their versions, share links and
+// grants, folders, Git LFS objects and locks, registry content, quota and
+// usage records, and grants other users gave them. Blobs left without references are purged from storage. It
+// returns the number of files deleted and is safe to call again after a
+// partial failure.
+func DeleteUserData(username string) (int, error) {
+    if _, err := DeleteS3Uploads("username = $1", username); err != nil {
+        return 0, err
+    }
+    if _, err := DeleteOCIUploads("owner = $1", username); err != nil {
+        return 0, err
+    }
+
+    rows, err := database.DB.Query("SELECT id FROM user_files WHERE uploader = $1", username)
+    if err != nil {
+        return 0, err
+    }
+    var ids []int
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        ids = append(ids, id)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    // One transaction per file, like purgeTrashed, so a huge account does
+    // not hold every lock at once. Share links and grants go by cascade.
+    deleted := 0
+    for _, id := range ids {
+        var orphans []string
+        gone := false
+        err := database.WithTx(func(tx *sql.Tx) error {
+            var err error
+            orphans, err = DeleteFileTx(tx, id)
+            if err == sql.ErrNoRows {
+                return nil
+            }
+            gone = err == nil
+            return err
+        })
+        if err != nil {
+            return deleted, err
+        }
+        PurgeBlobs(orphans)
+        if gone {
+            deleted++
+        }
+    }
+    if err := deleteLFSObjects(username); err != nil {
+        return deleted, err
+    }
+    if err := deleteOCIData(username); err != nil {
+        return deleted, err
+    }
+
+    err = database.WithTx(func(tx *sql.Tx) error {
+        for _, q := range []string{
+            "DELETE FROM file_grants WHERE grantee = $1",
+            "DELETE FROM folders WHERE owner = $1",
+            "DELETE FROM user_quotas WHERE username = $1",
+            "DELETE FROM usage_ledger WHERE username = $1",
+            "DELETE FROM s3_access_keys WHERE username = $1",
+            "DELETE FROM ssh_keys WHERE username = $1",
+        } {
+            if _, err := tx.Exec(q, username); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    return deleted, err
+}
+
+// RenameUser moves everything from oldName to newName after a username
+// change. The auth service retries until it gets an answer, so a rename that
+// was already applied (oldName owns nothing, newName does) succeeds again
+// without changing anything.
+func RenameUser(oldName, newName string) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        owns := func(name string) (bool, error) {
+            var found bool
+            err := tx.QueryRow(
+                `SELECT EXISTS (SELECT 1 FROM user_files WHERE uploader = $1)
+                     OR EXISTS (SELECT 1 FROM folders WHERE owner = $1)`,
+                name,
+            ).Scan(&found)
+            return found, err
+        }
+        taken, err := owns(newName)
+        if err != nil {
+            return err
+        }
+        if taken {
+            pending, err := owns(oldName)
+            if err != nil {
+                return err
+            }
+            if !pending {
+                return nil
+            }
+            return ErrUsernameInUse
+        }
+
+        // A quota row can outlive a deleted account; the new name starts
+        // clean, unless the old name's row has already moved there
+        _, err = tx.Exec(
+            "DELETE FROM user_quotas WHERE username = $1 AND EXISTS (SELECT 1 FROM user_quotas WHERE username = $2)",
+            newName, oldName,
+        )
+        if err != nil {
+            return err
+        }
+        for _, q := range []string{
+            "UPDATE user_files SET uploader = $2 WHERE uploader = $1",
+            "UPDATE folders SET owner = $2 WHERE owner = $1",
+            "UPDATE file_grants SET grantee = $2 WHERE grantee = $1",
+            "UPDATE file_grants SET granted_by = $2 WHERE granted_by = $1",
+            "UPDATE user_quotas SET username = $2 WHERE username = $1",
+            "UPDATE usage_ledger SET username = $2 WHERE username = $1",
+            "UPDATE tus_uploads SET uploader = $2 WHERE uploader = $1",
+            "UPDATE s3_access_keys SET username = $2 WHERE username = $1",
+            "UPDATE s3_multipart_uploads SET username = $2 WHERE username = $1",
+            "UPDATE lfs_objects SET owner = $2 WHERE owner = $1",
+            "UPDATE lfs_locks SET owner = $2 WHERE owner = $1",
+            "UPDATE lfs_locks SET locked_by = $2 WHERE locked_by = $1",
+            "UPDATE oci_blobs SET owner = $2 WHERE owner = $1",
+            "UPDATE oci_manifests SET owner = $2 WHERE owner = $1",
+            "UPDATE oci_uploads SET owner = $2 WHERE owner = $1",
+            "UPDATE ssh_keys SET username = $2 WHERE username = $1",
+        } {
+            if _, err := tx.Exec(q, oldName, newName); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "file-service/config"
+)
+
+// PasswordCheckError is a refusal from the auth service's password check.
+// RetryAfter is set when the login was rate limited or the account is locked.
+type PasswordCheckError struct {
+    Status     int
+    Message    string
+    RetryAfter time.Duration
+}
+
+func (e *PasswordCheckError) Error() string {
+    return e.Message
+}
+
+// PasswordOwner is who a verified username/password pair belongs to
+type PasswordOwner struct {
+    Username string `json:"username"`
+    Role     string `json:"role"`
+}
+
+var authClient = &http.Client{Timeout: 10 * time.Second}
+
+// VerifyPassword checks a username and account password with the auth
+// service, for clients that can only do HTTP basic auth. ip is the client's
+// address, so the auth service's rate limits apply per client. Every call
+// asks the auth service: a remembered answer would outlive password changes,
+// lockouts, 2FA enrollment and deleted accounts.
+func VerifyPassword(username, password, ip string) (PasswordOwner, error) {
+    data, err := json.Marshal(map[string]string{"username": username, "password": password, "ip": ip})
+    if err != nil {
+        return PasswordOwner{}, err
+    }
+    base := strings.TrimRight(config.GetEnvDefault("AUTH_SERVICE_URL", "http://localhost:8000"), "/")
+    req, err := http.NewRequest(http.MethodPost, base+"/internal/verify-password", bytes.NewReader(data))
+    if err != nil {
+        return PasswordOwner{}, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("X-Internal-Token", config.GetEnv("INTERNAL_API_TOKEN"))
+
+    resp, err := authClient.Do(req)
+    if err != nil {
+        return PasswordOwner{}, err
+    }
+    defer resp.Body.Close()
+
+    switch resp.StatusCode {
+    case http.StatusOK:
+    case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        checkErr := &PasswordCheckError{Status: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+        if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+            checkErr.RetryAfter = time.Duration(secs) * time.Second
+        }
+        return PasswordOwner{}, checkErr
+    default:
+        return PasswordOwner{}, fmt.Errorf("auth service: %s", resp.Status)
+    }
+
+    var owner PasswordOwner
+    err = json.NewDecoder(resp.Body).Decode(&owner)
+    return owner, err
+}
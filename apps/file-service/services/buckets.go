@@ -0,0 +1,124 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+
+    "file-service/database"
+    "file-service/models"
+)
+
+// The S3 gateway's buckets are the user's top-level folders, and an object
+// key is the path of a file below one: bucket "photos", key "2025/a.jpg" is
+// the file /photos/2025/a.jpg. Folders only show up as key prefixes.
+
+var (
+    // ErrNoSuchBucket means the user has no top-level folder by that name
+    ErrNoSuchBucket = errors.New("bucket not found")
+    // ErrBucketNotEmpty means the bucket still holds files
+    ErrBucketNotEmpty = errors.New("bucket is not empty")
+)
+
+// BucketObject is a file listed with its key relative to the bucket
+type BucketObject struct {
+    Key  string
+    File models.File
+}
+
+// ListBuckets returns owner's top-level folders
+func ListBuckets(owner string) ([]models.Folder, error) {
+    rows, err := database.DB.Query("SELECT "+folderColumns+" FROM folders WHERE owner = $1 AND parent_id IS NULL ORDER BY name", owner)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    buckets := []models.Folder{}
+    for rows.Next() {
+        var f models.Folder
+        if err := scanFolder(rows, &f); err != nil {
+            return nil, err
+        }
+        buckets = append(buckets, f)
+    }
+    return buckets, rows.Err()
+}
+
+// GetBucket loads the top-level folder called name
+func GetBucket(q Queryer, owner, name string) (models.Folder, error) {
+    var f models.Folder
+    err := scanFolder(q.QueryRow(
+        "SELECT "+folderColumns+" FROM folders WHERE owner = $1 AND parent_id IS NULL AND name = $2",
+        owner, name,
+    ), &f)
+    if err == sql.ErrNoRows {
+        return f, ErrNoSuchBucket
+    }
+    return f, err
+}
+
+// DeleteBucket removes an empty bucket along with any empty folders in it
+func DeleteBucket(owner, name string) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        bucket, err := GetBucket(tx, owner, name)
+        if err != nil {
+            return err
+        }
+        var hasFiles bool
+        err = tx.QueryRow(
+            `WITH RECURSIVE subtree AS (
+                SELECT id FROM folders WHERE id = $1
+                UNION ALL
+                SELECT c.id FROM folders c JOIN subtree s ON c.parent_id = s.id
+            )
+            SELECT EXISTS (SELECT 1 FROM user_files WHERE folder_id IN (SELECT id FROM subtree) AND trashed_at IS NULL)`,
+            bucket.ID,
+        ).Scan(&hasFiles)
+        if err != nil {
+            return err
+        }
+        if hasFiles {
+            return ErrBucketNotEmpty
+        }
+        // Subfolders go with it through ON DELETE CASCADE
+        _, err = tx.Exec("DELETE FROM folders WHERE id = $1", bucket.ID)
+        return err
+    })
+}
+
+// ListBucketObjects calls fn for each live file in the bucket whose key
+// starts with prefix and sorts after after, in byte order of the keys as S3
+// lists them. It stops early when fn returns false.
+func ListBucketObjects(owner string, bucketID int, prefix, after string, fn func(BucketObject) bool) error {
+    rows, err := database.DB.Query(
+        `WITH RECURSIVE tree AS (
+            SELECT id, ''::text AS path FROM folders WHERE id = $2 AND owner = $1
+            UNION ALL
+            SELECT c.id, t.path || c.name || '/' FROM folders c JOIN tree t ON c.parent_id = t.id
+        ),
+        objects AS (
+            SELECT t.path || f.filename AS object_key, `+models.FileColumns+`
+            FROM user_files f JOIN blobs b ON b.content_hash = f.content_hash JOIN tree t ON t.id = f.folder_id
+            WHERE f.trashed_at IS NULL
+        )
+        SELECT * FROM objects
+        WHERE left(object_key, length($3)) = $3 AND object_key > $4 COLLATE "C"
+        ORDER BY object_key COLLATE "C"`,
+        owner, bucketID, prefix, after,
+    )
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var obj BucketObject
+        if err := rows.Scan(append([]interface{}{&obj.Key}, models.FileDest(&obj.File)...)...); err != nil {
+            return err
+        }
+        if !fn(obj) {
+            return nil
+        }
+    }
+    return rows.Err()
+}
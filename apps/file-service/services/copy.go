@@ -0,0 +1,165 @@
+package services
+
+import (
+    "database/sql"
+
+    "file-service/database"
+    "file-service/models"
+)
+
+// CopyFile copies the current version of one of owner's files to name in
+// folderID. The copy shares the blob, so no bytes are written, but it is
+// charged to the quota like an upload and starts its own version history.
+func CopyFile(owner string, fileID int, folderID *int, name string) (models.File, error) {
+    var file models.File
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var err error
+        file, err = copyFileTx(tx, owner, fileID, folderID, name)
+        return err
+    })
+    return file, err
+}
+
+func copyFileTx(tx *sql.Tx, owner string, fileID int, folderID *int, name string) (models.File, error) {
+    src, err := GetFile(tx, fileID)
+    if err != nil {
+        return models.File{}, err
+    }
+    if src.Uploader != owner || src.TrashedAt != nil {
+        return models.File{}, sql.ErrNoRows
+    }
+    if !ValidName(name) {
+        return models.File{}, ErrInvalidName
+    }
+    if err := CheckFolder(tx, owner, folderID); err != nil {
+        return models.File{}, err
+    }
+    if taken, err := NameTaken(tx, owner, folderID, name); err != nil || taken {
+        if err == nil {
+            err = ErrNameTaken
+        }
+        return models.File{}, err
+    }
+
+    if err := ChargeUsageTx(tx, owner, src.Size); err != nil {
+        return models.File{}, err
+    }
+    refCount, err := ReferenceBlobTx(tx, src.ContentHash)
+    if err != nil {
+        return models.File{}, err
+    }
+
+    file := models.File{
+        Filename:       name,
+        Uploader:       owner,
+        Size:           src.Size,
+        MIMEType:       src.MIMEType,
+        ContentHash:    src.ContentHash,
+        ReferenceCount: refCount,
+        FolderID:       folderID,
+        Version:        1,
+    }
+    err = tx.QueryRow(
+        `INSERT INTO user_files
+        (filename, uploader, size, mime_type, content_hash, upload_date, download_count, is_public, public_link, folder_id, current_version)
+         VALUES ($1, $2, $3, $4, $5, now(), 0, FALSE, NULL, $6, 1) RETURNING id, upload_date`,
+        name, owner, src.Size, src.MIMEType, src.ContentHash, folderID,
+    ).Scan(&file.ID, &file.UploadDate)
+    if isUniqueViolation(err) {
+        return models.File{}, ErrNameTaken
+    }
+    if err != nil {
+        return models.File{}, err
+    }
+    _, err = tx.Exec(
+        "INSERT INTO file_versions (file_id, version, content_hash, size, mime_type, created_at) VALUES ($1, 1, $2, $3, $4, $5)",
+        file.ID, src.ContentHash, src.Size, src.MIMEType, file.UploadDate,
+    )
+    if err != nil {
+        return models.File{}, err
+    }
+    return file, RecordUsageTx(tx, owner, file.ID, src.Size, "copy")
+}
+
+// CopyFolder copies one of owner's folders to name in parentID. With
+// recursive, its files and subfolders are copied too, otherwise only an
+// empty folder is created. Everything happens in one transaction, so a copy
+// that would exceed the quota leaves nothing behind.
+func CopyFolder(owner string, id int, parentID *int, name string, recursive bool) (models.Folder, error) {
+    var folder models.Folder
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var err error
+        folder, err = copyFolderTx(tx, owner, id, parentID, name, recursive)
+        return err
+    })
+    return folder, err
+}
+
+func copyFolderTx(tx *sql.Tx, owner string, id int, parentID *int, name string, recursive bool) (models.Folder, error) {
+    if err := lockFolderTree(tx, owner); err != nil {
+        return models.Folder{}, err
+    }
+    if _, err := GetFolder(tx, owner, id); err != nil {
+        return models.Folder{}, err
+    }
+    if cycle, err := inSubtree(tx, id, parentID); err != nil || cycle {
+        if err == nil {
+            err = ErrFolderCycle
+        }
+        return models.Folder{}, err
+    }
+
+    folder, err := CreateFolder(tx, owner, parentID, name)
+    if err != nil || !recursive {
+        return folder, err
+    }
+    return folder, copyChildrenTx(tx, owner, id, folder.ID)
+}
+
+// copyChildrenTx copies the contents of folder src into folder dst
+func copyChildrenTx(tx *sql.Tx, owner string, src, dst int) error {
+    type child struct {
+        id       int
+        name     string
+        isFolder bool
+    }
+    rows, err := tx.Query(
+        `SELECT id, name, TRUE FROM folders WHERE owner = $1 AND parent_id = $2
+         UNION ALL
+         SELECT id, filename, FALSE FROM user_files WHERE uploader = $1 AND folder_id = $2 AND trashed_at IS NULL`,
+        owner, src,
+    )
+    if err != nil {
+        return err
+    }
+    var children []child
+    for rows.Next() {
+        var c child
+        if err := rows.Scan(&c.id, &c.name, &c.isFolder); err != nil {
+            rows.Close()
+            return err
+        }
+        children = append(children, c)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for _, c := range children {
+        if !c.isFolder {
+            if _, err := copyFileTx(tx, owner, c.id, &dst, c.name); err != nil {
+                return err
+            }
+            continue
+        }
+        sub, err := CreateFolder(tx, owner, &dst, c.name)
+        if err != nil {
+            return err
+        }
+        if err := copyChildrenTx(tx, owner, c.id, sub.ID); err != nil {
+            return err
+        }
+    }
+    return nil
+}
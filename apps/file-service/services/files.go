@@ -0,0 +1,269 @@
+package services
+
+import (
+    "database/sql"
+    "log"
+    "mime"
+    "path/filepath"
+    "time"
+
+    "file-service/database"
+    "file-service/models"
+    "file-service/storage"
+)
+
+// StoreFile adds a file entry for uploader pointing at the blob for the staged content.
+// If uploader already has a file with that name in the folder, the content is
+// added to it as a new version instead. The staged file is only moved into
+// storage when no blob with that hash exists yet; otherwise the existing blob
+// gains a reference. Callers should Discard the staged blob afterwards either way.
+func StoreFile(uploader, filename, mimeType string, folderID *int, blob *StagedBlob) (models.File, error) {
+    var file models.File
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var err error
+        file, err = StoreFileTx(tx, uploader, filename, mimeType, folderID, blob)
+        return err
+    })
+    return file, err
+}
+
+// StoreFileTx is StoreFile inside the caller's transaction. The blob's bytes are
+// written before the transaction commits, while its lock is held; if the
+// transaction fails afterwards the caller must not commit it.
+func StoreFileTx(tx *sql.Tx, uploader, filename, mimeType string, folderID *int, blob *StagedBlob) (models.File, error) {
+    if !ValidName(filename) {
+        return models.File{}, ErrInvalidName
+    }
+    if err := CheckFolder(tx, uploader, folderID); err != nil {
+        return models.File{}, err
+    }
+
+    // Re-uploading to an existing name adds a version to that file
+    var existingID int
+    err := tx.QueryRow(
+        "SELECT id FROM user_files WHERE uploader = $1 AND folder_id IS NOT DISTINCT FROM $2 AND filename = $3 AND trashed_at IS NULL FOR UPDATE",
+        uploader, folderID, filename,
+    ).Scan(&existingID)
+    if err == nil {
+        return AddVersionTx(tx, existingID, mimeType, blob)
+    }
+    if err != sql.ErrNoRows {
+        return models.File{}, err
+    }
+    if taken, err := NameTaken(tx, uploader, folderID, filename); err != nil || taken {
+        if err == nil {
+            err = ErrNameTaken
+        }
+        return models.File{}, err
+    }
+
+    // Charge the quota first so an over-quota upload never touches the blob store
+    if err := ChargeUsageTx(tx, uploader, blob.Size); err != nil {
+        return models.File{}, err
+    }
+
+    refCount, err := AcquireBlobTx(tx, blob)
+    if err != nil {
+        return models.File{}, err
+    }
+
+    file := models.File{
+        Filename:       filename,
+        Uploader:       uploader,
+        Size:           blob.Size,
+        MIMEType:       mimeType,
+        ContentHash:    blob.Hash,
+        ReferenceCount: refCount,
+        FolderID:       folderID,
+        Version:        1,
+    }
+    err = tx.QueryRow(
+        `INSERT INTO user_files
+        (filename, uploader, size, mime_type, content_hash, upload_date, download_count, is_public, public_link, folder_id, current_version)
+         VALUES ($1, $2, $3, $4, $5, $6, 0, FALSE, NULL, $7, 1) RETURNING id, upload_date`,
+        filename, uploader, blob.Size, mimeType, blob.Hash, time.Now(), folderID,
+    ).Scan(&file.ID, &file.UploadDate)
+    if isUniqueViolation(err) {
+        err = ErrNameTaken
+    }
+    if err == nil {
+        _, err = tx.Exec(
+            "INSERT INTO file_versions (file_id, version, content_hash, size, mime_type, created_at) VALUES ($1, 1, $2, $3, $4, $5)",
+            file.ID, blob.Hash, blob.Size, mimeType, file.UploadDate,
+        )
+    }
+    if err == nil {
+        err = RecordUsageTx(tx, uploader, file.ID, blob.Size, "upload")
+    }
+    if err != nil {
+        discardNewBlob(blob.Hash, refCount)
+        return models.File{}, err
+    }
+    return file, nil
+}
+
+// GetFile loads a file entry by id, with its blob's reference count
+func GetFile(q Queryer, id int) (models.File, error) {
+    var f models.File
+    err := models.ScanFile(q.QueryRow(
+        "SELECT "+models.FileColumns+" FROM user_files f JOIN blobs b ON b.content_hash = f.content_hash WHERE f.id = $1",
+        id,
+    ), &f)
+    return f, err
+}
+
+// AcquireBlobTx takes one reference on the blob for the staged content, creating
+// the blob (and writing its bytes) if this is the first reference. It returns
+// the new reference count.
+func AcquireBlobTx(tx *sql.Tx, blob *StagedBlob) (int, error) {
+    if err := lockBlob(tx, blob.Hash); err != nil {
+        return 0, err
+    }
+
+    res, err := tx.Exec(
+        "INSERT INTO blobs (content_hash, size, reference_count) VALUES ($1, $2, 1) ON CONFLICT (content_hash) DO NOTHING",
+        blob.Hash, blob.Size,
+    )
+    if err != nil {
+        return 0, err
+    }
+    if inserted, _ := res.RowsAffected(); inserted == 1 {
+        if err := blob.commit(); err != nil {
+            return 0, err
+        }
+        return 1, nil
+    }
+
+    // Duplicate content - the new entry shares the existing blob
+    var refCount int
+    err = tx.QueryRow(
+        "UPDATE blobs SET reference_count = reference_count + 1 WHERE content_hash = $1 RETURNING reference_count",
+        blob.Hash,
+    ).Scan(&refCount)
+    return refCount, err
+}
+
+// discardNewBlob removes bytes written for a blob whose creating transaction is
+// about to roll back. It runs before the rollback, while the blob lock is still
+// held, so a concurrent upload of the same content cannot have written them.
+func discardNewBlob(contentHash string, refCount int) {
+    if refCount == 1 {
+        storage.Store.Delete(contentHash)
+    }
+}
+
+// ReferenceBlobTx takes one more reference on a blob that is already stored
+func ReferenceBlobTx(tx *sql.Tx, contentHash string) (int, error) {
+    if err := lockBlob(tx, contentHash); err != nil {
+        return 0, err
+    }
+    var refCount int
+    err := tx.QueryRow(
+        "UPDATE blobs SET reference_count = reference_count + 1 WHERE content_hash = $1 RETURNING reference_count",
+        contentHash,
+    ).Scan(&refCount)
+    return refCount, err
+}
+
+// DeleteFileTx removes a file entry with all its versions, gives their bytes back
+// to the owner's usage and releases their blobs. It returns the content hashes
+// that lost their last reference, to PurgeBlobs after committing.
+func DeleteFileTx(tx *sql.Tx, fileID int) ([]string, error) {
+    var uploader string
+    err := tx.QueryRow("SELECT uploader FROM user_files WHERE id = $1 FOR UPDATE", fileID).Scan(&uploader)
+    if err != nil {
+        return nil, err
+    }
+
+    versions, err := listVersionsTx(tx, fileID)
+    if err != nil {
+        return nil, err
+    }
+
+    // Versions go with the entry through ON DELETE CASCADE
+    if _, err := tx.Exec("DELETE FROM user_files WHERE id = $1", fileID); err != nil {
+        return nil, err
+    }
+
+    var orphans []string
+    for _, v := range versions {
+        if err := CreditUsageTx(tx, uploader, fileID, v.Size, "delete"); err != nil {
+            return nil, err
+        }
+        orphaned, err := ReleaseBlobTx(tx, v.ContentHash)
+        if err != nil {
+            return nil, err
+        }
+        if orphaned {
+            orphans = append(orphans, v.ContentHash)
+        }
+    }
+    return orphans, nil
+}
+
+// ReleaseBlobTx drops one reference to a blob and deletes its row once nothing
+// points at it. When it reports orphaned, call PurgeBlob after committing.
+func ReleaseBlobTx(tx *sql.Tx, contentHash string) (orphaned bool, err error) {
+    if err := lockBlob(tx, contentHash); err != nil {
+        return false, err
+    }
+
+    var refCount int
+    err = tx.QueryRow(
+        "UPDATE blobs SET reference_count = reference_count - 1 WHERE content_hash = $1 RETURNING reference_count",
+        contentHash,
+    ).Scan(&refCount)
+    if err != nil {
+        return false, err
+    }
+    if refCount > 0 {
+        return false, nil
+    }
+    _, err = tx.Exec("DELETE FROM blobs WHERE content_hash = $1", contentHash)
+    return err == nil, err
+}
+
+// PurgeBlob removes the stored bytes of a released blob. It re-checks under the
+// blob lock, because the same content may have been uploaded again since the
+// release committed, in which case the bytes belong to the new blob.
+func PurgeBlob(contentHash string) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        if err := lockBlob(tx, contentHash); err != nil {
+            return err
+        }
+        var exists bool
+        err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM blobs WHERE content_hash = $1)", contentHash).Scan(&exists)
+        if err != nil || exists {
+            return err
+        }
+        return storage.Store.Delete(contentHash)
+    })
+}
+
+// PurgeBlobs runs PurgeBlob for each hash, logging failures; leftover bytes
+// without a blob row are harmless and get overwritten by a later upload
+func PurgeBlobs(hashes []string) {
+    for _, hash := range hashes {
+        if err := PurgeBlob(hash); err != nil {
+            log.Println("failed to remove blob", hash+":", err)
+        }
+    }
+}
+
+// lockBlob serialises uploads and deletes of the same content hash until the transaction ends
+func lockBlob(tx *sql.Tx, contentHash string) error {
+    _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", contentHash)
+    return err
+}
+
+// DetectMIMEType determines the MIME type from the file extension, falling back to the client's value
+func DetectMIMEType(filename, fallback string) string {
+    mimeType := mime.TypeByExtension(filepath.Ext(filename))
+    if mimeType == "" {
+        mimeType = fallback
+    }
+    if mimeType == "" {
+        mimeType = "application/octet-stream"
+    }
+    return mimeType
+}
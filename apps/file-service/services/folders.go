@@ -0,0 +1,449 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "strings"
+
+    "github.com/lib/pq"
+
+    "file-service/database"
+    "file-service/models"
+)
+
+var (
+    // ErrNameTaken means a file or folder with that name already exists in the target folder
+    ErrNameTaken = errors.New("a file or folder with that name already exists here")
+    // ErrInvalidName rejects empty names, "." / ".." and names containing slashes
+    ErrInvalidName = errors.New("invalid name")
+    // ErrFolderNotFound means the folder does not exist or belongs to someone else
+    ErrFolderNotFound = errors.New("folder not found")
+    // ErrFolderCycle means a folder would be moved into its own subtree
+    ErrFolderCycle = errors.New("cannot move a folder into itself")
+)
+
+// Queryer is satisfied by both *sql.DB and *sql.Tx.
+type Queryer interface {
+    QueryRow(query string, args ...interface{}) *sql.Row
+    Query(query string, args ...interface{}) (*sql.Rows, error)
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+const folderColumns = "id, name, owner, parent_id, created_at"
+
+func scanFolder(s models.FileScanner, f *models.Folder) error {
+    return s.Scan(&f.ID, &f.Name, &f.Owner, &f.ParentID, &f.CreatedAt)
+}
+
+// ValidName reports whether name can be used for a file or folder
+func ValidName(name string) bool {
+    return name != "" && name != "." && name != ".." && len(name) <= 255 && !strings.ContainsAny(name, `/\`)
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation
+func isUniqueViolation(err error) bool {
+    var pqErr *pq.Error
+    return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// GetFolder loads one of owner's folders
+func GetFolder(q Queryer, owner string, id int) (models.Folder, error) {
+    var f models.Folder
+    err := scanFolder(q.QueryRow("SELECT "+folderColumns+" FROM folders WHERE id = $1 AND owner = $2", id, owner), &f)
+    if err == sql.ErrNoRows {
+        return f, ErrFolderNotFound
+    }
+    return f, err
+}
+
+// CheckFolder verifies that folderID (nil for the root) is one of owner's folders
+func CheckFolder(q Queryer, owner string, folderID *int) error {
+    if folderID == nil {
+        return nil
+    }
+    _, err := GetFolder(q, owner, *folderID)
+    return err
+}
+
+// NameTaken reports whether a file or folder named name already sits in parentID
+func NameTaken(q Queryer, owner string, parentID *int, name string) (bool, error) {
+    var taken bool
+    err := q.QueryRow(
+        `SELECT EXISTS (SELECT 1 FROM folders WHERE owner = $1 AND parent_id IS NOT DISTINCT FROM $2 AND name = $3)
+             OR EXISTS (SELECT 1 FROM user_files WHERE uploader = $1 AND folder_id IS NOT DISTINCT FROM $2 AND filename = $3 AND trashed_at IS NULL)`,
+        owner, parentID, name,
+    ).Scan(&taken)
+    return taken, err
+}
+
+// CreateFolder makes a new folder named name inside parentID (nil for the root)
+func CreateFolder(q Queryer, owner string, parentID *int, name string) (models.Folder, error) {
+    if !ValidName(name) {
+        return models.Folder{}, ErrInvalidName
+    }
+    if err := CheckFolder(q, owner, parentID); err != nil {
+        return models.Folder{}, err
+    }
+    if taken, err := NameTaken(q, owner, parentID, name); err != nil || taken {
+        if err == nil {
+            err = ErrNameTaken
+        }
+        return models.Folder{}, err
+    }
+
+    var f models.Folder
+    err := scanFolder(q.QueryRow(
+        "INSERT INTO folders (name, owner, parent_id) VALUES ($1, $2, $3) RETURNING "+folderColumns,
+        name, owner, parentID,
+    ), &f)
+    if isUniqueViolation(err) {
+        return f, ErrNameTaken
+    }
+    return f, err
+}
+
+// ResolvePath walks a slash-separated path such as "/projects/2025" from the root
+// and returns the folder id it names (nil for "/" or ""). With create, missing
+// folders along the way are created like mkdir -p.
+func ResolvePath(q Queryer, owner, path string, create bool) (*int, error) {
+    var parentID *int
+    for _, name := range strings.Split(path, "/") {
+        if name == "" {
+            continue
+        }
+        if !ValidName(name) {
+            return nil, ErrInvalidName
+        }
+
+        var id int
+        err := q.QueryRow(
+            "SELECT id FROM folders WHERE owner = $1 AND parent_id IS NOT DISTINCT FROM $2 AND name = $3",
+            owner, parentID, name,
+        ).Scan(&id)
+        if err == sql.ErrNoRows && create {
+            id, err = ensureFolder(q, owner, parentID, name)
+        } else if err == sql.ErrNoRows {
+            err = ErrFolderNotFound
+        }
+        if err != nil {
+            return nil, err
+        }
+        parentID = &id
+    }
+    return parentID, nil
+}
+
+// ensureFolder returns the id of the folder name in parentID, creating it if
+// needed. Concurrent callers creating the same folder all get its id instead
+// of all but one failing with ErrNameTaken.
+func ensureFolder(q Queryer, owner string, parentID *int, name string) (int, error) {
+    var fileTaken bool
+    err := q.QueryRow(
+        "SELECT EXISTS (SELECT 1 FROM user_files WHERE uploader = $1 AND folder_id IS NOT DISTINCT FROM $2 AND filename = $3 AND trashed_at IS NULL)",
+        owner, parentID, name,
+    ).Scan(&fileTaken)
+    if err != nil {
+        return 0, err
+    }
+    if fileTaken {
+        return 0, ErrNameTaken
+    }
+
+    var id int
+    err = q.QueryRow(
+        `INSERT INTO folders (name, owner, parent_id) VALUES ($1, $2, $3)
+         ON CONFLICT (owner, (COALESCE(parent_id, 0)), name) DO NOTHING RETURNING id`,
+        name, owner, parentID,
+    ).Scan(&id)
+    if err == sql.ErrNoRows {
+        err = q.QueryRow(
+            "SELECT id FROM folders WHERE owner = $1 AND parent_id IS NOT DISTINCT FROM $2 AND name = $3",
+            owner, parentID, name,
+        ).Scan(&id)
+    }
+    return id, err
+}
+
+// lockFolderTree serializes moves and copies within owner's folders, so two
+// of them cannot each pass the cycle check and together make a loop
+func lockFolderTree(tx *sql.Tx, owner string) error {
+    _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('folders'), hashtext($1))", owner)
+    return err
+}
+
+// Breadcrumbs returns the chain of folders from the root down to id
+func Breadcrumbs(q Queryer, owner string, id int) ([]models.Folder, error) {
+    rows, err := q.Query(
+        `WITH RECURSIVE chain AS (
+            SELECT `+folderColumns+`, 0 AS depth FROM folders WHERE id = $1 AND owner = $2
+            UNION ALL
+            SELECT p.id, p.name, p.owner, p.parent_id, p.created_at, c.depth + 1
+            FROM folders p JOIN chain c ON p.id = c.parent_id
+        )
+        SELECT `+folderColumns+` FROM chain ORDER BY depth DESC`,
+        id, owner,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var crumbs []models.Folder
+    for rows.Next() {
+        var f models.Folder
+        if err := scanFolder(rows, &f); err != nil {
+            return nil, err
+        }
+        crumbs = append(crumbs, f)
+    }
+    return crumbs, rows.Err()
+}
+
+// FolderPath returns the "/a/b" path of folderID (nil is "/")
+func FolderPath(q Queryer, owner string, folderID *int) (string, error) {
+    if folderID == nil {
+        return "/", nil
+    }
+    crumbs, err := Breadcrumbs(q, owner, *folderID)
+    if err != nil {
+        return "", err
+    }
+    var names []string
+    for _, c := range crumbs {
+        names = append(names, c.Name)
+    }
+    return "/" + strings.Join(names, "/"), nil
+}
+
+// ListFolder returns the direct children of parentID (nil for the root) with breadcrumbs
+func ListFolder(owner string, parentID *int) (models.FolderListing, error) {
+    listing := models.FolderListing{Breadcrumbs: []models.Folder{}, Folders: []models.Folder{}, Files: []models.File{}}
+    if parentID != nil {
+        crumbs, err := Breadcrumbs(database.DB, owner, *parentID)
+        if err != nil {
+            return listing, err
+        }
+        if len(crumbs) == 0 {
+            return listing, ErrFolderNotFound
+        }
+        listing.Breadcrumbs = crumbs
+        listing.Folder = &crumbs[len(crumbs)-1]
+    }
+
+    rows, err := database.DB.Query(
+        "SELECT "+folderColumns+" FROM folders WHERE owner = $1 AND parent_id IS NOT DISTINCT FROM $2 ORDER BY name",
+        owner, parentID,
+    )
+    if err != nil {
+        return listing, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var f models.Folder
+        if err := scanFolder(rows, &f); err != nil {
+            return listing, err
+        }
+        listing.Folders = append(listing.Folders, f)
+    }
+    if err := rows.Err(); err != nil {
+        return listing, err
+    }
+
+    fileRows, err := database.DB.Query(
+        "SELECT "+models.FileColumns+" FROM user_files f JOIN blobs b ON b.content_hash = f.content_hash WHERE f.uploader = $1 AND f.folder_id IS NOT DISTINCT FROM $2 AND f.trashed_at IS NULL ORDER BY f.filename",
+        owner, parentID,
+    )
+    if err != nil {
+        return listing, err
+    }
+    defer fileRows.Close()
+    for fileRows.Next() {
+        var f models.File
+        if err := models.ScanFile(fileRows, &f); err != nil {
+            return listing, err
+        }
+        listing.Files = append(listing.Files, f)
+    }
+    return listing, fileRows.Err()
+}
+
+// UpdateFolder renames and/or moves a folder. newParentID is only applied when
+// move is set, so a nil newParentID with move moves the folder to the root.
+func UpdateFolder(owner string, id int, newName *string, move bool, newParentID *int) (models.Folder, error) {
+    var folder models.Folder
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var err error
+        folder, err = updateFolderTx(tx, owner, id, newName, move, newParentID)
+        return err
+    })
+    return folder, err
+}
+
+func updateFolderTx(tx *sql.Tx, owner string, id int, newName *string, move bool, newParentID *int) (models.Folder, error) {
+    folder, err := GetFolder(tx, owner, id)
+    if err != nil {
+        return folder, err
+    }
+
+    name, parentID := folder.Name, folder.ParentID
+    if newName != nil {
+        name = *newName
+    }
+    if move {
+        parentID = newParentID
+        if err := lockFolderTree(tx, owner); err != nil {
+            return folder, err
+        }
+        if err := CheckFolder(tx, owner, parentID); err != nil {
+            return folder, err
+        }
+        // The new parent must not be the folder itself or one of its descendants
+        if cycle, err := inSubtree(tx, id, parentID); err != nil || cycle {
+            if err == nil {
+                err = ErrFolderCycle
+            }
+            return folder, err
+        }
+    }
+    if !ValidName(name) {
+        return folder, ErrInvalidName
+    }
+    if name == folder.Name && sameFolder(parentID, folder.ParentID) {
+        return folder, nil
+    }
+    if taken, err := NameTaken(tx, owner, parentID, name); err != nil || taken {
+        if err == nil {
+            err = ErrNameTaken
+        }
+        return folder, err
+    }
+
+    err = scanFolder(tx.QueryRow(
+        "UPDATE folders SET name = $1, parent_id = $2 WHERE id = $3 RETURNING "+folderColumns,
+        name, parentID, id,
+    ), &folder)
+    if isUniqueViolation(err) {
+        return folder, ErrNameTaken
+    }
+    return folder, err
+}
+
+// UpdateFile renames and/or moves one of owner's files, with the same move semantics as UpdateFolder
+func UpdateFile(owner string, id int, newName *string, move bool, newFolderID *int) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        return updateFileTx(tx, owner, id, newName, move, newFolderID)
+    })
+}
+
+func updateFileTx(tx *sql.Tx, owner string, id int, newName *string, move bool, newFolderID *int) error {
+    var name string
+    var folderID *int
+    err := tx.QueryRow("SELECT filename, folder_id FROM user_files WHERE id = $1 AND uploader = $2 AND trashed_at IS NULL FOR UPDATE", id, owner).Scan(&name, &folderID)
+    if err != nil {
+        return err
+    }
+
+    oldName, oldFolderID := name, folderID
+    if newName != nil {
+        name = *newName
+    }
+    if move {
+        folderID = newFolderID
+        if err := CheckFolder(tx, owner, folderID); err != nil {
+            return err
+        }
+    }
+    if !ValidName(name) {
+        return ErrInvalidName
+    }
+    if name == oldName && sameFolder(folderID, oldFolderID) {
+        return nil
+    }
+    if taken, err := NameTaken(tx, owner, folderID, name); err != nil || taken {
+        if err == nil {
+            err = ErrNameTaken
+        }
+        return err
+    }
+
+    _, err = tx.Exec("UPDATE user_files SET filename = $1, folder_id = $2 WHERE id = $3", name, folderID, id)
+    if isUniqueViolation(err) {
+        return ErrNameTaken
+    }
+    return err
+}
+
+// DeleteFolder removes a folder with everything below it. Files in the subtree
+// go to the trash like DeleteFile; restoring one recreates its folder path.
+func DeleteFolder(owner string, id int) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        return deleteFolderTx(tx, owner, id)
+    })
+}
+
+func deleteFolderTx(tx *sql.Tx, owner string, id int) error {
+    if _, err := GetFolder(tx, owner, id); err != nil {
+        return err
+    }
+
+    rows, err := tx.Query(
+        `WITH RECURSIVE subtree AS (
+            SELECT id FROM folders WHERE id = $1
+            UNION ALL
+            SELECT c.id FROM folders c JOIN subtree s ON c.parent_id = s.id
+        )
+        SELECT f.id FROM user_files f WHERE f.folder_id IN (SELECT id FROM subtree) AND f.trashed_at IS NULL FOR UPDATE`,
+        id,
+    )
+    if err != nil {
+        return err
+    }
+    var fileIDs []int
+    for rows.Next() {
+        var fileID int
+        if err := rows.Scan(&fileID); err != nil {
+            rows.Close()
+            return err
+        }
+        fileIDs = append(fileIDs, fileID)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return err
+    }
+
+    for _, fileID := range fileIDs {
+        if err := TrashFileTx(tx, fileID); err != nil {
+            return err
+        }
+    }
+
+    // Child folders go with it through ON DELETE CASCADE
+    _, err = tx.Exec("DELETE FROM folders WHERE id = $1", id)
+    return err
+}
+
+// inSubtree reports whether folderID is the folder root or one of its descendants
+func inSubtree(q Queryer, root int, folderID *int) (bool, error) {
+    if folderID == nil {
+        return false, nil
+    }
+    var found bool
+    err := q.QueryRow(
+        `WITH RECURSIVE subtree AS (
+            SELECT id FROM folders WHERE id = $1
+            UNION ALL
+            SELECT c.id FROM folders c JOIN subtree s ON c.parent_id = s.id
+        )
+        SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)`,
+        root, *folderID,
+    ).Scan(&found)
+    return found, err
+}
+
+func sameFolder(a, b *int) bool {
+    if a == nil || b == nil {
+        return a == nil && b == nil
+    }
+    return *a == *b
+}
@@ -0,0 +1,157 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "strings"
+
+    "file-service/database"
+    "file-service/models"
+)
+
+var (
+    ErrInvalidPermission = errors.New("permission must be viewer, downloader or editor")
+    ErrInvalidGrantee    = errors.New("invalid grantee")
+    ErrUnknownGrantee    = errors.New("no user with that name")
+    ErrGrantNotFound     = errors.New("grant not found")
+)
+
+// Access is what a user may do with a file. Levels are ordered, so a check
+// for AccessDownloader also passes editors and the owner.
+type Access int
+
+const (
+    AccessNone Access = iota
+    AccessViewer
+    AccessDownloader
+    AccessEditor
+    AccessOwner
+)
+
+// ParsePermission maps a grant permission name to its access level
+func ParsePermission(permission string) (Access, error) {
+    switch permission {
+    case models.PermissionViewer:
+        return AccessViewer, nil
+    case models.PermissionDownloader:
+        return AccessDownloader, nil
+    case models.PermissionEditor:
+        return AccessEditor, nil
+    }
+    return AccessNone, ErrInvalidPermission
+}
+
+// FileAccess loads a live file and works out what user may do with it: owners
+// have full access, everybody else only what a grant gives them. Trashed files
+// are reported as sql.ErrNoRows.
+func FileAccess(q Queryer, user string, fileID int) (models.File, Access, error) {
+    f, err := GetFile(q, fileID)
+    if err == nil && f.TrashedAt != nil {
+        err = sql.ErrNoRows
+    }
+    if err != nil {
+        return f, AccessNone, err
+    }
+    if f.Uploader == user {
+        return f, AccessOwner, nil
+    }
+
+    var permission string
+    err = q.QueryRow("SELECT permission FROM file_grants WHERE file_id = $1 AND grantee = $2", fileID, user).Scan(&permission)
+    if err == sql.ErrNoRows {
+        return f, AccessNone, nil
+    }
+    if err != nil {
+        return f, AccessNone, err
+    }
+    access, err := ParsePermission(permission)
+    return f, access, err
+}
+
+// GrantAccess shares fileID with grantee at permission, replacing any earlier grant
+func GrantAccess(fileID int, owner, grantee, permission string) (models.FileGrant, error) {
+    var g models.FileGrant
+    grantee = strings.TrimSpace(grantee)
+    if grantee == "" || grantee == owner || len(grantee) > 100 {
+        return g, ErrInvalidGrantee
+    }
+    if _, err := ParsePermission(permission); err != nil {
+        return g, err
+    }
+    var exists bool
+    if err := database.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", grantee).Scan(&exists); err != nil {
+        return g, err
+    }
+    if !exists {
+        return g, ErrUnknownGrantee
+    }
+
+    err := database.DB.QueryRow(
+        `INSERT INTO file_grants (file_id, grantee, permission, granted_by) VALUES ($1, $2, $3, $4)
+         ON CONFLICT (file_id, grantee) DO UPDATE SET permission = EXCLUDED.permission, granted_by = EXCLUDED.granted_by
+         RETURNING id, file_id, grantee, permission, granted_by, created_at`,
+        fileID, grantee, permission, owner,
+    ).Scan(&g.ID, &g.FileID, &g.Grantee, &g.Permission, &g.GrantedBy, &g.CreatedAt)
+    return g, err
+}
+
+// ListGrants returns who fileID is shared with
+func ListGrants(fileID int) ([]models.FileGrant, error) {
+    rows, err := database.DB.Query(
+        "SELECT id, file_id, grantee, permission, granted_by, created_at FROM file_grants WHERE file_id = $1 ORDER BY grantee",
+        fileID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    grants := []models.FileGrant{}
+    for rows.Next() {
+        var g models.FileGrant
+        if err := rows.Scan(&g.ID, &g.FileID, &g.Grantee, &g.Permission, &g.GrantedBy, &g.CreatedAt); err != nil {
+            return nil, err
+        }
+        grants = append(grants, g)
+    }
+    return grants, rows.Err()
+}
+
+// RevokeGrant stops sharing fileID with grantee
+func RevokeGrant(fileID int, grantee string) error {
+    res, err := database.DB.Exec("DELETE FROM file_grants WHERE file_id = $1 AND grantee = $2", fileID, grantee)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrGrantNotFound
+    }
+    return nil
+}
+
+// ListSharedWithMe returns live files other users have shared with user
+func ListSharedWithMe(user string) ([]models.SharedFile, error) {
+    rows, err := database.DB.Query(
+        `SELECT `+models.FileColumns+`, g.permission, g.created_at
+         FROM file_grants g
+         JOIN user_files f ON f.id = g.file_id
+         JOIN blobs b ON b.content_hash = f.content_hash
+         WHERE g.grantee = $1 AND f.trashed_at IS NULL
+         ORDER BY g.created_at DESC`,
+        user,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    files := []models.SharedFile{}
+    for rows.Next() {
+        var s models.SharedFile
+        if err := rows.Scan(append(models.FileDest(&s.File), &s.Permission, &s.SharedAt)...); err != nil {
+            return nil, err
+        }
+        files = append(files, s)
+    }
+    return files, rows.Err()
+}
@@ -0,0 +1,307 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "regexp"
+
+    "file-service/database"
+    "file-service/models"
+)
+
+var (
+    // ErrLFSObjectNotFound means the repository has no object with that oid
+    ErrLFSObjectNotFound = errors.New("object does not exist")
+    // ErrLFSLockExists means the path is already locked
+    ErrLFSLockExists = errors.New("path is already locked")
+    // ErrLFSLockNotFound means the repository has no lock with that id
+    ErrLFSLockNotFound = errors.New("lock not found")
+    // ErrLFSLockNotOwned refuses to release someone else's lock without force
+    ErrLFSLockNotOwned = errors.New("lock is held by another user")
+)
+
+var lfsOIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ValidLFSOID reports whether oid is a lowercase hex SHA-256, the only hash LFS objects use here
+func ValidLFSOID(oid string) bool {
+    return lfsOIDPattern.MatchString(oid)
+}
+
+const lfsObjectColumns = "owner, repo, oid, size, created_at"
+
+func scanLFSObject(row models.FileScanner, o *models.LFSObject) error {
+    return row.Scan(&o.Owner, &o.Repo, &o.OID, &o.Size, &o.CreatedAt)
+}
+
+// GetLFSObject loads an object of owner's repository
+func GetLFSObject(owner, repo, oid string) (models.LFSObject, error) {
+    var o models.LFSObject
+    err := scanLFSObject(database.DB.QueryRow(
+        "SELECT "+lfsObjectColumns+" FROM lfs_objects WHERE owner = $1 AND repo = $2 AND oid = $3",
+        owner, repo, oid,
+    ), &o)
+    if err == sql.ErrNoRows {
+        return o, ErrLFSObjectNotFound
+    }
+    return o, err
+}
+
+// LinkLFSObject adds an object to the repository without an upload when
+// owner already has that content, in another repository or among their
+// files. Only content the owner holds counts, so knowing a hash is not
+// enough to reach someone else's data. It reports whether the object is now
+// in the repository.
+func LinkLFSObject(owner, repo, oid string, size int64) (bool, error) {
+    linked := false
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var exists, held bool
+        err := tx.QueryRow(
+            `SELECT EXISTS (SELECT 1 FROM lfs_objects WHERE owner = $1 AND repo = $2 AND oid = $3),
+                EXISTS (SELECT 1 FROM lfs_objects WHERE owner = $1 AND oid = $3)
+                    OR EXISTS (SELECT 1 FROM file_versions v JOIN user_files f ON f.id = v.file_id
+                        WHERE f.uploader = $1 AND v.content_hash = $3)`,
+            owner, repo, oid,
+        ).Scan(&exists, &held)
+        if err != nil || exists || !held {
+            linked = err == nil && exists
+            return err
+        }
+
+        var blobSize int64
+        err = tx.QueryRow("SELECT size FROM blobs WHERE content_hash = $1", oid).Scan(&blobSize)
+        if err == sql.ErrNoRows || (err == nil && blobSize != size) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        if err := ChargeUsageTx(tx, owner, size); err != nil {
+            return err
+        }
+        if _, err := ReferenceBlobTx(tx, oid); err != nil {
+            return err
+        }
+        if err := insertLFSObjectTx(tx, owner, repo, oid, size); err != nil {
+            return err
+        }
+        linked = true
+        return nil
+    })
+    return linked, err
+}
+
+// StoreLFSObject adds the staged content to owner's repository, charging
+// their quota and sharing the blob with any identical content already stored.
+// Storing an object the repository already has is a no-op. Callers should
+// Discard the staged blob afterwards either way.
+func StoreLFSObject(owner, repo string, blob *StagedBlob) (models.LFSObject, error) {
+    var obj models.LFSObject
+    err := database.WithTx(func(tx *sql.Tx) error {
+        err := scanLFSObject(tx.QueryRow(
+            "SELECT "+lfsObjectColumns+" FROM lfs_objects WHERE owner = $1 AND repo = $2 AND oid = $3",
+            owner, repo, blob.Hash,
+        ), &obj)
+        if err != sql.ErrNoRows {
+            return err
+        }
+
+        if err := ChargeUsageTx(tx, owner, blob.Size); err != nil {
+            return err
+        }
+        refCount, err := AcquireBlobTx(tx, blob)
+        if err != nil {
+            return err
+        }
+        if err := insertLFSObjectTx(tx, owner, repo, blob.Hash, blob.Size); err != nil {
+            discardNewBlob(blob.Hash, refCount)
+            return err
+        }
+        obj = models.LFSObject{Owner: owner, Repo: repo, OID: blob.Hash, Size: blob.Size}
+        return nil
+    })
+    return obj, err
+}
+
+// insertLFSObjectTx records an object whose blob reference and quota charge
+// the caller has already taken
+func insertLFSObjectTx(tx *sql.Tx, owner, repo, oid string, size int64) error {
+    _, err := tx.Exec("INSERT INTO lfs_objects (owner, repo, oid, size) VALUES ($1, $2, $3, $4)", owner, repo, oid, size)
+    if err != nil {
+        return err
+    }
+    return recordLFSUsageTx(tx, owner, size, "lfs_upload")
+}
+
+// recordLFSUsageTx appends a ledger entry for an LFS object. LFS objects are
+// not files, so the entry has no file id.
+func recordLFSUsageTx(tx *sql.Tx, owner string, delta int64, reason string) error {
+    _, err := tx.Exec(
+        "INSERT INTO usage_ledger (username, file_id, delta_bytes, reason) VALUES ($1, NULL, $2, $3)",
+        owner, delta, reason,
+    )
+    return err
+}
+
+// DeleteLFSObject removes an object from owner's repository, crediting its
+// size back and purging the blob once nothing else references it. Git never
+// deletes LFS objects itself; this is for pruning what history no longer needs.
+func DeleteLFSObject(owner, repo, oid string) error {
+    orphaned := false
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var size int64
+        err := tx.QueryRow(
+            "DELETE FROM lfs_objects WHERE owner = $1 AND repo = $2 AND oid = $3 RETURNING size",
+            owner, repo, oid,
+        ).Scan(&size)
+        if err == sql.ErrNoRows {
+            return ErrLFSObjectNotFound
+        }
+        if err != nil {
+            return err
+        }
+        if err := releaseQuotaTx(tx, owner, size); err != nil {
+            return err
+        }
+        if err := recordLFSUsageTx(tx, owner, -size, "lfs_delete"); err != nil {
+            return err
+        }
+        orphaned, err = ReleaseBlobTx(tx, oid)
+        return err
+    })
+    if err == nil && orphaned {
+        PurgeBlobs([]string{oid})
+    }
+    return err
+}
+
+// deleteLFSObjects drops all of username's LFS objects and locks, releasing
+// their blobs. Usage is not credited back: it is only used when the account
+// and its quota row go away too.
+func deleteLFSObjects(username string) error {
+    var orphans []string
+    err := database.WithTx(func(tx *sql.Tx) error {
+        rows, err := tx.Query("DELETE FROM lfs_objects WHERE owner = $1 RETURNING oid", username)
+        if err != nil {
+            return err
+        }
+        var oids []string
+        for rows.Next() {
+            var oid string
+            if err := rows.Scan(&oid); err != nil {
+                rows.Close()
+                return err
+            }
+            oids = append(oids, oid)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+
+        for _, oid := range oids {
+            orphaned, err := ReleaseBlobTx(tx, oid)
+            if err != nil {
+                return err
+            }
+            if orphaned {
+                orphans = append(orphans, oid)
+            }
+        }
+        _, err = tx.Exec("DELETE FROM lfs_locks WHERE owner = $1", username)
+        return err
+    })
+    if err == nil {
+        PurgeBlobs(orphans)
+    }
+    return err
+}
+
+const lfsLockColumns = "id, owner, repo, path, locked_by, locked_at"
+
+func scanLFSLock(row models.FileScanner, l *models.LFSLock) error {
+    return row.Scan(&l.ID, &l.Owner, &l.Repo, &l.Path, &l.LockedBy.Name, &l.LockedAt)
+}
+
+// CreateLFSLock locks path in owner's repository for user. If the path is
+// already locked it returns the existing lock with ErrLFSLockExists.
+func CreateLFSLock(owner, repo, path, user string) (models.LFSLock, error) {
+    var lock models.LFSLock
+    err := scanLFSLock(database.DB.QueryRow(
+        `INSERT INTO lfs_locks (owner, repo, path, locked_by) VALUES ($1, $2, $3, $4)
+         ON CONFLICT (owner, repo, path) DO NOTHING RETURNING `+lfsLockColumns,
+        owner, repo, path, user,
+    ), &lock)
+    if err != sql.ErrNoRows {
+        return lock, err
+    }
+
+    err = scanLFSLock(database.DB.QueryRow(
+        "SELECT "+lfsLockColumns+" FROM lfs_locks WHERE owner = $1 AND repo = $2 AND path = $3",
+        owner, repo, path,
+    ), &lock)
+    if err == nil {
+        err = ErrLFSLockExists
+    }
+    return lock, err
+}
+
+// LFSLockFilter narrows ListLFSLocks; zero values match everything
+type LFSLockFilter struct {
+    Path   string
+    ID     int
+    Cursor int // only locks with a larger id
+    Limit  int
+}
+
+// ListLFSLocks lists the repository's locks in id order. next is the cursor
+// for the following page, or 0 when there are no more.
+func ListLFSLocks(owner, repo string, f LFSLockFilter) (locks []models.LFSLock, next int, err error) {
+    rows, err := database.DB.Query(
+        `SELECT `+lfsLockColumns+` FROM lfs_locks
+         WHERE owner = $1 AND repo = $2 AND ($3 = '' OR path = $3) AND ($4 = 0 OR id = $4) AND id > $5
+         ORDER BY id LIMIT $6`,
+        owner, repo, f.Path, f.ID, f.Cursor, f.Limit+1,
+    )
+    if err != nil {
+        return nil, 0, err
+    }
+    defer rows.Close()
+
+    locks = []models.LFSLock{}
+    for rows.Next() {
+        var l models.LFSLock
+        if err := scanLFSLock(rows, &l); err != nil {
+            return nil, 0, err
+        }
+        locks = append(locks, l)
+    }
+    if len(locks) > f.Limit {
+        locks = locks[:f.Limit]
+        next = locks[len(locks)-1].ID
+    }
+    return locks, next, rows.Err()
+}
+
+// UnlockLFS releases a lock. Only its holder may, unless force is set.
+func UnlockLFS(owner, repo string, id int, user string, force bool) (models.LFSLock, error) {
+    var lock models.LFSLock
+    err := database.WithTx(func(tx *sql.Tx) error {
+        err := scanLFSLock(tx.QueryRow(
+            "SELECT "+lfsLockColumns+" FROM lfs_locks WHERE owner = $1 AND repo = $2 AND id = $3 FOR UPDATE",
+            owner, repo, id,
+        ), &lock)
+        if err == sql.ErrNoRows {
+            return ErrLFSLockNotFound
+        }
+        if err != nil {
+            return err
+        }
+        if lock.LockedBy.Name != user && !force {
+            return ErrLFSLockNotOwned
+        }
+        _, err = tx.Exec("DELETE FROM lfs_locks WHERE id = $1", id)
+        return err
+    })
+    return lock, err
+}
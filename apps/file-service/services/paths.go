@@ -0,0 +1,128 @@
+package services
+
+import (
+    "database/sql"
+    "strings"
+
+    "file-service/database"
+    "file-service/models"
+)
+
+// PathEntry is what a slash-separated path in a user's tree names. Folder and
+// File are both nil when the parent exists but nothing is called Name in it.
+type PathEntry struct {
+    ParentID *int   // folder holding the entry, nil for the root
+    Name     string // last path segment, "" for the root itself
+    Folder   *models.Folder
+    File     *models.File
+}
+
+// IsRoot reports whether the path is the root folder
+func (e PathEntry) IsRoot() bool {
+    return e.Name == ""
+}
+
+// Exists reports whether the path names a folder, a live file or the root
+func (e PathEntry) Exists() bool {
+    return e.IsRoot() || e.Folder != nil || e.File != nil
+}
+
+// LookupPath resolves a path such as "/projects/2025/report.pdf". It fails
+// with ErrFolderNotFound when a folder along the way is missing.
+func LookupPath(q Queryer, owner, path string) (PathEntry, error) {
+    path = strings.Trim(path, "/")
+    if path == "" {
+        return PathEntry{}, nil
+    }
+
+    dir, name := "", path
+    if i := strings.LastIndex(path, "/"); i >= 0 {
+        dir, name = path[:i], path[i+1:]
+    }
+    if !ValidName(name) {
+        return PathEntry{}, ErrInvalidName
+    }
+    parentID, err := ResolvePath(q, owner, dir, false)
+    if err != nil {
+        return PathEntry{}, err
+    }
+    entry := PathEntry{ParentID: parentID, Name: name}
+
+    var folder models.Folder
+    err = scanFolder(q.QueryRow(
+        "SELECT "+folderColumns+" FROM folders WHERE owner = $1 AND parent_id IS NOT DISTINCT FROM $2 AND name = $3",
+        owner, parentID, name,
+    ), &folder)
+    if err == nil {
+        entry.Folder = &folder
+        return entry, nil
+    }
+    if err != sql.ErrNoRows {
+        return entry, err
+    }
+
+    var file models.File
+    err = models.ScanFile(q.QueryRow(
+        "SELECT "+models.FileColumns+" FROM user_files f JOIN blobs b ON b.content_hash = f.content_hash WHERE f.uploader = $1 AND f.folder_id IS NOT DISTINCT FROM $2 AND f.filename = $3 AND f.trashed_at IS NULL",
+        owner, parentID, name,
+    ), &file)
+    if err == nil {
+        entry.File = &file
+        return entry, nil
+    }
+    if err == sql.ErrNoRows {
+        return entry, nil
+    }
+    return entry, err
+}
+
+// removeEntryTx deletes whatever entry names: files go to the trash, folders
+// with everything in them
+func removeEntryTx(tx *sql.Tx, owner string, entry PathEntry) error {
+    if entry.File != nil {
+        return TrashFileTx(tx, entry.File.ID)
+    }
+    return deleteFolderTx(tx, owner, entry.Folder.ID)
+}
+
+// MoveEntry moves src to where dst points. With replace, an existing dst is
+// removed first in the same transaction, so a move that fails leaves it in
+// place.
+func MoveEntry(owner string, src, dst PathEntry, replace bool) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        if err := lockFolderTree(tx, owner); err != nil {
+            return err
+        }
+        if replace && dst.Exists() {
+            if err := removeEntryTx(tx, owner, dst); err != nil {
+                return err
+            }
+        }
+        if src.File != nil {
+            return updateFileTx(tx, owner, src.File.ID, &dst.Name, true, dst.ParentID)
+        }
+        _, err := updateFolderTx(tx, owner, src.Folder.ID, &dst.Name, true, dst.ParentID)
+        return err
+    })
+}
+
+// CopyEntry is MoveEntry for a copy. Folders are copied with their contents
+// when recursive is set, as by CopyFolder.
+func CopyEntry(owner string, src, dst PathEntry, replace, recursive bool) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        if err := lockFolderTree(tx, owner); err != nil {
+            return err
+        }
+        if replace && dst.Exists() {
+            if err := removeEntryTx(tx, owner, dst); err != nil {
+                return err
+            }
+        }
+        if src.File != nil {
+            _, err := copyFileTx(tx, owner, src.File.ID, dst.ParentID, dst.Name)
+            return err
+        }
+        _, err := copyFolderTx(tx, owner, src.Folder.ID, dst.ParentID, dst.Name, recursive)
+        return err
+    })
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/models"
+)
+
+var (
+    // ErrQuotaExceeded means the upload would take the user over their quota
+    ErrQuotaExceeded = errors.New("storage quota exceeded")
+    // ErrFileTooLarge means the file is bigger than the user's whole quota
+    ErrFileTooLarge = errors.New("file is larger than the storage quota")
+)
+
+// DefaultQuota is the quota for users without an admin override
+func DefaultQuota() int64 {
+    return config.GetEnvInt64("DEFAULT_QUOTA_BYTES", 10<<30) // 10GB
+}
+
+// ChargeUsageTx adds size bytes to username's usage, failing if that would exceed
+// their quota. The quota row stays locked until the transaction ends.
+func ChargeUsageTx(tx *sql.Tx, username string, size int64) error {
+    used, limit, err := lockQuotaTx(tx, username)
+    if err != nil {
+        return err
+    }
+    if size > limit {
+        return ErrFileTooLarge
+    }
+    if used+size > limit {
+        return ErrQuotaExceeded
+    }
+    _, err = tx.Exec("UPDATE user_quotas SET used_bytes = used_bytes + $1, updated_at = now() WHERE username = $2", size, username)
+    return err
+}
+
+// CreditUsageTx gives size bytes back to username when one of their files goes away
+func CreditUsageTx(tx *sql.Tx, username string, fileID int, size int64, reason string) error {
+    if err := releaseQuotaTx(tx, username, size); err != nil {
+        return err
+    }
+    return RecordUsageTx(tx, username, fileID, -size, reason)
+}
+
+// releaseQuotaTx takes size bytes off username's used_bytes without a ledger entry
+func releaseQuotaTx(tx *sql.Tx, username string, size int64) error {
+    if _, _, err := lockQuotaTx(tx, username); err != nil {
+        return err
+    }
+    _, err := tx.Exec("UPDATE user_quotas SET used_bytes = GREATEST(used_bytes - $1, 0), updated_at = now() WHERE username = $2", size, username)
+    return err
+}
+
+// RecordUsageTx appends an entry to the usage ledger
+func RecordUsageTx(tx *sql.Tx, username string, fileID int, delta int64, reason string) error {
+    _, err := tx.Exec(
+        "INSERT INTO usage_ledger (username, file_id, delta_bytes, reason) VALUES ($1, $2, $3, $4)",
+        username, fileID, delta, reason,
+    )
+    return err
+}
+
+// CheckQuota reports whether size more bytes would fit, without reserving them.
+// Used to refuse resumable uploads up front; the charge happens when they complete.
+func CheckQuota(username string, size int64) error {
+    return CheckStagedQuota(username, 0, size)
+}
+
+// CheckStagedQuota is CheckQuota for an upload that arrives in pieces, where
+// staged bytes of unfinished uploads already wait to be charged
+func CheckStagedQuota(username string, staged, size int64) error {
+    usage, err := GetUsage(username)
+    if err != nil {
+        return err
+    }
+    if size > usage.LimitBytes {
+        return ErrFileTooLarge
+    }
+    if usage.UsedBytes+staged+size > usage.LimitBytes {
+        return ErrQuotaExceeded
+    }
+    return nil
+}
+
+// GetUsage reports logical and physical usage for username
+func GetUsage(username string) (models.Usage, error) {
+    usage := models.Usage{Username: username, LimitBytes: DefaultQuota()}
+
+    var quota sql.NullInt64
+    err := database.DB.QueryRow("SELECT used_bytes, quota_bytes FROM user_quotas WHERE username = $1", username).Scan(&usage.UsedBytes, &quota)
+    if err != nil && err != sql.ErrNoRows {
+        return usage, err
+    }
+    if quota.Valid {
+        usage.LimitBytes = quota.Int64
+    }
+
+    err = database.DB.QueryRow(
+        `SELECT COUNT(*) FILTER (WHERE trashed_at IS NULL),
+            (SELECT COALESCE(SUM(b.size), 0) FROM blobs b
+             WHERE b.content_hash IN (SELECT v.content_hash FROM file_versions v
+                 JOIN user_files f ON f.id = v.file_id WHERE f.uploader = $1
+                 UNION SELECT oid FROM lfs_objects WHERE owner = $1
+                 UNION SELECT content_hash FROM oci_blobs WHERE owner = $1
+                 UNION SELECT content_hash FROM oci_manifests WHERE owner = $1)),
+            (SELECT COALESCE(SUM(v.size), 0) FROM file_versions v
+             JOIN user_files f ON f.id = v.file_id WHERE f.uploader = $1 AND f.trashed_at IS NOT NULL)
+         FROM user_files WHERE uploader = $1`,
+        username,
+    ).Scan(&usage.FileCount, &usage.PhysicalBytes, &usage.TrashBytes)
+    if err != nil {
+        return usage, err
+    }
+    usage.DedupSavings = usage.UsedBytes - usage.PhysicalBytes
+    if usage.DedupSavings < 0 {
+        usage.DedupSavings = 0
+    }
+    return usage, nil
+}
+
+// SetQuota overrides username's quota; a nil quota restores the default
+func SetQuota(username string, quota *int64) error {
+    _, err := database.DB.Exec(
+        `INSERT INTO user_quotas (username, quota_bytes) VALUES ($1, $2)
+         ON CONFLICT (username) DO UPDATE SET quota_bytes = EXCLUDED.quota_bytes, updated_at = now()`,
+        username, quota,
+    )
+    return err
+}
+
+// lockQuotaTx locks (creating if needed) username's quota row and returns usage and limit
+func lockQuotaTx(tx *sql.Tx, username string) (used, limit int64, err error) {
+    _, err = tx.Exec("INSERT INTO user_quotas (username) VALUES ($1) ON CONFLICT (username) DO NOTHING", username)
+    if err != nil {
+        return 0, 0, err
+    }
+    var quota sql.NullInt64
+    err = tx.QueryRow("SELECT used_bytes, quota_bytes FROM user_quotas WHERE username = $1 FOR UPDATE", username).Scan(&used, &quota)
+    if err != nil {
+        return 0, 0, err
+    }
+    limit = DefaultQuota()
+    if quota.Valid {
+        limit = quota.Int64
+    }
+    return used, limit, nil
+}
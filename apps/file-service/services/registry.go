@@ -0,0 +1,489 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "os"
+    "path/filepath"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/models"
+)
+
+var (
+    // ErrOCIBlobUnknown means the repository has no blob with that digest
+    ErrOCIBlobUnknown = errors.New("blob unknown to registry")
+    // ErrOCIManifestUnknown means the repository has no manifest with that digest or tag
+    ErrOCIManifestUnknown = errors.New("manifest unknown")
+    // ErrOCIManifestBlobUnknown rejects a manifest pointing at content the repository does not have
+    ErrOCIManifestBlobUnknown = errors.New("manifest references a blob or manifest that is not in the repository")
+    // ErrOCIBlobReferenced refuses to delete a blob that a manifest of the repository still points at
+    ErrOCIBlobReferenced = errors.New("blob is referenced by a manifest; delete the manifest first")
+)
+
+// Registry content is held per repository: each blob and manifest row takes
+// one blob reference and is charged to the owner's quota, so layers shared
+// between repositories (or with files) are stored once.
+
+const ociBlobColumns = "owner, repo, content_hash, size, created_at"
+
+func scanOCIBlob(row models.FileScanner, b *models.OCIBlob) error {
+    return row.Scan(&b.Owner, &b.Repo, &b.ContentHash, &b.Size, &b.CreatedAt)
+}
+
+const ociManifestColumns = "owner, repo, content_hash, media_type, size, created_at"
+
+func scanOCIManifest(row models.FileScanner, m *models.OCIManifest) error {
+    return row.Scan(&m.Owner, &m.Repo, &m.ContentHash, &m.MediaType, &m.Size, &m.CreatedAt)
+}
+
+// GetOCIBlob loads a blob of owner's repository
+func GetOCIBlob(owner, repo, contentHash string) (models.OCIBlob, error) {
+    var b models.OCIBlob
+    err := scanOCIBlob(database.DB.QueryRow(
+        "SELECT "+ociBlobColumns+" FROM oci_blobs WHERE owner = $1 AND repo = $2 AND content_hash = $3",
+        owner, repo, contentHash,
+    ), &b)
+    if err == sql.ErrNoRows {
+        return b, ErrOCIBlobUnknown
+    }
+    return b, err
+}
+
+// StoreOCIBlob adds the staged content to the repository. Pushing a blob the
+// repository already has is a no-op. Callers should Discard the staged blob
+// afterwards either way.
+func StoreOCIBlob(owner, repo string, blob *StagedBlob) (models.OCIBlob, error) {
+    var b models.OCIBlob
+    err := database.WithTx(func(tx *sql.Tx) error {
+        err := scanOCIBlob(tx.QueryRow(
+            "SELECT "+ociBlobColumns+" FROM oci_blobs WHERE owner = $1 AND repo = $2 AND content_hash = $3",
+            owner, repo, blob.Hash,
+        ), &b)
+        if err != sql.ErrNoRows {
+            return err
+        }
+
+        if err := ChargeUsageTx(tx, owner, blob.Size); err != nil {
+            return err
+        }
+        refCount, err := AcquireBlobTx(tx, blob)
+        if err != nil {
+            return err
+        }
+        err = scanOCIBlob(tx.QueryRow(
+            "INSERT INTO oci_blobs (owner, repo, content_hash, size) VALUES ($1, $2, $3, $4) RETURNING "+ociBlobColumns,
+            owner, repo, blob.Hash, blob.Size,
+        ), &b)
+        if err == nil {
+            err = recordOCIUsageTx(tx, owner, blob.Size, "oci_push")
+        }
+        if err != nil {
+            discardNewBlob(blob.Hash, refCount)
+        }
+        return err
+    })
+    return b, err
+}
+
+// MountOCIBlob makes a blob of owner's fromRepo available in repo without
+// uploading it again. ok is false when fromRepo does not have it.
+func MountOCIBlob(owner, repo, fromRepo, contentHash string) (b models.OCIBlob, ok bool, err error) {
+    err = database.WithTx(func(tx *sql.Tx) error {
+        err := scanOCIBlob(tx.QueryRow(
+            "SELECT "+ociBlobColumns+" FROM oci_blobs WHERE owner = $1 AND repo = $2 AND content_hash = $3",
+            owner, repo, contentHash,
+        ), &b)
+        if err != sql.ErrNoRows {
+            ok = err == nil
+            return err
+        }
+
+        var size int64
+        err = tx.QueryRow(
+            "SELECT size FROM oci_blobs WHERE owner = $1 AND repo = $2 AND content_hash = $3",
+            owner, fromRepo, contentHash,
+        ).Scan(&size)
+        if err == sql.ErrNoRows {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        if err := ChargeUsageTx(tx, owner, size); err != nil {
+            return err
+        }
+        if _, err := ReferenceBlobTx(tx, contentHash); err != nil {
+            return err
+        }
+        err = scanOCIBlob(tx.QueryRow(
+            "INSERT INTO oci_blobs (owner, repo, content_hash, size) VALUES ($1, $2, $3, $4) RETURNING "+ociBlobColumns,
+            owner, repo, contentHash, size,
+        ), &b)
+        if err != nil {
+            return err
+        }
+        ok = true
+        return recordOCIUsageTx(tx, owner, size, "oci_mount")
+    })
+    return b, ok, err
+}
+
+// DeleteOCIBlob removes a blob from the repository, giving its bytes back to
+// the owner's quota. Blobs a manifest still points at are kept.
+func DeleteOCIBlob(owner, repo, contentHash string) error {
+    var orphans []string
+    err := database.WithTx(func(tx *sql.Tx) error {
+        // PutOCIManifest holds the blob rows it references FOR SHARE, so
+        // locking the row first waits for it and the check below sees its
+        // references
+        var size int64
+        err := tx.QueryRow(
+            "SELECT size FROM oci_blobs WHERE owner = $1 AND repo = $2 AND content_hash = $3 FOR UPDATE",
+            owner, repo, contentHash,
+        ).Scan(&size)
+        if err == sql.ErrNoRows {
+            return ErrOCIBlobUnknown
+        }
+        if err != nil {
+            return err
+        }
+        var referenced bool
+        err = tx.QueryRow(
+            "SELECT EXISTS (SELECT 1 FROM oci_manifest_blobs WHERE owner = $1 AND repo = $2 AND blob_hash = $3)",
+            owner, repo, contentHash,
+        ).Scan(&referenced)
+        if err != nil {
+            return err
+        }
+        if referenced {
+            return ErrOCIBlobReferenced
+        }
+
+        _, err = tx.Exec("DELETE FROM oci_blobs WHERE owner = $1 AND repo = $2 AND content_hash = $3", owner, repo, contentHash)
+        if err != nil {
+            return err
+        }
+        orphans, err = releaseOCIContentTx(tx, owner, contentHash, size, orphans)
+        return err
+    })
+    if err == nil {
+        PurgeBlobs(orphans)
+    }
+    return err
+}
+
+// recordOCIUsageTx appends a ledger entry for registry content, which has no file id
+func recordOCIUsageTx(tx *sql.Tx, owner string, delta int64, reason string) error {
+    _, err := tx.Exec(
+        "INSERT INTO usage_ledger (username, file_id, delta_bytes, reason) VALUES ($1, NULL, $2, $3)",
+        owner, delta, reason,
+    )
+    return err
+}
+
+// releaseOCIContentTx credits a removed blob or manifest back to owner and
+// drops its blob reference, adding the hash to orphans if that was the last one
+func releaseOCIContentTx(tx *sql.Tx, owner, contentHash string, size int64, orphans []string) ([]string, error) {
+    if err := releaseQuotaTx(tx, owner, size); err != nil {
+        return orphans, err
+    }
+    if err := recordOCIUsageTx(tx, owner, -size, "oci_delete"); err != nil {
+        return orphans, err
+    }
+    orphaned, err := ReleaseBlobTx(tx, contentHash)
+    if orphaned {
+        orphans = append(orphans, contentHash)
+    }
+    return orphans, err
+}
+
+// PutOCIManifest stores a manifest pushed to the repository and, when tag is
+// set, points the tag at it. Every blob and child manifest it references
+// must already be in the repository, and the blobs stay until the manifest
+// is deleted. Callers should Discard the staged blob afterwards either way.
+func PutOCIManifest(owner, repo, tag, mediaType string, blob *StagedBlob, blobs, manifests []string) (models.OCIManifest, error) {
+    var m models.OCIManifest
+    err := database.WithTx(func(tx *sql.Tx) error {
+        // FOR SHARE holds the referenced rows until this commits, so a
+        // DeleteOCIBlob waiting on one sees the references recorded below
+        for _, refs := range []struct {
+            table  string
+            hashes []string
+        }{{"oci_blobs", blobs}, {"oci_manifests", manifests}} {
+            for _, hash := range refs.hashes {
+                var found int
+                err := tx.QueryRow(
+                    "SELECT 1 FROM "+refs.table+" WHERE owner = $1 AND repo = $2 AND content_hash = $3 FOR SHARE",
+                    owner, repo, hash,
+                ).Scan(&found)
+                if err == sql.ErrNoRows {
+                    return ErrOCIManifestBlobUnknown
+                }
+                if err != nil {
+                    return err
+                }
+            }
+        }
+
+        err := scanOCIManifest(tx.QueryRow(
+            "SELECT "+ociManifestColumns+" FROM oci_manifests WHERE owner = $1 AND repo = $2 AND content_hash = $3",
+            owner, repo, blob.Hash,
+        ), &m)
+        if err == sql.ErrNoRows {
+            err = insertOCIManifestTx(tx, owner, repo, mediaType, blob, &m)
+        }
+        if err == nil {
+            err = recordOCIManifestBlobsTx(tx, owner, repo, blob.Hash, blobs)
+        }
+        if err != nil || tag == "" {
+            return err
+        }
+
+        _, err = tx.Exec(
+            `INSERT INTO oci_tags (owner, repo, tag, content_hash) VALUES ($1, $2, $3, $4)
+             ON CONFLICT (owner, repo, tag) DO UPDATE SET content_hash = EXCLUDED.content_hash, updated_at = now()`,
+            owner, repo, tag, blob.Hash,
+        )
+        return err
+    })
+    return m, err
+}
+
+func insertOCIManifestTx(tx *sql.Tx, owner, repo, mediaType string, blob *StagedBlob, m *models.OCIManifest) error {
+    if err := ChargeUsageTx(tx, owner, blob.Size); err != nil {
+        return err
+    }
+    refCount, err := AcquireBlobTx(tx, blob)
+    if err != nil {
+        return err
+    }
+    err = scanOCIManifest(tx.QueryRow(
+        "INSERT INTO oci_manifests (owner, repo, content_hash, media_type, size) VALUES ($1, $2, $3, $4, $5) RETURNING "+ociManifestColumns,
+        owner, repo, blob.Hash, mediaType, blob.Size,
+    ), m)
+    if err == nil {
+        err = recordOCIUsageTx(tx, owner, blob.Size, "oci_push")
+    }
+    if err != nil {
+        discardNewBlob(blob.Hash, refCount)
+    }
+    return err
+}
+
+// recordOCIManifestBlobsTx notes which blobs a manifest points at
+func recordOCIManifestBlobsTx(tx *sql.Tx, owner, repo, manifestHash string, blobs []string) error {
+    for _, hash := range blobs {
+        _, err := tx.Exec(
+            `INSERT INTO oci_manifest_blobs (owner, repo, manifest_hash, blob_hash) VALUES ($1, $2, $3, $4)
+             ON CONFLICT DO NOTHING`,
+            owner, repo, manifestHash, hash,
+        )
+        if err != nil {
+            return err
+        }
+    }
+    _, err := tx.Exec(
+        "UPDATE oci_manifests SET blobs_indexed = TRUE WHERE owner = $1 AND repo = $2 AND content_hash = $3 AND NOT blobs_indexed",
+        owner, repo, manifestHash,
+    )
+    return err
+}
+
+// UnindexedOCIManifests lists manifests whose blob references have not been
+// recorded yet, i.e. those pushed before oci_manifest_blobs existed
+func UnindexedOCIManifests() ([]models.OCIManifest, error) {
+    rows, err := database.DB.Query("SELECT " + ociManifestColumns + " FROM oci_manifests WHERE NOT blobs_indexed")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var manifests []models.OCIManifest
+    for rows.Next() {
+        var m models.OCIManifest
+        if err := scanOCIManifest(rows, &m); err != nil {
+            return nil, err
+        }
+        manifests = append(manifests, m)
+    }
+    return manifests, rows.Err()
+}
+
+// IndexOCIManifest records the blobs an existing manifest points at
+func IndexOCIManifest(m models.OCIManifest, blobs []string) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        return recordOCIManifestBlobsTx(tx, m.Owner, m.Repo, m.ContentHash, blobs)
+    })
+}
+
+// GetOCIManifest loads a manifest of the repository by content hash
+func GetOCIManifest(owner, repo, contentHash string) (models.OCIManifest, error) {
+    var m models.OCIManifest
+    err := scanOCIManifest(database.DB.QueryRow(
+        "SELECT "+ociManifestColumns+" FROM oci_manifests WHERE owner = $1 AND repo = $2 AND content_hash = $3",
+        owner, repo, contentHash,
+    ), &m)
+    if err == sql.ErrNoRows {
+        return m, ErrOCIManifestUnknown
+    }
+    return m, err
+}
+
+// ResolveOCITag returns the content hash of the manifest tag points at
+func ResolveOCITag(owner, repo, tag string) (string, error) {
+    var hash string
+    err := database.DB.QueryRow(
+        "SELECT content_hash FROM oci_tags WHERE owner = $1 AND repo = $2 AND tag = $3",
+        owner, repo, tag,
+    ).Scan(&hash)
+    if err == sql.ErrNoRows {
+        return "", ErrOCIManifestUnknown
+    }
+    return hash, err
+}
+
+// DeleteOCIManifest removes a manifest and every tag pointing at it
+func DeleteOCIManifest(owner, repo, contentHash string) error {
+    var orphans []string
+    err := database.WithTx(func(tx *sql.Tx) error {
+        // Tags go with it by cascade
+        var size int64
+        err := tx.QueryRow(
+            "DELETE FROM oci_manifests WHERE owner = $1 AND repo = $2 AND content_hash = $3 RETURNING size",
+            owner, repo, contentHash,
+        ).Scan(&size)
+        if err == sql.ErrNoRows {
+            return ErrOCIManifestUnknown
+        }
+        if err != nil {
+            return err
+        }
+        orphans, err = releaseOCIContentTx(tx, owner, contentHash, size, orphans)
+        return err
+    })
+    if err == nil {
+        PurgeBlobs(orphans)
+    }
+    return err
+}
+
+// DeleteOCITag removes a tag, leaving the manifest it pointed at
+func DeleteOCITag(owner, repo, tag string) error {
+    res, err := database.DB.Exec("DELETE FROM oci_tags WHERE owner = $1 AND repo = $2 AND tag = $3", owner, repo, tag)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrOCIManifestUnknown
+    }
+    return nil
+}
+
+// ListOCITags lists up to n of the repository's tags in lexical order,
+// starting after last
+func ListOCITags(owner, repo, last string, n int) ([]string, error) {
+    rows, err := database.DB.Query(
+        `SELECT tag FROM oci_tags WHERE owner = $1 AND repo = $2 AND tag > $3 COLLATE "C"
+         ORDER BY tag COLLATE "C" LIMIT $4`,
+        owner, repo, last, n,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    tags := []string{}
+    for rows.Next() {
+        var tag string
+        if err := rows.Scan(&tag); err != nil {
+            return nil, err
+        }
+        tags = append(tags, tag)
+    }
+    return tags, rows.Err()
+}
+
+// OCIRepositoryExists reports whether owner has pushed anything to repo
+func OCIRepositoryExists(owner, repo string) (bool, error) {
+    var exists bool
+    err := database.DB.QueryRow(
+        `SELECT EXISTS (SELECT 1 FROM oci_manifests WHERE owner = $1 AND repo = $2)
+             OR EXISTS (SELECT 1 FROM oci_blobs WHERE owner = $1 AND repo = $2)`,
+        owner, repo,
+    ).Scan(&exists)
+    return exists, err
+}
+
+// deleteOCIData drops all of username's registry content, releasing its
+// blobs. As with deleteLFSObjects, usage is not credited back.
+func deleteOCIData(username string) error {
+    var orphans []string
+    err := database.WithTx(func(tx *sql.Tx) error {
+        rows, err := tx.Query(
+            `WITH b AS (DELETE FROM oci_blobs WHERE owner = $1 RETURNING content_hash),
+                  m AS (DELETE FROM oci_manifests WHERE owner = $1 RETURNING content_hash)
+             SELECT content_hash FROM b UNION ALL SELECT content_hash FROM m`,
+            username,
+        )
+        if err != nil {
+            return err
+        }
+        var hashes []string
+        for rows.Next() {
+            var hash string
+            if err := rows.Scan(&hash); err != nil {
+                rows.Close()
+                return err
+            }
+            hashes = append(hashes, hash)
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+
+        for _, hash := range hashes {
+            orphaned, err := ReleaseBlobTx(tx, hash)
+            if err != nil {
+                return err
+            }
+            if orphaned {
+                orphans = append(orphans, hash)
+            }
+        }
+        return nil
+    })
+    if err == nil {
+        PurgeBlobs(orphans)
+    }
+    return err
+}
+
+// OCIUploadPath is where chunked blob uploads are staged, one file per upload
+func OCIUploadPath() string {
+    return config.GetEnvDefault("OCI_UPLOAD_PATH", "./oci-uploads")
+}
+
+// DeleteOCIUploads removes the blob uploads matching where and their staged
+// bytes, returning the ids of the uploads it removed
+func DeleteOCIUploads(where string, args ...interface{}) ([]string, error) {
+    rows, err := database.DB.Query("DELETE FROM oci_uploads WHERE "+where+" RETURNING id", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var ids []string
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return ids, err
+        }
+        os.Remove(filepath.Join(OCIUploadPath(), id))
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
@@ -0,0 +1,241 @@
+package services
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strings"
+    "time"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/models"
+    "file-service/utils"
+)
+
+var (
+    // ErrS3KeyNotFound means the access key does not exist or belongs to someone else
+    ErrS3KeyNotFound = errors.New("access key not found")
+    // ErrS3KeyNameRequired rejects keys without a name, or with one over 100 characters
+    ErrS3KeyNameRequired = errors.New("a name of at most 100 characters is required")
+)
+
+// s3AccessKeyPrefix starts every access key id, like AWS's "AKIA"
+const s3AccessKeyPrefix = "FVAK"
+
+// s3KeySecretPath is the file holding the key that encrypts S3 secrets at
+// rest. Every file-service instance needs the same file; it never goes into
+// the database.
+func s3KeySecretPath() string {
+    return config.GetEnvDefault("S3_KEY_SECRET_PATH", "./s3_key_secret")
+}
+
+// s3KeyCipher seals the secret_key_sealed column of s3_access_keys
+var s3KeyCipher cipher.AEAD
+
+// loadS3KeySecret reads the hex-encoded AES-256 key at path, generating and
+// saving one if there is none yet
+func loadS3KeySecret(path string) (cipher.AEAD, error) {
+    data, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        secret := make([]byte, 32)
+        if _, err := rand.Read(secret); err != nil {
+            return nil, err
+        }
+        if err := os.WriteFile(path, []byte(hex.EncodeToString(secret)+"\n"), 0600); err != nil {
+            return nil, err
+        }
+        log.Println("generated S3 key secret at", path)
+        data = []byte(hex.EncodeToString(secret))
+    } else if err != nil {
+        return nil, err
+    }
+
+    secret, err := hex.DecodeString(strings.TrimSpace(string(data)))
+    if err != nil || len(secret) != 32 {
+        return nil, fmt.Errorf("%s must hold 32 hex-encoded bytes", path)
+    }
+    block, err := aes.NewCipher(secret)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// sealS3Secret encrypts a secret access key for storage as nonce then
+// ciphertext, bound to its access key id
+func sealS3Secret(accessKeyID, secret string) ([]byte, error) {
+    nonce := make([]byte, s3KeyCipher.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+    return s3KeyCipher.Seal(nonce, nonce, []byte(secret), []byte(accessKeyID)), nil
+}
+
+// openS3Secret decrypts a secret sealed by sealS3Secret
+func openS3Secret(accessKeyID string, sealed []byte) (string, error) {
+    n := s3KeyCipher.NonceSize()
+    if len(sealed) < n {
+        return "", fmt.Errorf("S3 key %s is not sealed", accessKeyID)
+    }
+    plain, err := s3KeyCipher.Open(nil, sealed[:n], sealed[n:], []byte(accessKeyID))
+    if err != nil {
+        return "", fmt.Errorf("S3 key %s does not decrypt with %s: %w", accessKeyID, s3KeySecretPath(), err)
+    }
+    return string(plain), nil
+}
+
+// InitS3Keys loads the key secret and encrypts any secrets still stored in
+// plain text by earlier versions
+func InitS3Keys() error {
+    aead, err := loadS3KeySecret(s3KeySecretPath())
+    if err != nil {
+        return err
+    }
+    s3KeyCipher = aead
+
+    return database.WithTx(func(tx *sql.Tx) error {
+        rows, err := tx.Query("SELECT access_key_id, secret_key FROM s3_access_keys WHERE secret_key IS NOT NULL FOR UPDATE")
+        if err != nil {
+            return err
+        }
+        plain := map[string]string{}
+        for rows.Next() {
+            var id, secret string
+            if err := rows.Scan(&id, &secret); err != nil {
+                rows.Close()
+                return err
+            }
+            plain[id] = secret
+        }
+        rows.Close()
+        if err := rows.Err(); err != nil {
+            return err
+        }
+
+        for id, secret := range plain {
+            sealed, err := sealS3Secret(id, secret)
+            if err != nil {
+                return err
+            }
+            if _, err := tx.Exec("UPDATE s3_access_keys SET secret_key_sealed = $1, secret_key = NULL WHERE access_key_id = $2", sealed, id); err != nil {
+                return err
+            }
+        }
+        if len(plain) > 0 {
+            log.Printf("encrypted %d stored S3 secret keys", len(plain))
+        }
+        return nil
+    })
+}
+
+// newS3AccessKeyID returns an AWS-style 20 character key id
+func newS3AccessKeyID() (string, error) {
+    const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        return "", err
+    }
+    for i := range b {
+        b[i] = alphabet[int(b[i])%len(alphabet)]
+    }
+    return s3AccessKeyPrefix + string(b), nil
+}
+
+// CreateS3Key issues a new access key for username. The returned key is the
+// only time its secret is shown.
+func CreateS3Key(username, name string, readOnly bool) (models.S3AccessKey, error) {
+    if name == "" || len(name) > 100 {
+        return models.S3AccessKey{}, ErrS3KeyNameRequired
+    }
+    id, err := newS3AccessKeyID()
+    if err != nil {
+        return models.S3AccessKey{}, err
+    }
+    key := models.S3AccessKey{
+        Username:    username,
+        Name:        name,
+        AccessKeyID: id,
+        SecretKey:   utils.GenerateRandomString(40),
+        ReadOnly:    readOnly,
+    }
+    if len(key.SecretKey) != 40 {
+        return models.S3AccessKey{}, errors.New("could not generate a secret key")
+    }
+    sealed, err := sealS3Secret(key.AccessKeyID, key.SecretKey)
+    if err != nil {
+        return models.S3AccessKey{}, err
+    }
+    err = database.DB.QueryRow(
+        "INSERT INTO s3_access_keys (username, name, access_key_id, secret_key_sealed, read_only) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at",
+        key.Username, key.Name, key.AccessKeyID, sealed, key.ReadOnly,
+    ).Scan(&key.ID, &key.CreatedAt)
+    return key, err
+}
+
+// ListS3Keys returns username's access keys without their secrets
+func ListS3Keys(username string) ([]models.S3AccessKey, error) {
+    rows, err := database.DB.Query(
+        "SELECT id, username, name, access_key_id, read_only, last_used_at, created_at FROM s3_access_keys WHERE username = $1 ORDER BY created_at DESC",
+        username,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    keys := []models.S3AccessKey{}
+    for rows.Next() {
+        var k models.S3AccessKey
+        if err := rows.Scan(&k.ID, &k.Username, &k.Name, &k.AccessKeyID, &k.ReadOnly, &k.LastUsedAt, &k.CreatedAt); err != nil {
+            return nil, err
+        }
+        keys = append(keys, k)
+    }
+    return keys, rows.Err()
+}
+
+// DeleteS3Key revokes one of username's access keys
+func DeleteS3Key(username string, id int) error {
+    res, err := database.DB.Exec("DELETE FROM s3_access_keys WHERE id = $1 AND username = $2", id, username)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrS3KeyNotFound
+    }
+    return nil
+}
+
+// LookupS3Key finds the key a SigV4 request claims to be signed with.
+// last_used_at is written at most once a minute, as for access tokens.
+func LookupS3Key(accessKeyID string) (models.S3AccessKey, error) {
+    var k models.S3AccessKey
+    var sealed []byte
+    err := database.DB.QueryRow(
+        "SELECT id, username, name, access_key_id, secret_key_sealed, read_only, last_used_at, created_at FROM s3_access_keys WHERE access_key_id = $1",
+        accessKeyID,
+    ).Scan(&k.ID, &k.Username, &k.Name, &k.AccessKeyID, &sealed, &k.ReadOnly, &k.LastUsedAt, &k.CreatedAt)
+    if err == sql.ErrNoRows {
+        return k, ErrS3KeyNotFound
+    }
+    if err != nil {
+        return k, err
+    }
+    if k.SecretKey, err = openS3Secret(k.AccessKeyID, sealed); err != nil {
+        return k, err
+    }
+
+    if k.LastUsedAt == nil || time.Since(*k.LastUsedAt) > time.Minute {
+        if _, err := database.DB.Exec("UPDATE s3_access_keys SET last_used_at = now() WHERE id = $1", k.ID); err != nil {
+            return k, err
+        }
+    }
+    return k, nil
+}
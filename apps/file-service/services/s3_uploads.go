@@ -0,0 +1,35 @@
+package services
+
+import (
+    "os"
+    "path/filepath"
+
+    "file-service/config"
+    "file-service/database"
+)
+
+// S3MultipartPath is where multipart upload parts are staged, one directory per upload
+func S3MultipartPath() string {
+    return config.GetEnvDefault("S3_MULTIPART_PATH", "./s3-multipart")
+}
+
+// DeleteS3Uploads removes the multipart uploads matching where and their
+// staged parts, returning the ids of the uploads it removed
+func DeleteS3Uploads(where string, args ...interface{}) ([]string, error) {
+    rows, err := database.DB.Query("DELETE FROM s3_multipart_uploads WHERE "+where+" RETURNING id", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var ids []string
+    for rows.Next() {
+        var id string
+        if err := rows.Scan(&id); err != nil {
+            return ids, err
+        }
+        os.RemoveAll(filepath.Join(S3MultipartPath(), id))
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/crypto/bcrypt"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/models"
+    "file-service/utils"
+)
+
+var (
+    ErrLinkNotFound  = errors.New("share link not found")
+    ErrLinkGone      = errors.New("share link has expired or been revoked")
+    ErrLinkPassword  = errors.New("share link password required or incorrect")
+    ErrLinkExhausted = errors.New("share link download limit reached")
+)
+
+// LinkThrottledError refuses a share link after too many wrong passwords,
+// for the link or from the caller's address
+type LinkThrottledError struct {
+    RetryAfter time.Duration
+}
+
+func (e *LinkThrottledError) Error() string {
+    return fmt.Sprintf("too many wrong passwords, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// Wrong share link passwords allowed per link and per client address within
+// SHARE_PASSWORD_WINDOW. Set up on first use, once the environment is loaded.
+var (
+    linkPasswordLimitsOnce sync.Once
+    linkPasswordFailures   *utils.SlidingWindow
+    ipPasswordFailures     *utils.SlidingWindow
+)
+
+func linkPasswordLimits() (perLink, perIP *utils.SlidingWindow) {
+    linkPasswordLimitsOnce.Do(func() {
+        window := config.GetEnvDuration("SHARE_PASSWORD_WINDOW", 15*time.Minute)
+        linkPasswordFailures = utils.NewSlidingWindow(int(config.GetEnvInt64("SHARE_PASSWORD_LINK_LIMIT", 10)), window)
+        ipPasswordFailures = utils.NewSlidingWindow(int(config.GetEnvInt64("SHARE_PASSWORD_IP_LIMIT", 20)), window)
+    })
+    return linkPasswordFailures, ipPasswordFailures
+}
+
+// ShareOptions are the restrictions a new share link is created with; zero
+// values mean "no restriction".
+type ShareOptions struct {
+    Name         string
+    Password     string
+    ExpiresAt    *time.Time
+    MaxDownloads *int
+}
+
+const shareLinkColumns = "id, file_id, name, token, COALESCE(password_hash, ''), expires_at, max_downloads, download_count, revoked_at, created_at"
+
+func scanShareLink(s models.FileScanner, l *models.ShareLink) error {
+    err := s.Scan(&l.ID, &l.FileID, &l.Name, &l.Token, &l.PasswordHash, &l.ExpiresAt, &l.MaxDownloads, &l.DownloadCount, &l.RevokedAt, &l.CreatedAt)
+    if err != nil {
+        return err
+    }
+    l.HasPassword = l.PasswordHash != ""
+    l.URL = ShareURL(l.Token)
+    return nil
+}
+
+// ShareURL is the public download address for a share link token
+func ShareURL(token string) string {
+    base := strings.TrimRight(config.GetEnvDefault("PUBLIC_BASE_URL", "http://localhost:8001"), "/")
+    return fmt.Sprintf("%s/public/%s/download", base, token)
+}
+
+// CreateShareLink adds a new public link to fileID
+func CreateShareLink(fileID int, opts ShareOptions) (models.ShareLink, error) {
+    var link models.ShareLink
+
+    name := strings.TrimSpace(opts.Name)
+    if name == "" {
+        name = "Public link"
+    }
+    var hash sql.NullString
+    if opts.Password != "" {
+        h, err := bcrypt.GenerateFromPassword([]byte(opts.Password), bcrypt.DefaultCost)
+        if err != nil {
+            return link, err
+        }
+        hash = sql.NullString{String: string(h), Valid: true}
+    }
+
+    err := database.WithTx(func(tx *sql.Tx) error {
+        err := scanShareLink(tx.QueryRow(
+            `INSERT INTO share_links (file_id, name, token, password_hash, expires_at, max_downloads)
+             VALUES ($1, $2, $3, $4, $5, $6) RETURNING `+shareLinkColumns,
+            fileID, name, utils.GenerateRandomString(32), hash, opts.ExpiresAt, opts.MaxDownloads,
+        ), &link)
+        if err != nil {
+            return err
+        }
+        return syncPublicFlag(tx, fileID)
+    })
+    return link, err
+}
+
+// ListShareLinks returns every link of fileID, including revoked ones, newest first
+func ListShareLinks(fileID int) ([]models.ShareLink, error) {
+    rows, err := database.DB.Query("SELECT "+shareLinkColumns+" FROM share_links WHERE file_id = $1 ORDER BY created_at DESC", fileID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    links := []models.ShareLink{}
+    for rows.Next() {
+        var l models.ShareLink
+        if err := scanShareLink(rows, &l); err != nil {
+            return nil, err
+        }
+        links = append(links, l)
+    }
+    return links, rows.Err()
+}
+
+// RevokeShareLink disables one link of fileID. Revoking twice is a no-op.
+func RevokeShareLink(fileID, linkID int) error {
+    return database.WithTx(func(tx *sql.Tx) error {
+        res, err := tx.Exec(
+            "UPDATE share_links SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1 AND file_id = $2",
+            linkID, fileID,
+        )
+        if err != nil {
+            return err
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            return ErrLinkNotFound
+        }
+        return syncPublicFlag(tx, fileID)
+    })
+}
+
+// syncPublicFlag keeps user_files.is_public true while the file has a live link
+func syncPublicFlag(tx *sql.Tx, fileID int) error {
+    _, err := tx.Exec(
+        "UPDATE user_files SET is_public = EXISTS (SELECT 1 FROM share_links WHERE file_id = $1 AND revoked_at IS NULL) WHERE id = $1",
+        fileID,
+    )
+    return err
+}
+
+// OpenShareLink checks every rule on the link behind token and, if the
+// download is allowed, counts it. Every authorized request counts, ranged
+// ones included, so max_downloads bounds what can be fetched through the
+// link. Wrong passwords are counted per link and per ip; past either limit
+// the link answers LinkThrottledError until the window moves on. It returns
+// the file to serve.
+func OpenShareLink(token, password, ip string) (models.File, error) {
+    perLink, perIP := linkPasswordLimits()
+    if wait := max(perLink.Wait(token), perIP.Wait(ip)); wait > 0 {
+        return models.File{}, &LinkThrottledError{RetryAfter: wait}
+    }
+
+    var file models.File
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var link models.ShareLink
+        err := scanShareLink(tx.QueryRow(
+            "SELECT "+shareLinkColumns+" FROM share_links WHERE token = $1 FOR UPDATE",
+            token,
+        ), &link)
+        if err == sql.ErrNoRows {
+            return ErrLinkNotFound
+        }
+        if err != nil {
+            return err
+        }
+
+        if link.RevokedAt != nil || (link.ExpiresAt != nil && time.Now().After(*link.ExpiresAt)) {
+            return ErrLinkGone
+        }
+        if link.HasPassword && bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password)) != nil {
+            perLink.Allow(token)
+            perIP.Allow(ip)
+            return ErrLinkPassword
+        }
+        if link.MaxDownloads != nil && link.DownloadCount >= *link.MaxDownloads {
+            return ErrLinkExhausted
+        }
+
+        file, err = GetFile(tx, link.FileID)
+        if err != nil {
+            return err
+        }
+        if file.TrashedAt != nil {
+            return ErrLinkNotFound
+        }
+
+        if _, err := tx.Exec("UPDATE share_links SET download_count = download_count + 1 WHERE id = $1", link.ID); err != nil {
+            return err
+        }
+        _, err = tx.Exec("UPDATE user_files SET download_count = download_count + 1 WHERE id = $1", link.FileID)
+        return err
+    })
+    return file, err
+}
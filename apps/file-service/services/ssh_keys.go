@@ -0,0 +1,112 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "strings"
+    "time"
+
+    "golang.org/x/crypto/ssh"
+
+    "file-service/database"
+    "file-service/models"
+)
+
+var (
+    // ErrSSHKeyNotFound means the key does not exist or belongs to someone else
+    ErrSSHKeyNotFound = errors.New("SSH key not found")
+    // ErrSSHKeyInvalid rejects anything that is not a single authorized_keys line
+    ErrSSHKeyInvalid = errors.New("public key must be one line in authorized_keys format")
+    // ErrSSHKeyInUse means the same key is already registered, possibly by another user
+    ErrSSHKeyInUse = errors.New("this key is already registered")
+    // ErrSSHKeyNameRequired rejects keys without a name, or with one over 100 characters
+    ErrSSHKeyNameRequired = errors.New("a name of at most 100 characters is required")
+)
+
+// AddSSHKey registers an authorized_keys line for username. When name is
+// empty the key's comment is used. A key can only belong to one user, so a
+// connection offering it identifies the account.
+func AddSSHKey(username, name, authorizedKey string) (models.SSHKey, error) {
+    pub, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+    if err != nil || len(options) > 0 || strings.TrimSpace(string(rest)) != "" {
+        return models.SSHKey{}, ErrSSHKeyInvalid
+    }
+    if name == "" {
+        name = comment
+    }
+    if name == "" || len(name) > 100 {
+        return models.SSHKey{}, ErrSSHKeyNameRequired
+    }
+
+    key := models.SSHKey{
+        Username:    username,
+        Name:        name,
+        PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+        Fingerprint: ssh.FingerprintSHA256(pub),
+    }
+    err = database.DB.QueryRow(
+        "INSERT INTO ssh_keys (username, name, public_key, fingerprint) VALUES ($1, $2, $3, $4) RETURNING id, created_at",
+        key.Username, key.Name, key.PublicKey, key.Fingerprint,
+    ).Scan(&key.ID, &key.CreatedAt)
+    if isUniqueViolation(err) {
+        return models.SSHKey{}, ErrSSHKeyInUse
+    }
+    return key, err
+}
+
+// ListSSHKeys returns username's registered keys, newest first
+func ListSSHKeys(username string) ([]models.SSHKey, error) {
+    rows, err := database.DB.Query(
+        "SELECT id, username, name, public_key, fingerprint, last_used_at, created_at FROM ssh_keys WHERE username = $1 ORDER BY created_at DESC",
+        username,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    keys := []models.SSHKey{}
+    for rows.Next() {
+        var k models.SSHKey
+        if err := rows.Scan(&k.ID, &k.Username, &k.Name, &k.PublicKey, &k.Fingerprint, &k.LastUsedAt, &k.CreatedAt); err != nil {
+            return nil, err
+        }
+        keys = append(keys, k)
+    }
+    return keys, rows.Err()
+}
+
+// DeleteSSHKey removes one of username's keys
+func DeleteSSHKey(username string, id int) error {
+    res, err := database.DB.Exec("DELETE FROM ssh_keys WHERE id = $1 AND username = $2", id, username)
+    if err != nil {
+        return err
+    }
+    if n, _ := res.RowsAffected(); n == 0 {
+        return ErrSSHKeyNotFound
+    }
+    return nil
+}
+
+// LookupSSHKey finds the registered key username is offering. last_used_at
+// is written at most once a minute, as for access tokens.
+func LookupSSHKey(username string, pub ssh.PublicKey) (models.SSHKey, error) {
+    var k models.SSHKey
+    err := database.DB.QueryRow(
+        "SELECT id, username, name, public_key, fingerprint, last_used_at, created_at FROM ssh_keys WHERE fingerprint = $1 AND username = $2",
+        ssh.FingerprintSHA256(pub), username,
+    ).Scan(&k.ID, &k.Username, &k.Name, &k.PublicKey, &k.Fingerprint, &k.LastUsedAt, &k.CreatedAt)
+    if err == sql.ErrNoRows {
+        return k, ErrSSHKeyNotFound
+    }
+    if err != nil {
+        return k, err
+    }
+
+    if k.LastUsedAt == nil || time.Since(*k.LastUsedAt) > time.Minute {
+        if _, err := database.DB.Exec("UPDATE ssh_keys SET last_used_at = now() WHERE id = $1", k.ID); err != nil {
+            return k, err
+        }
+    }
+    return k, nil
+}
@@ -0,0 +1,83 @@
+package services
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "io"
+    "os"
+
+    "file-service/config"
+    "file-service/storage"
+    "file-service/utils"
+)
+
+// StagedBlob is content sitting in a local file whose SHA-256 is already known,
+// ready to be moved into the content-addressed store.
+type StagedBlob struct {
+    Path string
+    Hash string
+    Size int64
+}
+
+func uploadTempPath() string {
+    return config.GetEnvDefault("UPLOAD_TEMP_PATH", "./upload-staging")
+}
+
+// StageBlob streams src into a temp file, computing the SHA-256 in the same pass
+func StageBlob(src io.Reader) (*StagedBlob, error) {
+    if err := os.MkdirAll(uploadTempPath(), os.ModePerm); err != nil {
+        return nil, err
+    }
+    tmp, err := os.CreateTemp(uploadTempPath(), "upload-*")
+    if err != nil {
+        return nil, err
+    }
+
+    hasher := sha256.New()
+    size, err := io.Copy(io.MultiWriter(tmp, hasher), src)
+    if closeErr := tmp.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(tmp.Name())
+        return nil, err
+    }
+    return &StagedBlob{Path: tmp.Name(), Hash: hex.EncodeToString(hasher.Sum(nil)), Size: size}, nil
+}
+
+// StageFile hashes a file that is already on local disk, e.g. a finished tus upload
+func StageFile(path string) (*StagedBlob, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    fi, err := f.Stat()
+    if err != nil {
+        return nil, err
+    }
+    hash, err := utils.ComputeSHA256(f)
+    if err != nil {
+        return nil, err
+    }
+    return &StagedBlob{Path: path, Hash: hash, Size: fi.Size()}, nil
+}
+
+// Discard removes the staged file if it was not moved into storage
+func (b *StagedBlob) Discard() {
+    os.Remove(b.Path)
+}
+
+// commit moves the staged bytes into the storage backend under their hash
+func (b *StagedBlob) commit() error {
+    if importer, ok := storage.Store.(storage.Importer); ok {
+        return importer.Import(b.Hash, b.Path)
+    }
+    f, err := os.Open(b.Path)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    return storage.Store.Put(b.Hash, f, b.Size)
+}
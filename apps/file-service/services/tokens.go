@@ -0,0 +1,68 @@
+package services
+
+import (
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "errors"
+    "time"
+
+    "github.com/lib/pq"
+
+    "file-service/database"
+)
+
+// ErrInvalidAccessToken is returned for unknown, revoked or expired personal access tokens
+var ErrInvalidAccessToken = errors.New("invalid or expired access token")
+
+// TokenRevoked reports whether an access token, by jti or session id, has been
+// denylisted by the auth service (logout or refresh token reuse)
+func TokenRevoked(jti, sessionID string) (bool, error) {
+    var revoked bool
+    err := database.DB.QueryRow(
+        "SELECT EXISTS (SELECT 1 FROM token_denylist WHERE id IN ($1, $2) AND id <> '' AND expires_at > now())",
+        jti, sessionID,
+    ).Scan(&revoked)
+    return revoked, err
+}
+
+// AccessTokenOwner is who a personal access token acts as, and what it may do
+type AccessTokenOwner struct {
+    Username string
+    Role     string
+    Scopes   []string
+}
+
+// LookupAccessToken resolves a personal access token issued by the auth
+// service. last_used_at is only written once a minute per token to keep
+// busy scripts from turning every request into a write.
+func LookupAccessToken(raw string) (AccessTokenOwner, error) {
+    var owner AccessTokenOwner
+    var id int
+    var expiresAt, lastUsedAt *time.Time
+
+    sum := sha256.Sum256([]byte(raw))
+    err := database.DB.QueryRow(
+        `SELECT t.id, u.username, u.role, t.scopes, t.expires_at, t.last_used_at
+         FROM personal_access_tokens t
+         JOIN users u ON u.id = t.user_id
+         WHERE t.token_hash = $1`,
+        hex.EncodeToString(sum[:]),
+    ).Scan(&id, &owner.Username, &owner.Role, pq.Array(&owner.Scopes), &expiresAt, &lastUsedAt)
+    if err == sql.ErrNoRows {
+        return owner, ErrInvalidAccessToken
+    }
+    if err != nil {
+        return owner, err
+    }
+    if expiresAt != nil && time.Now().After(*expiresAt) {
+        return owner, ErrInvalidAccessToken
+    }
+
+    if lastUsedAt == nil || time.Since(*lastUsedAt) > time.Minute {
+        if _, err := database.DB.Exec("UPDATE personal_access_tokens SET last_used_at = now() WHERE id = $1", id); err != nil {
+            return owner, err
+        }
+    }
+    return owner, nil
+}
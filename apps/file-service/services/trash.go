@@ -0,0 +1,213 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "log"
+    "time"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/models"
+)
+
+// ErrNotInTrash means the file does not exist in the user's trash
+var ErrNotInTrash = errors.New("file not in trash")
+
+// TrashRetention is how long trashed files are kept before the purger removes them
+func TrashRetention() time.Duration {
+    return config.GetEnvDuration("TRASH_RETENTION", 30*24*time.Hour)
+}
+
+// TrashFileTx moves a live file to the trash. It keeps its versions, blob
+// references and quota charge until the file is purged from the trash. The
+// folder path is remembered so a restore can put the file back.
+func TrashFileTx(tx *sql.Tx, fileID int) error {
+    var owner string
+    var folderID *int
+    err := tx.QueryRow(
+        "SELECT uploader, folder_id FROM user_files WHERE id = $1 AND trashed_at IS NULL FOR UPDATE",
+        fileID,
+    ).Scan(&owner, &folderID)
+    if err != nil {
+        return err
+    }
+
+    path, err := FolderPath(tx, owner, folderID)
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(
+        "UPDATE user_files SET trashed_at = now(), original_path = $1, folder_id = NULL WHERE id = $2",
+        path, fileID,
+    )
+    return err
+}
+
+// ListTrash returns owner's trashed files, most recently deleted first
+func ListTrash(owner string) ([]models.TrashedFile, error) {
+    rows, err := database.DB.Query(
+        "SELECT "+models.FileColumns+", COALESCE(f.original_path, '/') FROM user_files f JOIN blobs b ON b.content_hash = f.content_hash WHERE f.uploader = $1 AND f.trashed_at IS NOT NULL ORDER BY f.trashed_at DESC",
+        owner,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    retention := TrashRetention()
+    items := []models.TrashedFile{}
+    for rows.Next() {
+        var t models.TrashedFile
+        if err := rows.Scan(append(models.FileDest(&t.File), &t.OriginalPath)...); err != nil {
+            return nil, err
+        }
+        t.PurgeAt = t.TrashedAt.Add(retention)
+        items = append(items, t)
+    }
+    return items, rows.Err()
+}
+
+// RestoreFile takes a file out of the trash and puts it back where it was
+// deleted from, recreating the folder path if it has since been removed.
+func RestoreFile(owner string, fileID int) (models.File, error) {
+    var file models.File
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var name string
+        var path sql.NullString
+        err := tx.QueryRow(
+            "SELECT filename, original_path FROM user_files WHERE id = $1 AND uploader = $2 AND trashed_at IS NOT NULL FOR UPDATE",
+            fileID, owner,
+        ).Scan(&name, &path)
+        if err == sql.ErrNoRows {
+            return ErrNotInTrash
+        }
+        if err != nil {
+            return err
+        }
+
+        folderID, err := ResolvePath(tx, owner, path.String, true)
+        if err != nil {
+            return err
+        }
+        if taken, err := NameTaken(tx, owner, folderID, name); err != nil || taken {
+            if err == nil {
+                err = ErrNameTaken
+            }
+            return err
+        }
+
+        _, err = tx.Exec(
+            "UPDATE user_files SET trashed_at = NULL, original_path = NULL, folder_id = $1 WHERE id = $2",
+            folderID, fileID,
+        )
+        if isUniqueViolation(err) {
+            return ErrNameTaken
+        }
+        if err != nil {
+            return err
+        }
+        file, err = GetFile(tx, fileID)
+        return err
+    })
+    return file, err
+}
+
+// PurgeTrashedFile permanently deletes one of owner's trashed files
+func PurgeTrashedFile(owner string, fileID int) error {
+    var exists bool
+    err := database.DB.QueryRow(
+        "SELECT EXISTS (SELECT 1 FROM user_files WHERE id = $1 AND uploader = $2 AND trashed_at IS NOT NULL)",
+        fileID, owner,
+    ).Scan(&exists)
+    if err != nil {
+        return err
+    }
+    if !exists {
+        return ErrNotInTrash
+    }
+    _, err = purgeTrashed([]int{fileID})
+    return err
+}
+
+// EmptyTrash permanently deletes everything in owner's trash
+func EmptyTrash(owner string) (int, error) {
+    ids, err := trashedIDs("SELECT id FROM user_files WHERE uploader = $1 AND trashed_at IS NOT NULL", owner)
+    if err != nil {
+        return 0, err
+    }
+    return purgeTrashed(ids)
+}
+
+// PurgeExpiredTrash permanently deletes files trashed longer ago than retention
+func PurgeExpiredTrash(retention time.Duration) (int, error) {
+    ids, err := trashedIDs("SELECT id FROM user_files WHERE trashed_at < $1", time.Now().Add(-retention))
+    if err != nil {
+        return 0, err
+    }
+    return purgeTrashed(ids)
+}
+
+// StartTrashPurger runs PurgeExpiredTrash with TRASH_RETENTION every interval
+func StartTrashPurger(interval time.Duration) {
+    go func() {
+        for range time.Tick(interval) {
+            n, err := PurgeExpiredTrash(TrashRetention())
+            if err != nil {
+                log.Println("trash purge failed:", err)
+            } else if n > 0 {
+                log.Printf("purged %d expired files from trash", n)
+            }
+        }
+    }()
+}
+
+func trashedIDs(query string, args ...interface{}) ([]int, error) {
+    rows, err := database.DB.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var ids []int
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            return nil, err
+        }
+        ids = append(ids, id)
+    }
+    return ids, rows.Err()
+}
+
+// purgeTrashed deletes each file in its own transaction, so one large purge
+// never holds every lock at once. Files restored in the meantime are skipped.
+// Blob references and usage are released here and nowhere else.
+func purgeTrashed(ids []int) (int, error) {
+    purged := 0
+    for _, id := range ids {
+        var orphans []string
+        deleted := false
+        err := database.WithTx(func(tx *sql.Tx) error {
+            var trashed bool
+            err := tx.QueryRow("SELECT trashed_at IS NOT NULL FROM user_files WHERE id = $1 FOR UPDATE", id).Scan(&trashed)
+            if err == sql.ErrNoRows || (err == nil && !trashed) {
+                return nil
+            }
+            if err != nil {
+                return err
+            }
+            orphans, err = DeleteFileTx(tx, id)
+            deleted = err == nil
+            return err
+        })
+        if err != nil {
+            return purged, err
+        }
+        PurgeBlobs(orphans)
+        if deleted {
+            purged++
+        }
+    }
+    return purged, nil
+}
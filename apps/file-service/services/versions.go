@@ -0,0 +1,264 @@
+package services
+
+import (
+    "database/sql"
+    "errors"
+    "log"
+    "time"
+
+    "file-service/config"
+    "file-service/database"
+    "file-service/models"
+)
+
+// ErrVersionNotFound means the file has no such version (or it was pruned)
+var ErrVersionNotFound = errors.New("version not found")
+
+const versionColumns = "v.id, v.file_id, v.version, v.size, v.mime_type, v.content_hash, v.created_at, v.version = f.current_version"
+
+func scanVersion(s models.FileScanner, v *models.FileVersion) error {
+    return s.Scan(&v.ID, &v.FileID, &v.Version, &v.Size, &v.MIMEType, &v.ContentHash, &v.CreatedAt, &v.IsCurrent)
+}
+
+// AddVersionTx makes the staged content the newest version of fileID. Uploading
+// the same bytes as the current version is a no-op.
+func AddVersionTx(tx *sql.Tx, fileID int, mimeType string, blob *StagedBlob) (models.File, error) {
+    file, err := GetFile(tx, fileID)
+    if err != nil {
+        return file, err
+    }
+    if file.ContentHash == blob.Hash {
+        return file, nil
+    }
+
+    if err := ChargeUsageTx(tx, file.Uploader, blob.Size); err != nil {
+        return models.File{}, err
+    }
+    refCount, err := AcquireBlobTx(tx, blob)
+    if err != nil {
+        return models.File{}, err
+    }
+    if err := appendVersionTx(tx, fileID, file.Uploader, blob.Hash, blob.Size, mimeType, "version"); err != nil {
+        discardNewBlob(blob.Hash, refCount)
+        return models.File{}, err
+    }
+    return GetFile(tx, fileID)
+}
+
+// appendVersionTx records content as the next version of fileID and makes it current.
+// The caller has already charged the quota and taken the blob reference.
+func appendVersionTx(tx *sql.Tx, fileID int, uploader, contentHash string, size int64, mimeType, reason string) error {
+    var next int
+    err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM file_versions WHERE file_id = $1", fileID).Scan(&next)
+    if err != nil {
+        return err
+    }
+
+    _, err = tx.Exec(
+        "INSERT INTO file_versions (file_id, version, content_hash, size, mime_type) VALUES ($1, $2, $3, $4, $5)",
+        fileID, next, contentHash, size, mimeType,
+    )
+    if err != nil {
+        return err
+    }
+    _, err = tx.Exec(
+        "UPDATE user_files SET content_hash = $1, size = $2, mime_type = $3, upload_date = now(), current_version = $4 WHERE id = $5",
+        contentHash, size, mimeType, next, fileID,
+    )
+    if err != nil {
+        return err
+    }
+    return RecordUsageTx(tx, uploader, fileID, size, reason)
+}
+
+// ListVersions returns all versions of fileID, newest first
+func ListVersions(q Queryer, fileID int) ([]models.FileVersion, error) {
+    rows, err := q.Query(
+        "SELECT "+versionColumns+" FROM file_versions v JOIN user_files f ON f.id = v.file_id WHERE v.file_id = $1 ORDER BY v.version DESC",
+        fileID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    versions := []models.FileVersion{}
+    for rows.Next() {
+        var v models.FileVersion
+        if err := scanVersion(rows, &v); err != nil {
+            return nil, err
+        }
+        versions = append(versions, v)
+    }
+    return versions, rows.Err()
+}
+
+// listVersionsTx is ListVersions with the version rows locked for update
+func listVersionsTx(tx *sql.Tx, fileID int) ([]models.FileVersion, error) {
+    rows, err := tx.Query(
+        "SELECT "+versionColumns+" FROM file_versions v JOIN user_files f ON f.id = v.file_id WHERE v.file_id = $1 ORDER BY v.version DESC FOR UPDATE OF v",
+        fileID,
+    )
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var versions []models.FileVersion
+    for rows.Next() {
+        var v models.FileVersion
+        if err := scanVersion(rows, &v); err != nil {
+            return nil, err
+        }
+        versions = append(versions, v)
+    }
+    return versions, rows.Err()
+}
+
+// GetVersion loads one version of fileID
+func GetVersion(q Queryer, fileID, version int) (models.FileVersion, error) {
+    var v models.FileVersion
+    err := scanVersion(q.QueryRow(
+        "SELECT "+versionColumns+" FROM file_versions v JOIN user_files f ON f.id = v.file_id WHERE v.file_id = $1 AND v.version = $2",
+        fileID, version,
+    ), &v)
+    if err == sql.ErrNoRows {
+        return v, ErrVersionNotFound
+    }
+    return v, err
+}
+
+// RestoreVersion makes an old version current again by appending a copy of it
+// as the newest version, so history stays linear and nothing is lost.
+func RestoreVersion(fileID, version int) (models.File, error) {
+    var file models.File
+    err := database.WithTx(func(tx *sql.Tx) error {
+        if _, err := tx.Exec("SELECT 1 FROM user_files WHERE id = $1 FOR UPDATE", fileID); err != nil {
+            return err
+        }
+        current, err := GetFile(tx, fileID)
+        if err != nil {
+            return err
+        }
+        old, err := GetVersion(tx, fileID, version)
+        if err != nil {
+            return err
+        }
+        if old.IsCurrent {
+            file = current
+            return nil
+        }
+
+        if err := ChargeUsageTx(tx, current.Uploader, old.Size); err != nil {
+            return err
+        }
+        if _, err := ReferenceBlobTx(tx, old.ContentHash); err != nil {
+            return err
+        }
+        if err := appendVersionTx(tx, fileID, current.Uploader, old.ContentHash, old.Size, old.MIMEType, "restore"); err != nil {
+            return err
+        }
+        file, err = GetFile(tx, fileID)
+        return err
+    })
+    return file, err
+}
+
+// PruneVersions deletes old versions of fileID under a retention policy: a
+// version survives if it is among the keepLast newest or younger than keepDays.
+// A zero setting disables that rule; with both zero nothing is pruned. The
+// current version is always kept. It returns how many versions were removed.
+func PruneVersions(fileID, keepLast, keepDays int) (int, error) {
+    if keepLast <= 0 && keepDays <= 0 {
+        return 0, nil
+    }
+
+    var orphans []string
+    removed := 0
+    err := database.WithTx(func(tx *sql.Tx) error {
+        var uploader string
+        err := tx.QueryRow("SELECT uploader FROM user_files WHERE id = $1 FOR UPDATE", fileID).Scan(&uploader)
+        if err != nil {
+            return err
+        }
+        versions, err := listVersionsTx(tx, fileID)
+        if err != nil {
+            return err
+        }
+
+        cutoff := time.Now().AddDate(0, 0, -keepDays)
+        for i, v := range versions {
+            keep := v.IsCurrent ||
+                (keepLast > 0 && i < keepLast) ||
+                (keepDays > 0 && v.CreatedAt.After(cutoff))
+            if keep {
+                continue
+            }
+
+            if _, err := tx.Exec("DELETE FROM file_versions WHERE id = $1", v.ID); err != nil {
+                return err
+            }
+            if err := CreditUsageTx(tx, uploader, fileID, v.Size, "prune"); err != nil {
+                return err
+            }
+            orphaned, err := ReleaseBlobTx(tx, v.ContentHash)
+            if err != nil {
+                return err
+            }
+            if orphaned {
+                orphans = append(orphans, v.ContentHash)
+            }
+            removed++
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    PurgeBlobs(orphans)
+    return removed, nil
+}
+
+// PruneAllVersions applies the retention policy to every file with history
+func PruneAllVersions(keepLast, keepDays int) error {
+    rows, err := database.DB.Query("SELECT file_id FROM file_versions GROUP BY file_id HAVING COUNT(*) > 1")
+    if err != nil {
+        return err
+    }
+    var fileIDs []int
+    for rows.Next() {
+        var id int
+        if err := rows.Scan(&id); err != nil {
+            rows.Close()
+            return err
+        }
+        fileIDs = append(fileIDs, id)
+    }
+    rows.Close()
+
+    for _, id := range fileIDs {
+        if _, err := PruneVersions(id, keepLast, keepDays); err != nil && err != sql.ErrNoRows {
+            return err
+        }
+    }
+    return nil
+}
+
+// StartVersionPruner applies VERSION_KEEP_LAST / VERSION_KEEP_DAYS to all files
+// every interval. It does nothing when neither is configured.
+func StartVersionPruner(interval time.Duration) {
+    keepLast := int(config.GetEnvInt64("VERSION_KEEP_LAST", 0))
+    keepDays := int(config.GetEnvInt64("VERSION_KEEP_DAYS", 0))
+    if keepLast <= 0 && keepDays <= 0 {
+        return
+    }
+
+    go func() {
+        for range time.Tick(interval) {
+            if err := PruneAllVersions(keepLast, keepDays); err != nil {
+                log.Println("version pruning failed:", err)
+            }
+        }
+    }()
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+    "errors"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+)
+
+// LocalBackend keeps objects on disk under Root. With ShardDepth > 0 objects
+// are spread over nested two-character directories (ab/cd/abcd...) so no
+// single directory grows to millions of entries.
+type LocalBackend struct {
+    Root       string
+    ShardDepth int
+}
+
+func NewLocal(root string, shardDepth int) (*LocalBackend, error) {
+    if err := os.MkdirAll(root, os.ModePerm); err != nil {
+        return nil, err
+    }
+    return &LocalBackend{Root: root, ShardDepth: shardDepth}, nil
+}
+
+// Path returns the on-disk location of key.
+func (l *LocalBackend) Path(key string) string {
+    parts := []string{l.Root}
+    for i := 0; i < l.ShardDepth && len(key) >= (i+1)*2; i++ {
+        parts = append(parts, key[i*2:(i+1)*2])
+    }
+    return filepath.Join(append(parts, key)...)
+}
+
+func (l *LocalBackend) Put(key string, r io.Reader, size int64) error {
+    if !validKey(key) {
+        return errors.New("storage: invalid key")
+    }
+    dstPath := l.Path(key)
+    if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+        return err
+    }
+
+    // Write next to the destination and rename, so readers never see a partial object
+    tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".upload-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+
+    if _, err := io.Copy(tmp, r); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), dstPath)
+}
+
+// Import atomically renames localPath into place, copying only when it lives on another filesystem
+func (l *LocalBackend) Import(key, localPath string) error {
+    if !validKey(key) {
+        return errors.New("storage: invalid key")
+    }
+    dstPath := l.Path(key)
+    if err := os.MkdirAll(filepath.Dir(dstPath), os.ModePerm); err != nil {
+        return err
+    }
+    if err := os.Rename(localPath, dstPath); err == nil {
+        return nil
+    }
+
+    src, err := os.Open(localPath)
+    if err != nil {
+        return err
+    }
+    defer src.Close()
+    if err := l.Put(key, src, -1); err != nil {
+        return err
+    }
+    return os.Remove(localPath)
+}
+
+func (l *LocalBackend) Get(key string) (io.ReadSeekCloser, error) {
+    if !validKey(key) {
+        return nil, ErrNotExist
+    }
+    f, err := os.Open(l.Path(key))
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, ErrNotExist
+    }
+    return f, err
+}
+
+func (l *LocalBackend) Stat(key string) (ObjectInfo, error) {
+    if !validKey(key) {
+        return ObjectInfo{}, ErrNotExist
+    }
+    fi, err := os.Stat(l.Path(key))
+    if errors.Is(err, fs.ErrNotExist) {
+        return ObjectInfo{}, ErrNotExist
+    }
+    if err != nil {
+        return ObjectInfo{}, err
+    }
+    return ObjectInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Delete removes key; deleting a missing key is not an error.
+func (l *LocalBackend) Delete(key string) error {
+    if !validKey(key) {
+        return nil
+    }
+    err := os.Remove(l.Path(key))
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil
+    }
+    return err
+}
+
+func (l *LocalBackend) List(prefix string) ([]ObjectInfo, error) {
+    var objects []ObjectInfo
+    err := filepath.WalkDir(l.Root, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        name := d.Name()
+        if d.IsDir() && p != l.Root && strings.HasPrefix(name, ".") {
+            return filepath.SkipDir
+        }
+        if d.IsDir() || strings.HasPrefix(name, ".") || !strings.HasPrefix(name, prefix) {
+            return nil
+        }
+        fi, err := d.Info()
+        if err != nil {
+            return err
+        }
+        objects = append(objects, ObjectInfo{Key: name, Size: fi.Size(), ModTime: fi.ModTime()})
+        return nil
+    })
+    return objects, err
+}
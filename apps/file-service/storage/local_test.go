@@ -0,0 +1,188 @@
+package storage
+
+import (
+    "errors"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "testing"
+)
+
+const testKey = "abcdef0123456789"
+
+func putString(t *testing.T, b Backend, key, content string) {
+    t.Helper()
+    if err := b.Put(key, strings.NewReader(content), int64(len(content))); err != nil {
+        t.Fatalf("Put(%q): %v", key, err)
+    }
+}
+
+func readAll(t *testing.T, b Backend, key string) string {
+    t.Helper()
+    rc, err := b.Get(key)
+    if err != nil {
+        t.Fatalf("Get(%q): %v", key, err)
+    }
+    defer rc.Close()
+    data, err := io.ReadAll(rc)
+    if err != nil {
+        t.Fatalf("reading %q: %v", key, err)
+    }
+    return string(data)
+}
+
+func listKeys(t *testing.T, b Backend, prefix string) []string {
+    t.Helper()
+    objects, err := b.List(prefix)
+    if err != nil {
+        t.Fatalf("List(%q): %v", prefix, err)
+    }
+    keys := []string{}
+    for _, o := range objects {
+        keys = append(keys, o.Key)
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// testBackendSemantics runs the behaviour every Backend must share
+func testBackendSemantics(t *testing.T, b Backend) {
+    putString(t, b, testKey, "hello world")
+    if got := readAll(t, b, testKey); got != "hello world" {
+        t.Fatalf("Get = %q, want %q", got, "hello world")
+    }
+
+    info, err := b.Stat(testKey)
+    if err != nil {
+        t.Fatalf("Stat: %v", err)
+    }
+    if info.Key != testKey || info.Size != 11 {
+        t.Fatalf("Stat = %+v, want key %q size 11", info, testKey)
+    }
+
+    // Overwriting replaces the content
+    putString(t, b, testKey, "bye")
+    if got := readAll(t, b, testKey); got != "bye" {
+        t.Fatalf("Get after overwrite = %q, want %q", got, "bye")
+    }
+
+    // Seeking then reading serves the tail
+    putString(t, b, testKey, "0123456789")
+    rc, err := b.Get(testKey)
+    if err != nil {
+        t.Fatalf("Get: %v", err)
+    }
+    if _, err := rc.Seek(6, io.SeekStart); err != nil {
+        t.Fatalf("Seek: %v", err)
+    }
+    tail, err := io.ReadAll(rc)
+    rc.Close()
+    if err != nil || string(tail) != "6789" {
+        t.Fatalf("read after Seek = %q, %v; want %q", tail, err, "6789")
+    }
+
+    putString(t, b, "abff00", "x")
+    putString(t, b, "cd0000", "y")
+    putString(t, b, "empty0", "")
+    if got := readAll(t, b, "empty0"); got != "" {
+        t.Fatalf("empty object read back as %q", got)
+    }
+    if keys := listKeys(t, b, "ab"); strings.Join(keys, ",") != "abcdef0123456789,abff00" {
+        t.Fatalf("List(ab) = %v", keys)
+    }
+    if keys := listKeys(t, b, ""); len(keys) != 4 {
+        t.Fatalf("List() = %v, want 4 keys", keys)
+    }
+
+    if err := b.Delete(testKey); err != nil {
+        t.Fatalf("Delete: %v", err)
+    }
+    if _, err := b.Stat(testKey); !errors.Is(err, ErrNotExist) {
+        t.Fatalf("Stat after Delete = %v, want ErrNotExist", err)
+    }
+    if _, err := b.Get(testKey); !errors.Is(err, ErrNotExist) {
+        t.Fatalf("Get after Delete = %v, want ErrNotExist", err)
+    }
+    if err := b.Delete(testKey); err != nil {
+        t.Fatalf("deleting a missing key: %v", err)
+    }
+
+    for _, key := range []string{"", ".", "..", "a/b", `a\b`} {
+        if err := b.Put(key, strings.NewReader("x"), 1); err == nil {
+            t.Errorf("Put(%q) accepted an invalid key", key)
+        }
+        if _, err := b.Get(key); !errors.Is(err, ErrNotExist) {
+            t.Errorf("Get(%q) = %v, want ErrNotExist", key, err)
+        }
+    }
+}
+
+func TestLocalBackend(t *testing.T) {
+    b, err := NewLocal(t.TempDir(), 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    testBackendSemantics(t, b)
+}
+
+func TestShardedBackend(t *testing.T) {
+    root := t.TempDir()
+    b, err := NewLocal(root, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    testBackendSemantics(t, b)
+}
+
+func TestShardedLayout(t *testing.T) {
+    root := t.TempDir()
+    b, err := NewLocal(root, 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    putString(t, b, testKey, "data")
+
+    want := filepath.Join(root, "ab", "cd", testKey)
+    if b.Path(testKey) != want {
+        t.Fatalf("Path = %q, want %q", b.Path(testKey), want)
+    }
+    if _, err := os.Stat(want); err != nil {
+        t.Fatalf("object not stored at %s: %v", want, err)
+    }
+
+    // Keys shorter than the shard prefix stay as shallow as they can
+    if got := b.Path("abc"); got != filepath.Join(root, "ab", "abc") {
+        t.Fatalf("Path(abc) = %q", got)
+    }
+
+    // Leftover temp files from an interrupted Put are not objects
+    if err := os.WriteFile(filepath.Join(root, "ab", "cd", ".upload-123"), []byte("partial"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if keys := listKeys(t, b, ""); len(keys) != 1 || keys[0] != testKey {
+        t.Fatalf("List() = %v, want only %s", keys, testKey)
+    }
+}
+
+func TestLocalImport(t *testing.T) {
+    b, err := NewLocal(t.TempDir(), 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    src := filepath.Join(t.TempDir(), "staged")
+    if err := os.WriteFile(src, []byte("imported"), 0644); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := b.Import(testKey, src); err != nil {
+        t.Fatalf("Import: %v", err)
+    }
+    if got := readAll(t, b, testKey); got != "imported" {
+        t.Fatalf("Get = %q, want %q", got, "imported")
+    }
+    if _, err := os.Stat(src); !errors.Is(err, os.ErrNotExist) {
+        t.Fatalf("staged file still present after Import: %v", err)
+    }
+}
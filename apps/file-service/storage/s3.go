@@ -0,0 +1,261 @@
+package storage
+
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+
+    "file-service/utils"
+)
+
+// S3Config holds the settings for an S3-compatible object store (AWS, MinIO, Ceph RGW...).
+type S3Config struct {
+    Endpoint  string // e.g. http://localhost:9000
+    Region    string
+    Bucket    string
+    AccessKey string
+    SecretKey string
+}
+
+// S3Backend talks to an S3-compatible store using path-style URLs
+// (<endpoint>/<bucket>/<key>) and SigV4 request signing.
+type S3Backend struct {
+    cfg    S3Config
+    cred   utils.SigV4Credentials
+    Client *http.Client
+}
+
+func NewS3(cfg S3Config) (*S3Backend, error) {
+    if cfg.Endpoint == "" || cfg.Bucket == "" {
+        return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required for the s3 backend")
+    }
+    cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+    return &S3Backend{
+        cfg: cfg,
+        cred: utils.SigV4Credentials{
+            AccessKey: cfg.AccessKey,
+            SecretKey: cfg.SecretKey,
+            Region:    cfg.Region,
+            Service:   "s3",
+        },
+        Client: http.DefaultClient,
+    }, nil
+}
+
+func (s *S3Backend) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+    u := s.cfg.Endpoint + "/" + s.cfg.Bucket + "/"
+    if key != "" {
+        u += utils.SigV4URIEncode(key, false)
+    }
+    if len(query) > 0 {
+        u += "?" + utils.SigV4CanonicalQuery(query)
+    }
+    return http.NewRequest(method, u, body)
+}
+
+func (s *S3Backend) do(req *http.Request) (*http.Response, error) {
+    utils.SignRequestV4(req, s.cred, utils.UnsignedPayload, time.Now())
+    resp, err := s.Client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode == http.StatusNotFound {
+        resp.Body.Close()
+        return nil, ErrNotExist
+    }
+    if resp.StatusCode >= 300 {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+        resp.Body.Close()
+        return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, msg)
+    }
+    return resp, nil
+}
+
+// Put uploads r in a single PUT. size must be known, S3 needs a Content-Length.
+func (s *S3Backend) Put(key string, r io.Reader, size int64) error {
+    if !validKey(key) {
+        return errors.New("storage: invalid key")
+    }
+    if size < 0 {
+        return errors.New("storage: s3 backend needs the object size")
+    }
+    req, err := s.newRequest(http.MethodPut, key, nil, r)
+    if err != nil {
+        return err
+    }
+    req.ContentLength = size
+    if size == 0 {
+        req.Body = http.NoBody
+    }
+    resp, err := s.do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+func (s *S3Backend) Get(key string) (io.ReadSeekCloser, error) {
+    info, err := s.Stat(key)
+    if err != nil {
+        return nil, err
+    }
+    return &s3Object{backend: s, key: key, size: info.Size}, nil
+}
+
+func (s *S3Backend) Stat(key string) (ObjectInfo, error) {
+    if !validKey(key) {
+        return ObjectInfo{}, ErrNotExist
+    }
+    req, err := s.newRequest(http.MethodHead, key, nil, nil)
+    if err != nil {
+        return ObjectInfo{}, err
+    }
+    resp, err := s.do(req)
+    if err != nil {
+        return ObjectInfo{}, err
+    }
+    resp.Body.Close()
+    modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+    return ObjectInfo{Key: key, Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+// Delete removes key; S3 treats deleting a missing key as success too.
+func (s *S3Backend) Delete(key string) error {
+    if !validKey(key) {
+        return nil
+    }
+    req, err := s.newRequest(http.MethodDelete, key, nil, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := s.do(req)
+    if errors.Is(err, ErrNotExist) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    return nil
+}
+
+type listBucketResult struct {
+    Contents []struct {
+        Key          string    `xml:"Key"`
+        Size         int64     `xml:"Size"`
+        LastModified time.Time `xml:"LastModified"`
+    } `xml:"Contents"`
+    IsTruncated           bool   `xml:"IsTruncated"`
+    NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List pages through ListObjectsV2 until every key under prefix is returned.
+func (s *S3Backend) List(prefix string) ([]ObjectInfo, error) {
+    var objects []ObjectInfo
+    token := ""
+    for {
+        query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+        if token != "" {
+            query.Set("continuation-token", token)
+        }
+        req, err := s.newRequest(http.MethodGet, "", query, nil)
+        if err != nil {
+            return nil, err
+        }
+        resp, err := s.do(req)
+        if err != nil {
+            return nil, err
+        }
+        var result listBucketResult
+        err = xml.NewDecoder(resp.Body).Decode(&result)
+        resp.Body.Close()
+        if err != nil {
+            return nil, err
+        }
+        for _, c := range result.Contents {
+            objects = append(objects, ObjectInfo{Key: c.Key, Size: c.Size, ModTime: c.LastModified})
+        }
+        if !result.IsTruncated || result.NextContinuationToken == "" {
+            return objects, nil
+        }
+        token = result.NextContinuationToken
+    }
+}
+
+// PresignGet returns a URL the client can download key from directly.
+func (s *S3Backend) PresignGet(key string, expires time.Duration) (string, error) {
+    req, err := s.newRequest(http.MethodGet, key, nil, nil)
+    if err != nil {
+        return "", err
+    }
+    return utils.PresignURLV4(req, s.cred, expires, time.Now()), nil
+}
+
+// s3Object is a seekable view of a remote object. Reads are served by a
+// ranged GET opened lazily from the current offset, so http.ServeContent
+// can answer Range requests without downloading the whole object.
+type s3Object struct {
+    backend *S3Backend
+    key     string
+    size    int64
+    offset  int64
+    body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+    if o.offset >= o.size {
+        return 0, io.EOF
+    }
+    if o.body == nil {
+        req, err := o.backend.newRequest(http.MethodGet, o.key, nil, nil)
+        if err != nil {
+            return 0, err
+        }
+        req.Header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+        resp, err := o.backend.do(req)
+        if err != nil {
+            return 0, err
+        }
+        o.body = resp.Body
+    }
+    n, err := o.body.Read(p)
+    o.offset += int64(n)
+    return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+    var abs int64
+    switch whence {
+    case io.SeekStart:
+        abs = offset
+    case io.SeekCurrent:
+        abs = o.offset + offset
+    case io.SeekEnd:
+        abs = o.size + offset
+    default:
+        return 0, errors.New("storage: invalid whence")
+    }
+    if abs < 0 {
+        return 0, errors.New("storage: negative position")
+    }
+    if abs != o.offset && o.body != nil {
+        o.body.Close()
+        o.body = nil
+    }
+    o.offset = abs
+    return abs, nil
+}
+
+func (o *s3Object) Close() error {
+    if o.body != nil {
+        return o.body.Close()
+    }
+    return nil
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+    "errors"
+    "io"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+
+    "file-service/config"
+)
+
+// ErrNotExist is returned when a key is not present in the backend.
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+    Key     string
+    Size    int64
+    ModTime time.Time
+}
+
+// Backend stores blobs under flat keys (the content hash for file data).
+// Put must not leave a partially written object visible under key.
+type Backend interface {
+    Put(key string, r io.Reader, size int64) error
+    Get(key string) (io.ReadSeekCloser, error)
+    Stat(key string) (ObjectInfo, error)
+    Delete(key string) error
+    List(prefix string) ([]ObjectInfo, error)
+}
+
+// Presigner is implemented by backends that can hand out time-limited
+// direct download URLs, so the service does not have to proxy the bytes.
+type Presigner interface {
+    PresignGet(key string, expires time.Duration) (string, error)
+}
+
+// Importer is implemented by backends that can take ownership of a local
+// file more cheaply than copying it through Put, e.g. with a same-disk rename.
+// The file at localPath is gone after a successful Import.
+type Importer interface {
+    Import(key, localPath string) error
+}
+
+// Store is the backend selected by STORAGE_BACKEND.
+var Store Backend
+
+func Init() {
+    var err error
+    Store, err = New(config.GetEnvDefault("STORAGE_BACKEND", "local"))
+    if err != nil {
+        log.Fatal("Failed to init storage:", err)
+    }
+}
+
+// New builds a backend by name from the STORAGE_* / S3_* settings.
+func New(name string) (Backend, error) {
+    switch name {
+    case "local":
+        return NewLocal(config.GetEnvDefault("STORAGE_PATH", "./uploads"), 0)
+    case "sharded":
+        depth, err := strconv.Atoi(config.GetEnvDefault("STORAGE_SHARD_DEPTH", "2"))
+        if err != nil || depth < 1 {
+            return nil, errors.New("STORAGE_SHARD_DEPTH must be a positive integer")
+        }
+        return NewLocal(config.GetEnvDefault("STORAGE_PATH", "./uploads"), depth)
+    case "s3":
+        return NewS3(S3Config{
+            Endpoint:  config.GetEnv("S3_ENDPOINT"),
+            Region:    config.GetEnvDefault("S3_REGION", "us-east-1"),
+            Bucket:    config.GetEnv("S3_BUCKET"),
+            AccessKey: config.GetEnv("S3_ACCESS_KEY"),
+            SecretKey: config.GetEnv("S3_SECRET_KEY"),
+        })
+    }
+    return nil, errors.New("unknown storage backend " + strconv.Quote(name))
+}
+
+func validKey(key string) bool {
+    return key != "" && key != "." && key != ".." && !strings.ContainsAny(key, `/\`)
+}
@@ -4,10 +4,9 @@ import (
     "crypto/sha256"
     "encoding/hex"
     "io"
-    "mime/multipart"
 )
 
-func ComputeSHA256(file multipart.File) (string, error) {
+func ComputeSHA256(file io.Reader) (string, error) {
     hasher := sha256.New()
     if _, err := io.Copy(hasher, file); err != nil {
         return "", err
@@ -0,0 +1,121 @@
+package utils
+
+import (
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// JWKSCache holds the auth service's public signing keys. It is refreshed on
+// a timer, and on demand when a token names a kid it has not seen, so a key
+// rotation is picked up without waiting for the next refresh.
+type JWKSCache struct {
+    URL string
+    // MinRefetch limits on-demand refetches so bogus kids cannot hammer the auth service
+    MinRefetch time.Duration
+
+    mu          sync.RWMutex
+    keys        map[string]ed25519.PublicKey
+    lastFetch   time.Time
+    fetchClient *http.Client
+}
+
+var JWKS *JWKSCache
+
+// NewJWKSCache creates a cache for the JWKS document at url
+func NewJWKSCache(url string) *JWKSCache {
+    return &JWKSCache{
+        URL:         url,
+        MinRefetch:  30 * time.Second,
+        keys:        map[string]ed25519.PublicKey{},
+        fetchClient: &http.Client{Timeout: 10 * time.Second},
+    }
+}
+
+// Key returns the public key for kid, refetching the JWKS once if it is unknown
+func (c *JWKSCache) Key(kid string) (ed25519.PublicKey, error) {
+    c.mu.RLock()
+    key, ok := c.keys[kid]
+    recent := time.Since(c.lastFetch) < c.MinRefetch
+    c.mu.RUnlock()
+    if ok {
+        return key, nil
+    }
+    if recent {
+        return nil, ErrUnknownKey
+    }
+
+    if err := c.Refresh(); err != nil {
+        return nil, err
+    }
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    if key, ok := c.keys[kid]; ok {
+        return key, nil
+    }
+    return nil, ErrUnknownKey
+}
+
+// Refresh downloads the JWKS and replaces the cached keys
+func (c *JWKSCache) Refresh() error {
+    c.mu.Lock()
+    c.lastFetch = time.Now()
+    c.mu.Unlock()
+
+    resp, err := c.fetchClient.Get(c.URL)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("fetching JWKS: %s", resp.Status)
+    }
+
+    var doc struct {
+        Keys []struct {
+            Kty string `json:"kty"`
+            Crv string `json:"crv"`
+            X   string `json:"x"`
+            Kid string `json:"kid"`
+        } `json:"keys"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+        return err
+    }
+
+    keys := map[string]ed25519.PublicKey{}
+    for _, k := range doc.Keys {
+        if k.Kty != "OKP" || k.Crv != "Ed25519" {
+            continue
+        }
+        x, err := base64.RawURLEncoding.DecodeString(k.X)
+        if err != nil || len(x) != ed25519.PublicKeySize {
+            continue
+        }
+        keys[k.Kid] = ed25519.PublicKey(x)
+    }
+
+    c.mu.Lock()
+    c.keys = keys
+    c.mu.Unlock()
+    return nil
+}
+
+// Start refreshes the cache every interval in the background
+func (c *JWKSCache) Start(interval time.Duration) {
+    go func() {
+        for range time.Tick(interval) {
+            if err := c.Refresh(); err != nil {
+                log.Println("JWKS refresh failed:", err)
+            }
+        }
+    }()
+}
@@ -1,33 +1,24 @@
 package utils
 
 import (
-    "time"
     "github.com/golang-jwt/jwt/v5"
-    "file-service/config"
 )
 
 type Claims struct {
-    Username string `json:"username"`
+    Username  string `json:"username"`
+    Role      string `json:"role"`
+    SessionID string `json:"sid"`
     jwt.RegisteredClaims
 }
 
-func GenerateJWT(username string) (string, error) {
-    expTime := time.Now().Add(24 * time.Hour)
-    claims := &Claims{
-        Username: username,
-        RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(expTime),
-        },
-    }
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    return token.SignedString([]byte(config.GetEnv("JWT_SECRET")))
-}
-
+// ValidateToken verifies an access token issued by the auth service against
+// its published JWKS. This service holds no signing key and cannot mint tokens.
 func ValidateToken(tokenStr string) (*Claims, error) {
     claims := &Claims{}
     token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-        return []byte(config.GetEnv("JWT_SECRET")), nil
-    })
+        kid, _ := token.Header["kid"].(string)
+        return JWKS.Key(kid)
+    }, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}))
     if err != nil || !token.Valid {
         return nil, err
     }
@@ -0,0 +1,74 @@
+package utils
+
+import (
+    "sync"
+    "time"
+)
+
+// SlidingWindow allows at most Limit events per key in any Window-long span.
+// It keeps the timestamps of recent events per key, which is cheap at the
+// small limits it is used with. State is per process.
+type SlidingWindow struct {
+    Limit  int
+    Window time.Duration
+
+    mu        sync.Mutex
+    hits      map[string][]time.Time
+    lastSweep time.Time
+}
+
+func NewSlidingWindow(limit int, window time.Duration) *SlidingWindow {
+    return &SlidingWindow{Limit: limit, Window: window, hits: map[string][]time.Time{}}
+}
+
+// Allow records an event for key if it is within the limit. Otherwise it
+// returns false and how long until the oldest event leaves the window.
+func (s *SlidingWindow) Allow(key string) (bool, time.Duration) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    now := time.Now()
+    times, wait := s.recent(key, now)
+    if wait > 0 {
+        return false, wait
+    }
+    s.hits[key] = append(times, now)
+    return true, 0
+}
+
+// Wait reports how long until key may have another event, without recording one
+func (s *SlidingWindow) Wait(key string) time.Duration {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    _, wait := s.recent(key, time.Now())
+    return wait
+}
+
+// recent trims key's events to the window and reports how long until there
+// is room for another. The caller holds mu.
+func (s *SlidingWindow) recent(key string, now time.Time) ([]time.Time, time.Duration) {
+    cutoff := now.Add(-s.Window)
+
+    // Forget idle keys once per window so the map does not grow forever
+    if now.Sub(s.lastSweep) > s.Window {
+        for k, times := range s.hits {
+            if len(times) == 0 || !times[len(times)-1].After(cutoff) {
+                delete(s.hits, k)
+            }
+        }
+        s.lastSweep = now
+    }
+
+    times := s.hits[key]
+    i := 0
+    for i < len(times) && !times[i].After(cutoff) {
+        i++
+    }
+    times = times[i:]
+    s.hits[key] = times
+
+    if len(times) >= s.Limit {
+        return times, times[0].Sub(cutoff)
+    }
+    return times, 0
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+    "testing"
+    "time"
+)
+
+func TestSlidingWindowWaitDoesNotRecord(t *testing.T) {
+    s := NewSlidingWindow(2, time.Minute)
+    for i := 0; i < 5; i++ {
+        if wait := s.Wait("link"); wait != 0 {
+            t.Fatalf("Wait = %s before any event", wait)
+        }
+    }
+
+    s.Allow("link")
+    s.Allow("link")
+    if wait := s.Wait("link"); wait <= 0 || wait > time.Minute {
+        t.Fatalf("Wait = %s at the limit, want within the window", wait)
+    }
+    if ok, _ := s.Allow("link"); ok {
+        t.Fatal("Allow past the limit")
+    }
+    if wait := s.Wait("other"); wait != 0 {
+        t.Fatalf("limit leaked to another key: Wait = %s", wait)
+    }
+}
+
+func TestSlidingWindowForgetsOldEvents(t *testing.T) {
+    s := NewSlidingWindow(1, 20*time.Millisecond)
+    s.Allow("ip")
+    if s.Wait("ip") == 0 {
+        t.Fatal("second event allowed inside the window")
+    }
+    time.Sleep(30 * time.Millisecond)
+    if wait := s.Wait("ip"); wait != 0 {
+        t.Fatalf("Wait = %s after the window passed", wait)
+    }
+}
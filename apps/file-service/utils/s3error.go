@@ -0,0 +1,27 @@
+package utils
+
+import (
+    "encoding/xml"
+    "net/http"
+)
+
+// S3Error is the XML error body S3 clients expect
+type S3Error struct {
+    XMLName   xml.Name `xml:"Error"`
+    Code      string   `xml:"Code"`
+    Message   string   `xml:"Message"`
+    Resource  string   `xml:"Resource,omitempty"`
+    RequestID string   `xml:"RequestId"`
+}
+
+// WriteS3Error answers status with an S3 error document. HEAD responses get
+// no body, as S3 clients read the code from the status alone.
+func WriteS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+    w.Header().Set("Content-Type", "application/xml")
+    w.WriteHeader(status)
+    if r.Method == http.MethodHead {
+        return
+    }
+    w.Write([]byte(xml.Header))
+    xml.NewEncoder(w).Encode(S3Error{Code: code, Message: message, Resource: r.URL.Path, RequestID: GenerateRandomString(16)})
+}
@@ -0,0 +1,247 @@
+package utils
+
+import (
+    "bufio"
+    "crypto/hmac"
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "hash"
+    "hash/crc32"
+    "hash/crc64"
+    "io"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Payload hashes announcing an aws-chunked body, where the content arrives in
+// chunks that are each signed (chaining from the request signature) or not
+// signed at all, optionally followed by trailing checksum headers.
+const (
+    StreamingPayload               = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+    StreamingPayloadTrailer        = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+    StreamingUnsignedPayloadTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// maxChunkSize bounds how much of a signed chunk is buffered before its
+// signature can be checked; SDKs send 64KB to 8MB chunks
+const maxChunkSize = 16 << 20
+
+// ErrChunkSignature means a chunk or the trailer of an aws-chunked body
+// failed verification
+var ErrChunkSignature = errors.New("aws-chunked payload signature mismatch")
+
+// ErrChunkFormat means an aws-chunked body could not be parsed, was cut off
+// before its final chunk, or did not match X-Amz-Decoded-Content-Length
+var ErrChunkFormat = errors.New("malformed aws-chunked payload")
+
+// ErrChecksumMismatch means a trailing x-amz-checksum-* did not match the content
+var ErrChecksumMismatch = errors.New("trailing checksum does not match the content")
+
+// ErrUnsupportedChecksum means X-Amz-Trailer names a checksum we cannot verify
+var ErrUnsupportedChecksum = errors.New("unsupported trailing checksum")
+
+// errChunkTruncated is returned when the body ends before its final chunk
+var errChunkTruncated = fmt.Errorf("%w: %w", ErrChunkFormat, io.ErrUnexpectedEOF)
+
+// crc64NVME is the CRC-64/NVME table (reflected polynomial) S3 uses
+var crc64NVME = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
+// checksumHashes are the x-amz-checksum-* trailers we verify
+var checksumHashes = map[string]func() hash.Hash{
+    "x-amz-checksum-crc32":     func() hash.Hash { return crc32.NewIEEE() },
+    "x-amz-checksum-crc32c":    func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+    "x-amz-checksum-crc64nvme": func() hash.Hash { return crc64.New(crc64NVME) },
+    "x-amz-checksum-sha1":      sha1.New,
+    "x-amz-checksum-sha256":    sha256.New,
+}
+
+// ChunkedPayloadReader decodes an aws-chunked request body. With Cred set,
+// every chunk's signature is checked against the chain starting at
+// SeedSignature before its bytes are handed out, and so is the trailer's. A
+// body that ends before its zero-length final chunk, or whose content is not
+// DecodedLength bytes, is an error, as is a trailer that is missing, not the
+// one announced, or whose checksum does not match.
+type ChunkedPayloadReader struct {
+    Cred          *SigV4Credentials
+    Time          time.Time
+    SeedSignature string
+    DecodedLength int64
+    Trailer       string // lowercase x-amz-checksum-* name, or "" for none
+
+    r        *bufio.Reader
+    pending  []byte
+    prevSig  string
+    read     int64
+    checksum hash.Hash
+    err      error
+}
+
+// NewChunkedPayloadReader decodes body. cred is nil for unsigned chunks;
+// decodedLength is X-Amz-Decoded-Content-Length and trailer X-Amz-Trailer.
+func NewChunkedPayloadReader(body io.Reader, cred *SigV4Credentials, t time.Time, seedSignature string, decodedLength int64, trailer string) (*ChunkedPayloadReader, error) {
+    c := &ChunkedPayloadReader{
+        Cred: cred, Time: t, SeedSignature: seedSignature, DecodedLength: decodedLength, Trailer: strings.ToLower(trailer),
+        r: bufio.NewReader(body), prevSig: seedSignature,
+    }
+    if c.Trailer != "" {
+        newHash, ok := checksumHashes[c.Trailer]
+        if !ok {
+            return nil, fmt.Errorf("%w: %s", ErrUnsupportedChecksum, trailer)
+        }
+        c.checksum = newHash()
+    }
+    return c, nil
+}
+
+func (c *ChunkedPayloadReader) Read(p []byte) (int, error) {
+    for len(c.pending) == 0 {
+        if c.err != nil {
+            return 0, c.err
+        }
+        c.err = c.nextChunk()
+    }
+    n := copy(p, c.pending)
+    c.pending = c.pending[n:]
+    return n, nil
+}
+
+// nextChunk reads one chunk into pending, returning io.EOF after the last one
+func (c *ChunkedPayloadReader) nextChunk() error {
+    header, err := c.readLine()
+    if err == io.EOF {
+        return errChunkTruncated
+    }
+    if err != nil {
+        return err
+    }
+    sizeHex, ext, _ := strings.Cut(header, ";")
+    size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+    if err != nil || size < 0 || size > maxChunkSize {
+        return ErrChunkFormat
+    }
+    if c.read+size > c.DecodedLength {
+        return fmt.Errorf("%w: more than the %d bytes announced", ErrChunkFormat, c.DecodedLength)
+    }
+
+    data := make([]byte, size)
+    if _, err := io.ReadFull(c.r, data); err != nil {
+        return errChunkTruncated
+    }
+    if size > 0 {
+        line, err := c.readLine()
+        if err == io.EOF {
+            return errChunkTruncated
+        }
+        if err != nil || line != "" {
+            return ErrChunkFormat
+        }
+    }
+
+    if c.Cred != nil {
+        sig := strings.TrimPrefix(strings.TrimSpace(ext), "chunk-signature=")
+        sum := sha256.Sum256(data)
+        want := c.sign("AWS4-HMAC-SHA256-PAYLOAD", EmptyPayloadHash, hex.EncodeToString(sum[:]))
+        if !hmac.Equal([]byte(sig), []byte(want)) {
+            return ErrChunkSignature
+        }
+        c.prevSig = want
+    }
+
+    if size == 0 {
+        if c.read != c.DecodedLength {
+            return fmt.Errorf("%w: %d bytes sent, %d announced", ErrChunkFormat, c.read, c.DecodedLength)
+        }
+        return c.readTrailer()
+    }
+    c.read += size
+    if c.checksum != nil {
+        c.checksum.Write(data)
+    }
+    c.pending = data
+    return nil
+}
+
+// readTrailer reads what follows the final chunk up to an empty line or the
+// end: nothing, or the announced checksum (and, for signed bodies, the
+// trailer signature). It returns io.EOF once everything checks out.
+func (c *ChunkedPayloadReader) readTrailer() error {
+    var canonical strings.Builder
+    var value, sig string
+    found := false
+    for {
+        line, err := c.readLine()
+        if err == io.EOF || (err == nil && line == "") {
+            break
+        }
+        if err != nil {
+            return err
+        }
+        name, v, ok := strings.Cut(line, ":")
+        name, v = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(v)
+        switch {
+        case !ok:
+            return ErrChunkFormat
+        case name == "x-amz-trailer-signature":
+            sig = v
+        case name == c.Trailer && !found:
+            value, found = v, true
+            canonical.WriteString(name + ":" + v + "\n")
+        default:
+            return fmt.Errorf("%w: unexpected trailer %s", ErrChunkFormat, name)
+        }
+    }
+
+    if c.Trailer == "" {
+        if sig != "" {
+            return ErrChunkFormat
+        }
+        return io.EOF
+    }
+    if !found {
+        return fmt.Errorf("%w: missing trailer %s", ErrChunkFormat, c.Trailer)
+    }
+    if c.Cred != nil {
+        sum := sha256.Sum256([]byte(canonical.String()))
+        want := c.sign("AWS4-HMAC-SHA256-TRAILER", hex.EncodeToString(sum[:]))
+        if !hmac.Equal([]byte(sig), []byte(want)) {
+            return ErrChunkSignature
+        }
+    }
+    if value != base64.StdEncoding.EncodeToString(c.checksum.Sum(nil)) {
+        return ErrChecksumMismatch
+    }
+    return io.EOF
+}
+
+// sign computes the next signature in the chain for a chunk or trailer
+func (c *ChunkedPayloadReader) sign(algorithm string, hashes ...string) string {
+    stringToSign := strings.Join(append([]string{
+        algorithm,
+        c.Time.UTC().Format(SigV4TimeFormat),
+        c.Cred.Scope(c.Time),
+        c.prevSig,
+    }, hashes...), "\n")
+    return SigV4Signature(*c.Cred, c.Time, stringToSign)
+}
+
+// readLine reads a chunk header or trailer line. It returns io.EOF at the
+// end of the body, and ErrChunkFormat for a line cut off by the end or
+// longer than the reader's buffer.
+func (c *ChunkedPayloadReader) readLine() (string, error) {
+    line, err := c.r.ReadSlice('\n')
+    if err == bufio.ErrBufferFull {
+        return "", ErrChunkFormat
+    }
+    if err == io.EOF && len(line) > 0 {
+        return "", errChunkTruncated
+    }
+    if err != nil {
+        return "", err
+    }
+    return strings.TrimRight(string(line), "\r\n"), nil
+}
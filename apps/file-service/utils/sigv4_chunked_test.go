@@ -0,0 +1,193 @@
+package utils
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "hash/crc64"
+    "io"
+    "strings"
+    "testing"
+)
+
+// The Amazon S3 "Signature Calculations for the Authorization Header:
+// Transferring Payload in Multiple Chunks" example: 66560 bytes of 'a' in a
+// 64KB chunk, a 1KB chunk and the final empty chunk
+const awsChunkedSeed = "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9"
+
+var awsChunkSignatures = []string{
+    "ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648",
+    "0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497",
+    "b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9",
+}
+
+func awsChunkedBody() []byte {
+    var b bytes.Buffer
+    for i, size := range []int{65536, 1024, 0} {
+        fmt.Fprintf(&b, "%x;chunk-signature=%s\r\n", size, awsChunkSignatures[i])
+        b.Write(bytes.Repeat([]byte("a"), size))
+        b.WriteString("\r\n")
+    }
+    return b.Bytes()
+}
+
+func decodeChunked(body []byte, cred *SigV4Credentials, seed string, decodedLength int64, trailer string) ([]byte, error) {
+    r, err := NewChunkedPayloadReader(bytes.NewReader(body), cred, awsExampleTime, seed, decodedLength, trailer)
+    if err != nil {
+        return nil, err
+    }
+    return io.ReadAll(r)
+}
+
+func TestChunkedSeedSignatureAWSExample(t *testing.T) {
+    req := awsExampleRequest(t, "PUT", "/examplebucket/chunkObject.txt", map[string]string{
+        "Content-Encoding":             "aws-chunked",
+        "Content-Length":               "66824",
+        "X-Amz-Content-Sha256":         StreamingPayload,
+        "X-Amz-Date":                   "20130524T000000Z",
+        "X-Amz-Decoded-Content-Length": "66560",
+        "X-Amz-Storage-Class":          "REDUCED_REDUNDANCY",
+    })
+    req.Host = "s3.amazonaws.com"
+    signed := []string{"content-encoding", "content-length", "host", "x-amz-content-sha256", "x-amz-date", "x-amz-decoded-content-length", "x-amz-storage-class"}
+    canonical := SigV4CanonicalRequest(req, signed, StreamingPayload)
+    if got := SigV4Signature(awsExampleCred, awsExampleTime, SigV4StringToSign(awsExampleCred, awsExampleTime, canonical)); got != awsChunkedSeed {
+        t.Fatalf("seed signature = %s, want %s", got, awsChunkedSeed)
+    }
+}
+
+func TestChunkedPayloadAWSExample(t *testing.T) {
+    body := awsChunkedBody()
+    if len(body) != 66824 {
+        t.Fatalf("example body is %d bytes, want the documented 66824", len(body))
+    }
+    got, err := decodeChunked(body, &awsExampleCred, awsChunkedSeed, 66560, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, bytes.Repeat([]byte("a"), 66560)) {
+        t.Fatalf("decoded %d bytes, not the example content", len(got))
+    }
+}
+
+func TestChunkedPayloadRejects(t *testing.T) {
+    body := awsChunkedBody()
+    final := bytes.LastIndex(body, []byte("0;chunk-signature="))
+    tampered := bytes.Replace(body, []byte("aaaa\r\n400;"), []byte("aaab\r\n400;"), 1)
+
+    tests := []struct {
+        name    string
+        body    []byte
+        length  int64
+        want    error
+        wantEOF bool
+    }{
+        {"missing final chunk", body[:final], 66560, ErrChunkFormat, true},
+        {"cut inside a chunk", body[:40000], 66560, ErrChunkFormat, true},
+        {"cut inside a chunk header", body[:final+5], 66560, ErrChunkFormat, true},
+        {"empty body", nil, 66560, ErrChunkFormat, true},
+        {"shorter than announced", body, 66561, ErrChunkFormat, false},
+        {"longer than announced", body, 66559, ErrChunkFormat, false},
+        {"tampered chunk", tampered, 66560, ErrChunkSignature, false},
+        {"wrong seed", body, 66560, ErrChunkSignature, false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            seed := awsChunkedSeed
+            if tt.name == "wrong seed" {
+                seed = strings.Repeat("0", 64)
+            }
+            _, err := decodeChunked(tt.body, &awsExampleCred, seed, tt.length, "")
+            if !errors.Is(err, tt.want) {
+                t.Fatalf("err = %v, want %v", err, tt.want)
+            }
+            if tt.wantEOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+                t.Fatalf("err = %v, want it to report io.ErrUnexpectedEOF", err)
+            }
+        })
+    }
+}
+
+// trailerBody builds an aws-chunked body of content in 10-byte chunks with the
+// given trailer lines, signing chunks and trailer when cred is set
+func trailerBody(content string, cred *SigV4Credentials, seed string, trailers ...string) []byte {
+    c := &ChunkedPayloadReader{Cred: cred, Time: awsExampleTime, prevSig: seed}
+    var b bytes.Buffer
+    for off := 0; ; off += 10 {
+        chunk := content[min(off, len(content)):min(off+10, len(content))]
+        fmt.Fprintf(&b, "%x", len(chunk))
+        if cred != nil {
+            sum := sha256.Sum256([]byte(chunk))
+            c.prevSig = c.sign("AWS4-HMAC-SHA256-PAYLOAD", EmptyPayloadHash, hex.EncodeToString(sum[:]))
+            b.WriteString(";chunk-signature=" + c.prevSig)
+        }
+        b.WriteString("\r\n" + chunk)
+        if len(chunk) == 0 {
+            break
+        }
+        b.WriteString("\r\n")
+    }
+    var canonical strings.Builder
+    for _, line := range trailers {
+        b.WriteString(line + "\r\n")
+        canonical.WriteString(line + "\n")
+    }
+    if cred != nil && len(trailers) > 0 {
+        sum := sha256.Sum256([]byte(canonical.String()))
+        b.WriteString("x-amz-trailer-signature:" + c.sign("AWS4-HMAC-SHA256-TRAILER", hex.EncodeToString(sum[:])) + "\r\n")
+    }
+    b.WriteString("\r\n")
+    return b.Bytes()
+}
+
+func TestChunkedPayloadTrailers(t *testing.T) {
+    const content = "the quick brown fox jumps over the lazy dog"
+    crc := make([]byte, 4)
+    sum := crc32.ChecksumIEEE([]byte(content))
+    crc[0], crc[1], crc[2], crc[3] = byte(sum>>24), byte(sum>>16), byte(sum>>8), byte(sum)
+    good := "x-amz-checksum-crc32:" + base64.StdEncoding.EncodeToString(crc)
+    bad := "x-amz-checksum-crc32:AAAAAA=="
+    seed := strings.Repeat("ab", 32)
+
+    tests := []struct {
+        name    string
+        body    []byte
+        cred    *SigV4Credentials
+        trailer string
+        want    error
+    }{
+        {"unsigned with checksum", trailerBody(content, nil, seed, good), nil, "x-amz-checksum-crc32", nil},
+        {"signed with checksum", trailerBody(content, &awsExampleCred, seed, good), &awsExampleCred, "x-amz-checksum-crc32", nil},
+        {"wrong checksum", trailerBody(content, nil, seed, bad), nil, "x-amz-checksum-crc32", ErrChecksumMismatch},
+        {"missing trailer", trailerBody(content, nil, seed), nil, "x-amz-checksum-crc32", ErrChunkFormat},
+        {"undeclared trailer", trailerBody(content, nil, seed, "x-amz-checksum-sha1:AAAA"), nil, "x-amz-checksum-crc32", ErrChunkFormat},
+        {"trailer without announcement", trailerBody(content, nil, seed, good), nil, "", ErrChunkFormat},
+        {"trailer signed for other content", bytes.Replace(trailerBody(content, &awsExampleCred, seed, bad), []byte(bad), []byte(good), 1), &awsExampleCred, "x-amz-checksum-crc32", ErrChunkSignature},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, err := decodeChunked(tt.body, tt.cred, seed, int64(len(content)), tt.trailer)
+            if !errors.Is(err, tt.want) {
+                t.Fatalf("err = %v, want %v", err, tt.want)
+            }
+            if tt.want == nil && string(got) != content {
+                t.Fatalf("decoded %q", got)
+            }
+        })
+    }
+
+    if _, err := NewChunkedPayloadReader(nil, nil, awsExampleTime, seed, 0, "x-amz-checksum-md5"); !errors.Is(err, ErrUnsupportedChecksum) {
+        t.Fatalf("unknown trailer = %v, want ErrUnsupportedChecksum", err)
+    }
+}
+
+func TestCRC64NVMECheckValue(t *testing.T) {
+    // The CRC-64/NVME check value for "123456789"
+    if got := crc64.Checksum([]byte("123456789"), crc64NVME); got != 0xae8b14860a799888 {
+        t.Fatalf("crc64nvme = %x, want ae8b14860a799888", got)
+    }
+}